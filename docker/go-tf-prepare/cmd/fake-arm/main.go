@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	stdlog "log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/go-logr/stdr"
+	"github.com/urfave/cli/v2"
+	"github.com/xenitab/github-actions/docker/go-tf-prepare/pkg/azure/fake"
+)
+
+func main() {
+	stdr.SetVerbosity(1)
+	log := stdr.New(stdlog.New(os.Stderr, "", stdlog.LstdFlags|stdlog.Lshortfile))
+	log = log.WithName("fake-arm")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	app := &cli.App{
+		Usage: "Local Azure Resource Manager stand-in for end-to-end tests of tf-prepare",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "address",
+				Usage: "Address to listen on",
+				Value: "127.0.0.1:8443",
+			},
+			&cli.StringFlag{
+				Name:     "certificate-file",
+				Usage:    "File the self-signed server certificate is written to, use it as SSL_CERT_FILE for tf-prepare",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "object-id",
+				Usage: "Object ID of the principal in the issued tokens",
+				Value: "00000000-0000-0000-0000-000000000000",
+			},
+			&cli.StringSliceFlag{
+				Name:  "lock-api-version",
+				Usage: "Supported api-versions for management locks",
+				Value: cli.NewStringSlice("2016-09-01"),
+			},
+			&cli.IntFlag{
+				Name:  "lro-polls",
+				Usage: "Number of polls before a long-running operation completes",
+				Value: 1,
+			},
+		},
+		Action: func(cli *cli.Context) error {
+			arm := fake.NewARM()
+			arm.LROPolls = cli.Int("lro-polls")
+			arm.LockAPIVersions = cli.StringSlice("lock-api-version")
+
+			server, err := fake.NewServer(cli.String("address"), arm, cli.String("object-id"))
+			if err != nil {
+				return err
+			}
+			defer server.Close()
+
+			err = os.WriteFile(cli.String("certificate-file"), server.CertificatePEM(), 0o600)
+			if err != nil {
+				return err
+			}
+
+			log.Info("Fake ARM listening", "url", server.URL, "certificateFile", cli.String("certificate-file"))
+			<-ctx.Done()
+
+			for _, request := range arm.Requests() {
+				log.Info("Request", "method", request.Method, "path", request.Path, "apiVersion", request.APIVersion)
+			}
+
+			return nil
+		},
+	}
+
+	err := app.Run(os.Args)
+	if err != nil {
+		log.Error(err, "CLI execution failed")
+		os.Exit(1)
+	}
+
+	os.Exit(0)
+}
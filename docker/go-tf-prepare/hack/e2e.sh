@@ -0,0 +1,151 @@
+#!/bin/bash
+set -euo pipefail
+
+# Runs tf-prepare against cmd/fake-arm and verifies the requests it sends: the first run creates the backend
+# in dependency order, the second run only reads it and the status reports every resource as present
+
+cd "$(dirname "${BASH_SOURCE[0]}")/.."
+
+WORK_DIR="$(mktemp -d)"
+ADDRESS="127.0.0.1:18443"
+OBJECT_ID="55555555-2222-2222-2222-222222222222"
+SUBSCRIPTION_ID="33333333-3333-3333-3333-333333333333"
+LOCK_API_VERSION="2016-09-01"
+
+go build -o "${WORK_DIR}/tf-prepare" .
+go build -o "${WORK_DIR}/fake-arm" ./cmd/fake-arm
+
+"${WORK_DIR}/fake-arm" --address "${ADDRESS}" --certificate-file "${WORK_DIR}/fake.pem" --object-id "${OBJECT_ID}" --lock-api-version "${LOCK_API_VERSION}" 2>"${WORK_DIR}/fake-arm.log" &
+FAKE_ARM_PID=$!
+trap 'kill ${FAKE_ARM_PID} 2>/dev/null || true; rm -rf "${WORK_DIR}"' EXIT
+
+for _ in $(seq 1 50); do
+  [ -s "${WORK_DIR}/fake.pem" ] && break
+  sleep 0.1
+done
+
+export SSL_CERT_FILE="${WORK_DIR}/fake.pem"
+export AZURE_RESOURCE_MANAGER_ENDPOINT="https://${ADDRESS}"
+export AZURE_AUTHORITY_HOST="https://${ADDRESS}"
+export AZURE_TENANT_ID="11111111-1111-1111-1111-111111111111"
+export AZURE_CLIENT_ID="44444444-4444-4444-4444-444444444444"
+export AZURE_CLIENT_SECRET="e2e"
+export AZURE_EXCLUDE_ENVIRONMENT_CREDENTIAL="false"
+export AZURE_SUBSCRIPTION_ID="${SUBSCRIPTION_ID}"
+export AZURE_RESOURCE_GROUP_NAME="rg-e2e"
+export AZURE_RESOURCE_GROUP_LOCATION="westeurope"
+export AZURE_STORAGE_ACCOUNT_NAME="sae2e"
+export AZURE_STORAGE_ACCOUNT_CONTAINER="tfstate"
+export AZURE_KEYVAULT_NAME="kv-e2e"
+export AZURE_KEYVAULT_KEY_NAME="sops"
+export AZURE_SERVICE_PRINCIPAL_OBJECT_ID="${OBJECT_ID}"
+
+# requests writes the requests received by fake-arm after the first $1 as "METHOD path" lines,
+# the paths are lower case since the SDK clients don't agree on the casing of resourceGroups
+requests() {
+  curl --silent --fail --cacert "${SSL_CERT_FILE}" "https://${ADDRESS}/_fake/requests" |
+    jq --raw-output ".[$1:][] | \"\(.Method) \(.Path | ascii_downcase)\"" |
+    sed "s|/subscriptions/${SUBSCRIPTION_ID}|/subscriptions/sub|"
+}
+
+request_count() {
+  curl --silent --fail --cacert "${SSL_CERT_FILE}" "https://${ADDRESS}/_fake/requests" | jq length
+}
+
+# assert_requests compares the requests after the first $1 with the expected lines on stdin
+assert_requests() {
+  local name="$1"
+  local skip="$2"
+  cat >"${WORK_DIR}/expected"
+  requests "${skip}" >"${WORK_DIR}/actual"
+  if [ "${name}" = "idempotent run" ]; then
+    # the steps of the second run are concurrent, so only the requests are compared and not their order
+    sort --output "${WORK_DIR}/expected" "${WORK_DIR}/expected"
+    sort --output "${WORK_DIR}/actual" "${WORK_DIR}/actual"
+  fi
+
+  if ! diff -u "${WORK_DIR}/expected" "${WORK_DIR}/actual"; then
+    echo "unexpected requests in the ${name}" >&2
+    exit 1
+  fi
+}
+
+RG="/subscriptions/sub/resourcegroups/rg-e2e"
+SA="${RG}/providers/microsoft.storage/storageaccounts/sae2e"
+KV="${RG}/providers/microsoft.keyvault/vaults/kv-e2e"
+LOCK="providers/microsoft.authorization/locks/donotdelete"
+
+# the first run is serial, which makes the order of the requests deterministic
+AZURE_PARALLEL="false" "${WORK_DIR}/tf-prepare" azure
+assert_requests "first run" 0 <<EOF
+GET /subscriptions/sub/providers/microsoft.authorization
+GET ${RG}/${LOCK}
+GET ${SA}/${LOCK}
+GET ${KV}/${LOCK}
+HEAD ${RG}
+PUT ${RG}
+GET ${SA}
+GET /subscriptions/sub/providers/microsoft.storage
+POST /subscriptions/sub/providers/microsoft.storage/register
+POST /subscriptions/sub/providers/microsoft.storage/checknameavailability
+PUT ${SA}
+GET /_fake/operations/00000001
+GET /_fake/operations/00000001
+GET ${SA}/blobservices/default/containers/tfstate
+PUT ${SA}/blobservices/default/containers/tfstate
+GET ${KV}
+POST /subscriptions/sub/providers/microsoft.keyvault/checknameavailability
+PUT ${KV}
+GET /_fake/operations/00000002
+GET /_fake/operations/00000002
+GET ${KV}
+GET ${KV}
+PUT ${KV}/accesspolicies/add
+GET ${KV}/keys/sops
+PUT ${KV}/keys/sops
+GET ${RG}/${LOCK}
+GET ${SA}/${LOCK}
+GET ${KV}/${LOCK}
+GET ${SA}/${LOCK}
+PUT ${SA}/${LOCK}
+GET ${KV}/${LOCK}
+PUT ${KV}/${LOCK}
+EOF
+
+SKIP="$(request_count)"
+"${WORK_DIR}/tf-prepare" azure
+assert_requests "idempotent run" "${SKIP}" <<EOF
+GET /subscriptions/sub/providers/microsoft.authorization
+GET ${RG}/${LOCK}
+GET ${SA}/${LOCK}
+GET ${KV}/${LOCK}
+HEAD ${RG}
+GET ${SA}
+GET ${SA}/blobservices/default/containers/tfstate
+GET ${KV}
+GET ${KV}
+GET ${KV}/keys/sops
+GET ${RG}/${LOCK}
+GET ${SA}/${LOCK}
+GET ${KV}/${LOCK}
+GET ${SA}/${LOCK}
+GET ${KV}/${LOCK}
+EOF
+
+if requests "${SKIP}" | grep --invert-match --quiet --extended-regexp '^(GET|HEAD) '; then
+  echo "the idempotent run changed resources" >&2
+  exit 1
+fi
+
+# every management lock request uses the api-version supported by fake-arm instead of the armlocks default
+WRONG_LOCK_API_VERSIONS="$(curl --silent --fail --cacert "${SSL_CERT_FILE}" "https://${ADDRESS}/_fake/requests" |
+  jq --raw-output --arg version "${LOCK_API_VERSION}" '.[] | select((.Path | ascii_downcase | contains("/providers/microsoft.authorization/locks/")) and .APIVersion != $version) | "\(.Method) \(.Path) \(.APIVersion)"')"
+if [ -n "${WRONG_LOCK_API_VERSIONS}" ]; then
+  echo "management lock requests without api-version ${LOCK_API_VERSION}:" >&2
+  echo "${WRONG_LOCK_API_VERSIONS}" >&2
+  exit 1
+fi
+
+"${WORK_DIR}/tf-prepare" azure status
+
+echo "e2e tests passed"
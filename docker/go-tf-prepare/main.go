@@ -4,6 +4,8 @@ import (
 	"context"
 	stdlog "log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/go-logr/logr"
 	"github.com/go-logr/stdr"
@@ -11,19 +13,69 @@ import (
 	"github.com/xenitab/github-actions/docker/go-tf-prepare/pkg/azure"
 )
 
+// version is set when building, with -ldflags "-X main.version=<version>"
+var version = "dev"
+
 func main() {
 	stdr.SetVerbosity(1)
 	log := stdr.New(stdlog.New(os.Stderr, "", stdlog.LstdFlags|stdlog.Lshortfile))
 	log = log.WithName("tf-prepare")
 
-	ctx := logr.NewContext(context.Background(), log)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx = logr.NewContext(ctx, log)
 
 	app := &cli.App{
+		Version: version,
 		Commands: []*cli.Command{
 			{
 				Name:  "azure",
 				Usage: "Terraform prepare for Azure",
 				Flags: azure.Flags(),
+				Subcommands: []*cli.Command{
+					{
+						Name:  "status",
+						Usage: "Report the state of the Terraform backend without creating anything",
+						Action: func(cli *cli.Context) error {
+							err := azure.StatusAction(ctx, cli)
+							if err != nil {
+								return err
+							}
+							return nil
+						},
+					},
+					{
+						Name:      "unlock",
+						Usage:     "Remove the resource locks for maintenance, run the command (or wait for an interrupt) and restore the locks afterwards",
+						ArgsUsage: "[command [arguments...]]",
+						Action: func(cli *cli.Context) error {
+							err := azure.UnlockAction(ctx, cli)
+							if err != nil {
+								return err
+							}
+							return nil
+						},
+					},
+					{
+						Name:  "rotate-key",
+						Usage: "Create a new version of the KeyVault Key and report the SOPS files still encrypted with an older version",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:    "sops-directory",
+								Usage:   "Directory with SOPS encrypted files to check for older key versions",
+								Value:   ".terraform/plans",
+								EnvVars: []string{"SOPS_DIRECTORY"},
+							},
+						},
+						Action: func(cli *cli.Context) error {
+							err := azure.RotateKeyAction(ctx, cli)
+							if err != nil {
+								return err
+							}
+							return nil
+						},
+					},
+				},
 				Action: func(cli *cli.Context) error {
 					err := azure.Action(ctx, cli)
 					if err != nil {
@@ -3,12 +3,10 @@ package azure
 import (
 	"context"
 	"fmt"
-	"net/http"
 	"strings"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
-	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
@@ -17,6 +15,7 @@ import (
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armresources"
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/storage/armstorage"
 	"github.com/go-logr/logr"
+	"github.com/xenitab/github-actions/docker/go-tf-prepare/pkg/azure/internal/azerrors"
 
 	adapter "github.com/microsoft/kiota-authentication-azure-go"
 	msgraphsdk "github.com/microsoftgraph/msgraph-sdk-go"
@@ -24,536 +23,1367 @@ import (
 )
 
 // CreateResourceGroup creates Azure Resource Group (if it doesn't exist) or returns error
-func CreateResourceGroup(ctx context.Context, cred azcore.TokenCredential, config azureConfig) error {
+func CreateResourceGroup(ctx context.Context, clients *clientFactory, config azureConfig) (stepResult, error) {
 	resourceGroupName := config.ResourceGroupName
 	resourceGroupLocation := config.ResourceGroupLocation
-	subscriptionID := config.SubscriptionID
 
 	log, err := logr.FromContext(ctx)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	client, err := armresources.NewResourceGroupsClient(subscriptionID, cred, &arm.ClientOptions{})
-	if err != nil {
-		log.Error(err, "armresources.NewResourceGroupsClient")
-		return err
-	}
-	resourceGroupExists, err := client.CheckExistence(ctx, resourceGroupName, &armresources.ResourceGroupsClientCheckExistenceOptions{})
+	state, err := getResourceGroupState(ctx, clients, config)
 	if err != nil {
-		log.Error(err, "client.CheckExistence")
-		return err
+		return "", err
 	}
-	if !resourceGroupExists.Success {
+
+	if state.Status == resourceStatusMissing {
+		client, err := clients.resourceGroupsClient()
+		if err != nil {
+			log.Error(err, "armresources.NewResourceGroupsClient")
+			return "", err
+		}
+
 		_, err = client.CreateOrUpdate(ctx, resourceGroupName, armresources.ResourceGroup{
 			Location: to.Ptr(resourceGroupLocation),
+			Tags:     resourceTags(config),
 		}, nil)
 		if err != nil {
 			log.Error(err, "client.CreateOrUpdate")
-			return err
+			return "", err
 		}
 
 		log.Info("Azure Resource Group created", "resourceGroupName", resourceGroupName)
-		return nil
+		return stepResultCreated, nil
 	}
 
 	log.Info("Azure Resource Group already exists", "resourceGroupName", resourceGroupName)
-	return nil
+	return stepResultUnchanged, nil
+}
+
+func getResourceGroupState(ctx context.Context, clients *clientFactory, config azureConfig) (resourceState, error) {
+	resourceGroupName := config.ResourceGroupName
+
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return resourceState{}, err
+	}
+
+	client, err := clients.resourceGroupsClient()
+	if err != nil {
+		log.Error(err, "armresources.NewResourceGroupsClient")
+		return resourceState{}, err
+	}
+	resourceGroupExists, err := client.CheckExistence(ctx, resourceGroupName, &armresources.ResourceGroupsClientCheckExistenceOptions{})
+	if err != nil {
+		log.Error(err, "client.CheckExistence")
+		return resourceState{}, err
+	}
+	if !resourceGroupExists.Success {
+		return resourceState{Status: resourceStatusMissing}, nil
+	}
+
+	return resourceState{Status: resourceStatusPresent}, nil
 }
 
 // CreateStorageAccount creates Azure Storage Account (if it doesn't exist) or returns error
-func CreateStorageAccount(ctx context.Context, cred azcore.TokenCredential, config azureConfig) error {
+func CreateStorageAccount(ctx context.Context, clients *clientFactory, config azureConfig) (stepResult, error) {
 	resourceGroupName := config.ResourceGroupName
 	resourceGroupLocation := config.ResourceGroupLocation
 	storageAccountName := config.StorageAccountName
-	subscriptionID := config.SubscriptionID
 	log, err := logr.FromContext(ctx)
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	state, err := getStorageAccountState(ctx, clients, config)
+	if err != nil {
+		return "", err
+	}
+
+	if state.Status == resourceStatusMisconfigured {
+		if !config.Reconcile {
+			log.Info("Azure Storage Account does not match the configuration, use reconcile to update it", "storageAccountName", storageAccountName, "reason", state.Reason)
+			return stepResultUnchanged, nil
+		}
+
+		return updateStorageAccount(ctx, clients, config, state)
+	}
+
+	if state.Status != resourceStatusMissing {
+		log.Info("Azure Storage Account already exists", "storageAccountName", storageAccountName)
+		return stepResultUnchanged, nil
+	}
+
+	client, err := clients.accountsClient()
+	if err != nil {
+		log.Error(err, "armstorage.NewAccountsClient")
+		return "", err
+	}
+
+	err = registerResourceProviderIfNeeded(ctx, clients, config, "Microsoft.Storage")
+	if err != nil {
+		return "", err
+	}
+
+	res, err := client.CheckNameAvailability(
+		ctx,
+		armstorage.AccountCheckNameAvailabilityParameters{
+			Name: to.Ptr(storageAccountName),
+			Type: to.Ptr("Microsoft.Storage/storageAccounts"),
+		},
+		nil)
+
+	if err != nil {
+		log.Error(err, "client.CheckNameAvailability")
+		return "", err
+	}
+
+	if !*res.CheckNameAvailabilityResult.NameAvailable {
+		err := fmt.Errorf("Azure Storage Account Name '%s' not available", storageAccountName)
+		log.Error(err, "azure.CreateStorageAccount")
+		return "", err
+	}
+
+	poller, err := client.BeginCreate(
+		ctx,
+		resourceGroupName,
+		storageAccountName,
+		armstorage.AccountCreateParameters{
+			SKU: &armstorage.SKU{
+				Name: to.Ptr(armstorage.SKUName(config.StorageAccountSKU)),
+				Tier: to.Ptr(storageAccountSKUTier(config)),
+			},
+			Kind:     to.Ptr(armstorage.Kind(config.StorageAccountKind)),
+			Location: to.Ptr(resourceGroupLocation),
+			Tags:     resourceTags(config),
+			Properties: &armstorage.AccountPropertiesCreateParameters{
+				AccessTier:                   storageAccountAccessTier(config),
+				AllowBlobPublicAccess:        to.Ptr(false),
+				MinimumTLSVersion:            to.Ptr(armstorage.MinimumTLSVersionTLS12),
+				Encryption:                   storageAccountEncryption(config),
+				PublicNetworkAccess:          to.Ptr(armstorage.PublicNetworkAccess(config.StorageAccountPublicNetworkAccess)),
+				NetworkRuleSet:               storageAccountNetworkRuleSet(config),
+				AllowSharedKeyAccess:         to.Ptr(config.StorageAccountSharedKeyAccess),
+				DefaultToOAuthAuthentication: to.Ptr(config.StorageAccountDefaultToOAuth),
+			},
+		}, nil)
+
+	if err != nil {
+		log.Error(err, "client.BeginCreate")
+		return "", err
+	}
+
+	_, err = poller.PollUntilDone(ctx, &runtime.PollUntilDoneOptions{
+		Frequency: 30 * time.Second,
+	})
+	if err != nil {
+		log.Error(err, "poller.PollUntilDone")
+		return "", err
+	}
+
+	log.Info("Azure Storage Account created", "storageAccountName", storageAccountName)
+	return stepResultCreated, nil
+}
+
+// storageAccountEncryption returns the encryption of a new Storage Account, the customer-managed key is configured after it is created
+func storageAccountEncryption(config azureConfig) *armstorage.Encryption {
+	if !config.StorageAccountDoubleEncryption {
+		return nil
+	}
+
+	return &armstorage.Encryption{
+		KeySource:                       to.Ptr(armstorage.KeySourceMicrosoftStorage),
+		RequireInfrastructureEncryption: to.Ptr(true),
+		Services: &armstorage.EncryptionServices{
+			Blob: &armstorage.EncryptionService{Enabled: to.Ptr(true), KeyType: to.Ptr(armstorage.KeyTypeAccount)},
+			File: &armstorage.EncryptionService{Enabled: to.Ptr(true), KeyType: to.Ptr(armstorage.KeyTypeAccount)},
+		},
+	}
+}
+
+func getStorageAccountState(ctx context.Context, clients *clientFactory, config azureConfig) (resourceState, error) {
+	resourceGroupName := config.ResourceGroupName
+	storageAccountName := config.StorageAccountName
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return resourceState{}, err
+	}
+
+	client, err := clients.accountsClient()
+	if err != nil {
+		log.Error(err, "armstorage.NewAccountsClient")
+		return resourceState{}, err
+	}
+	res, err := client.GetProperties(ctx, resourceGroupName, storageAccountName, nil)
+	if azerrors.IsNotFound(err) {
+		return resourceState{Status: resourceStatusMissing}, nil
+	}
+
+	if err != nil {
+		log.Error(err, "client.GetProperties")
+		return resourceState{}, err
+	}
+
+	reasons := getStorageAccountDifferences(config, res.Account)
+	if len(reasons) > 0 {
+		return resourceState{Status: resourceStatusMisconfigured, Reason: strings.Join(reasons, ", ")}, nil
+	}
+
+	return resourceState{Status: resourceStatusPresent}, nil
+}
+
+// getStorageAccountDifferences returns how the existing Storage Account differs from the configuration
+func getStorageAccountDifferences(config azureConfig, account armstorage.Account) []string {
+	reasons := []string{}
+
+	if account.SKU != nil && account.SKU.Name != nil && !strings.EqualFold(string(*account.SKU.Name), config.StorageAccountSKU) {
+		reasons = append(reasons, fmt.Sprintf("sku is %s", *account.SKU.Name))
+	}
+
+	if account.Kind != nil && !strings.EqualFold(string(*account.Kind), config.StorageAccountKind) {
+		reasons = append(reasons, fmt.Sprintf("kind is %s", *account.Kind))
+	}
+
+	properties := account.Properties
+	if properties == nil {
+		return reasons
+	}
+
+	accessTier := storageAccountAccessTier(config)
+	if accessTier != nil && properties.AccessTier != nil && *properties.AccessTier != *accessTier {
+		reasons = append(reasons, fmt.Sprintf("access tier is %s", *properties.AccessTier))
+	}
+
+	if properties.AllowBlobPublicAccess == nil || *properties.AllowBlobPublicAccess {
+		reasons = append(reasons, "blob public access is allowed")
+	}
+
+	if properties.MinimumTLSVersion == nil || *properties.MinimumTLSVersion != armstorage.MinimumTLSVersionTLS12 {
+		reasons = append(reasons, "minimum TLS version is not TLS1_2")
+	}
+
+	// infrastructure encryption can only be enabled when the storage account is created
+	if config.StorageAccountDoubleEncryption && (properties.Encryption == nil || properties.Encryption.RequireInfrastructureEncryption == nil || !*properties.Encryption.RequireInfrastructureEncryption) {
+		reasons = append(reasons, "infrastructure encryption is not enabled, the storage account has to be recreated")
+	}
+
+	reasons = append(reasons, getStorageAccountNetworkDifferences(config, properties)...)
+
+	return reasons
+}
+
+// updateStorageAccount updates the settings of the existing Azure Storage Account that can be changed after creation
+func updateStorageAccount(ctx context.Context, clients *clientFactory, config azureConfig, state resourceState) (stepResult, error) {
+	resourceGroupName := config.ResourceGroupName
+	storageAccountName := config.StorageAccountName
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return "", err
 	}
 
-	client, err := armstorage.NewAccountsClient(subscriptionID, cred, &arm.ClientOptions{})
+	client, err := clients.accountsClient()
 	if err != nil {
 		log.Error(err, "armstorage.NewAccountsClient")
+		return "", err
+	}
+
+	_, err = client.Update(ctx, resourceGroupName, storageAccountName, armstorage.AccountUpdateParameters{
+		Properties: &armstorage.AccountPropertiesUpdateParameters{
+			AccessTier:                   storageAccountAccessTier(config),
+			AllowBlobPublicAccess:        to.Ptr(false),
+			MinimumTLSVersion:            to.Ptr(armstorage.MinimumTLSVersionTLS12),
+			PublicNetworkAccess:          to.Ptr(armstorage.PublicNetworkAccess(config.StorageAccountPublicNetworkAccess)),
+			NetworkRuleSet:               storageAccountNetworkRuleSet(config),
+			AllowSharedKeyAccess:         to.Ptr(config.StorageAccountSharedKeyAccess),
+			DefaultToOAuthAuthentication: to.Ptr(config.StorageAccountDefaultToOAuth),
+		},
+	}, nil)
+	if err != nil {
+		log.Error(err, "client.Update")
+		return "", err
+	}
+
+	log.Info("Azure Storage Account updated", "storageAccountName", storageAccountName, "reason", state.Reason)
+
+	updatedState, err := getStorageAccountState(ctx, clients, config)
+	if err != nil {
+		return "", err
+	}
+
+	if updatedState.Status != resourceStatusPresent {
+		log.Info("Azure Storage Account still does not match the configuration, the remaining settings can't be changed by tf-prepare", "storageAccountName", storageAccountName, "reason", updatedState.Reason)
+	}
+
+	return stepResultUpdated, nil
+}
+
+// storageAccountSKUTier returns the tier of the Storage Account SKU, for example Premium for Premium_LRS
+func storageAccountSKUTier(config azureConfig) armstorage.SKUTier {
+	if strings.HasPrefix(config.StorageAccountSKU, string(armstorage.SKUTierPremium)) {
+		return armstorage.SKUTierPremium
+	}
+
+	return armstorage.SKUTierStandard
+}
+
+// storageAccountAccessTier returns the access tier of the Storage Account, BlockBlobStorage accounts don't have one
+func storageAccountAccessTier(config azureConfig) *armstorage.AccessTier {
+	if config.StorageAccountKind == string(armstorage.KindBlockBlobStorage) {
+		return nil
+	}
+
+	return to.Ptr(armstorage.AccessTier(config.StorageAccountAccessTier))
+}
+
+func registerResourceProviderIfNeeded(ctx context.Context, clients *clientFactory, config azureConfig, resourceProviderNamespace string) error {
+	log, err := logr.FromContext(ctx)
+	if err != nil {
 		return err
 	}
-	_, err = client.GetProperties(ctx, resourceGroupName, storageAccountName, nil)
 
-	if err == nil {
-		log.Info("Azure Storage Account already exists", "storageAccountName", storageAccountName)
+	registrationState, err := getResourceProviderRegistrationState(ctx, clients, config, resourceProviderNamespace)
+	if err != nil {
+		return err
+	}
+
+	if registrationState == "Registered" {
+		log.Info("Azure Resource Provider already registered", "resourceProviderNamespace", resourceProviderNamespace, "registrationState", registrationState)
+		return nil
+	}
+
+	client, err := clients.providersClient()
+	if err != nil {
+		log.Error(err, "armresources.NewProvidersClient")
+		return err
+	}
+
+	regRes, err := client.Register(ctx, resourceProviderNamespace, &armresources.ProvidersClientRegisterOptions{})
+	if err != nil {
+		log.Error(err, "client.Register")
+		return err
+	}
+
+	log.Info("Registering Azure Resource Provider", "resourceProviderNamespace", resourceProviderNamespace, "registrationState", *regRes.RegistrationState)
+
+	if *regRes.RegistrationState == "Registered" {
+		log.Info("Azure Resource Provider registered", "resourceProviderNamespace", resourceProviderNamespace, "registrationState", *regRes.RegistrationState)
 		return nil
 	}
 
-	if err != nil && strings.Contains(err.Error(), "ResourceNotFound") {
-		err := registerResourceProviderIfNeeded(ctx, cred, config, "Microsoft.Storage")
+	currentRegistrationState := ""
+	for i := 1; i < 10; i++ {
+		res, err := client.Get(ctx, resourceProviderNamespace, &armresources.ProvidersClientGetOptions{})
 		if err != nil {
+			log.Error(err, "client.Get")
 			return err
 		}
 
-		res, err := client.CheckNameAvailability(
-			ctx,
-			armstorage.AccountCheckNameAvailabilityParameters{
-				Name: to.Ptr(storageAccountName),
-				Type: to.Ptr("Microsoft.Storage/storageAccounts"),
-			},
-			nil)
+		currentRegistrationState = *res.RegistrationState
+		if currentRegistrationState == "Registered" {
+			log.Info("Azure Resource Provider registered", "resourceProviderNamespace", resourceProviderNamespace, "registrationState", currentRegistrationState)
+			return nil
+		}
 
-		if err != nil {
-			log.Error(err, "client.CheckNameAvailability")
+		if currentRegistrationState != "Registering" {
+			err := fmt.Errorf("unknown registration state")
+			log.Error(err, "Azure Resource Provider in unknown registration state", "resourceProviderNamespace", resourceProviderNamespace, "registrationState", currentRegistrationState)
 			return err
 		}
 
-		if !*res.CheckNameAvailabilityResult.NameAvailable {
-			err := fmt.Errorf("Azure Storage Account Name '%s' not available", storageAccountName)
-			log.Error(err, "azure.CreateStorageAccount")
-			return err
+		log.Info("Registering Azure Resource Provider", "resourceProviderNamespace", resourceProviderNamespace, "registrationState", currentRegistrationState, "retryCounter", i)
+
+		select {
+		case <-time.After(time.Duration(i*5) * time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
 		}
+	}
 
-		poller, err := client.BeginCreate(
-			ctx,
-			resourceGroupName,
-			storageAccountName,
-			armstorage.AccountCreateParameters{
-				SKU: &armstorage.SKU{
-					Name: to.Ptr(armstorage.SKUNameStandardGRS),
-					Tier: to.Ptr(armstorage.SKUTierStandard),
-				},
-				Kind:     to.Ptr(armstorage.KindStorageV2),
-				Location: to.Ptr(resourceGroupLocation),
-				Properties: &armstorage.AccountPropertiesCreateParameters{
-					AccessTier:            to.Ptr(armstorage.AccessTierHot),
-					AllowBlobPublicAccess: to.Ptr(false),
-					MinimumTLSVersion:     to.Ptr(armstorage.MinimumTLSVersionTLS12),
-				},
-			}, nil)
+	err = fmt.Errorf("registration not completed within the specified time period")
+	log.Error(err, "Unable to register Azure Resource Provider", resourceProviderNamespace, "registrationState", currentRegistrationState)
 
-		if err != nil {
-			log.Error(err, "client.BeginCreate")
-			return err
+	return err
+}
+
+func getResourceProviderRegistrationState(ctx context.Context, clients *clientFactory, config azureConfig, resourceProviderNamespace string) (string, error) {
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	client, err := clients.providersClient()
+	if err != nil {
+		log.Error(err, "armresources.NewProvidersClient")
+		return "", err
+	}
+
+	res, err := client.Get(ctx, resourceProviderNamespace, &armresources.ProvidersClientGetOptions{})
+	if err != nil {
+		log.Error(err, "client.Get")
+		return "", err
+	}
+
+	return *res.RegistrationState, nil
+}
+
+// CreateStorageAccountContainer creates Storage Account Container (if it doesn't exist) or returns error
+func CreateStorageAccountContainer(ctx context.Context, clients *clientFactory, config azureConfig) (stepResult, error) {
+	resourceGroupName := config.ResourceGroupName
+	storageAccountName := config.StorageAccountName
+	storageAccountContainer := config.StorageAccountContainer
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	state, err := getStorageAccountContainerState(ctx, clients, config)
+	if err != nil {
+		return "", err
+	}
+
+	if state.Status == resourceStatusMisconfigured {
+		if !config.Reconcile {
+			log.Info("Azure Storage Account Container does not match the configuration, use reconcile to update it", "storageAccountContainer", storageAccountContainer, "reason", state.Reason)
+			return stepResultUnchanged, nil
 		}
 
-		_, err = poller.PollUntilDone(ctx, &runtime.PollUntilDoneOptions{
-			Frequency: 30 * time.Second,
-		})
-		if err != nil {
-			log.Error(err, "poller.PollUntilDone")
-			return err
+		return updateStorageAccountContainer(ctx, clients, config, state)
+	}
+
+	if state.Status != resourceStatusMissing {
+		log.Info("Azure Storage Account Container already exists", "storageAccountContainer", storageAccountContainer)
+		return stepResultUnchanged, nil
+	}
+
+	client, err := clients.blobContainersClient()
+	if err != nil {
+		log.Error(err, "armstorage.NewBlobContainersClient")
+		return "", err
+	}
+
+	_, err = client.Create(
+		ctx,
+		resourceGroupName,
+		storageAccountName,
+		storageAccountContainer,
+		armstorage.BlobContainer{
+			ContainerProperties: storageAccountContainerProperties(config),
+		}, nil)
+
+	if err != nil {
+		log.Error(err, "client.Create")
+		return "", err
+	}
+
+	// the immutability policy and legal hold can only be set on the created container
+	err = setStorageAccountContainerImmutability(ctx, clients, config, &armstorage.ContainerProperties{})
+	if err != nil {
+		return "", err
+	}
+
+	log.Info("Azure Storage Account Container created", "storageAccountContainer", storageAccountContainer)
+	return stepResultCreated, nil
+}
+
+func getStorageAccountContainerState(ctx context.Context, clients *clientFactory, config azureConfig) (resourceState, error) {
+	resourceGroupName := config.ResourceGroupName
+	storageAccountName := config.StorageAccountName
+	storageAccountContainer := config.StorageAccountContainer
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return resourceState{}, err
+	}
+
+	client, err := clients.blobContainersClient()
+	if err != nil {
+		log.Error(err, "armstorage.NewBlobContainersClient")
+		return resourceState{}, err
+	}
+	res, err := client.Get(
+		ctx,
+		resourceGroupName,
+		storageAccountName,
+		storageAccountContainer, nil)
+
+	if azerrors.IsNotFound(err) {
+		return resourceState{Status: resourceStatusMissing}, nil
+	}
+
+	if err != nil {
+		log.Error(err, "client.Get")
+		return resourceState{}, err
+	}
+
+	reasons := getStorageAccountContainerDifferences(config, res.ContainerProperties)
+	if len(reasons) > 0 {
+		return resourceState{Status: resourceStatusMisconfigured, Reason: strings.Join(reasons, ", ")}, nil
+	}
+
+	return resourceState{Status: resourceStatusPresent}, nil
+}
+
+// CreateKeyVault creates Azure Key Vault (if it doesn't exist) or returns error
+func CreateKeyVault(ctx context.Context, clients *clientFactory, config azureConfig) (stepResult, error) {
+	resourceGroupName := config.ResourceGroupName
+	resourceGroupLocation := config.ResourceGroupLocation
+	keyVaultName := config.KeyVaultName
+	tenantID := config.TenantID
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	state, err := getKeyVaultState(ctx, clients, config)
+	if err != nil {
+		return "", err
+	}
+
+	if state.Status == resourceStatusMisconfigured {
+		if !config.Reconcile {
+			log.Info("Azure KeyVault does not match the configuration, use reconcile to update it", "keyVaultName", keyVaultName, "reason", state.Reason)
+			return stepResultUnchanged, nil
+		}
+
+		return updateKeyVault(ctx, clients, config, state)
+	}
+
+	if state.Status != resourceStatusMissing {
+		log.Info("Azure KeyVault already exists", "keyVaultName", keyVaultName)
+		return stepResultUnchanged, nil
+	}
+
+	client, err := clients.vaultsClient()
+	if err != nil {
+		return "", err
+	}
+
+	keyVaultNameAvailable, err := client.CheckNameAvailability(ctx, armkeyvault.VaultCheckNameAvailabilityParameters{Name: to.Ptr(keyVaultName), Type: to.Ptr("Microsoft.KeyVault/vaults")}, nil)
+	if err != nil {
+		log.Error(err, "client.CheckNameAvailability")
+		return "", err
+	}
+
+	if !*keyVaultNameAvailable.CheckNameAvailabilityResult.NameAvailable {
+		deletedKeyVault, err := getDeletedKeyVault(ctx, clients, config)
+		if err != nil {
+			return "", err
+		}
+
+		if deletedKeyVault == nil {
+			reason := "name is already in use"
+			if keyVaultNameAvailable.CheckNameAvailabilityResult.Message != nil {
+				reason = *keyVaultNameAvailable.CheckNameAvailabilityResult.Message
+			}
+			err := fmt.Errorf("Azure KeyVault name %s not available: %s", keyVaultName, reason)
+			log.Error(err, "client.CheckNameAvailability", "keyVaultName", keyVaultName)
+			return "", err
+		}
+
+		if !config.RecoverDeletedKeyVault {
+			err := fmt.Errorf("Azure KeyVault %s is soft-deleted, enable recover-deleted-keyvault to recover it or purge it", keyVaultName)
+			log.Error(err, "client.CheckNameAvailability", "keyVaultName", keyVaultName)
+			return "", err
+		}
+
+		return recoverKeyVault(ctx, clients, config)
+	}
+
+	poll, err := client.BeginCreateOrUpdate(
+		ctx,
+		resourceGroupName,
+		keyVaultName,
+		armkeyvault.VaultCreateOrUpdateParameters{
+			Location: to.Ptr(resourceGroupLocation),
+			Tags:     resourceTags(config),
+			Properties: &armkeyvault.VaultProperties{
+				TenantID: to.Ptr(tenantID),
+				SKU: &armkeyvault.SKU{
+					Family: to.Ptr(armkeyvault.SKUFamilyA),
+					Name:   to.Ptr(keyVaultSKUName(config)),
+				},
+				AccessPolicies:            []*armkeyvault.AccessPolicyEntry{},
+				EnableRbacAuthorization:   to.Ptr(config.KeyVaultAuthorization == keyVaultAuthorizationRBAC),
+				EnablePurgeProtection:     keyVaultPurgeProtection(config),
+				SoftDeleteRetentionInDays: to.Ptr(int32(config.KeyVaultSoftDeleteRetentionDays)),
+				PublicNetworkAccess:       to.Ptr(config.KeyVaultPublicNetworkAccess),
+				NetworkACLs:               keyVaultNetworkACLs(config),
+			},
+		}, nil)
+	if err != nil {
+		log.Error(err, "client.BeginCreateOrUpdate")
+		return "", err
+	}
+	_, err = poll.PollUntilDone(ctx, &runtime.PollUntilDoneOptions{
+		Frequency: 5 * time.Second,
+	})
+	if err != nil {
+		log.Error(err, "poll.PollUntilDone")
+		return "", err
+	}
+
+	log.Info("Azure KeyVault created", "keyVaultName", keyVaultName)
+	return stepResultCreated, nil
+}
+
+// getDeletedKeyVault returns the soft-deleted Azure Key Vault with the name in the resource group location, or nil if there is none
+func getDeletedKeyVault(ctx context.Context, clients *clientFactory, config azureConfig) (*armkeyvault.DeletedVault, error) {
+	keyVaultName := config.KeyVaultName
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := clients.vaultsClient()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := client.GetDeleted(ctx, keyVaultName, config.ResourceGroupLocation, nil)
+	if azerrors.IsNotFound(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		log.Error(err, "client.GetDeleted")
+		return nil, err
+	}
+
+	// a deleted vault can only be recovered into the resource group it was deleted from
+	vaultID := ""
+	if res.Properties != nil && res.Properties.VaultID != nil {
+		vaultID = *res.Properties.VaultID
+	}
+
+	if !strings.EqualFold(vaultID, keyVaultScope(clients, config)) {
+		err := fmt.Errorf("Azure KeyVault %s is soft-deleted in another resource group or subscription: %s", keyVaultName, vaultID)
+		log.Error(err, "client.GetDeleted")
+		return nil, err
+	}
+
+	return &res.DeletedVault, nil
+}
+
+// recoverKeyVault recovers the soft-deleted Azure Key Vault together with its keys
+func recoverKeyVault(ctx context.Context, clients *clientFactory, config azureConfig) (stepResult, error) {
+	keyVaultName := config.KeyVaultName
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	client, err := clients.vaultsClient()
+	if err != nil {
+		return "", err
+	}
+
+	poll, err := client.BeginCreateOrUpdate(
+		ctx,
+		config.ResourceGroupName,
+		keyVaultName,
+		armkeyvault.VaultCreateOrUpdateParameters{
+			Location: to.Ptr(config.ResourceGroupLocation),
+			Properties: &armkeyvault.VaultProperties{
+				TenantID: to.Ptr(config.TenantID),
+				SKU: &armkeyvault.SKU{
+					Family: to.Ptr(armkeyvault.SKUFamilyA),
+					Name:   to.Ptr(keyVaultSKUName(config)),
+				},
+				CreateMode: to.Ptr(armkeyvault.CreateModeRecover),
+			},
+		}, nil)
+	if err != nil {
+		log.Error(err, "client.BeginCreateOrUpdate")
+		return "", err
+	}
+	_, err = poll.PollUntilDone(ctx, &runtime.PollUntilDoneOptions{
+		Frequency: 5 * time.Second,
+	})
+	if err != nil {
+		log.Error(err, "poll.PollUntilDone")
+		return "", err
+	}
+
+	log.Info("Azure KeyVault recovered", "keyVaultName", keyVaultName)
+	return stepResultRecovered, nil
+}
+
+func getKeyVaultState(ctx context.Context, clients *clientFactory, config azureConfig) (resourceState, error) {
+	resourceGroupName := config.ResourceGroupName
+	keyVaultName := config.KeyVaultName
+	tenantID := config.TenantID
+
+	client, err := clients.vaultsClient()
+	if err != nil {
+		return resourceState{}, err
+	}
+
+	res, err := client.Get(ctx, resourceGroupName, keyVaultName, nil)
+	if azerrors.IsNotFound(err) {
+		return resourceState{Status: resourceStatusMissing}, nil
+	}
+
+	if err != nil {
+		return resourceState{}, fmt.Errorf("Failed Azure/CreateKeyVault/client.Get: %v", err)
+	}
+
+	properties := res.Vault.Properties
+	if properties != nil && properties.TenantID != nil && *properties.TenantID != tenantID {
+		return resourceState{Status: resourceStatusMisconfigured, Reason: fmt.Sprintf("tenant ID is %s", *properties.TenantID)}, nil
+	}
+
+	reasons := getKeyVaultDifferences(config, properties)
+	if len(reasons) > 0 {
+		return resourceState{Status: resourceStatusMisconfigured, Reason: strings.Join(reasons, ", ")}, nil
+	}
+
+	return resourceState{Status: resourceStatusPresent}, nil
+}
+
+// updateKeyVault updates the settings of an existing Azure Key Vault that can be changed after creation
+func updateKeyVault(ctx context.Context, clients *clientFactory, config azureConfig, state resourceState) (stepResult, error) {
+	resourceGroupName := config.ResourceGroupName
+	keyVaultName := config.KeyVaultName
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	client, err := clients.vaultsClient()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = client.Update(ctx, resourceGroupName, keyVaultName, armkeyvault.VaultPatchParameters{
+		Properties: &armkeyvault.VaultPatchProperties{
+			SKU: &armkeyvault.SKU{
+				Family: to.Ptr(armkeyvault.SKUFamilyA),
+				Name:   to.Ptr(keyVaultSKUName(config)),
+			},
+			EnablePurgeProtection: keyVaultPurgeProtection(config),
+			PublicNetworkAccess:   to.Ptr(config.KeyVaultPublicNetworkAccess),
+			NetworkACLs:           keyVaultNetworkACLs(config),
+		},
+	}, nil)
+	if err != nil {
+		log.Error(err, "client.Update")
+		return "", err
+	}
+
+	log.Info("Azure KeyVault updated", "keyVaultName", keyVaultName, "reason", state.Reason)
+
+	updatedState, err := getKeyVaultState(ctx, clients, config)
+	if err != nil {
+		return "", err
+	}
+
+	if updatedState.Status != resourceStatusPresent {
+		log.Info("Azure KeyVault still does not match the configuration, the remaining settings can't be changed after creation", "keyVaultName", keyVaultName, "reason", updatedState.Reason)
+	}
+
+	return stepResultUpdated, nil
+}
+
+// getKeyVaultDifferences returns how the properties of an existing Azure Key Vault differ from the configuration
+func getKeyVaultDifferences(config azureConfig, properties *armkeyvault.VaultProperties) []string {
+	if properties == nil {
+		return nil
+	}
+
+	reasons := []string{}
+
+	rbacAuthorization := properties.EnableRbacAuthorization != nil && *properties.EnableRbacAuthorization
+	if rbacAuthorization != (config.KeyVaultAuthorization == keyVaultAuthorizationRBAC) {
+		reasons = append(reasons, fmt.Sprintf("RBAC authorization is %t", rbacAuthorization))
+	}
+
+	// a standard vault can be upgraded to premium for HSM keys, premium vaults are left as they are
+	if keyVaultSKUName(config) == armkeyvault.SKUNamePremium && properties.SKU != nil && properties.SKU.Name != nil && !strings.EqualFold(string(*properties.SKU.Name), string(armkeyvault.SKUNamePremium)) {
+		reasons = append(reasons, fmt.Sprintf("sku is %s", *properties.SKU.Name))
+	}
+
+	purgeProtection := properties.EnablePurgeProtection != nil && *properties.EnablePurgeProtection
+	if config.KeyVaultPurgeProtection && !purgeProtection {
+		// purge protection can't be disabled once enabled, so only a missing one is reported
+		reasons = append(reasons, "purge protection is disabled")
+	}
+
+	if properties.SoftDeleteRetentionInDays != nil && int(*properties.SoftDeleteRetentionInDays) != config.KeyVaultSoftDeleteRetentionDays {
+		reasons = append(reasons, fmt.Sprintf("soft delete retention is %d days", *properties.SoftDeleteRetentionInDays))
+	}
+
+	publicNetworkAccess := "Enabled"
+	if properties.PublicNetworkAccess != nil {
+		publicNetworkAccess = *properties.PublicNetworkAccess
+	}
+	if !strings.EqualFold(publicNetworkAccess, config.KeyVaultPublicNetworkAccess) {
+		reasons = append(reasons, fmt.Sprintf("public network access is %s", publicNetworkAccess))
+	}
+
+	if !keyVaultNetworkACLsEqual(properties.NetworkACLs, keyVaultNetworkACLs(config)) {
+		reasons = append(reasons, "network rules differ")
+	}
+
+	return reasons
+}
+
+// keyVaultPurgeProtection returns nil when purge protection is disabled, since the API rejects setting it to false
+func keyVaultPurgeProtection(config azureConfig) *bool {
+	if !config.KeyVaultPurgeProtection {
+		return nil
+	}
+
+	return to.Ptr(true)
+}
+
+func keyVaultNetworkACLs(config azureConfig) *armkeyvault.NetworkRuleSet {
+	defaultAction := armkeyvault.NetworkRuleActionAllow
+	if len(config.KeyVaultIPRules) > 0 || len(config.KeyVaultVirtualNetworkRules) > 0 {
+		defaultAction = armkeyvault.NetworkRuleActionDeny
+	}
+
+	ipRules := []*armkeyvault.IPRule{}
+	for _, ipRule := range config.KeyVaultIPRules {
+		ipRules = append(ipRules, &armkeyvault.IPRule{Value: to.Ptr(ipRule)})
+	}
+
+	virtualNetworkRules := []*armkeyvault.VirtualNetworkRule{}
+	for _, virtualNetworkRule := range config.KeyVaultVirtualNetworkRules {
+		virtualNetworkRules = append(virtualNetworkRules, &armkeyvault.VirtualNetworkRule{ID: to.Ptr(virtualNetworkRule)})
+	}
+
+	return &armkeyvault.NetworkRuleSet{
+		Bypass:              to.Ptr(armkeyvault.NetworkRuleBypassOptionsAzureServices),
+		DefaultAction:       to.Ptr(defaultAction),
+		IPRules:             ipRules,
+		VirtualNetworkRules: virtualNetworkRules,
+	}
+}
+
+func keyVaultNetworkACLsEqual(a, b *armkeyvault.NetworkRuleSet) bool {
+	defaultAction := func(ruleSet *armkeyvault.NetworkRuleSet) armkeyvault.NetworkRuleAction {
+		if ruleSet == nil || ruleSet.DefaultAction == nil {
+			return armkeyvault.NetworkRuleActionAllow
+		}
+		return *ruleSet.DefaultAction
+	}
+
+	ipRules := func(ruleSet *armkeyvault.NetworkRuleSet) []string {
+		values := []string{}
+		if ruleSet == nil {
+			return values
+		}
+		for _, ipRule := range ruleSet.IPRules {
+			if ipRule != nil && ipRule.Value != nil {
+				// a single address is returned as a /32 range
+				values = append(values, strings.TrimSuffix(*ipRule.Value, "/32"))
+			}
+		}
+		return values
+	}
+
+	virtualNetworkRules := func(ruleSet *armkeyvault.NetworkRuleSet) []string {
+		values := []string{}
+		if ruleSet == nil {
+			return values
+		}
+		for _, virtualNetworkRule := range ruleSet.VirtualNetworkRules {
+			if virtualNetworkRule != nil && virtualNetworkRule.ID != nil {
+				values = append(values, *virtualNetworkRule.ID)
+			}
+		}
+		return values
+	}
+
+	return strings.EqualFold(string(defaultAction(a)), string(defaultAction(b))) &&
+		stringSetsEqual(ipRules(a), ipRules(b)) &&
+		stringSetsEqual(virtualNetworkRules(a), virtualNetworkRules(b))
+}
+
+// stringSetsEqual reports if a and b contain the same values, ignoring order and case
+func stringSetsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+OUTER:
+	for _, i := range a {
+		for _, j := range b {
+			if strings.EqualFold(i, j) {
+				continue OUTER
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// CreateKeyVaultAccessPolicy creates Azure Key Vault Access Policy (if it doesn't exist) or returns error
+func CreateKeyVaultAccessPolicy(ctx context.Context, clients *clientFactory, config azureConfig) (stepResult, error) {
+	currentUserObjectID, err := getAccessPolicyObjectID(ctx, clients, config)
+	if err != nil {
+		return "", err
+	}
+
+	return createKeyVaultAccessPolicy(ctx, clients, config, currentUserObjectID, keyVaultAccessPolicyKeyPermissions(config))
+}
+
+func getKeyVaultAccessPolicyState(ctx context.Context, clients *clientFactory, config azureConfig, currentUserObjectID string) (resourceState, error) {
+	return getKeyVaultAccessPolicyStateForPermissions(ctx, clients, config, currentUserObjectID, keyVaultAccessPolicyKeyPermissions(config))
+}
+
+// createKeyVaultAccessPolicy adds an access policy with the permissions for the object ID (if it doesn't exist) or returns error
+func createKeyVaultAccessPolicy(ctx context.Context, clients *clientFactory, config azureConfig, objectID string, permissions armkeyvault.Permissions) (stepResult, error) {
+	resourceGroupName := config.ResourceGroupName
+	keyVaultName := config.KeyVaultName
+	tenantID := config.TenantID
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	state, err := getKeyVaultAccessPolicyStateForPermissions(ctx, clients, config, objectID, permissions)
+	if err != nil {
+		return "", err
+	}
+
+	if state.Status == resourceStatusPresent {
+		// If the correct Key Permissions already exists, return early
+		log.Info("Azure KeyVault Access Policy already correct", "objectID", objectID)
+		return stepResultUnchanged, nil
+	}
+
+	client, err := clients.vaultsClient()
+	if err != nil {
+		return "", err
+	}
+
+	accessPolicies := []*armkeyvault.AccessPolicyEntry{
+		{
+			TenantID:    &tenantID,
+			ObjectID:    &objectID,
+			Permissions: &permissions,
+		},
+	}
+
+	properties := armkeyvault.VaultAccessPolicyProperties{AccessPolicies: accessPolicies}
+	parameters := armkeyvault.VaultAccessPolicyParameters{Properties: &properties}
+	options := armkeyvault.VaultsClientUpdateAccessPolicyOptions{}
+
+	_, err = client.UpdateAccessPolicy(ctx, resourceGroupName, keyVaultName, armkeyvault.AccessPolicyUpdateKindAdd, parameters, &options)
+	if err != nil {
+		log.Error(err, "client.UpdateAccessPolicy")
+		return "", err
+	}
+
+	log.Info("Azure KeyVault Access Policy created or updated", "objectID", objectID)
+
+	if state.Status == resourceStatusMisconfigured {
+		return stepResultUpdated, nil
+	}
+
+	return stepResultCreated, nil
+}
+
+func getKeyVaultAccessPolicyStateForPermissions(ctx context.Context, clients *clientFactory, config azureConfig, objectID string, permissions armkeyvault.Permissions) (resourceState, error) {
+	resourceGroupName := config.ResourceGroupName
+	keyVaultName := config.KeyVaultName
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return resourceState{}, err
+	}
+
+	client, err := clients.vaultsClient()
+	if err != nil {
+		return resourceState{}, err
+	}
+
+	kv, err := client.Get(ctx, resourceGroupName, keyVaultName, nil)
+	if err != nil {
+		log.Error(err, "client.Get")
+		return resourceState{}, err
+	}
+
+	state := resourceState{Status: resourceStatusMissing}
+
+	// Loop through all access policies
+	for _, accessPolicy := range kv.Vault.Properties.AccessPolicies {
+		// Check if the object id for the access policy is the same as the requested object id
+		if *accessPolicy.ObjectID == objectID {
+			// Check if the Key Permissions in the access policy are the same as the required Key Permissions
+			if keyPermissionsEqual(accessPolicy.Permissions.Keys, permissions.Keys) {
+				return resourceState{Status: resourceStatusPresent}, nil
+			}
+			state = resourceState{Status: resourceStatusMisconfigured, Reason: "key permissions differ"}
 		}
-
-		log.Info("Azure Storage Account created", "storageAccountName", storageAccountName)
-		return nil
 	}
 
-	log.Error(err, "client.GetProperties")
-	return err
+	return state, nil
 }
 
-func registerResourceProviderIfNeeded(ctx context.Context, cred azcore.TokenCredential, config azureConfig, resourceProviderNamespace string) error {
-	subscriptionID := config.SubscriptionID
+// getAccessPolicyObjectID returns the configured object ID, or the object ID of the caller from
+// the oid claim of the ARM token, falling back to looking it up in Microsoft Graph
+func getAccessPolicyObjectID(ctx context.Context, clients *clientFactory, config azureConfig) (string, error) {
+	servicePrincipalObjectID := config.ServicePrincipalObjectID
 	log, err := logr.FromContext(ctx)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	client, err := armresources.NewProvidersClient(subscriptionID, cred, &arm.ClientOptions{})
-	if err != nil {
-		log.Error(err, "armresources.NewProvidersClient")
-		return err
+	if servicePrincipalObjectID != "" {
+		return servicePrincipalObjectID, nil
 	}
 
-	res, err := client.Get(ctx, resourceProviderNamespace, &armresources.ProvidersClientGetOptions{})
+	token, err := clients.cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{clients.resourceManagerScope()}})
 	if err != nil {
-		log.Error(err, "client.Get")
-		return err
-	}
-
-	if *res.RegistrationState == "Registered" {
-		log.Info("Azure Resource Provider already registered", "resourceProviderNamespace", resourceProviderNamespace, "registrationState", *res.RegistrationState)
-		return nil
+		log.Error(err, "cred.GetToken")
+		return "", err
 	}
 
-	regRes, err := client.Register(ctx, resourceProviderNamespace, &armresources.ProvidersClientRegisterOptions{})
+	claims, err := parseTokenClaims(token.Token)
 	if err != nil {
-		log.Error(err, "client.Register")
-		return err
+		log.Info("Unable to parse access token, looking up object ID in Microsoft Graph", "error", err)
 	}
 
-	log.Info("Registering Azure Resource Provider", "resourceProviderNamespace", resourceProviderNamespace, "registrationState", *regRes.RegistrationState)
-
-	if *regRes.RegistrationState == "Registered" {
-		log.Info("Azure Resource Provider registered", "resourceProviderNamespace", resourceProviderNamespace, "registrationState", *regRes.RegistrationState)
-		return nil
+	if claims.ObjectID != "" {
+		return claims.ObjectID, nil
 	}
 
-	currentRegistrationState := ""
-	for i := 1; i < 10; i++ {
-		res, err := client.Get(ctx, resourceProviderNamespace, &armresources.ProvidersClientGetOptions{})
+	if claims.appID() != "" {
+		servicePrincipalObjectID, err := getServicePrincipalObjectID(ctx, clients.cred, clients.graphEndpoint, claims.appID())
 		if err != nil {
-			log.Error(err, "client.Get")
-			return err
+			log.Error(err, "getServicePrincipalObjectID")
+			return "", err
 		}
 
-		currentRegistrationState = *res.RegistrationState
-		if currentRegistrationState == "Registered" {
-			log.Info("Azure Resource Provider registered", "resourceProviderNamespace", resourceProviderNamespace, "registrationState", currentRegistrationState)
-			return nil
-		}
+		return servicePrincipalObjectID, nil
+	}
 
-		if currentRegistrationState != "Registering" {
-			err := fmt.Errorf("unknown registration state")
-			log.Error(err, "Azure Resource Provider in unknown registration state", "resourceProviderNamespace", resourceProviderNamespace, "registrationState", currentRegistrationState)
-			return err
-		}
+	currentUserObjectID, err := getCurrentUserObjectID(ctx, clients.cred, clients.graphEndpoint)
+	if err != nil {
+		log.Error(err, "getCurrentUserObjectID")
+		return "", err
+	}
 
-		log.Info("Registering Azure Resource Provider", "resourceProviderNamespace", resourceProviderNamespace, "registrationState", currentRegistrationState, "retryCounter", i)
+	return currentUserObjectID, nil
+}
 
-		time.Sleep(time.Duration(i*5) * time.Second)
+func keyVaultAccessPolicyKeyPermissions(config azureConfig) armkeyvault.Permissions {
+	permissions := armkeyvault.Permissions{
+		Keys: []*armkeyvault.KeyPermissions{
+			to.Ptr(armkeyvault.KeyPermissionsUpdate),
+			to.Ptr(armkeyvault.KeyPermissionsCreate),
+			to.Ptr(armkeyvault.KeyPermissionsGet),
+			to.Ptr(armkeyvault.KeyPermissionsList),
+			to.Ptr(armkeyvault.KeyPermissionsEncrypt),
+			to.Ptr(armkeyvault.KeyPermissionsDecrypt),
+		},
 	}
 
-	err = fmt.Errorf("registration not completed within the specified time period")
-	log.Error(err, "Unable to register Azure Resource Provider", resourceProviderNamespace, "registrationState", currentRegistrationState)
+	// the rotation policy of an existing key can only be updated through the data plane
+	if isKeyRotationPolicyConfigured(config) {
+		permissions.Keys = append(permissions.Keys,
+			to.Ptr(armkeyvault.KeyPermissionsGetrotationpolicy),
+			to.Ptr(armkeyvault.KeyPermissionsSetrotationpolicy),
+		)
+	}
 
-	return err
+	return permissions
 }
 
-// CreateStorageAccountContainer creates Storage Account Container (if it doesn't exist) or returns error
-func CreateStorageAccountContainer(ctx context.Context, cred azcore.TokenCredential, config azureConfig) error {
+// CreateKeyVaultKey creates Azure Key Vault Key (if it doesn't exist) or returns error
+func CreateKeyVaultKey(ctx context.Context, clients *clientFactory, config azureConfig) (stepResult, error) {
 	resourceGroupName := config.ResourceGroupName
-	storageAccountName := config.StorageAccountName
-	storageAccountContainer := config.StorageAccountContainer
-	subscriptionID := config.SubscriptionID
+	keyVaultName := config.KeyVaultName
+	keyName := config.KeyVaultKeyName
 	log, err := logr.FromContext(ctx)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	client, err := armstorage.NewBlobContainersClient(subscriptionID, cred, &arm.ClientOptions{})
+	state, err := getKeyVaultKeyState(ctx, clients, config)
 	if err != nil {
-		log.Error(err, "armstorage.NewBlobContainersClient")
-		return err
+		return "", err
 	}
-	_, err = client.Get(
-		ctx,
-		resourceGroupName,
-		storageAccountName,
-		storageAccountContainer, nil)
 
-	if err == nil {
-		log.Info("Azure Storage Account Container already exists", "storageAccountContainer", storageAccountContainer)
-		return nil
+	if state.Status == resourceStatusMisconfigured {
+		return updateKeyVaultKey(ctx, clients, config, state)
 	}
 
-	if err != nil && strings.Contains(err.Error(), "The specified container does not exist") {
-		_, err := client.Create(
-			ctx,
-			resourceGroupName,
-			storageAccountName,
-			storageAccountContainer,
-			armstorage.BlobContainer{}, nil)
+	if state.Status != resourceStatusMissing {
+		log.Info("Azure KeyVault Key already exists", "keyName", keyName)
+		return stepResultUnchanged, nil
+	}
 
-		if err != nil {
-			log.Error(err, "client.Create")
-			return err
-		}
+	client, err := clients.keysClient()
+	if err != nil {
+		log.Error(err, "armkeyvault.NewKeysClient")
+		return "", err
+	}
 
-		log.Info("Azure Storage Account Container created", "storageAccountContainer", storageAccountContainer)
-		return nil
+	_, err = client.CreateIfNotExist(
+		ctx,
+		resourceGroupName,
+		keyVaultName,
+		keyName,
+		armkeyvault.KeyCreateParameters{
+			Tags:       resourceTags(config),
+			Properties: keyVaultKeyProperties(config),
+		}, nil)
+	if err != nil {
+		log.Error(err, "armkeyvault.NewKeysClient")
+		return "", err
 	}
 
-	log.Error(err, "armstorage.NewBlobContainersClient")
-	return err
+	log.Info("Azure KeyVault Key created", "keyName", keyName)
+	return stepResultCreated, nil
 }
 
-// CreateKeyVault creates Azure Key Vault (if it doesn't exist) or returns error
-func CreateKeyVault(ctx context.Context, cred azcore.TokenCredential, config azureConfig) error {
+func getKeyVaultKeyState(ctx context.Context, clients *clientFactory, config azureConfig) (resourceState, error) {
 	resourceGroupName := config.ResourceGroupName
-	resourceGroupLocation := config.ResourceGroupLocation
 	keyVaultName := config.KeyVaultName
-	subscriptionID := config.SubscriptionID
-	tenantID := config.TenantID
+	keyName := config.KeyVaultKeyName
 	log, err := logr.FromContext(ctx)
 	if err != nil {
-		return err
+		return resourceState{}, err
 	}
 
-	client, err := armkeyvault.NewVaultsClient(subscriptionID, cred, &arm.ClientOptions{})
+	client, err := clients.keysClient()
 	if err != nil {
-		return err
+		log.Error(err, "armkeyvault.NewKeysClient")
+		return resourceState{}, err
 	}
 
-	_, err = client.Get(ctx, resourceGroupName, keyVaultName, nil)
-	if err == nil {
-		log.Info("Azure KeyVault already exists", "keyVaultName", keyVaultName)
-		return nil
+	res, err := client.Get(ctx, resourceGroupName, keyVaultName, keyName, nil)
+	if azerrors.IsNotFound(err) {
+		return resourceState{Status: resourceStatusMissing}, nil
 	}
 
-	if err != nil && strings.Contains(err.Error(), "ResourceNotFound") {
-		keyVaultNameAvailable, err := client.CheckNameAvailability(ctx, armkeyvault.VaultCheckNameAvailabilityParameters{Name: to.Ptr(keyVaultName), Type: to.Ptr("Microsoft.KeyVault/vaults")}, nil)
-		if err != nil {
-			log.Error(err, "client.CheckNameAvailability")
-			return err
-		}
+	if err != nil {
+		log.Error(err, "client.Get")
+		return resourceState{}, err
+	}
 
-		if !*keyVaultNameAvailable.CheckNameAvailabilityResult.NameAvailable {
-			log.Error(err, "client.CheckNameAvailability: Azure KeyVault Name not available", "keyVaultName", keyVaultName)
-			return err
-		}
+	properties := res.Key.Properties
+	if properties != nil && properties.Attributes != nil && properties.Attributes.Enabled != nil && !*properties.Attributes.Enabled {
+		return resourceState{Status: resourceStatusMisconfigured, Reason: "key is disabled"}, nil
+	}
 
-		poll, err := client.BeginCreateOrUpdate(
-			ctx,
-			resourceGroupName,
-			keyVaultName,
-			armkeyvault.VaultCreateOrUpdateParameters{
-				Location: to.Ptr(resourceGroupLocation),
-				Properties: &armkeyvault.VaultProperties{
-					TenantID: to.Ptr(tenantID),
-					SKU: &armkeyvault.SKU{
-						Family: to.Ptr(armkeyvault.SKUFamilyA),
-						Name:   to.Ptr(armkeyvault.SKUNameStandard),
-					},
-					AccessPolicies: []*armkeyvault.AccessPolicyEntry{},
-				},
-			}, nil)
-		if err != nil {
-			log.Error(err, "client.BeginCreateOrUpdate")
-			return err
-		}
-		_, err = poll.PollUntilDone(ctx, &runtime.PollUntilDoneOptions{
-			Frequency: 5 * time.Second,
-		})
-		if err != nil {
-			log.Error(err, "poll.PollUntilDone")
-			return err
+	keyDifferences, rotationPolicyDifferences := getKeyVaultKeyDifferences(config, properties)
+	reasons := append(keyDifferences, rotationPolicyDifferences...)
+	if len(reasons) > 0 {
+		state := resourceState{Status: resourceStatusMisconfigured, Reason: strings.Join(reasons, ", ")}
+		if len(rotationPolicyDifferences) > 0 {
+			state.Differences = []resourceDifference{resourceDifferenceRotationPolicy}
 		}
-
-		log.Info("Azure KeyVault created", "keyVaultName", keyVaultName)
-		return nil
+		return state, nil
 	}
 
-	return fmt.Errorf("Failed Azure/CreateKeyVault/client.Get: %v", err)
+	return resourceState{Status: resourceStatusPresent}, nil
 }
 
-// CreateKeyVaultAccessPolicy creates Azure Key Vault Access Policy (if it doesn't exist) or returns error
-func CreateKeyVaultAccessPolicy(ctx context.Context, cred azcore.TokenCredential, config azureConfig) error {
+// updateKeyVaultKey updates the rotation policy of an existing Azure Key Vault Key, the other
+// properties of the key only change when a new version is created with rotate-key
+func updateKeyVaultKey(ctx context.Context, clients *clientFactory, config azureConfig, state resourceState) (stepResult, error) {
 	resourceGroupName := config.ResourceGroupName
 	keyVaultName := config.KeyVaultName
-	subscriptionID := config.SubscriptionID
-	tenantID := config.TenantID
-	servicePrincipalObjectID := config.ServicePrincipalObjectID
+	keyName := config.KeyVaultKeyName
 	log, err := logr.FromContext(ctx)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	var currentUserObjectID string
-	if servicePrincipalObjectID == "" {
-		var err error
-		currentUserObjectID, err = getCurrentUserObjectID(ctx, cred, tenantID)
-		if err != nil {
-			log.Error(err, "getCurrentUserObjectID")
-			return err
-		}
-	}
-	if servicePrincipalObjectID != "" {
-		currentUserObjectID = servicePrincipalObjectID
+	client, err := clients.keysClient()
+	if err != nil {
+		log.Error(err, "armkeyvault.NewKeysClient")
+		return "", err
 	}
 
-	client, err := armkeyvault.NewVaultsClient(subscriptionID, cred, &arm.ClientOptions{})
+	res, err := client.Get(ctx, resourceGroupName, keyVaultName, keyName, nil)
 	if err != nil {
-		return err
+		log.Error(err, "client.Get")
+		return "", err
 	}
 
-	keyPermissions := armkeyvault.Permissions{
-		Keys: []*armkeyvault.KeyPermissions{
-			to.Ptr(armkeyvault.KeyPermissionsUpdate),
-			to.Ptr(armkeyvault.KeyPermissionsCreate),
-			to.Ptr(armkeyvault.KeyPermissionsGet),
-			to.Ptr(armkeyvault.KeyPermissionsList),
-			to.Ptr(armkeyvault.KeyPermissionsEncrypt),
-			to.Ptr(armkeyvault.KeyPermissionsDecrypt),
-		},
+	keyDifferences, rotationPolicyDifferences := getKeyVaultKeyDifferences(config, res.Key.Properties)
+	if len(keyDifferences) == 0 && len(rotationPolicyDifferences) == 0 {
+		log.Info("Azure KeyVault Key does not match the configuration", "keyName", keyName, "reason", state.Reason)
+		return stepResultUnchanged, nil
 	}
 
-	accessPolicies := []*armkeyvault.AccessPolicyEntry{
-		{
-			TenantID:    &tenantID,
-			ObjectID:    &currentUserObjectID,
-			Permissions: &keyPermissions,
-		},
+	if len(keyDifferences) > 0 {
+		log.Info("Azure KeyVault Key does not match the configuration, use rotate-key to create a version with the configured properties", "keyName", keyName, "reason", strings.Join(keyDifferences, ", "))
 	}
 
-	properties := armkeyvault.VaultAccessPolicyProperties{AccessPolicies: accessPolicies}
-	parameters := armkeyvault.VaultAccessPolicyParameters{Properties: &properties}
-	options := armkeyvault.VaultsClientUpdateAccessPolicyOptions{}
-
-	kv, err := client.Get(ctx, resourceGroupName, keyVaultName, nil)
-	if err != nil {
-		log.Error(err, "client.Get")
-		return err
+	if len(rotationPolicyDifferences) == 0 {
+		return stepResultUnchanged, nil
 	}
 
-	// Loop through all access policies
-	for _, accessPolicy := range kv.Vault.Properties.AccessPolicies {
-		// Check if the current object id for the access policy is the same as the current user object id
-		if *accessPolicy.ObjectID == currentUserObjectID {
-			// Check if the Key Permissions in the access policy are the same as the required Key Permissions
-			if keyPermissionsEqual(accessPolicy.Permissions.Keys, keyPermissions.Keys) {
-				// If the correct Key Permissions already exists, return early
-				log.Info("Azure KeyVault Access Policy already correct", "currentUserObjectID", currentUserObjectID)
-				return nil
-			}
-		}
+	if !config.Reconcile {
+		log.Info("Azure KeyVault Key rotation policy does not match the configuration, use reconcile to update it", "keyName", keyName)
+		return stepResultUnchanged, nil
 	}
 
-	_, err = client.UpdateAccessPolicy(ctx, resourceGroupName, keyVaultName, armkeyvault.AccessPolicyUpdateKindAdd, parameters, &options)
+	err = updateKeyVaultKeyRotationPolicy(ctx, clients, config)
 	if err != nil {
-		log.Error(err, "client.UpdateAccessPolicy")
-		return err
+		return "", err
 	}
 
-	log.Info("Azure KeyVault Access Policy created or updated", "currentUserObjectID", currentUserObjectID)
-
-	return nil
+	log.Info("Azure KeyVault Key rotation policy updated", "keyName", keyName)
+	return stepResultUpdated, nil
 }
 
-// CreateKeyVaultKey creates Azure Key Vault Key (if it doesn't exist) or returns error
-func CreateKeyVaultKey(ctx context.Context, cred azcore.TokenCredential, config azureConfig) error {
+// CreateResourceLock creates Azure Resource Lock (if it doesn't exist) or return error
+func CreateResourceLock(ctx context.Context, clients *clientFactory, config azureConfig, resourceProviderNamespace, parentResourcePath, resourceType, resourceName, lockName string) (stepResult, error) {
 	resourceGroupName := config.ResourceGroupName
-	keyVaultName := config.KeyVaultName
-	keyName := config.KeyVaultKeyName
-	subscriptionID := config.SubscriptionID
 	log, err := logr.FromContext(ctx)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	client, err := armkeyvault.NewKeysClient(subscriptionID, cred, &arm.ClientOptions{})
+	state, err := getResourceLockState(ctx, clients, config, resourceProviderNamespace, parentResourcePath, resourceType, resourceName, lockName)
 	if err != nil {
-		log.Error(err, "armkeyvault.NewKeysClient")
-		return err
+		return "", err
 	}
 
-	_, err = client.Get(ctx, resourceGroupName, keyVaultName, keyName, nil)
-	if err == nil {
-		log.Info("Azure KeyVault Key already exists", "keyName", keyName)
-		return nil
+	if state.Status == resourceStatusMisconfigured && !config.Reconcile {
+		log.Info("Azure Resource Lock does not match the configuration, use reconcile to update it", "resourceGroupName", resourceGroupName, "resourceProviderNamespace", resourceProviderNamespace, "resourceType", resourceType, "resourceName", resourceName, "reason", state.Reason)
+		return stepResultUnchanged, nil
 	}
 
-	_, err = client.CreateIfNotExist(
-		ctx,
-		resourceGroupName,
-		keyVaultName,
-		keyName,
-		armkeyvault.KeyCreateParameters{
-			Properties: &armkeyvault.KeyProperties{
-				Attributes: &armkeyvault.KeyAttributes{
-					Enabled: to.Ptr(true),
-				},
-				KeySize: to.Ptr[int32](2048),
-				KeyOps: []*armkeyvault.JSONWebKeyOperation{
-					to.Ptr(armkeyvault.JSONWebKeyOperationEncrypt),
-					to.Ptr(armkeyvault.JSONWebKeyOperationDecrypt),
-				},
-				Kty: to.Ptr(armkeyvault.JSONWebKeyTypeRSA),
-			}}, nil)
+	if state.Status == resourceStatusPresent {
+		log.Info("Azure Resource Lock already exists", "resourceGroupName", resourceGroupName, "resourceProviderNamespace", resourceProviderNamespace, "resourceType", resourceType, "resourceName", resourceName)
+		return stepResultUnchanged, nil
+	}
+
+	client, err := clients.managementLocksClient()
 	if err != nil {
-		log.Error(err, "armkeyvault.NewKeysClient")
-		return err
+		log.Error(err, "armlocks.NewManagementLocksClient")
+		return "", err
 	}
 
-	log.Info("Azure KeyVault Key created", "keyName", keyName)
-	return nil
-}
+	ctx, err = withLockAPIVersion(ctx, clients)
+	if err != nil {
+		return "", err
+	}
 
-// fixApiVersionTransporter is needed for NewManagementLocksClient since it uses an api-version that doesn't seem to work
-type fixApiVersionTransporter struct {
-	apiVersion string
-	httpClient *http.Client
-}
+	_, err = client.CreateOrUpdateAtResourceLevel(ctx, resourceGroupName, resourceProviderNamespace, parentResourcePath, resourceType, resourceName, lockName, resourceLockObject(config), &armlocks.ManagementLocksClientCreateOrUpdateAtResourceLevelOptions{})
+	if err != nil {
+		log.Error(err, "client.CreateOrUpdateAtResourceLevel")
+		return "", authorizationError(err, "write Microsoft.Authorization/locks")
+	}
 
-func (t *fixApiVersionTransporter) Do(req *http.Request) (*http.Response, error) {
-	reqQP := req.URL.Query()
-	reqQP.Set("api-version", t.apiVersion)
-	req.URL.RawQuery = reqQP.Encode()
+	if state.Status == resourceStatusMisconfigured {
+		log.Info("Azure Resource Lock updated", "resourceGroupName", resourceGroupName, "resourceProviderNamespace", resourceProviderNamespace, "resourceType", resourceType, "resourceName", resourceName, "reason", state.Reason)
+		return stepResultUpdated, nil
+	}
 
-	return t.httpClient.Do(req)
+	log.Info("Azure Resource Lock created", "resourceGroupName", resourceGroupName, "resourceProviderNamespace", resourceProviderNamespace, "resourceType", resourceType, "resourceName", resourceName)
+	return stepResultCreated, nil
 }
 
-// CreateResourceLock creates Azure Resource Lock (if it doesn't exist) or return error
-func CreateResourceLock(ctx context.Context, cred azcore.TokenCredential, config azureConfig, resourceProviderNamespace, parentResourcePath, resourceType, resourceName, lockName string) error {
+func getResourceLockState(ctx context.Context, clients *clientFactory, config azureConfig, resourceProviderNamespace, parentResourcePath, resourceType, resourceName, lockName string) (resourceState, error) {
 	resourceGroupName := config.ResourceGroupName
-	subscriptionID := config.SubscriptionID
 	log, err := logr.FromContext(ctx)
 	if err != nil {
-		return err
+		return resourceState{}, err
 	}
 
-	client, err := armlocks.NewManagementLocksClient(subscriptionID, cred, &arm.ClientOptions{
-		ClientOptions: policy.ClientOptions{
-			Transport: &fixApiVersionTransporter{
-				apiVersion: "2016-09-01",
-				httpClient: http.DefaultClient,
-			},
-		},
-	})
+	client, err := clients.managementLocksClient()
 	if err != nil {
 		log.Error(err, "armlocks.NewManagementLocksClient")
-		return err
+		return resourceState{}, err
 	}
 
-	_, err = client.GetAtResourceLevel(ctx, resourceGroupName, resourceProviderNamespace, parentResourcePath, resourceType, resourceName, lockName, &armlocks.ManagementLocksClientGetAtResourceLevelOptions{})
-	if err == nil {
-		log.Info("Azure Resource Lock already exists", "resourceGroupName", resourceGroupName, "resourceProviderNamespace", resourceProviderNamespace, "resourceType", resourceType, "resourceName", resourceName)
-		return nil
+	ctx, err = withLockAPIVersion(ctx, clients)
+	if err != nil {
+		return resourceState{}, err
 	}
 
-	if err != nil && strings.Contains(err.Error(), "LockNotFound") {
-		_, err = client.CreateOrUpdateAtResourceLevel(ctx, resourceGroupName, resourceProviderNamespace, parentResourcePath, resourceType, resourceName, lockName, armlocks.ManagementLockObject{Properties: &armlocks.ManagementLockProperties{Level: to.Ptr(armlocks.LockLevelCanNotDelete), Notes: to.Ptr("CanNotDelete")}}, &armlocks.ManagementLocksClientCreateOrUpdateAtResourceLevelOptions{})
-		if err != nil {
-			log.Error(err, "client.CreateOrUpdateAtResourceLevel")
-			return err
-		}
+	res, err := client.GetAtResourceLevel(ctx, resourceGroupName, resourceProviderNamespace, parentResourcePath, resourceType, resourceName, lockName, &armlocks.ManagementLocksClientGetAtResourceLevelOptions{})
+	if azerrors.IsNotFound(err) {
+		return resourceState{Status: resourceStatusMissing}, nil
+	}
 
-		log.Info("Azure Resource Lock created", "resourceGroupName", resourceGroupName, "resourceProviderNamespace", resourceProviderNamespace, "resourceType", resourceType, "resourceName", resourceName)
-		return nil
+	if err != nil {
+		log.Error(err, "client.GetAtResourceLevel")
+		return resourceState{}, err
 	}
 
-	log.Error(err, "client.GetAtResourceLevel")
-	return err
+	reasons := getResourceLockDifferences(config, res.ManagementLockObject.Properties)
+	if len(reasons) > 0 {
+		return resourceState{Status: resourceStatusMisconfigured, Reason: strings.Join(reasons, ", ")}, nil
+	}
+
+	return resourceState{Status: resourceStatusPresent}, nil
 }
 
-func getCurrentUserObjectID(ctx context.Context, cred azcore.TokenCredential, tenantID string) (string, error) {
+func getCurrentUserObjectID(ctx context.Context, cred azcore.TokenCredential, graphEndpoint string) (string, error) {
 	log, err := logr.FromContext(ctx)
 	if err != nil {
 		return "", err
 	}
 
-	auth, err := adapter.NewAzureIdentityAuthenticationProviderWithScopes(cred, []string{"https://graph.microsoft.com"})
+	client, err := newGraphClient(cred, graphEndpoint)
 	if err != nil {
-		log.Error(err, "adapter.NewAzureIdentityAuthenticationProviderWithScopes")
+		log.Error(err, "newGraphClient")
 		return "", err
 	}
 
-	adapter, err := msgraphsdk.NewGraphRequestAdapter(auth)
+	me, err := client.Me().Get(ctx, &users.UserItemRequestBuilderGetRequestConfiguration{})
 	if err != nil {
-		log.Error(err, "msgraphsdk.NewGraphRequestAdapter")
+		log.Error(err, "client.Me().Get()")
 		return "", err
 	}
 
-	client := msgraphsdk.NewGraphServiceClient(adapter)
+	id := me.GetId()
 
-	me, err := client.Me().Get(ctx, &users.UserItemRequestBuilderGetRequestConfiguration{})
+	return *id, nil
+}
+
+func getServicePrincipalObjectID(ctx context.Context, cred azcore.TokenCredential, graphEndpoint string, appID string) (string, error) {
+	log, err := logr.FromContext(ctx)
 	if err != nil {
-		log.Error(err, "client.Me().Get()")
 		return "", err
 	}
-	me.GetId()
 
-	id := me.GetId()
+	client, err := newGraphClient(cred, graphEndpoint)
+	if err != nil {
+		log.Error(err, "newGraphClient")
+		return "", err
+	}
+
+	servicePrincipal, err := client.ServicePrincipalsWithAppId(&appID).Get(ctx, nil)
+	if err != nil {
+		log.Error(err, "client.ServicePrincipalsWithAppId().Get()")
+		return "", err
+	}
+
+	id := servicePrincipal.GetId()
 
 	return *id, nil
 }
 
+func newGraphClient(cred azcore.TokenCredential, graphEndpoint string) (*msgraphsdk.GraphServiceClient, error) {
+	if graphEndpoint == "" {
+		return nil, fmt.Errorf("no Microsoft Graph endpoint configured for the cloud, set the service principal object ID instead")
+	}
+
+	auth, err := adapter.NewAzureIdentityAuthenticationProviderWithScopes(cred, []string{graphEndpoint + "/.default"})
+	if err != nil {
+		return nil, err
+	}
+
+	adapter, err := msgraphsdk.NewGraphRequestAdapter(auth)
+	if err != nil {
+		return nil, err
+	}
+
+	adapter.SetBaseUrl(graphEndpoint + "/v1.0")
+	return msgraphsdk.NewGraphServiceClient(adapter), nil
+}
+
 func keyPermissionsEqual(a, b []*armkeyvault.KeyPermissions) bool {
 	if (a == nil) != (b == nil) {
 		return false
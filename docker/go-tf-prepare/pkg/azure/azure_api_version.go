@@ -0,0 +1,147 @@
+package azure
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/go-logr/logr"
+)
+
+// managementLocksAPIVersion is the api-version armlocks uses when it isn't overridden
+const managementLocksAPIVersion = "2020-05-01"
+
+type apiVersionContextKey struct{}
+
+// withAPIVersion returns a context that overrides the api-version of the requests sent with it, an empty version keeps the api-version of the client
+func withAPIVersion(ctx context.Context, apiVersion string) context.Context {
+	if apiVersion == "" {
+		return ctx
+	}
+
+	return context.WithValue(ctx, apiVersionContextKey{}, apiVersion)
+}
+
+// apiVersionPolicy sets the api-version query parameter of requests with an api-version in their context,
+// other requests are sent with the api-version of the client
+type apiVersionPolicy struct{}
+
+func (apiVersionPolicy) Do(req *policy.Request) (*http.Response, error) {
+	apiVersion, ok := req.Raw().Context().Value(apiVersionContextKey{}).(string)
+	if ok {
+		query := req.Raw().URL.Query()
+		query.Set("api-version", apiVersion)
+		req.Raw().URL.RawQuery = query.Encode()
+	}
+
+	return req.Next()
+}
+
+// withLockAPIVersion returns a context with the management locks api-version supported by Azure Resource Manager,
+// which is detected from the Microsoft.Authorization resource provider. Concurrent callers share a single detection,
+// the result is cached once it succeeded and the next caller detects it again after an error.
+func withLockAPIVersion(ctx context.Context, clients *clientFactory) (context.Context, error) {
+	clients.lockAPIVersionMu.Lock()
+	lookup := clients.lockAPIVersionLookup
+	owner := lookup == nil
+	if owner {
+		lookup = &apiVersionLookup{done: make(chan struct{})}
+		clients.lockAPIVersionLookup = lookup
+	}
+	clients.lockAPIVersionMu.Unlock()
+
+	if owner {
+		lookup.apiVersion, lookup.err = getLockAPIVersion(ctx, clients)
+		if lookup.err != nil {
+			clients.lockAPIVersionMu.Lock()
+			clients.lockAPIVersionLookup = nil
+			clients.lockAPIVersionMu.Unlock()
+		}
+		close(lookup.done)
+	}
+
+	select {
+	case <-lookup.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if lookup.err != nil {
+		return nil, lookup.err
+	}
+
+	return withAPIVersion(ctx, lookup.apiVersion), nil
+}
+
+// apiVersionLookup is a single api-version detection, its result is set before done is closed
+type apiVersionLookup struct {
+	done       chan struct{}
+	apiVersion string
+	err        error
+}
+
+// getLockAPIVersion returns the api-version to use for management locks, empty if the default of armlocks is supported
+func getLockAPIVersion(ctx context.Context, clients *clientFactory) (string, error) {
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	client, err := clients.providersClient()
+	if err != nil {
+		log.Error(err, "armresources.NewProvidersClient")
+		return "", err
+	}
+
+	res, err := client.Get(ctx, "Microsoft.Authorization", nil)
+	if err != nil {
+		log.Error(err, "client.Get")
+		return "", err
+	}
+
+	apiVersions := []string{}
+	for _, resourceType := range res.ResourceTypes {
+		if resourceType == nil || resourceType.ResourceType == nil || !strings.EqualFold(*resourceType.ResourceType, "locks") {
+			continue
+		}
+
+		for _, apiVersion := range resourceType.APIVersions {
+			if apiVersion != nil {
+				apiVersions = append(apiVersions, *apiVersion)
+			}
+		}
+	}
+
+	apiVersion := selectAPIVersion(managementLocksAPIVersion, apiVersions)
+	if apiVersion != "" {
+		log.V(1).Info("Using management locks api-version supported by Azure Resource Manager", "apiVersion", apiVersion, "supportedApiVersions", apiVersions)
+	}
+
+	return apiVersion, nil
+}
+
+// selectAPIVersion returns the newest supported api-version, preferring stable versions over previews.
+// It is empty if the default is supported or if no api-versions are known.
+func selectAPIVersion(defaultAPIVersion string, supported []string) string {
+	if len(supported) == 0 || slices.Contains(supported, defaultAPIVersion) {
+		return ""
+	}
+
+	sorted := slices.Clone(supported)
+	// api-versions are dates, so they sort by their string value
+	slices.SortFunc(sorted, func(a, b string) int {
+		aPreview, bPreview := strings.Contains(a, "preview"), strings.Contains(b, "preview")
+		if aPreview != bPreview {
+			if aPreview {
+				return 1
+			}
+			return -1
+		}
+
+		return strings.Compare(b, a)
+	})
+
+	return sorted[0]
+}
@@ -0,0 +1,125 @@
+package azure
+
+import (
+	"errors"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+// failingTransport fails the first request to the resource provider and sends the others to the transport
+type failingTransport struct {
+	transport policy.Transporter
+	failed    bool
+}
+
+func (f *failingTransport) Do(req *http.Request) (*http.Response, error) {
+	if !f.failed && strings.HasSuffix(req.URL.Path, "/providers/Microsoft.Authorization") {
+		f.failed = true
+		return nil, errors.New("connection reset")
+	}
+
+	return f.transport.Do(req)
+}
+
+func TestWithLockAPIVersionRetriesAfterError(t *testing.T) {
+	ctx := newTestContext(t)
+	server, clients := newTestClients(t)
+	clients.options.Transport = &failingTransport{transport: server.Transport()}
+
+	_, err := withLockAPIVersion(ctx, clients)
+	if err == nil {
+		t.Fatal("withLockAPIVersion didn't fail when the resource provider couldn't be read")
+	}
+
+	_, err = withLockAPIVersion(ctx, clients)
+	if err != nil {
+		t.Fatalf("withLockAPIVersion didn't retry after the error: %v", err)
+	}
+	if clients.lockAPIVersionLookup == nil {
+		t.Error("api-version wasn't cached after it was detected")
+	}
+}
+
+// blockingTransport holds the requests to the resource provider until release is closed, failing them when fail is set
+type blockingTransport struct {
+	transport policy.Transporter
+	release   chan struct{}
+	fail      atomic.Bool
+	requests  atomic.Int32
+}
+
+func (b *blockingTransport) Do(req *http.Request) (*http.Response, error) {
+	if strings.HasSuffix(req.URL.Path, "/providers/Microsoft.Authorization") {
+		b.requests.Add(1)
+		<-b.release
+		if b.fail.Load() {
+			return nil, errors.New("connection reset")
+		}
+	}
+
+	return b.transport.Do(req)
+}
+
+// lookupConcurrently calls withLockAPIVersion from several goroutines, releasing the transport once they all wait
+func lookupConcurrently(t *testing.T, clients *clientFactory, transport *blockingTransport) []error {
+	t.Helper()
+
+	ctx := newTestContext(t)
+	errs := make([]error, 5)
+	started := sync.WaitGroup{}
+	wg := sync.WaitGroup{}
+	for i := range errs {
+		started.Add(1)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			started.Done()
+			_, errs[i] = withLockAPIVersion(ctx, clients)
+		}(i)
+	}
+
+	started.Wait()
+	for transport.requests.Load() == 0 {
+		runtime.Gosched()
+	}
+	// give the other callers time to wait for the lookup
+	time.Sleep(50 * time.Millisecond)
+	close(transport.release)
+	wg.Wait()
+
+	return errs
+}
+
+func TestWithLockAPIVersionSharesLookup(t *testing.T) {
+	server, clients := newTestClients(t)
+	transport := &blockingTransport{transport: server.Transport(), release: make(chan struct{})}
+	transport.fail.Store(true)
+	clients.options.Transport = transport
+
+	for _, err := range lookupConcurrently(t, clients, transport) {
+		if err == nil {
+			t.Error("withLockAPIVersion didn't return the error of the shared lookup")
+		}
+	}
+	if requests := transport.requests.Load(); requests != 1 {
+		t.Errorf("concurrent callers sent %d lookups, expected 1", requests)
+	}
+
+	transport.fail.Store(false)
+	transport.release = make(chan struct{})
+	for _, err := range lookupConcurrently(t, clients, transport) {
+		if err != nil {
+			t.Errorf("withLockAPIVersion after the failed lookup: %v", err)
+		}
+	}
+	if requests := transport.requests.Load(); requests != 2 {
+		t.Errorf("%d lookups were sent, expected one retry after the error", requests)
+	}
+}
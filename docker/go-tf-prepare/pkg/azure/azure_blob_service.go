@@ -0,0 +1,200 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/storage/armstorage"
+	"github.com/go-logr/logr"
+)
+
+// isBlobServiceConfigured reports if any blob service setting is configured, the unset settings are left as they are
+func isBlobServiceConfigured(config azureConfig) bool {
+	return config.BlobVersioning != nil || config.BlobSoftDeleteRetentionDays != nil || config.ContainerSoftDeleteRetentionDays != nil || config.BlobChangeFeed != nil || config.BlobRestoreDays != nil
+}
+
+// ConfigureBlobService configures versioning, soft delete, change feed and point-in-time restore of the Storage Account blob service (if it differs) or returns error
+func ConfigureBlobService(ctx context.Context, clients *clientFactory, config azureConfig) (stepResult, error) {
+	resourceGroupName := config.ResourceGroupName
+	storageAccountName := config.StorageAccountName
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	state, err := getBlobServiceState(ctx, clients, config)
+	if err != nil {
+		return "", err
+	}
+
+	if state.Status == resourceStatusPresent {
+		log.Info("Azure Storage Account Blob Service already configured", "storageAccountName", storageAccountName)
+		return stepResultUnchanged, nil
+	}
+
+	// the blob service of a Storage Account created in this run is configured without reconcile
+	if state.Status == resourceStatusMisconfigured && !config.Reconcile && !isDependencyCreated(ctx) {
+		log.Info("Azure Storage Account Blob Service does not match the configuration, use reconcile to update it", "storageAccountName", storageAccountName, "reason", state.Reason)
+		return stepResultUnchanged, nil
+	}
+
+	client, err := clients.blobServicesClient()
+	if err != nil {
+		log.Error(err, "armstorage.NewBlobServicesClient")
+		return "", err
+	}
+
+	_, err = client.SetServiceProperties(ctx, resourceGroupName, storageAccountName, armstorage.BlobServiceProperties{
+		BlobServiceProperties: blobServiceProperties(config),
+	}, nil)
+	if err != nil {
+		log.Error(err, "client.SetServiceProperties")
+		return "", err
+	}
+
+	log.Info("Azure Storage Account Blob Service configured", "storageAccountName", storageAccountName, "reason", state.Reason)
+	return stepResultUpdated, nil
+}
+
+func getBlobServiceState(ctx context.Context, clients *clientFactory, config azureConfig) (resourceState, error) {
+	resourceGroupName := config.ResourceGroupName
+	storageAccountName := config.StorageAccountName
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return resourceState{}, err
+	}
+
+	client, err := clients.blobServicesClient()
+	if err != nil {
+		log.Error(err, "armstorage.NewBlobServicesClient")
+		return resourceState{}, err
+	}
+
+	res, err := client.GetServiceProperties(ctx, resourceGroupName, storageAccountName, nil)
+	if err != nil {
+		log.Error(err, "client.GetServiceProperties")
+		return resourceState{}, err
+	}
+
+	// the blob service always exists with the storage account, so it is either configured or not
+	reasons := getBlobServiceDifferences(config, res.BlobServiceProperties.BlobServiceProperties)
+	if len(reasons) > 0 {
+		return resourceState{Status: resourceStatusMisconfigured, Reason: strings.Join(reasons, ", ")}, nil
+	}
+
+	return resourceState{Status: resourceStatusPresent}, nil
+}
+
+func getBlobServiceDifferences(config azureConfig, properties *armstorage.BlobServicePropertiesProperties) []string {
+	if properties == nil {
+		properties = &armstorage.BlobServicePropertiesProperties{}
+	}
+
+	reasons := []string{}
+
+	versioning := properties.IsVersioningEnabled != nil && *properties.IsVersioningEnabled
+	if config.BlobVersioning != nil && versioning != *config.BlobVersioning {
+		reasons = append(reasons, fmt.Sprintf("versioning is %s", enabledString(versioning)))
+	}
+
+	if config.BlobSoftDeleteRetentionDays != nil {
+		if reason := deleteRetentionPolicyDifference("blob", properties.DeleteRetentionPolicy, *config.BlobSoftDeleteRetentionDays); reason != "" {
+			reasons = append(reasons, reason)
+		}
+	}
+
+	if config.ContainerSoftDeleteRetentionDays != nil {
+		if reason := deleteRetentionPolicyDifference("container", properties.ContainerDeleteRetentionPolicy, *config.ContainerSoftDeleteRetentionDays); reason != "" {
+			reasons = append(reasons, reason)
+		}
+	}
+
+	changeFeed := properties.ChangeFeed != nil && properties.ChangeFeed.Enabled != nil && *properties.ChangeFeed.Enabled
+	if config.BlobChangeFeed != nil && changeFeed != *config.BlobChangeFeed {
+		reasons = append(reasons, fmt.Sprintf("change feed is %s", enabledString(changeFeed)))
+	}
+
+	restoreDays := 0
+	if properties.RestorePolicy != nil && properties.RestorePolicy.Enabled != nil && *properties.RestorePolicy.Enabled && properties.RestorePolicy.Days != nil {
+		restoreDays = int(*properties.RestorePolicy.Days)
+	}
+	if config.BlobRestoreDays != nil && restoreDays != *config.BlobRestoreDays {
+		reasons = append(reasons, retentionString("point-in-time restore", restoreDays))
+	}
+
+	return reasons
+}
+
+// deleteRetentionPolicyDifference returns how the soft delete policy differs from the configured retention, 0 days means disabled
+func deleteRetentionPolicyDifference(name string, policy *armstorage.DeleteRetentionPolicy, days int) string {
+	currentDays := 0
+	if policy != nil && policy.Enabled != nil && *policy.Enabled && policy.Days != nil {
+		currentDays = int(*policy.Days)
+	}
+
+	if currentDays == days {
+		return ""
+	}
+
+	return retentionString(fmt.Sprintf("%s soft delete", name), currentDays)
+}
+
+// blobServiceProperties returns the configured blob service settings, the properties that aren't sent are left as they are
+func blobServiceProperties(config azureConfig) *armstorage.BlobServicePropertiesProperties {
+	properties := &armstorage.BlobServicePropertiesProperties{
+		IsVersioningEnabled: config.BlobVersioning,
+	}
+
+	if config.BlobSoftDeleteRetentionDays != nil {
+		properties.DeleteRetentionPolicy = deleteRetentionPolicy(*config.BlobSoftDeleteRetentionDays)
+	}
+
+	if config.ContainerSoftDeleteRetentionDays != nil {
+		properties.ContainerDeleteRetentionPolicy = deleteRetentionPolicy(*config.ContainerSoftDeleteRetentionDays)
+	}
+
+	if config.BlobChangeFeed != nil {
+		properties.ChangeFeed = &armstorage.ChangeFeed{Enabled: config.BlobChangeFeed}
+	}
+
+	if config.BlobRestoreDays != nil {
+		properties.RestorePolicy = &armstorage.RestorePolicyProperties{Enabled: to.Ptr(false)}
+		if *config.BlobRestoreDays > 0 {
+			properties.RestorePolicy = &armstorage.RestorePolicyProperties{
+				Enabled: to.Ptr(true),
+				Days:    to.Ptr(int32(*config.BlobRestoreDays)),
+			}
+		}
+	}
+
+	return properties
+}
+
+func deleteRetentionPolicy(days int) *armstorage.DeleteRetentionPolicy {
+	if days == 0 {
+		return &armstorage.DeleteRetentionPolicy{Enabled: to.Ptr(false)}
+	}
+
+	return &armstorage.DeleteRetentionPolicy{
+		Enabled: to.Ptr(true),
+		Days:    to.Ptr(int32(days)),
+	}
+}
+
+func enabledString(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+
+	return "disabled"
+}
+
+func retentionString(name string, days int) string {
+	if days == 0 {
+		return fmt.Sprintf("%s is disabled", name)
+	}
+
+	return fmt.Sprintf("%s is %d days", name, days)
+}
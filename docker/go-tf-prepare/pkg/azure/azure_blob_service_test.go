@@ -0,0 +1,90 @@
+package azure
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+const testBlobServiceID = "/subscriptions/" + testSubscriptionID + "/resourceGroups/rg-test/providers/Microsoft.Storage/storageAccounts/satest/blobServices/default"
+
+func TestBlobServiceUnsetIsLeftAsIs(t *testing.T) {
+	ctx := newTestContext(t)
+	server, clients := newTestClients(t)
+
+	err := runAction(ctx, clients, newTestConfig(t), io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	for _, request := range server.Requests() {
+		if strings.EqualFold(request.Path, testBlobServiceID) {
+			t.Errorf("blob service isn't configured but %s %s was sent", request.Method, request.Path)
+		}
+	}
+}
+
+func TestBlobServiceNewStorageAccount(t *testing.T) {
+	ctx := newTestContext(t)
+	server, clients := newTestClients(t)
+
+	err := runAction(ctx, clients, newTestConfig(t, "--blob-versioning", "--blob-soft-delete-retention-days", "7"), io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	service, ok := server.Resource(testBlobServiceID)
+	if !ok {
+		t.Fatal("blob service of the new Storage Account wasn't configured")
+	}
+
+	properties, _ := service["properties"].(map[string]any)
+	if versioning := properties["isVersioningEnabled"]; versioning != true {
+		t.Errorf("versioning is %v, expected true", versioning)
+	}
+	if changeFeed := properties["changeFeed"]; changeFeed != nil {
+		t.Errorf("change feed is %v, expected it to be left as it is", changeFeed)
+	}
+}
+
+func TestBlobServiceExistingStorageAccountRequiresReconcile(t *testing.T) {
+	ctx := newTestContext(t)
+	server, clients := newTestClients(t)
+
+	err := runAction(ctx, clients, newTestConfig(t), io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	config := newTestConfig(t, "--blob-versioning")
+	skip := len(server.Requests())
+	err = runAction(ctx, clients, config, io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	for _, request := range writeRequests(server, skip) {
+		t.Errorf("run without reconcile sent %s %s", request.Method, request.Path)
+	}
+
+	state, err := getBlobServiceState(ctx, clients, config)
+	if err != nil {
+		t.Fatalf("getBlobServiceState: %v", err)
+	}
+	if state.Status != resourceStatusMisconfigured {
+		t.Errorf("status is %s, expected %s", state.Status, resourceStatusMisconfigured)
+	}
+
+	err = runAction(ctx, clients, newTestConfig(t, "--blob-versioning", "--reconcile"), io.Discard)
+	if err != nil {
+		t.Fatalf("runAction with reconcile: %v", err)
+	}
+
+	state, err = getBlobServiceState(ctx, clients, config)
+	if err != nil {
+		t.Fatalf("getBlobServiceState: %v", err)
+	}
+	if state.Status != resourceStatusPresent {
+		t.Errorf("status after reconcile is %s, expected %s: %s", state.Status, resourceStatusPresent, state.Reason)
+	}
+}
@@ -2,41 +2,146 @@ package azure
 
 import (
 	"context"
-	"fmt"
+	"errors"
+	"io"
+	"os"
+	"time"
 
-	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
-	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
 	"github.com/go-logr/logr"
 	"github.com/go-playground/validator/v10"
 	"github.com/urfave/cli/v2"
 )
 
 type azureConfig struct {
-	ServicePrincipalObjectID     string `validate:"omitempty,uuid"`
-	SubscriptionID               string `validate:"uuid"`
-	TenantID                     string `validate:"uuid"`
-	ResourceGroupName            string `validate:"resourcegroup,min=1,max=90"`
-	ResourceGroupLocation        string `validate:"alphanum,lowercase"`
-	StorageAccountName           string `validate:"alphanum,lowercase,min=3,max=24"`
-	StorageAccountContainer      string `validate:"storageaccountcontainer,min=3,max=24"`
-	KeyVaultName                 string `validate:"keyvault,min=3,max=24"`
-	KeyVaultKeyName              string `validate:"keyvaultkey,min=1,max=127"`
-	ResourceLocks                bool
-	ExcludeAzureCLICredential    bool
-	ExcludeEnvironmentCredential bool
-	ExcludeMSICredential         bool
+	ServicePrincipalObjectID          string   `validate:"omitempty,uuid"`
+	SubscriptionID                    string   `validate:"uuid"`
+	TenantID                          string   `validate:"uuid"`
+	ResourceGroupName                 string   `validate:"resourcegroup,min=1,max=90"`
+	ResourceGroupLocation             string   `validate:"alphanum,lowercase"`
+	StorageAccountName                string   `validate:"alphanum,lowercase,min=3,max=24"`
+	StorageAccountContainer           string   `validate:"storageaccountcontainer,min=3,max=24"`
+	StorageAccountContainerMetadata   []string `validate:"dive,containermetadata"`
+	ContainerVersionImmutability      bool
+	ContainerRetentionDays            int      `validate:"min=0,max=146000"`
+	ContainerLegalHoldTags            []string `validate:"unique,dive,alphanum,min=3,max=23"`
+	StorageAccountSKU                 string   `validate:"oneof=Standard_LRS Standard_GRS Standard_RAGRS Standard_ZRS Standard_GZRS Standard_RAGZRS Premium_LRS Premium_ZRS"`
+	StorageAccountKind                string   `validate:"oneof=StorageV2 BlockBlobStorage"`
+	StorageAccountAccessTier          string   `validate:"oneof=Hot Cool"`
+	StorageAccountPublicNetworkAccess string   `validate:"oneof=Enabled Disabled"`
+	StorageAccountIPRules             []string `validate:"dive,cidr|ip"`
+	StorageAccountVirtualNetworkRules []string `validate:"dive,startswith=/subscriptions/"`
+	StorageAccountSharedKeyAccess     bool
+	StorageAccountDefaultToOAuth      bool
+	PrivateEndpointSubnetID           string `validate:"omitempty,startswith=/subscriptions/"`
+	PrivateDNSZoneID                  string `validate:"omitempty,startswith=/subscriptions/,excluded_without=PrivateEndpointSubnetID"`
+	StorageAccountRoleAssignment      bool
+	StorageAccountRoleName            string   `validate:"required"`
+	StorageAccountRoleScope           string   `validate:"oneof=container account"`
+	StorageAccountRolePrincipalIDs    []string `validate:"unique,dive,uuid"`
+	// the blob service settings are pointers, nil leaves the setting of the Storage Account as it is
+	BlobVersioning                    *bool
+	BlobSoftDeleteRetentionDays       *int `validate:"omitempty,min=0,max=365"`
+	ContainerSoftDeleteRetentionDays  *int `validate:"omitempty,min=0,max=365"`
+	BlobChangeFeed                    *bool
+	BlobRestoreDays                   *int `validate:"omitempty,min=0,max=364"`
+	StorageAccountCMK                 bool
+	StorageAccountIdentityName        string `validate:"omitempty,userassignedidentity,min=3,max=128"`
+	StorageAccountDoubleEncryption    bool
+	KeyVaultName                      string `validate:"keyvault,min=3,max=24"`
+	KeyVaultKeyName                   string `validate:"keyvaultkey,min=1,max=127"`
+	KeyVaultAuthorization             string `validate:"oneof=accesspolicy rbac"`
+	KeyVaultRoleName                  string `validate:"required"`
+	KeyVaultKeyType                   string `validate:"oneof=RSA RSA-HSM EC EC-HSM"`
+	KeyVaultKeySize                   int
+	KeyVaultKeyCurve                  string
+	KeyVaultKeyOperations             []string      `validate:"min=1,unique,dive,oneof=encrypt decrypt sign verify wrapKey unwrapKey"`
+	KeyVaultKeyExpiry                 time.Duration `validate:"min=0"`
+	KeyVaultKeyRotateAfter            string        `validate:"omitempty,iso8601duration"`
+	KeyVaultKeyRotationExpiry         string        `validate:"omitempty,iso8601duration"`
+	KeyVaultKeyNotifyBeforeExpiry     string        `validate:"omitempty,iso8601duration"`
+	KeyVaultPurgeProtection           bool
+	KeyVaultSoftDeleteRetentionDays   int      `validate:"min=7,max=90"`
+	KeyVaultPublicNetworkAccess       string   `validate:"oneof=Enabled Disabled"`
+	KeyVaultIPRules                   []string `validate:"dive,cidr|ip"`
+	KeyVaultVirtualNetworkRules       []string `validate:"dive,startswith=/subscriptions/"`
+	Tags                              []string `validate:"dive,tag"`
+	MergeTags                         bool
+	Reconcile                         bool
+	RecoverDeletedKeyVault            bool
+	ResourceLocks                     bool
+	ResourceLockLevel                 string `validate:"oneof=CanNotDelete ReadOnly"`
+	ResourceLockScope                 string `validate:"oneof=resource resource-group"`
+	ResourceLockNotes                 string `validate:"max=512"`
+	ExcludeAzureCLICredential         bool
+	ExcludeEnvironmentCredential      bool
+	ExcludeMSICredential              bool
+	ExcludeWorkloadIdentityCredential bool
+	ClientID                          string `validate:"required_if=ExcludeWorkloadIdentityCredential false,omitempty,uuid"`
+	FederatedTokenFile                string
+	FederatedTokenAudience            string   `validate:"required"`
+	CredentialOrder                   []string `validate:"min=1,unique,dive,oneof=workload-identity environment msi cli"`
+	DisabledSteps                     []string `validate:"dive,oneof=resource-group storage-account storage-account-lock storage-account-container storage-account-blob-service storage-account-role-assignment private-endpoint keyvault keyvault-lock keyvault-access-policy keyvault-role-assignment keyvault-key resource-group-lock stale-resource-locks storage-account-identity storage-account-key-access storage-account-cmk tags"`
+	Parallel                          bool
+	DryRun                            bool
+	PlanFormat                        string        `validate:"oneof=text json"`
+	Cloud                             string        `validate:"oneof=public china usgovernment custom"`
+	CloudConfigFile                   string        `validate:"required_if=Cloud custom"`
+	ResourceManagerEndpoint           string        `validate:"omitempty,url"`
+	AuthorityHost                     string        `validate:"omitempty,url"`
+	ClientMaxRetries                  int           `validate:"min=0,max=10"`
+	ClientRetryDelay                  time.Duration `validate:"min=0s"`
+	ClientMaxRetryDelay               time.Duration `validate:"gtefield=ClientRetryDelay"`
+	ClientTryTimeout                  time.Duration `validate:"min=0s"`
+	HTTPProxy                         string        `validate:"omitempty,url"`
+	CABundleFile                      string        `validate:"omitempty,file"`
+	Version                           string
 }
 
 func (config azureConfig) Validate() error {
 	validate := validator.New()
 	validate.RegisterValidation("resourcegroup", validateResourceGroupName)
 	validate.RegisterValidation("storageaccountcontainer", validateStorageAccountContainerName)
+	validate.RegisterValidation("containermetadata", validateContainerMetadata)
 	validate.RegisterValidation("keyvault", validateKeyVaultName)
 	validate.RegisterValidation("keyvaultkey", validateKeyVaultKeyName)
+	validate.RegisterValidation("iso8601duration", validateISO8601Duration)
+	validate.RegisterValidation("userassignedidentity", validateUserAssignedIdentityName)
+	validate.RegisterValidation("tag", validateTag)
 	err := validate.Struct(config)
 	if err != nil {
 		return err
 	}
+
+	err = validateStorageAccountSKU(config)
+	if err != nil {
+		return err
+	}
+
+	err = validateKeyVaultKeyParameters(config)
+	if err != nil {
+		return err
+	}
+
+	err = validateKeyVaultKeyOperations(config)
+	if err != nil {
+		return err
+	}
+
+	err = validateBlobRestore(config)
+	if err != nil {
+		return err
+	}
+
+	err = validateContainerImmutability(config)
+	if err != nil {
+		return err
+	}
+
+	if config.StorageAccountCMK {
+		return validateStorageAccountCMK(config)
+	}
+
 	return nil
 }
 
@@ -45,7 +150,7 @@ func Flags() []cli.Flag {
 	flags := []cli.Flag{
 		&cli.StringFlag{
 			Name:     "service-principal-object-id",
-			Usage:    "Service Principal Object ID",
+			Usage:    "Object ID given access to the KeyVault, defaults to the object ID of the authenticated identity",
 			Required: false,
 			EnvVars:  []string{"AZURE_SERVICE_PRINCIPAL_OBJECT_ID"},
 		},
@@ -85,6 +190,149 @@ func Flags() []cli.Flag {
 			Required: true,
 			EnvVars:  []string{"AZURE_STORAGE_ACCOUNT_CONTAINER"},
 		},
+		&cli.StringSliceFlag{
+			Name:    "storage-account-container-metadata",
+			Usage:   "Metadata (key=value) of the Azure Storage Account Container, for example owner=team-a. Existing containers are only updated with reconcile",
+			EnvVars: []string{"AZURE_STORAGE_ACCOUNT_CONTAINER_METADATA"},
+		},
+		&cli.BoolFlag{
+			Name:    "container-version-immutability",
+			Usage:   "Should version-level immutability be enabled on the Azure Storage Account Container? Requires blob versioning and can't be disabled once enabled",
+			Value:   false,
+			EnvVars: []string{"AZURE_CONTAINER_VERSION_IMMUTABILITY"},
+		},
+		&cli.IntFlag{
+			Name:    "container-retention-days",
+			Usage:   "Number of days the blob versions in the Azure Storage Account Container are immutable (time-based retention policy), 0 leaves the policy as is. Requires version-level immutability",
+			Value:   0,
+			EnvVars: []string{"AZURE_CONTAINER_RETENTION_DAYS"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "container-legal-hold-tag",
+			Usage:   "Legal hold tag set on the Azure Storage Account Container, blobs can't be deleted while a tag is set. Existing containers are only updated with reconcile. Requires version-level immutability",
+			EnvVars: []string{"AZURE_CONTAINER_LEGAL_HOLD_TAGS"},
+		},
+		&cli.StringFlag{
+			Name:    "storage-account-sku",
+			Usage:   "SKU (replication) of the Azure Storage Account, for example Standard_LRS, Standard_GRS or Standard_RAGZRS",
+			Value:   "Standard_GRS",
+			EnvVars: []string{"AZURE_STORAGE_ACCOUNT_SKU"},
+		},
+		&cli.StringFlag{
+			Name:    "storage-account-kind",
+			Usage:   "Kind of the Azure Storage Account (StorageV2, or BlockBlobStorage for Premium SKUs)",
+			Value:   "StorageV2",
+			EnvVars: []string{"AZURE_STORAGE_ACCOUNT_KIND"},
+		},
+		&cli.StringFlag{
+			Name:    "storage-account-access-tier",
+			Usage:   "Access tier of the Azure Storage Account (Hot or Cool), not used for BlockBlobStorage",
+			Value:   "Hot",
+			EnvVars: []string{"AZURE_STORAGE_ACCOUNT_ACCESS_TIER"},
+		},
+		&cli.StringFlag{
+			Name:    "storage-account-public-network-access",
+			Usage:   "Public network access of the Azure Storage Account (Enabled or Disabled)",
+			Value:   "Enabled",
+			EnvVars: []string{"AZURE_STORAGE_ACCOUNT_PUBLIC_NETWORK_ACCESS"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "storage-account-ip-rule",
+			Usage:   "IP address or CIDR range allowed to access the Azure Storage Account, all other networks are denied when rules are set",
+			EnvVars: []string{"AZURE_STORAGE_ACCOUNT_IP_RULES"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "storage-account-virtual-network-rule",
+			Usage:   "Subnet resource ID allowed to access the Azure Storage Account, all other networks are denied when rules are set",
+			EnvVars: []string{"AZURE_STORAGE_ACCOUNT_VIRTUAL_NETWORK_RULES"},
+		},
+		&cli.BoolFlag{
+			Name:    "storage-account-shared-key-access",
+			Usage:   "Should the Azure Storage Account allow authorization with the account access keys? Terraform needs use_azuread_auth when disabled",
+			Value:   true,
+			EnvVars: []string{"AZURE_STORAGE_ACCOUNT_SHARED_KEY_ACCESS"},
+		},
+		&cli.BoolFlag{
+			Name:    "storage-account-default-to-oauth",
+			Usage:   "Should the Azure Portal default to Azure AD authorization for the Azure Storage Account?",
+			Value:   false,
+			EnvVars: []string{"AZURE_STORAGE_ACCOUNT_DEFAULT_TO_OAUTH"},
+		},
+		&cli.StringFlag{
+			Name:    "private-endpoint-subnet-id",
+			Usage:   "Subnet resource ID where a private endpoint for the Azure Storage Account blob service is created",
+			EnvVars: []string{"AZURE_PRIVATE_ENDPOINT_SUBNET_ID"},
+		},
+		&cli.StringFlag{
+			Name:    "private-dns-zone-id",
+			Usage:   "Resource ID of the privatelink.blob.core.windows.net private DNS zone the private endpoint is registered in",
+			EnvVars: []string{"AZURE_PRIVATE_DNS_ZONE_ID"},
+		},
+		&cli.BoolFlag{
+			Name:    "storage-account-role-assignment",
+			Usage:   "Should the storage role be assigned to the service principal and the additional principals? Needed by Terraform with use_azuread_auth",
+			Value:   false,
+			EnvVars: []string{"AZURE_STORAGE_ACCOUNT_ROLE_ASSIGNMENT"},
+		},
+		&cli.StringFlag{
+			Name:    "storage-account-role-name",
+			Usage:   "Role assigned for the Terraform state when using storage account role assignment",
+			Value:   "Storage Blob Data Contributor",
+			EnvVars: []string{"AZURE_STORAGE_ACCOUNT_ROLE_NAME"},
+		},
+		&cli.StringFlag{
+			Name:    "storage-account-role-scope",
+			Usage:   "Scope of the storage role assignment (container or account)",
+			Value:   storageRoleScopeContainer,
+			EnvVars: []string{"AZURE_STORAGE_ACCOUNT_ROLE_SCOPE"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "storage-account-role-principal-id",
+			Usage:   "Additional principal (object) ID the storage role is assigned to",
+			EnvVars: []string{"AZURE_STORAGE_ACCOUNT_ROLE_PRINCIPAL_IDS"},
+		},
+		&cli.BoolFlag{
+			Name:    "blob-versioning",
+			Usage:   "Should blob versioning be enabled for the Azure Storage Account? Left as it is when unset",
+			EnvVars: []string{"AZURE_BLOB_VERSIONING"},
+		},
+		&cli.IntFlag{
+			Name:    "blob-soft-delete-retention-days",
+			Usage:   "Number of days deleted blobs are retained (1-365), 0 disables blob soft delete. Left as it is when unset",
+			EnvVars: []string{"AZURE_BLOB_SOFT_DELETE_RETENTION_DAYS"},
+		},
+		&cli.IntFlag{
+			Name:    "container-soft-delete-retention-days",
+			Usage:   "Number of days deleted containers are retained (1-365), 0 disables container soft delete. Left as it is when unset",
+			EnvVars: []string{"AZURE_CONTAINER_SOFT_DELETE_RETENTION_DAYS"},
+		},
+		&cli.BoolFlag{
+			Name:    "blob-change-feed",
+			Usage:   "Should the blob change feed be enabled for the Azure Storage Account? Left as it is when unset",
+			EnvVars: []string{"AZURE_BLOB_CHANGE_FEED"},
+		},
+		&cli.IntFlag{
+			Name:    "blob-restore-days",
+			Usage:   "Number of days blobs can be restored to with point-in-time restore, 0 disables it. Requires versioning, change feed and a longer blob soft delete retention. Left as it is when unset",
+			EnvVars: []string{"AZURE_BLOB_RESTORE_DAYS"},
+		},
+		&cli.BoolFlag{
+			Name:    "storage-account-cmk",
+			Usage:   "Should the Azure Storage Account be encrypted with the Azure KeyVault Key (customer-managed key)?",
+			Value:   false,
+			EnvVars: []string{"AZURE_STORAGE_ACCOUNT_CMK"},
+		},
+		&cli.StringFlag{
+			Name:    "storage-account-identity-name",
+			Usage:   "Name of the user-assigned identity the Azure Storage Account uses to access the customer-managed key, defaults to id-<storage-account-name>",
+			EnvVars: []string{"AZURE_STORAGE_ACCOUNT_IDENTITY_NAME"},
+		},
+		&cli.BoolFlag{
+			Name:    "storage-account-infrastructure-encryption",
+			Usage:   "Should infrastructure (double) encryption be enabled for the Azure Storage Account? It can only be enabled when the account is created",
+			Value:   false,
+			EnvVars: []string{"AZURE_STORAGE_ACCOUNT_INFRASTRUCTURE_ENCRYPTION"},
+		},
 		&cli.StringFlag{
 			Name:     "keyvault-name",
 			Usage:    "Azure KeyVault Name",
@@ -97,12 +345,137 @@ func Flags() []cli.Flag {
 			Required: true,
 			EnvVars:  []string{"AZURE_KEYVAULT_KEY_NAME"},
 		},
+		&cli.StringFlag{
+			Name:    "keyvault-authorization",
+			Usage:   "Azure KeyVault authorization mode (accesspolicy or rbac)",
+			Value:   keyVaultAuthorizationAccessPolicy,
+			EnvVars: []string{"AZURE_KEYVAULT_AUTHORIZATION"},
+		},
+		&cli.StringFlag{
+			Name:    "keyvault-role-name",
+			Usage:   "Role assigned to the service principal on the Azure KeyVault when using rbac authorization, it has to allow creating keys and writing their rotation policy",
+			Value:   "Key Vault Crypto Officer",
+			EnvVars: []string{"AZURE_KEYVAULT_ROLE_NAME"},
+		},
+		&cli.StringFlag{
+			Name:    "keyvault-key-type",
+			Usage:   "Type of the Azure KeyVault Key (RSA, RSA-HSM, EC or EC-HSM), HSM keys use the premium KeyVault SKU",
+			Value:   "RSA",
+			EnvVars: []string{"AZURE_KEYVAULT_KEY_TYPE"},
+		},
+		&cli.IntFlag{
+			Name:    "keyvault-key-size",
+			Usage:   "Size of RSA Azure KeyVault Keys (2048, 3072 or 4096)",
+			Value:   2048,
+			EnvVars: []string{"AZURE_KEYVAULT_KEY_SIZE"},
+		},
+		&cli.StringFlag{
+			Name:    "keyvault-key-curve",
+			Usage:   "Curve of EC Azure KeyVault Keys (P-256, P-384, P-521 or P-256K)",
+			Value:   "P-256",
+			EnvVars: []string{"AZURE_KEYVAULT_KEY_CURVE"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "keyvault-key-operation",
+			Usage:   "Operation permitted with the Azure KeyVault Key, EC keys only support sign and verify",
+			Value:   cli.NewStringSlice("encrypt", "decrypt"),
+			EnvVars: []string{"AZURE_KEYVAULT_KEY_OPERATIONS"},
+		},
+		&cli.DurationFlag{
+			Name:    "keyvault-key-expiry",
+			Usage:   "Time until a created Azure KeyVault Key version expires, 0 for no expiry",
+			Value:   0,
+			EnvVars: []string{"AZURE_KEYVAULT_KEY_EXPIRY"},
+		},
+		&cli.StringFlag{
+			Name:    "keyvault-key-rotate-after",
+			Usage:   "ISO 8601 duration after creation when the rotation policy rotates the Azure KeyVault Key (for example P90D)",
+			EnvVars: []string{"AZURE_KEYVAULT_KEY_ROTATE_AFTER"},
+		},
+		&cli.StringFlag{
+			Name:    "keyvault-key-rotation-expiry",
+			Usage:   "ISO 8601 duration the rotation policy sets as expiry of new Azure KeyVault Key versions (for example P1Y)",
+			EnvVars: []string{"AZURE_KEYVAULT_KEY_ROTATION_EXPIRY"},
+		},
+		&cli.StringFlag{
+			Name:    "keyvault-key-notify-before-expiry",
+			Usage:   "ISO 8601 duration before expiry when the rotation policy sends a near expiry event (for example P30D)",
+			EnvVars: []string{"AZURE_KEYVAULT_KEY_NOTIFY_BEFORE_EXPIRY"},
+		},
+		&cli.BoolFlag{
+			Name:    "keyvault-purge-protection",
+			Usage:   "Should purge protection be enabled on the Azure KeyVault? It can't be disabled once enabled, so it has to be opted into",
+			Value:   false,
+			EnvVars: []string{"AZURE_KEYVAULT_PURGE_PROTECTION"},
+		},
+		&cli.IntFlag{
+			Name:    "keyvault-soft-delete-retention-days",
+			Usage:   "Number of days deleted Azure KeyVault objects are retained (7-90), can't be changed after creation",
+			Value:   90,
+			EnvVars: []string{"AZURE_KEYVAULT_SOFT_DELETE_RETENTION_DAYS"},
+		},
+		&cli.StringFlag{
+			Name:    "keyvault-public-network-access",
+			Usage:   "Public network access of the Azure KeyVault (Enabled or Disabled)",
+			Value:   "Enabled",
+			EnvVars: []string{"AZURE_KEYVAULT_PUBLIC_NETWORK_ACCESS"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "keyvault-ip-rule",
+			Usage:   "IP address or CIDR range allowed to access the Azure KeyVault, all other networks are denied when rules are set",
+			EnvVars: []string{"AZURE_KEYVAULT_IP_RULES"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "keyvault-virtual-network-rule",
+			Usage:   "Subnet resource ID allowed to access the Azure KeyVault, all other networks are denied when rules are set",
+			EnvVars: []string{"AZURE_KEYVAULT_VIRTUAL_NETWORK_RULES"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "tag",
+			Usage:   "Tag (key=value) set on the Azure resources created by tf-prepare",
+			EnvVars: []string{"AZURE_TAGS"},
+		},
+		&cli.BoolFlag{
+			Name:    "merge-tags",
+			Usage:   "Should the tags be merged onto the existing resource group, storage account, keyvault and key? Tags that aren't configured are kept",
+			Value:   false,
+			EnvVars: []string{"AZURE_MERGE_TAGS"},
+		},
+		&cli.BoolFlag{
+			Name:    "recover-deleted-keyvault",
+			Usage:   "Should a soft-deleted Azure KeyVault with the same name be recovered instead of failing?",
+			Value:   false,
+			EnvVars: []string{"AZURE_RECOVER_DELETED_KEYVAULT"},
+		},
+		&cli.BoolFlag{
+			Name:    "reconcile",
+			Usage:   "Should existing resources that don't match the configuration be updated?",
+			Value:   false,
+			EnvVars: []string{"AZURE_RECONCILE"},
+		},
 		&cli.BoolFlag{
 			Name:    "resource-locks",
 			Usage:   "Should Azure Resource Locks be used?",
 			Value:   true,
 			EnvVars: []string{"AZURE_RESOURCE_LOCKS"},
 		},
+		&cli.StringFlag{
+			Name:    "resource-lock-level",
+			Usage:   "Level of the Azure Resource Locks (CanNotDelete or ReadOnly). ReadOnly locks are removed while tf-prepare changes the resources below them and restored afterwards, they also prevent listing the Storage Account keys and other write operations, so the backend has to use Azure AD authentication",
+			Value:   "CanNotDelete",
+			EnvVars: []string{"AZURE_RESOURCE_LOCK_LEVEL"},
+		},
+		&cli.StringFlag{
+			Name:    "resource-lock-scope",
+			Usage:   "Scope of the Azure Resource Locks, either the Storage Account and KeyVault (resource) or the whole Resource Group (resource-group). Locks left at the other scope are deleted with reconcile",
+			Value:   resourceLockScopeResource,
+			EnvVars: []string{"AZURE_RESOURCE_LOCK_SCOPE"},
+		},
+		&cli.StringFlag{
+			Name:    "resource-lock-notes",
+			Usage:   "Notes of the Azure Resource Locks, for example a ticket reference. Defaults to the lock level",
+			EnvVars: []string{"AZURE_RESOURCE_LOCK_NOTES"},
+		},
 		&cli.BoolFlag{
 			Name:    "exclude-cli-credential",
 			Usage:   "Should Azure CLI authentication be excluded from authentication chain?",
@@ -121,114 +494,260 @@ func Flags() []cli.Flag {
 			Value:   true,
 			EnvVars: []string{"AZURE_EXCLUDE_MSI_CREDENTIAL"},
 		},
+		&cli.BoolFlag{
+			Name:    "exclude-workload-identity-credential",
+			Usage:   "Should Azure workload identity federation (GitHub Actions OIDC or federated token file) be excluded from authentication chain?",
+			Value:   true,
+			EnvVars: []string{"AZURE_EXCLUDE_WORKLOAD_IDENTITY_CREDENTIAL"},
+		},
+		&cli.StringFlag{
+			Name:    "client-id",
+			Usage:   "Client ID of the application or user-assigned identity used with workload identity federation",
+			EnvVars: []string{"AZURE_CLIENT_ID"},
+		},
+		&cli.StringFlag{
+			Name:    "federated-token-file",
+			Usage:   "File containing the federated token, if not set the token is requested from GitHub Actions",
+			EnvVars: []string{"AZURE_FEDERATED_TOKEN_FILE"},
+		},
+		&cli.StringFlag{
+			Name:    "federated-token-audience",
+			Usage:   "Audience of the token requested from GitHub Actions",
+			Value:   "api://AzureADTokenExchange",
+			EnvVars: []string{"AZURE_FEDERATED_TOKEN_AUDIENCE"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "credential-order",
+			Usage:   "Order in which the credentials are tried (workload-identity, environment, msi and cli), excluded credentials are skipped",
+			Value:   cli.NewStringSlice(credentialWorkloadIdentity, credentialEnvironment, credentialMSI, credentialAzureCLI),
+			EnvVars: []string{"AZURE_CREDENTIAL_ORDER"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "disable-step",
+			Usage:   "Steps that should be skipped, together with the steps depending on them (for example keyvault)",
+			EnvVars: []string{"AZURE_DISABLE_STEPS"},
+		},
+		&cli.BoolFlag{
+			Name:    "parallel",
+			Usage:   "Should independent resources be created concurrently?",
+			Value:   true,
+			EnvVars: []string{"AZURE_PARALLEL"},
+		},
+		&cli.BoolFlag{
+			Name:    "dry-run",
+			Usage:   "Should the planned operations be printed instead of executed?",
+			Value:   false,
+			EnvVars: []string{"AZURE_DRY_RUN"},
+		},
+		&cli.StringFlag{
+			Name:    "plan-format",
+			Usage:   "Output format of the dry-run plan (text or json)",
+			Value:   "text",
+			EnvVars: []string{"AZURE_PLAN_FORMAT"},
+		},
+		&cli.StringFlag{
+			Name:    "cloud",
+			Usage:   "Azure cloud (public, china, usgovernment or custom)",
+			Value:   "public",
+			EnvVars: []string{"AZURE_CLOUD"},
+		},
+		&cli.StringFlag{
+			Name:    "cloud-config-file",
+			Usage:   "JSON file with the endpoints of the custom cloud (activeDirectoryAuthorityHost, resourceManagerEndpoint, resourceManagerAudience and graphEndpoint)",
+			EnvVars: []string{"AZURE_CLOUD_CONFIG_FILE"},
+		},
+		&cli.StringFlag{
+			Name:    "resource-manager-endpoint",
+			Usage:   "Custom Azure Resource Manager endpoint, for example a local stand-in server",
+			EnvVars: []string{"AZURE_RESOURCE_MANAGER_ENDPOINT"},
+		},
+		&cli.StringFlag{
+			Name:    "authority-host",
+			Usage:   "Custom Azure Active Directory authority host, overrides the one of the cloud",
+			EnvVars: []string{"AZURE_AUTHORITY_HOST"},
+		},
+		&cli.IntFlag{
+			Name:    "client-max-retries",
+			Usage:   "Number of times a failed Azure request is retried (0-10), 0 disables retries",
+			Value:   3,
+			EnvVars: []string{"AZURE_CLIENT_MAX_RETRIES"},
+		},
+		&cli.DurationFlag{
+			Name:    "client-retry-delay",
+			Usage:   "Initial delay before retrying a failed Azure request, it increases exponentially with each retry unless the response has a Retry-After header",
+			Value:   4 * time.Second,
+			EnvVars: []string{"AZURE_CLIENT_RETRY_DELAY"},
+		},
+		&cli.DurationFlag{
+			Name:    "client-max-retry-delay",
+			Usage:   "Maximum delay before retrying a failed Azure request",
+			Value:   60 * time.Second,
+			EnvVars: []string{"AZURE_CLIENT_MAX_RETRY_DELAY"},
+		},
+		&cli.DurationFlag{
+			Name:    "client-try-timeout",
+			Usage:   "Timeout of a single try of an Azure request, 0 disables it",
+			Value:   0,
+			EnvVars: []string{"AZURE_CLIENT_TRY_TIMEOUT"},
+		},
+		&cli.StringFlag{
+			Name:    "http-proxy",
+			Usage:   "URL of the HTTP proxy used for the Azure requests, hosts in the NO_PROXY environment variable are reached directly, HTTPS_PROXY is used when unset",
+			EnvVars: []string{"AZURE_HTTP_PROXY"},
+		},
+		&cli.StringFlag{
+			Name:    "ca-bundle-file",
+			Usage:   "PEM file with CA certificates trusted in addition to the system ones, for example for a TLS inspecting proxy",
+			EnvVars: []string{"AZURE_CA_BUNDLE_FILE"},
+		},
 	}
 	return flags
 }
 
-// Action executes the Azure action
-func Action(ctx context.Context, cli *cli.Context) error {
-	config := azureConfig{
-		ServicePrincipalObjectID:     cli.String("service-principal-object-id"),
-		SubscriptionID:               cli.String("subscription-id"),
-		TenantID:                     cli.String("tenant-id"),
-		ResourceGroupName:            cli.String("resource-group-name"),
-		ResourceGroupLocation:        cli.String("resource-group-location"),
-		StorageAccountName:           cli.String("storage-account-name"),
-		StorageAccountContainer:      cli.String("storage-account-container"),
-		KeyVaultName:                 cli.String("keyvault-name"),
-		KeyVaultKeyName:              cli.String("keyvault-key-name"),
-		ResourceLocks:                cli.Bool("resource-locks"),
-		ExcludeAzureCLICredential:    cli.Bool("exclude-cli-credential"),
-		ExcludeEnvironmentCredential: cli.Bool("exclude-environment-credential"),
-		ExcludeMSICredential:         cli.Bool("exclude-msi-credential"),
+func newAzureConfig(cli *cli.Context) azureConfig {
+	return azureConfig{
+		ServicePrincipalObjectID:          cli.String("service-principal-object-id"),
+		SubscriptionID:                    cli.String("subscription-id"),
+		TenantID:                          cli.String("tenant-id"),
+		ResourceGroupName:                 cli.String("resource-group-name"),
+		ResourceGroupLocation:             cli.String("resource-group-location"),
+		StorageAccountName:                cli.String("storage-account-name"),
+		StorageAccountContainer:           cli.String("storage-account-container"),
+		StorageAccountContainerMetadata:   cli.StringSlice("storage-account-container-metadata"),
+		ContainerVersionImmutability:      cli.Bool("container-version-immutability"),
+		ContainerRetentionDays:            cli.Int("container-retention-days"),
+		ContainerLegalHoldTags:            cli.StringSlice("container-legal-hold-tag"),
+		StorageAccountSKU:                 cli.String("storage-account-sku"),
+		StorageAccountKind:                cli.String("storage-account-kind"),
+		StorageAccountAccessTier:          cli.String("storage-account-access-tier"),
+		StorageAccountPublicNetworkAccess: cli.String("storage-account-public-network-access"),
+		StorageAccountIPRules:             cli.StringSlice("storage-account-ip-rule"),
+		StorageAccountVirtualNetworkRules: cli.StringSlice("storage-account-virtual-network-rule"),
+		StorageAccountSharedKeyAccess:     cli.Bool("storage-account-shared-key-access"),
+		StorageAccountDefaultToOAuth:      cli.Bool("storage-account-default-to-oauth"),
+		PrivateEndpointSubnetID:           cli.String("private-endpoint-subnet-id"),
+		PrivateDNSZoneID:                  cli.String("private-dns-zone-id"),
+		StorageAccountRoleAssignment:      cli.Bool("storage-account-role-assignment"),
+		StorageAccountRoleName:            cli.String("storage-account-role-name"),
+		StorageAccountRoleScope:           cli.String("storage-account-role-scope"),
+		StorageAccountRolePrincipalIDs:    cli.StringSlice("storage-account-role-principal-id"),
+		BlobVersioning:                    optionalBool(cli, "blob-versioning"),
+		BlobSoftDeleteRetentionDays:       optionalInt(cli, "blob-soft-delete-retention-days"),
+		ContainerSoftDeleteRetentionDays:  optionalInt(cli, "container-soft-delete-retention-days"),
+		BlobChangeFeed:                    optionalBool(cli, "blob-change-feed"),
+		BlobRestoreDays:                   optionalInt(cli, "blob-restore-days"),
+		StorageAccountCMK:                 cli.Bool("storage-account-cmk"),
+		StorageAccountIdentityName:        cli.String("storage-account-identity-name"),
+		StorageAccountDoubleEncryption:    cli.Bool("storage-account-infrastructure-encryption"),
+		KeyVaultName:                      cli.String("keyvault-name"),
+		KeyVaultKeyName:                   cli.String("keyvault-key-name"),
+		KeyVaultAuthorization:             cli.String("keyvault-authorization"),
+		KeyVaultRoleName:                  cli.String("keyvault-role-name"),
+		KeyVaultKeyType:                   cli.String("keyvault-key-type"),
+		KeyVaultKeySize:                   cli.Int("keyvault-key-size"),
+		KeyVaultKeyCurve:                  cli.String("keyvault-key-curve"),
+		KeyVaultKeyOperations:             cli.StringSlice("keyvault-key-operation"),
+		KeyVaultKeyExpiry:                 cli.Duration("keyvault-key-expiry"),
+		KeyVaultKeyRotateAfter:            cli.String("keyvault-key-rotate-after"),
+		KeyVaultKeyRotationExpiry:         cli.String("keyvault-key-rotation-expiry"),
+		KeyVaultKeyNotifyBeforeExpiry:     cli.String("keyvault-key-notify-before-expiry"),
+		KeyVaultPurgeProtection:           cli.Bool("keyvault-purge-protection"),
+		KeyVaultSoftDeleteRetentionDays:   cli.Int("keyvault-soft-delete-retention-days"),
+		KeyVaultPublicNetworkAccess:       cli.String("keyvault-public-network-access"),
+		KeyVaultIPRules:                   cli.StringSlice("keyvault-ip-rule"),
+		KeyVaultVirtualNetworkRules:       cli.StringSlice("keyvault-virtual-network-rule"),
+		Tags:                              cli.StringSlice("tag"),
+		MergeTags:                         cli.Bool("merge-tags"),
+		Reconcile:                         cli.Bool("reconcile"),
+		RecoverDeletedKeyVault:            cli.Bool("recover-deleted-keyvault"),
+		ResourceLocks:                     cli.Bool("resource-locks"),
+		ResourceLockLevel:                 cli.String("resource-lock-level"),
+		ResourceLockScope:                 cli.String("resource-lock-scope"),
+		ResourceLockNotes:                 cli.String("resource-lock-notes"),
+		ExcludeAzureCLICredential:         cli.Bool("exclude-cli-credential"),
+		ExcludeEnvironmentCredential:      cli.Bool("exclude-environment-credential"),
+		ExcludeMSICredential:              cli.Bool("exclude-msi-credential"),
+		ExcludeWorkloadIdentityCredential: cli.Bool("exclude-workload-identity-credential"),
+		ClientID:                          cli.String("client-id"),
+		FederatedTokenFile:                cli.String("federated-token-file"),
+		FederatedTokenAudience:            cli.String("federated-token-audience"),
+		CredentialOrder:                   cli.StringSlice("credential-order"),
+		DisabledSteps:                     cli.StringSlice("disable-step"),
+		Parallel:                          cli.Bool("parallel"),
+		DryRun:                            cli.Bool("dry-run"),
+		PlanFormat:                        cli.String("plan-format"),
+		Cloud:                             cli.String("cloud"),
+		CloudConfigFile:                   cli.String("cloud-config-file"),
+		ResourceManagerEndpoint:           cli.String("resource-manager-endpoint"),
+		AuthorityHost:                     cli.String("authority-host"),
+		ClientMaxRetries:                  cli.Int("client-max-retries"),
+		ClientRetryDelay:                  cli.Duration("client-retry-delay"),
+		ClientMaxRetryDelay:               cli.Duration("client-max-retry-delay"),
+		ClientTryTimeout:                  cli.Duration("client-try-timeout"),
+		HTTPProxy:                         cli.String("http-proxy"),
+		CABundleFile:                      cli.String("ca-bundle-file"),
+		Version:                           cli.App.Version,
 	}
+}
 
-	err := config.Validate()
-	if err != nil {
-		return err
+// optionalBool returns the value of the flag, nil if it isn't set
+func optionalBool(cli *cli.Context, name string) *bool {
+	if !cli.IsSet(name) {
+		return nil
 	}
 
-	cred, err := getCredentials(ctx, config)
-	if err != nil {
-		return err
-	}
+	return to.Ptr(cli.Bool(name))
+}
 
-	err = CreateResourceGroup(ctx, cred, config)
-	if err != nil {
-		return err
+// optionalInt returns the value of the flag, nil if it isn't set
+func optionalInt(cli *cli.Context, name string) *int {
+	if !cli.IsSet(name) {
+		return nil
 	}
 
-	err = CreateStorageAccount(ctx, cred, config)
+	return to.Ptr(cli.Int(name))
+}
+
+// Action executes the Azure action
+func Action(ctx context.Context, cli *cli.Context) error {
+	config := newAzureConfig(cli)
+
+	err := config.Validate()
 	if err != nil {
 		return err
 	}
 
-	if config.ResourceLocks {
-		err = CreateResourceLock(ctx, cred, config, "Microsoft.Storage", "", "storageAccounts", config.StorageAccountName, "DoNotDelete")
-		if err != nil {
-			return err
-		}
-	}
-
-	err = CreateStorageAccountContainer(ctx, cred, config)
+	clients, err := getClientFactory(ctx, config)
 	if err != nil {
 		return err
 	}
 
-	err = CreateKeyVault(ctx, cred, config)
+	return runAction(ctx, clients, config, os.Stdout)
+}
+
+// runAction applies all steps, or writes the planned operations when running a dry-run
+func runAction(ctx context.Context, clients *clientFactory, config azureConfig, w io.Writer) error {
+	log, err := logr.FromContext(ctx)
 	if err != nil {
 		return err
 	}
 
-	if config.ResourceLocks {
-		err = CreateResourceLock(ctx, cred, config, "Microsoft.KeyVault", "", "vaults", config.KeyVaultName, "DoNotDelete")
+	if config.DryRun {
+		operations, err := getPlannedOperations(ctx, clients, config)
 		if err != nil {
 			return err
 		}
-	}
 
-	err = CreateKeyVaultAccessPolicy(ctx, cred, config)
-	if err != nil {
-		return err
+		return writePlannedOperations(w, operations, config.PlanFormat)
 	}
 
-	err = CreateKeyVaultKey(ctx, cred, config)
+	restoreLocks, err := liftReadOnlyLocks(ctx, clients, config)
 	if err != nil {
-		return err
+		return errors.Join(err, restoreLocks())
 	}
 
-	return nil
-}
-
-func getCredentials(ctx context.Context, config azureConfig) (azcore.TokenCredential, error) {
-	log, err := logr.FromContext(ctx)
-	if err != nil {
-		return nil, err
-	}
-
-	if !config.ExcludeEnvironmentCredential {
-		cred, err := azidentity.NewEnvironmentCredential(nil)
-		if err == nil {
-			return cred, nil
-		}
-		log.Info("NewEnvironmentCredential failed", "error", err)
-	}
-	if !config.ExcludeMSICredential {
-		cred, err := azidentity.NewManagedIdentityCredential(nil)
-		if err == nil {
-			return cred, nil
-		}
-		log.Info("NewManagedIdentityCredential failed", "error", err)
-	}
-	if !config.ExcludeAzureCLICredential {
-		cred, err := azidentity.NewAzureCLICredential(nil)
-		if err == nil {
-			return cred, nil
-		}
-		log.Info("NewAzureCLICredential failed", "error", err)
-	}
+	outcomes, err := applySteps(ctx, clients, config, getSteps())
+	logStepOutcomes(log, outcomes)
 
-	err = fmt.Errorf("no credentials found")
-	log.Error(err, "all tested credentials failed")
-	return nil, err
+	return errors.Join(err, restoreLocks())
 }
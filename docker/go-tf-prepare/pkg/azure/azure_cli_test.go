@@ -0,0 +1,175 @@
+package azure
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/xenitab/github-actions/docker/go-tf-prepare/pkg/azure/fake"
+)
+
+const testStorageAccountLockID = "/subscriptions/" + testSubscriptionID + "/resourceGroups/rg-test/providers/Microsoft.Storage/storageAccounts/satest/providers/Microsoft.Authorization/locks/DoNotDelete"
+
+// writeRequests returns the requests that may have changed a resource, after the first skipped requests
+func writeRequests(server *fake.ARM, skip int) []fake.Request {
+	requests := []fake.Request{}
+	for _, request := range server.Requests()[skip:] {
+		if request.Method == http.MethodGet || request.Method == http.MethodHead {
+			continue
+		}
+		// the name availability checks are POST requests that don't change anything
+		if strings.HasSuffix(strings.ToLower(request.Path), "/checknameavailability") {
+			continue
+		}
+		requests = append(requests, request)
+	}
+
+	return requests
+}
+
+func TestRunActionCreatesBackend(t *testing.T) {
+	ctx := newTestContext(t)
+	server, clients := newTestClients(t)
+	config := newTestConfig(t)
+
+	err := runAction(ctx, clients, config, io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	for _, id := range []string{
+		"/subscriptions/" + testSubscriptionID + "/resourceGroups/rg-test",
+		"/subscriptions/" + testSubscriptionID + "/resourceGroups/rg-test/providers/Microsoft.Storage/storageAccounts/satest",
+		"/subscriptions/" + testSubscriptionID + "/resourceGroups/rg-test/providers/Microsoft.Storage/storageAccounts/satest/blobServices/default/containers/tfstate",
+		"/subscriptions/" + testSubscriptionID + "/resourceGroups/rg-test/providers/Microsoft.KeyVault/vaults/kv-test",
+		"/subscriptions/" + testSubscriptionID + "/resourceGroups/rg-test/providers/Microsoft.KeyVault/vaults/kv-test/keys/sops",
+		testStorageAccountLockID,
+	} {
+		if _, ok := server.Resource(id); !ok {
+			t.Errorf("resource %s was not created", id)
+		}
+	}
+
+	status := &bytes.Buffer{}
+	err = runStatus(ctx, clients, config, status)
+	if err != nil {
+		t.Errorf("runStatus: %v\n%s", err, status)
+	}
+}
+
+func TestRunActionIsIdempotent(t *testing.T) {
+	ctx := newTestContext(t)
+	server, clients := newTestClients(t)
+	config := newTestConfig(t)
+
+	err := runAction(ctx, clients, config, io.Discard)
+	if err != nil {
+		t.Fatalf("first runAction: %v", err)
+	}
+
+	skip := len(server.Requests())
+	err = runAction(ctx, clients, config, io.Discard)
+	if err != nil {
+		t.Fatalf("second runAction: %v", err)
+	}
+
+	for _, request := range writeRequests(server, skip) {
+		t.Errorf("second run sent %s %s", request.Method, request.Path)
+	}
+}
+
+func TestRunActionDryRun(t *testing.T) {
+	ctx := newTestContext(t)
+	server, clients := newTestClients(t)
+
+	plan := &bytes.Buffer{}
+	err := runAction(ctx, clients, newTestConfig(t, "--dry-run"), plan)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	for _, expected := range []string{`create Resource Group "rg-test"`, `create Storage Account "satest"`, `create KeyVault "kv-test"`} {
+		if !strings.Contains(plan.String(), expected) {
+			t.Errorf("plan doesn't contain %q:\n%s", expected, plan)
+		}
+	}
+
+	for _, request := range writeRequests(server, 0) {
+		t.Errorf("dry-run sent %s %s", request.Method, request.Path)
+	}
+
+	err = runAction(ctx, clients, newTestConfig(t), io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	plan.Reset()
+	err = runAction(ctx, clients, newTestConfig(t, "--dry-run"), plan)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	if !strings.Contains(plan.String(), "No changes.") {
+		t.Errorf("plan after apply has changes:\n%s", plan)
+	}
+}
+
+func TestRunActionReconcile(t *testing.T) {
+	ctx := newTestContext(t)
+	server, clients := newTestClients(t)
+	config := newTestConfig(t)
+
+	err := runAction(ctx, clients, config, io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	lock, _ := server.Resource(testStorageAccountLockID)
+	lock["properties"] = map[string]any{"level": "CanNotDelete", "notes": "changed outside of tf-prepare"}
+	server.PutResource(testStorageAccountLockID, lock)
+
+	status := &bytes.Buffer{}
+	err = runStatus(ctx, clients, config, status)
+	if err == nil || !strings.Contains(status.String(), `lock notes are "changed outside of tf-prepare"`) {
+		t.Fatalf("status doesn't report the changed lock notes: %v\n%s", err, status)
+	}
+
+	skip := len(server.Requests())
+	err = runAction(ctx, clients, config, io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	for _, request := range writeRequests(server, skip) {
+		t.Errorf("run without reconcile sent %s %s", request.Method, request.Path)
+	}
+
+	err = runAction(ctx, clients, newTestConfig(t, "--reconcile"), io.Discard)
+	if err != nil {
+		t.Fatalf("runAction with reconcile: %v", err)
+	}
+
+	status.Reset()
+	err = runStatus(ctx, clients, config, status)
+	if err != nil {
+		t.Errorf("runStatus after reconcile: %v\n%s", err, status)
+	}
+}
+
+func TestRunStatusMissing(t *testing.T) {
+	ctx := newTestContext(t)
+	_, clients := newTestClients(t)
+
+	status := &bytes.Buffer{}
+	err := runStatus(ctx, clients, newTestConfig(t), status)
+	if err == nil {
+		t.Fatalf("runStatus didn't fail for a missing backend:\n%s", status)
+	}
+
+	if !strings.Contains(status.String(), fmt.Sprintf("%s  ", resourceStatusMissing)) {
+		t.Errorf("status doesn't report missing resources:\n%s", status)
+	}
+}
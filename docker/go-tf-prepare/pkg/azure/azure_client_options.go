@@ -0,0 +1,122 @@
+package azure
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// userAgentApplicationID returns the application ID added to the user agent of the requests, azcore truncates it to 24 characters
+func userAgentApplicationID(config azureConfig) string {
+	version := config.Version
+	if version == "" {
+		version = "dev"
+	}
+
+	return fmt.Sprintf("tf-prepare/%s", version)
+}
+
+// getClientOptions returns the client options shared by all Azure SDK clients
+func getClientOptions(config azureConfig) (*arm.ClientOptions, error) {
+	retries := int32(config.ClientMaxRetries)
+	if retries == 0 {
+		// zero is the SDK default of three retries, a negative value disables them
+		retries = -1
+	}
+
+	transport, err := getTransport(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &arm.ClientOptions{
+		ClientOptions: policy.ClientOptions{
+			Retry: policy.RetryOptions{
+				MaxRetries:    retries,
+				TryTimeout:    config.ClientTryTimeout,
+				RetryDelay:    config.ClientRetryDelay,
+				MaxRetryDelay: config.ClientMaxRetryDelay,
+			},
+			Telemetry: policy.TelemetryOptions{
+				ApplicationID: userAgentApplicationID(config),
+			},
+			Transport: transport,
+		},
+	}, nil
+}
+
+// getTransport returns a HTTP client using the configured proxy and CA bundle, nil keeps the SDK default transport
+func getTransport(config azureConfig) (policy.Transporter, error) {
+	if config.HTTPProxy == "" && config.CABundleFile == "" {
+		return nil, nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if config.HTTPProxy != "" {
+		_, err := url.Parse(config.HTTPProxy)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse HTTP proxy %q: %w", config.HTTPProxy, err)
+		}
+
+		// NO_PROXY is still honored, the managed identity endpoint has to be reached directly
+		proxyConfig := httpproxy.Config{
+			HTTPProxy:  config.HTTPProxy,
+			HTTPSProxy: config.HTTPProxy,
+			NoProxy:    httpproxy.FromEnvironment().NoProxy,
+		}
+		proxyFunc := proxyConfig.ProxyFunc()
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			return proxyFunc(req.URL)
+		}
+	}
+
+	if config.CABundleFile != "" {
+		rootCAs, err := readCABundleFile(config.CABundleFile)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs:    rootCAs,
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// readCABundleFile returns the system certificate pool with the certificates of the PEM file added
+func readCABundleFile(path string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil {
+		rootCAs = x509.NewCertPool()
+	}
+
+	if !rootCAs.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in CA bundle file %s", path)
+	}
+
+	return rootCAs, nil
+}
+
+// credentialClientOptions returns the client options of the credentials, they keep the retries of azidentity
+// since managed identity uses its own defaults
+func credentialClientOptions(environment cloudEnvironment, options *arm.ClientOptions) policy.ClientOptions {
+	return policy.ClientOptions{
+		Cloud:     environment.Configuration,
+		Telemetry: options.Telemetry,
+		Transport: options.Transport,
+	}
+}
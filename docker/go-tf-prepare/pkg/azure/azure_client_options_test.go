@@ -0,0 +1,42 @@
+package azure
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestGetTransportHonorsNoProxy(t *testing.T) {
+	t.Setenv("NO_PROXY", "169.254.169.254")
+	t.Setenv("no_proxy", "")
+
+	transport, err := getTransport(azureConfig{HTTPProxy: "http://proxy.example:8080"})
+	if err != nil {
+		t.Fatalf("getTransport: %v", err)
+	}
+
+	proxy := transport.(*http.Client).Transport.(*http.Transport).Proxy
+
+	cases := map[string]string{
+		"https://management.azure.com/subscriptions":            "http://proxy.example:8080",
+		"http://169.254.169.254/metadata/identity/oauth2/token": "",
+	}
+	for target, expected := range cases {
+		req, err := http.NewRequest(http.MethodGet, target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		proxyURL, err := proxy(req)
+		if err != nil {
+			t.Fatalf("proxy for %s: %v", target, err)
+		}
+
+		actual := ""
+		if proxyURL != nil {
+			actual = proxyURL.String()
+		}
+		if actual != expected {
+			t.Errorf("proxy for %s is %q, expected %q", target, actual, expected)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package azure
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/authorization/armauthorization/v2"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/keyvault/armkeyvault"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/msi/armmsi"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armlocks"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armresources"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/storage/armstorage"
+	"github.com/Azure/azure-sdk-for-go/sdk/security/keyvault/azkeys"
+)
+
+// clientFactory creates the Azure SDK clients with a shared credential and client options,
+// which makes it possible to replace the transport with a fake when testing
+type clientFactory struct {
+	subscriptionID string
+	cred           azcore.TokenCredential
+	graphEndpoint  string
+	// customCloud disables the verification that Key Vault challenges are for a known Azure cloud
+	customCloud bool
+	options     arm.ClientOptions
+
+	// the management locks api-version is detected until it succeeds, see withLockAPIVersion
+	lockAPIVersionMu     sync.Mutex
+	lockAPIVersionLookup *apiVersionLookup
+}
+
+func newClientFactory(subscriptionID string, cred azcore.TokenCredential, environment cloudEnvironment, options *arm.ClientOptions) *clientFactory {
+	f := &clientFactory{
+		subscriptionID: subscriptionID,
+		cred:           cred,
+		graphEndpoint:  environment.GraphEndpoint,
+		customCloud:    environment.Custom,
+	}
+
+	if options != nil {
+		f.options = *options
+	}
+	f.options.Cloud = environment.Configuration
+	// api-version overrides are set per request, so every client keeps the standard transport
+	f.options.PerCallPolicies = append(slices.Clone(f.options.PerCallPolicies), policy.Policy(apiVersionPolicy{}))
+
+	return f
+}
+
+// getClientFactory returns a client factory for the cloud, credentials and client options in the config
+func getClientFactory(ctx context.Context, config azureConfig) (*clientFactory, error) {
+	environment, err := getCloudEnvironment(config)
+	if err != nil {
+		return nil, err
+	}
+
+	options, err := getClientOptions(config)
+	if err != nil {
+		return nil, err
+	}
+
+	cred, err := getCredentials(ctx, config, environment, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return newClientFactory(config.SubscriptionID, cred, environment, options), nil
+}
+
+// resourceManagerScope returns the scope of Azure Resource Manager tokens in the cloud
+func (f *clientFactory) resourceManagerScope() string {
+	return resourceManagerScope(f.options.Cloud)
+}
+
+// clientOptions returns a copy of the client options, since the SDK clients may modify them
+func (f *clientFactory) clientOptions() *arm.ClientOptions {
+	options := f.options
+	return &options
+}
+
+func (f *clientFactory) resourceGroupsClient() (*armresources.ResourceGroupsClient, error) {
+	return armresources.NewResourceGroupsClient(f.subscriptionID, f.cred, f.clientOptions())
+}
+
+func (f *clientFactory) providersClient() (*armresources.ProvidersClient, error) {
+	return armresources.NewProvidersClient(f.subscriptionID, f.cred, f.clientOptions())
+}
+
+func (f *clientFactory) tagsClient() (*armresources.TagsClient, error) {
+	return armresources.NewTagsClient(f.subscriptionID, f.cred, f.clientOptions())
+}
+
+func (f *clientFactory) accountsClient() (*armstorage.AccountsClient, error) {
+	return armstorage.NewAccountsClient(f.subscriptionID, f.cred, f.clientOptions())
+}
+
+func (f *clientFactory) blobServicesClient() (*armstorage.BlobServicesClient, error) {
+	return armstorage.NewBlobServicesClient(f.subscriptionID, f.cred, f.clientOptions())
+}
+
+func (f *clientFactory) blobContainersClient() (*armstorage.BlobContainersClient, error) {
+	return armstorage.NewBlobContainersClient(f.subscriptionID, f.cred, f.clientOptions())
+}
+
+func (f *clientFactory) vaultsClient() (*armkeyvault.VaultsClient, error) {
+	return armkeyvault.NewVaultsClient(f.subscriptionID, f.cred, f.clientOptions())
+}
+
+func (f *clientFactory) keysClient() (*armkeyvault.KeysClient, error) {
+	return armkeyvault.NewKeysClient(f.subscriptionID, f.cred, f.clientOptions())
+}
+
+// keysDataClient returns a Key Vault data plane client, used for the key operations that aren't available in Azure Resource Manager
+func (f *clientFactory) keysDataClient(vaultURL string) (*azkeys.Client, error) {
+	return azkeys.NewClient(vaultURL, f.cred, &azkeys.ClientOptions{
+		ClientOptions:                        f.clientOptions().ClientOptions,
+		DisableChallengeResourceVerification: f.customCloud,
+	})
+}
+
+func (f *clientFactory) userAssignedIdentitiesClient() (*armmsi.UserAssignedIdentitiesClient, error) {
+	return armmsi.NewUserAssignedIdentitiesClient(f.subscriptionID, f.cred, f.clientOptions())
+}
+
+func (f *clientFactory) privateEndpointsClient() (*armnetwork.PrivateEndpointsClient, error) {
+	return armnetwork.NewPrivateEndpointsClient(f.subscriptionID, f.cred, f.clientOptions())
+}
+
+func (f *clientFactory) privateDNSZoneGroupsClient() (*armnetwork.PrivateDNSZoneGroupsClient, error) {
+	return armnetwork.NewPrivateDNSZoneGroupsClient(f.subscriptionID, f.cred, f.clientOptions())
+}
+
+func (f *clientFactory) roleAssignmentsClient() (*armauthorization.RoleAssignmentsClient, error) {
+	return armauthorization.NewRoleAssignmentsClient(f.subscriptionID, f.cred, f.clientOptions())
+}
+
+func (f *clientFactory) roleDefinitionsClient() (*armauthorization.RoleDefinitionsClient, error) {
+	return armauthorization.NewRoleDefinitionsClient(f.cred, f.clientOptions())
+}
+
+func (f *clientFactory) managementLocksClient() (*armlocks.ManagementLocksClient, error) {
+	return armlocks.NewManagementLocksClient(f.subscriptionID, f.cred, f.clientOptions())
+}
+
+func resourceManagerScope(configuration cloud.Configuration) string {
+	return configuration.Services[cloud.ResourceManager].Audience + "/.default"
+}
@@ -0,0 +1,130 @@
+package azure
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/go-playground/validator/v10"
+)
+
+const (
+	cloudPublic       = "public"
+	cloudChina        = "china"
+	cloudUSGovernment = "usgovernment"
+	cloudCustom       = "custom"
+)
+
+// cloudEnvironment contains the endpoints of an Azure cloud
+type cloudEnvironment struct {
+	Configuration cloud.Configuration
+	GraphEndpoint string
+	// Custom is true for clouds unknown to Azure AD instance discovery
+	Custom bool
+}
+
+// cloudConfigFile is the format of the custom cloud endpoints file
+type cloudConfigFile struct {
+	ActiveDirectoryAuthorityHost string `json:"activeDirectoryAuthorityHost" validate:"url"`
+	ResourceManagerEndpoint      string `json:"resourceManagerEndpoint" validate:"url"`
+	ResourceManagerAudience      string `json:"resourceManagerAudience" validate:"omitempty,url"`
+	GraphEndpoint                string `json:"graphEndpoint" validate:"omitempty,url"`
+}
+
+var cloudEnvironments = map[string]cloudEnvironment{
+	cloudPublic: {
+		Configuration: cloud.AzurePublic,
+		GraphEndpoint: "https://graph.microsoft.com",
+	},
+	cloudChina: {
+		Configuration: cloud.AzureChina,
+		GraphEndpoint: "https://microsoftgraph.chinacloudapi.cn",
+	},
+	cloudUSGovernment: {
+		Configuration: cloud.AzureGovernment,
+		GraphEndpoint: "https://graph.microsoft.us",
+	},
+}
+
+// getCloudEnvironment returns the configured cloud, with the endpoint flags overriding the ones of the cloud
+func getCloudEnvironment(config azureConfig) (cloudEnvironment, error) {
+	environment, ok := cloudEnvironments[config.Cloud]
+	if config.Cloud == cloudCustom {
+		var err error
+		environment, err = readCloudConfigFile(config.CloudConfigFile)
+		if err != nil {
+			return cloudEnvironment{}, err
+		}
+	} else if !ok {
+		return cloudEnvironment{}, fmt.Errorf("unknown cloud %q", config.Cloud)
+	}
+
+	if config.ResourceManagerEndpoint != "" || config.AuthorityHost != "" {
+		environment = environment.withEndpoints(config.ResourceManagerEndpoint, config.AuthorityHost)
+	}
+
+	return environment, nil
+}
+
+// withEndpoints returns a copy of the environment with the non-empty endpoints replaced
+func (e cloudEnvironment) withEndpoints(resourceManagerEndpoint, authorityHost string) cloudEnvironment {
+	services := map[cloud.ServiceName]cloud.ServiceConfiguration{}
+	for name, service := range e.Configuration.Services {
+		services[name] = service
+	}
+
+	if resourceManagerEndpoint != "" {
+		services[cloud.ResourceManager] = cloud.ServiceConfiguration{
+			Audience: resourceManagerEndpoint,
+			Endpoint: resourceManagerEndpoint,
+		}
+	}
+
+	result := e
+	result.Configuration.Services = services
+	// only another resource manager makes the cloud custom, an authority host alone keeps the known cloud
+	result.Custom = e.Custom || resourceManagerEndpoint != ""
+	if authorityHost != "" {
+		result.Configuration.ActiveDirectoryAuthorityHost = authorityHost
+	}
+
+	return result
+}
+
+func readCloudConfigFile(path string) (cloudEnvironment, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return cloudEnvironment{}, err
+	}
+
+	file := cloudConfigFile{}
+	err = json.Unmarshal(b, &file)
+	if err != nil {
+		return cloudEnvironment{}, fmt.Errorf("unable to parse cloud config file %s: %w", path, err)
+	}
+
+	err = validator.New().Struct(file)
+	if err != nil {
+		return cloudEnvironment{}, fmt.Errorf("invalid cloud config file %s: %w", path, err)
+	}
+
+	audience := file.ResourceManagerAudience
+	if audience == "" {
+		audience = file.ResourceManagerEndpoint
+	}
+
+	return cloudEnvironment{
+		Configuration: cloud.Configuration{
+			ActiveDirectoryAuthorityHost: file.ActiveDirectoryAuthorityHost,
+			Services: map[cloud.ServiceName]cloud.ServiceConfiguration{
+				cloud.ResourceManager: {
+					Audience: audience,
+					Endpoint: file.ResourceManagerEndpoint,
+				},
+			},
+		},
+		GraphEndpoint: file.GraphEndpoint,
+		Custom:        true,
+	}, nil
+}
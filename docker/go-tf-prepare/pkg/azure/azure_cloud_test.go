@@ -0,0 +1,25 @@
+package azure
+
+import "testing"
+
+func TestGetCloudEnvironmentCustom(t *testing.T) {
+	cases := []struct {
+		args     []string
+		expected bool
+	}{
+		{args: nil, expected: false},
+		{args: []string{"--authority-host", "https://login.example"}, expected: false},
+		{args: []string{"--resource-manager-endpoint", "https://management.example"}, expected: true},
+	}
+
+	for _, c := range cases {
+		environment, err := getCloudEnvironment(newTestConfig(t, c.args...))
+		if err != nil {
+			t.Fatalf("getCloudEnvironment(%v): %v", c.args, err)
+		}
+
+		if environment.Custom != c.expected {
+			t.Errorf("getCloudEnvironment(%v).Custom = %t, expected %t", c.args, environment.Custom, c.expected)
+		}
+	}
+}
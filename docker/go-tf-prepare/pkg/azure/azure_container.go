@@ -0,0 +1,274 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/storage/armstorage"
+	"github.com/go-logr/logr"
+)
+
+// storageAccountContainerMetadata returns the configured key=value pairs as container metadata
+func storageAccountContainerMetadata(config azureConfig) map[string]*string {
+	return keyValueMap(config.StorageAccountContainerMetadata)
+}
+
+func storageAccountContainerProperties(config azureConfig) *armstorage.ContainerProperties {
+	properties := &armstorage.ContainerProperties{
+		Metadata: storageAccountContainerMetadata(config),
+	}
+
+	if config.ContainerVersionImmutability {
+		properties.ImmutableStorageWithVersioning = &armstorage.ImmutableStorageWithVersioning{
+			Enabled: to.Ptr(true),
+		}
+	}
+
+	return properties
+}
+
+func getStorageAccountContainerDifferences(config azureConfig, properties *armstorage.ContainerProperties) []string {
+	if properties == nil {
+		properties = &armstorage.ContainerProperties{}
+	}
+
+	reasons := []string{}
+
+	// metadata and legal hold tags are only added to existing containers with reconcile, so they are only compared then
+	if config.Reconcile {
+		for _, key := range getStorageAccountContainerMetadataDifferences(config, properties.Metadata) {
+			value, ok := lookupKey(properties.Metadata, key)
+			if !ok {
+				reasons = append(reasons, fmt.Sprintf("metadata %s is missing", key))
+				continue
+			}
+			reasons = append(reasons, fmt.Sprintf("metadata %s is %q", key, value))
+		}
+	}
+
+	if config.ContainerVersionImmutability && !isVersionImmutabilityEnabled(properties) {
+		reasons = append(reasons, "version-level immutability is disabled")
+	}
+
+	if config.ContainerRetentionDays > 0 {
+		currentDays := immutabilityPolicyDays(properties)
+		if currentDays != config.ContainerRetentionDays {
+			reasons = append(reasons, retentionString("immutability policy", currentDays))
+		}
+	}
+
+	if config.Reconcile {
+		for _, tag := range getMissingLegalHoldTags(config, properties) {
+			reasons = append(reasons, fmt.Sprintf("legal hold tag %s is missing", tag))
+		}
+	}
+
+	return reasons
+}
+
+// getStorageAccountContainerMetadataDifferences returns the sorted keys of the configured metadata that are missing or have another value
+func getStorageAccountContainerMetadataDifferences(config azureConfig, current map[string]*string) []string {
+	keys := []string{}
+	for key, value := range storageAccountContainerMetadata(config) {
+		currentValue, ok := lookupKey(current, key)
+		if !ok || currentValue != *value {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// lookupKey returns the value of the key, metadata keys and tag names are case-insensitive
+func lookupKey(metadata map[string]*string, key string) (string, bool) {
+	for k, v := range metadata {
+		if strings.EqualFold(k, key) && v != nil {
+			return *v, true
+		}
+	}
+
+	return "", false
+}
+
+func isVersionImmutabilityEnabled(properties *armstorage.ContainerProperties) bool {
+	return properties.ImmutableStorageWithVersioning != nil && properties.ImmutableStorageWithVersioning.Enabled != nil && *properties.ImmutableStorageWithVersioning.Enabled
+}
+
+// immutabilityPolicyDays returns the retention of the time-based immutability policy, 0 means there is no policy
+func immutabilityPolicyDays(properties *armstorage.ContainerProperties) int {
+	policy := properties.ImmutabilityPolicy
+	if policy == nil || policy.Properties == nil || policy.Properties.ImmutabilityPeriodSinceCreationInDays == nil {
+		return 0
+	}
+
+	return int(*policy.Properties.ImmutabilityPeriodSinceCreationInDays)
+}
+
+func isImmutabilityPolicyLocked(properties *armstorage.ContainerProperties) bool {
+	policy := properties.ImmutabilityPolicy
+	return policy != nil && policy.Properties != nil && policy.Properties.State != nil && *policy.Properties.State == armstorage.ImmutabilityPolicyStateLocked
+}
+
+// getMissingLegalHoldTags returns the configured legal hold tags that aren't set on the container, tags that aren't configured are left as they are
+func getMissingLegalHoldTags(config azureConfig, properties *armstorage.ContainerProperties) []string {
+	current := []string{}
+	if properties.LegalHold != nil {
+		for _, tag := range properties.LegalHold.Tags {
+			if tag != nil && tag.Tag != nil {
+				current = append(current, strings.ToLower(*tag.Tag))
+			}
+		}
+	}
+
+	missing := []string{}
+	for _, tag := range config.ContainerLegalHoldTags {
+		if !slices.Contains(current, strings.ToLower(tag)) {
+			missing = append(missing, tag)
+		}
+	}
+
+	return missing
+}
+
+// updateStorageAccountContainer updates the metadata and immutability settings of the existing Storage Account Container
+func updateStorageAccountContainer(ctx context.Context, clients *clientFactory, config azureConfig, state resourceState) (stepResult, error) {
+	resourceGroupName := config.ResourceGroupName
+	storageAccountName := config.StorageAccountName
+	storageAccountContainer := config.StorageAccountContainer
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	client, err := clients.blobContainersClient()
+	if err != nil {
+		log.Error(err, "armstorage.NewBlobContainersClient")
+		return "", err
+	}
+
+	res, err := client.Get(ctx, resourceGroupName, storageAccountName, storageAccountContainer, nil)
+	if err != nil {
+		log.Error(err, "client.Get")
+		return "", err
+	}
+
+	properties := res.ContainerProperties
+	if properties == nil {
+		properties = &armstorage.ContainerProperties{}
+	}
+
+	if len(getStorageAccountContainerMetadataDifferences(config, properties.Metadata)) > 0 {
+		// metadata that isn't configured is kept
+		metadata := map[string]*string{}
+		for key, value := range properties.Metadata {
+			if _, ok := lookupKey(storageAccountContainerMetadata(config), key); !ok {
+				metadata[key] = value
+			}
+		}
+		for key, value := range storageAccountContainerMetadata(config) {
+			metadata[key] = value
+		}
+
+		_, err = client.Update(ctx, resourceGroupName, storageAccountName, storageAccountContainer, armstorage.BlobContainer{
+			ContainerProperties: &armstorage.ContainerProperties{
+				Metadata: metadata,
+			},
+		}, nil)
+		if err != nil {
+			log.Error(err, "client.Update")
+			return "", err
+		}
+	}
+
+	if config.ContainerVersionImmutability && !isVersionImmutabilityEnabled(properties) {
+		// existing containers have to be migrated to version-level immutability, it can't be disabled afterwards
+		poller, err := client.BeginObjectLevelWorm(ctx, resourceGroupName, storageAccountName, storageAccountContainer, nil)
+		if err != nil {
+			log.Error(err, "client.BeginObjectLevelWorm")
+			return "", err
+		}
+
+		_, err = poller.PollUntilDone(ctx, nil)
+		if err != nil {
+			log.Error(err, "poller.PollUntilDone")
+			return "", err
+		}
+	}
+
+	err = setStorageAccountContainerImmutability(ctx, clients, config, properties)
+	if err != nil {
+		return "", err
+	}
+
+	log.Info("Azure Storage Account Container updated", "storageAccountContainer", storageAccountContainer, "reason", state.Reason)
+
+	updatedState, err := getStorageAccountContainerState(ctx, clients, config)
+	if err != nil {
+		return "", err
+	}
+
+	if updatedState.Status != resourceStatusPresent {
+		log.Info("Azure Storage Account Container still does not match the configuration", "storageAccountContainer", storageAccountContainer, "reason", updatedState.Reason)
+	}
+
+	return stepResultUpdated, nil
+}
+
+// setStorageAccountContainerImmutability sets the time-based immutability policy and the legal hold tags of the container (if they differ) or returns error
+func setStorageAccountContainerImmutability(ctx context.Context, clients *clientFactory, config azureConfig, properties *armstorage.ContainerProperties) error {
+	resourceGroupName := config.ResourceGroupName
+	storageAccountName := config.StorageAccountName
+	storageAccountContainer := config.StorageAccountContainer
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	client, err := clients.blobContainersClient()
+	if err != nil {
+		log.Error(err, "armstorage.NewBlobContainersClient")
+		return err
+	}
+
+	if config.ContainerRetentionDays > 0 && immutabilityPolicyDays(properties) != config.ContainerRetentionDays {
+		if isImmutabilityPolicyLocked(properties) {
+			log.Info("Azure Storage Account Container immutability policy is locked and can't be updated", "storageAccountContainer", storageAccountContainer, "retentionDays", immutabilityPolicyDays(properties))
+		} else {
+			options := &armstorage.BlobContainersClientCreateOrUpdateImmutabilityPolicyOptions{
+				Parameters: &armstorage.ImmutabilityPolicy{
+					Properties: &armstorage.ImmutabilityPolicyProperty{
+						ImmutabilityPeriodSinceCreationInDays: to.Ptr(int32(config.ContainerRetentionDays)),
+						AllowProtectedAppendWrites:            to.Ptr(false),
+					},
+				},
+			}
+			if properties.ImmutabilityPolicy != nil && properties.ImmutabilityPolicy.Etag != nil {
+				options.IfMatch = properties.ImmutabilityPolicy.Etag
+			}
+
+			_, err = client.CreateOrUpdateImmutabilityPolicy(ctx, resourceGroupName, storageAccountName, storageAccountContainer, options)
+			if err != nil {
+				log.Error(err, "client.CreateOrUpdateImmutabilityPolicy")
+				return err
+			}
+		}
+	}
+
+	missingTags := getMissingLegalHoldTags(config, properties)
+	if len(missingTags) > 0 {
+		_, err = client.SetLegalHold(ctx, resourceGroupName, storageAccountName, storageAccountContainer, armstorage.LegalHold{
+			Tags: to.SliceOfPtrs(missingTags...),
+		}, nil)
+		if err != nil {
+			log.Error(err, "client.SetLegalHold")
+			return err
+		}
+	}
+
+	return nil
+}
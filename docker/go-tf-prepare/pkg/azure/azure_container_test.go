@@ -0,0 +1,205 @@
+package azure
+
+import (
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/xenitab/github-actions/docker/go-tf-prepare/pkg/azure/fake"
+)
+
+const testContainerID = testStorageAccountID + "/blobServices/default/containers/tfstate"
+
+// getTestContainerProperties returns the properties of the container stored by the fake
+func getTestContainerProperties(t *testing.T, server *fake.ARM) map[string]any {
+	t.Helper()
+
+	container, ok := server.Resource(testContainerID)
+	if !ok {
+		t.Fatal("container wasn't created")
+	}
+
+	properties, _ := container["properties"].(map[string]any)
+	return properties
+}
+
+func testContainerRetentionDays(properties map[string]any) float64 {
+	policy, _ := properties["immutabilityPolicy"].(map[string]any)
+	policyProperties, _ := policy["properties"].(map[string]any)
+	days, _ := policyProperties["immutabilityPeriodSinceCreationInDays"].(float64)
+	return days
+}
+
+func TestStorageAccountContainerCreate(t *testing.T) {
+	ctx := newTestContext(t)
+	server, clients := newTestClients(t)
+
+	config := newTestConfig(t,
+		"--blob-versioning",
+		"--container-version-immutability",
+		"--container-retention-days", "30",
+		"--container-legal-hold-tag", "hold1",
+		"--storage-account-container-metadata", "env=dev",
+	)
+	err := runAction(ctx, clients, config, io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	properties := getTestContainerProperties(t, server)
+	metadata, _ := properties["metadata"].(map[string]any)
+	if metadata["env"] != "dev" {
+		t.Errorf("metadata is %v, expected env=dev", metadata)
+	}
+	versioning, _ := properties["immutableStorageWithVersioning"].(map[string]any)
+	if versioning["enabled"] != true {
+		t.Errorf("version-level immutability is %v, expected it to be enabled", versioning)
+	}
+	if days := testContainerRetentionDays(properties); days != 30 {
+		t.Errorf("retention is %v days, expected 30", days)
+	}
+	legalHold, _ := properties["legalHold"].(map[string]any)
+	tags, _ := legalHold["tags"].([]any)
+	if len(tags) != 1 {
+		t.Errorf("legal hold tags are %v, expected hold1", tags)
+	}
+
+	state, err := getStorageAccountContainerState(ctx, clients, config)
+	if err != nil {
+		t.Fatalf("getStorageAccountContainerState: %v", err)
+	}
+	if state.Status != resourceStatusPresent {
+		t.Errorf("status is %s (%s), expected %s", state.Status, state.Reason, resourceStatusPresent)
+	}
+}
+
+func TestStorageAccountContainerMetadataRequiresReconcile(t *testing.T) {
+	ctx := newTestContext(t)
+	server, clients := newTestClients(t)
+
+	err := runAction(ctx, clients, newTestConfig(t, "--storage-account-container-metadata", "owner=team-a"), io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	config := newTestConfig(t, "--storage-account-container-metadata", "env=dev")
+	state, err := getStorageAccountContainerState(ctx, clients, config)
+	if err != nil {
+		t.Fatalf("getStorageAccountContainerState: %v", err)
+	}
+	if state.Status != resourceStatusPresent {
+		t.Errorf("status without reconcile is %s (%s), expected %s", state.Status, state.Reason, resourceStatusPresent)
+	}
+
+	skip := len(server.Requests())
+	err = runAction(ctx, clients, config, io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+	for _, request := range writeRequests(server, skip) {
+		t.Errorf("run without reconcile sent %s %s", request.Method, request.Path)
+	}
+
+	config = newTestConfig(t, "--storage-account-container-metadata", "env=dev", "--reconcile")
+	state, err = getStorageAccountContainerState(ctx, clients, config)
+	if err != nil {
+		t.Fatalf("getStorageAccountContainerState: %v", err)
+	}
+	if state.Status != resourceStatusMisconfigured || state.Reason != "metadata env is missing" {
+		t.Errorf("status with reconcile is %s (%s), expected %s (metadata env is missing)", state.Status, state.Reason, resourceStatusMisconfigured)
+	}
+
+	err = runAction(ctx, clients, config, io.Discard)
+	if err != nil {
+		t.Fatalf("runAction with reconcile: %v", err)
+	}
+
+	metadata, _ := getTestContainerProperties(t, server)["metadata"].(map[string]any)
+	if metadata["env"] != "dev" || metadata["owner"] != "team-a" {
+		t.Errorf("metadata is %v, expected env=dev and the existing owner=team-a", metadata)
+	}
+}
+
+func TestStorageAccountContainerMigrate(t *testing.T) {
+	ctx := newTestContext(t)
+	server, clients := newTestClients(t)
+
+	err := runAction(ctx, clients, newTestConfig(t, "--blob-versioning"), io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	config := newTestConfig(t, "--blob-versioning", "--container-version-immutability", "--container-retention-days", "7", "--reconcile")
+	state, err := getStorageAccountContainerState(ctx, clients, config)
+	if err != nil {
+		t.Fatalf("getStorageAccountContainerState: %v", err)
+	}
+	if state.Status != resourceStatusMisconfigured || !strings.Contains(state.Reason, "version-level immutability is disabled") {
+		t.Errorf("status is %s (%s), expected version-level immutability to be disabled", state.Status, state.Reason)
+	}
+
+	skip := len(server.Requests())
+	err = runAction(ctx, clients, config, io.Discard)
+	if err != nil {
+		t.Fatalf("runAction with reconcile: %v", err)
+	}
+
+	migrated := slices.ContainsFunc(writeRequests(server, skip), func(request fake.Request) bool {
+		return request.Method == http.MethodPost && strings.EqualFold(request.Path, testContainerID+"/migrate")
+	})
+	if !migrated {
+		t.Error("existing container wasn't migrated to version-level immutability")
+	}
+
+	properties := getTestContainerProperties(t, server)
+	versioning, _ := properties["immutableStorageWithVersioning"].(map[string]any)
+	if versioning["enabled"] != true {
+		t.Errorf("version-level immutability is %v, expected it to be enabled", versioning)
+	}
+	if days := testContainerRetentionDays(properties); days != 7 {
+		t.Errorf("retention is %v days, expected 7", days)
+	}
+}
+
+func TestStorageAccountContainerImmutabilityPolicy(t *testing.T) {
+	ctx := newTestContext(t)
+	server, clients := newTestClients(t)
+
+	err := runAction(ctx, clients, newTestConfig(t, "--blob-versioning", "--container-version-immutability", "--container-retention-days", "7"), io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	// the fake rejects updates of the policy without the current ETag
+	err = runAction(ctx, clients, newTestConfig(t, "--blob-versioning", "--container-version-immutability", "--container-retention-days", "14", "--reconcile"), io.Discard)
+	if err != nil {
+		t.Fatalf("runAction with reconcile: %v", err)
+	}
+	if days := testContainerRetentionDays(getTestContainerProperties(t, server)); days != 14 {
+		t.Fatalf("retention is %v days, expected the unlocked policy to be updated to 14", days)
+	}
+
+	container, _ := server.Resource(testContainerID)
+	properties, _ := container["properties"].(map[string]any)
+	policy, _ := properties["immutabilityPolicy"].(map[string]any)
+	policyProperties, _ := policy["properties"].(map[string]any)
+	policyProperties["state"] = "Locked"
+	server.PutResource(testContainerID, container)
+
+	skip := len(server.Requests())
+	err = runAction(ctx, clients, newTestConfig(t, "--blob-versioning", "--container-version-immutability", "--container-retention-days", "30", "--reconcile"), io.Discard)
+	if err != nil {
+		t.Fatalf("runAction with a locked policy: %v", err)
+	}
+
+	for _, request := range writeRequests(server, skip) {
+		if strings.Contains(strings.ToLower(request.Path), "/immutabilitypolicies/") {
+			t.Errorf("locked policy was updated with %s %s", request.Method, request.Path)
+		}
+	}
+	if days := testContainerRetentionDays(getTestContainerProperties(t, server)); days != 14 {
+		t.Errorf("retention is %v days, expected the locked policy to stay at 14", days)
+	}
+}
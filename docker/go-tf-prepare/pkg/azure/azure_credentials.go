@@ -0,0 +1,154 @@
+package azure
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/go-logr/logr"
+)
+
+const (
+	credentialWorkloadIdentity = "workload-identity"
+	credentialEnvironment      = "environment"
+	credentialMSI              = "msi"
+	credentialAzureCLI         = "cli"
+)
+
+// credentialProbeTimeout limits how long a credential may take to get its first token,
+// managed identity retries for a long time when there is no identity endpoint
+const credentialProbeTimeout = 30 * time.Second
+
+// tokenClaims are the claims identifying the caller in an Azure AD access token
+type tokenClaims struct {
+	TenantID string `json:"tid"`
+	ObjectID string `json:"oid"`
+	AppID    string `json:"appid"`
+	// AuthorizedParty is the app ID in v2.0 tokens
+	AuthorizedParty string `json:"azp"`
+}
+
+// getCredentials returns the first credential in the configured order that can get a token for Azure Resource Manager
+func getCredentials(ctx context.Context, config azureConfig, environment cloudEnvironment, options *arm.ClientOptions) (azcore.TokenCredential, error) {
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	scope := resourceManagerScope(environment.Configuration)
+
+	errs := []error{}
+	for _, name := range config.CredentialOrder {
+		if isCredentialExcluded(config, name) {
+			log.V(1).Info("Credential excluded", "credential", name)
+			continue
+		}
+
+		cred, err := newCredential(config, environment, options, name)
+		if err != nil {
+			log.Info("Credential could not be created", "credential", name, "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+
+		claims, err := probeCredential(ctx, cred, scope)
+		if err != nil {
+			log.Info("Credential could not get a token", "credential", name, "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+
+		log.Info("Using credential", "credential", name, "tenantID", claims.TenantID, "objectID", claims.ObjectID, "appID", claims.appID())
+		return cred, nil
+	}
+
+	err = fmt.Errorf("no credentials found: %w", errors.Join(errs...))
+	log.Error(err, "all tested credentials failed")
+	return nil, err
+}
+
+func isCredentialExcluded(config azureConfig, name string) bool {
+	switch name {
+	case credentialWorkloadIdentity:
+		return config.ExcludeWorkloadIdentityCredential
+	case credentialEnvironment:
+		return config.ExcludeEnvironmentCredential
+	case credentialMSI:
+		return config.ExcludeMSICredential
+	case credentialAzureCLI:
+		return config.ExcludeAzureCLICredential
+	}
+
+	return true
+}
+
+func newCredential(config azureConfig, environment cloudEnvironment, options *arm.ClientOptions, name string) (azcore.TokenCredential, error) {
+	switch name {
+	case credentialWorkloadIdentity:
+		return newWorkloadIdentityCredential(config, environment, options)
+	case credentialEnvironment:
+		return azidentity.NewEnvironmentCredential(&azidentity.EnvironmentCredentialOptions{
+			ClientOptions: credentialClientOptions(environment, options),
+			// instance discovery only knows about the Azure clouds
+			DisableInstanceDiscovery: environment.Custom,
+		})
+	case credentialMSI:
+		return azidentity.NewManagedIdentityCredential(&azidentity.ManagedIdentityCredentialOptions{
+			ClientOptions: credentialClientOptions(environment, options),
+		})
+	case credentialAzureCLI:
+		return azidentity.NewAzureCLICredential(nil)
+	}
+
+	return nil, fmt.Errorf("unknown credential %q", name)
+}
+
+// probeCredential gets a token with the credential and returns the claims identifying the caller
+func probeCredential(ctx context.Context, cred azcore.TokenCredential, scope string) (tokenClaims, error) {
+	ctx, cancel := context.WithTimeout(ctx, credentialProbeTimeout)
+	defer cancel()
+
+	token, err := cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{scope}})
+	if err != nil {
+		return tokenClaims{}, err
+	}
+
+	return parseTokenClaims(token.Token)
+}
+
+// parseTokenClaims reads the claims of a JWT access token, without validating it
+func parseTokenClaims(token string) (tokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) < 2 {
+		return tokenClaims{}, fmt.Errorf("access token is not a JWT")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return tokenClaims{}, fmt.Errorf("unable to decode access token claims: %w", err)
+	}
+
+	claims := tokenClaims{}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return tokenClaims{}, fmt.Errorf("unable to parse access token claims: %w", err)
+	}
+
+	return claims, nil
+}
+
+func (c tokenClaims) appID() string {
+	if c.AppID != "" {
+		return c.AppID
+	}
+
+	return c.AuthorizedParty
+}
@@ -0,0 +1,135 @@
+package azure
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+)
+
+func TestGetCredentials(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	err := os.WriteFile(tokenFile, []byte("file-token"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missingTokenFile := filepath.Join(t.TempDir(), "missing")
+
+	cases := []struct {
+		name     string
+		args     []string
+		expected string
+		err      []string
+	}{
+		{
+			name:     "first credential in the order is used",
+			args:     []string{"--credential-order", "environment,workload-identity", "--federated-token-file", tokenFile},
+			expected: credentialEnvironment,
+		},
+		{
+			name:     "order is configurable",
+			args:     []string{"--credential-order", "workload-identity,environment", "--federated-token-file", tokenFile},
+			expected: credentialWorkloadIdentity,
+		},
+		{
+			name:     "excluded credentials are skipped",
+			args:     []string{"--credential-order", "environment,workload-identity", "--exclude-environment-credential", "--federated-token-file", tokenFile},
+			expected: credentialWorkloadIdentity,
+		},
+		{
+			name:     "credentials that can't get a token are skipped",
+			args:     []string{"--credential-order", "workload-identity,environment", "--federated-token-file", missingTokenFile},
+			expected: credentialEnvironment,
+		},
+		{
+			name: "every failure is reported",
+			args: []string{"--credential-order", "workload-identity,environment,msi", "--exclude-environment-credential", "--exclude-msi-credential", "--federated-token-file", missingTokenFile},
+			err:  []string{"no credentials found", "workload-identity: ", "missing"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			t.Setenv("AZURE_TENANT_ID", testTenantID)
+			t.Setenv("AZURE_CLIENT_ID", testClientID)
+			t.Setenv("AZURE_CLIENT_SECRET", "secret")
+			t.Setenv(githubActionsIDTokenRequestURL, "")
+			t.Setenv(githubActionsIDTokenRequestToken, "")
+
+			environment, options, _ := newTestTokenServer(t)
+			config := newTestConfig(t, append([]string{"--exclude-workload-identity-credential=false", "--exclude-environment-credential=false", "--exclude-cli-credential"}, c.args...)...)
+
+			cred, err := getCredentials(newTestContext(t), config, environment, options)
+			if len(c.err) > 0 {
+				if err == nil {
+					t.Fatal("getCredentials didn't fail")
+				}
+				for _, expected := range c.err {
+					if !strings.Contains(err.Error(), expected) {
+						t.Errorf("error %q doesn't contain %q", err, expected)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getCredentials: %v", err)
+			}
+
+			actual := ""
+			switch cred.(type) {
+			case *azidentity.EnvironmentCredential:
+				actual = credentialEnvironment
+			case *azidentity.ClientAssertionCredential:
+				actual = credentialWorkloadIdentity
+			}
+			if actual != c.expected {
+				t.Errorf("credential is %T, expected %s", cred, c.expected)
+			}
+		})
+	}
+}
+
+func TestParseTokenClaims(t *testing.T) {
+	cases := []struct {
+		name     string
+		token    string
+		expected tokenClaims
+		err      bool
+	}{
+		{
+			name:     "v1.0 token",
+			token:    "e30.eyJ0aWQiOiJ0ZW5hbnQiLCJvaWQiOiJvYmplY3QiLCJhcHBpZCI6ImFwcCJ9.",
+			expected: tokenClaims{TenantID: "tenant", ObjectID: "object", AppID: "app"},
+		},
+		{
+			name:     "v2.0 token",
+			token:    "e30.eyJ0aWQiOiJ0ZW5hbnQiLCJvaWQiOiJvYmplY3QiLCJhenAiOiJhcHAifQ.",
+			expected: tokenClaims{TenantID: "tenant", ObjectID: "object", AuthorizedParty: "app"},
+		},
+		{
+			name:  "not a JWT",
+			token: "opaque",
+			err:   true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			claims, err := parseTokenClaims(c.token)
+			if c.err {
+				if err == nil {
+					t.Errorf("parseTokenClaims returned %+v, expected an error", claims)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseTokenClaims: %v", err)
+			}
+			if claims != c.expected || claims.appID() != "app" {
+				t.Errorf("claims are %+v, expected %+v", claims, c.expected)
+			}
+		})
+	}
+}
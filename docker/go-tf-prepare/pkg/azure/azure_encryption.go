@@ -0,0 +1,334 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/keyvault/armkeyvault"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/msi/armmsi"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/storage/armstorage"
+	"github.com/go-logr/logr"
+	"github.com/xenitab/github-actions/docker/go-tf-prepare/pkg/azure/internal/azerrors"
+)
+
+// storageAccountKeyRoleName is the role the storage account identity needs to wrap and unwrap with the key when using rbac authorization
+const storageAccountKeyRoleName = "Key Vault Crypto Service Encryption User"
+
+// storageAccountIdentityName returns the name of the user-assigned identity used by the storage account to access the key
+func storageAccountIdentityName(config azureConfig) string {
+	if config.StorageAccountIdentityName != "" {
+		return config.StorageAccountIdentityName
+	}
+
+	return fmt.Sprintf("id-%s", config.StorageAccountName)
+}
+
+// CreateStorageAccountIdentity creates Azure User Assigned Identity for the Storage Account (if it doesn't exist) or returns error
+func CreateStorageAccountIdentity(ctx context.Context, clients *clientFactory, config azureConfig) (stepResult, error) {
+	resourceGroupName := config.ResourceGroupName
+	resourceGroupLocation := config.ResourceGroupLocation
+	identityName := storageAccountIdentityName(config)
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	identity, err := getStorageAccountIdentity(ctx, clients, config)
+	if err != nil {
+		return "", err
+	}
+
+	if identity != nil {
+		log.Info("Azure User Assigned Identity already exists", "identityName", identityName)
+		return stepResultUnchanged, nil
+	}
+
+	err = registerResourceProviderIfNeeded(ctx, clients, config, "Microsoft.ManagedIdentity")
+	if err != nil {
+		return "", err
+	}
+
+	client, err := clients.userAssignedIdentitiesClient()
+	if err != nil {
+		log.Error(err, "armmsi.NewUserAssignedIdentitiesClient")
+		return "", err
+	}
+
+	_, err = client.CreateOrUpdate(ctx, resourceGroupName, identityName, armmsi.Identity{
+		Location: to.Ptr(resourceGroupLocation),
+		Tags:     resourceTags(config),
+	}, nil)
+	if err != nil {
+		log.Error(err, "client.CreateOrUpdate")
+		return "", err
+	}
+
+	log.Info("Azure User Assigned Identity created", "identityName", identityName)
+	return stepResultCreated, nil
+}
+
+func getStorageAccountIdentityState(ctx context.Context, clients *clientFactory, config azureConfig) (resourceState, error) {
+	identity, err := getStorageAccountIdentity(ctx, clients, config)
+	if err != nil {
+		return resourceState{}, err
+	}
+
+	if identity == nil {
+		return resourceState{Status: resourceStatusMissing}, nil
+	}
+
+	return resourceState{Status: resourceStatusPresent}, nil
+}
+
+// getStorageAccountIdentity returns the user-assigned identity of the Storage Account, or nil if it doesn't exist
+func getStorageAccountIdentity(ctx context.Context, clients *clientFactory, config azureConfig) (*armmsi.Identity, error) {
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := clients.userAssignedIdentitiesClient()
+	if err != nil {
+		log.Error(err, "armmsi.NewUserAssignedIdentitiesClient")
+		return nil, err
+	}
+
+	res, err := client.Get(ctx, config.ResourceGroupName, storageAccountIdentityName(config), nil)
+	if azerrors.IsNotFound(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		log.Error(err, "client.Get")
+		return nil, err
+	}
+
+	if res.Identity.ID == nil || res.Identity.Properties == nil || res.Identity.Properties.PrincipalID == nil {
+		return nil, fmt.Errorf("Azure User Assigned Identity %s has no principal ID", storageAccountIdentityName(config))
+	}
+
+	return &res.Identity, nil
+}
+
+// CreateStorageAccountKeyAccess gives the Storage Account identity access to wrap and unwrap with the Azure Key Vault Key (if it doesn't have it) or returns error
+func CreateStorageAccountKeyAccess(ctx context.Context, clients *clientFactory, config azureConfig) (stepResult, error) {
+	identity, err := getStorageAccountIdentity(ctx, clients, config)
+	if err != nil {
+		return "", err
+	}
+
+	if identity == nil {
+		return "", fmt.Errorf("Azure User Assigned Identity %s doesn't exist", storageAccountIdentityName(config))
+	}
+
+	principalID := *identity.Properties.PrincipalID
+	if config.KeyVaultAuthorization == keyVaultAuthorizationRBAC {
+		return createRoleAssignment(ctx, clients, keyVaultScope(clients, config), storageAccountKeyRoleName, principalID)
+	}
+
+	return createKeyVaultAccessPolicy(ctx, clients, config, principalID, storageAccountKeyPermissions())
+}
+
+func getStorageAccountKeyAccessState(ctx context.Context, clients *clientFactory, config azureConfig) (resourceState, error) {
+	identity, err := getStorageAccountIdentity(ctx, clients, config)
+	if err != nil {
+		return resourceState{}, err
+	}
+
+	if identity == nil {
+		return parentMissingState(resourceKindStorageAccountIdentity), nil
+	}
+
+	principalID := *identity.Properties.PrincipalID
+	if config.KeyVaultAuthorization == keyVaultAuthorizationRBAC {
+		return getRoleAssignmentState(ctx, clients, keyVaultScope(clients, config), storageAccountKeyRoleName, principalID)
+	}
+
+	return getKeyVaultAccessPolicyStateForPermissions(ctx, clients, config, principalID, storageAccountKeyPermissions())
+}
+
+func storageAccountKeyPermissions() armkeyvault.Permissions {
+	return armkeyvault.Permissions{
+		Keys: []*armkeyvault.KeyPermissions{
+			to.Ptr(armkeyvault.KeyPermissionsGet),
+			to.Ptr(armkeyvault.KeyPermissionsWrapKey),
+			to.Ptr(armkeyvault.KeyPermissionsUnwrapKey),
+		},
+	}
+}
+
+// ConfigureStorageAccountEncryption configures the Storage Account to encrypt with the Azure Key Vault Key (if it isn't already) or returns error
+func ConfigureStorageAccountEncryption(ctx context.Context, clients *clientFactory, config azureConfig) (stepResult, error) {
+	resourceGroupName := config.ResourceGroupName
+	storageAccountName := config.StorageAccountName
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	state, err := getStorageAccountEncryptionState(ctx, clients, config)
+	if err != nil {
+		return "", err
+	}
+
+	if state.Status == resourceStatusPresent {
+		log.Info("Azure Storage Account already encrypted with customer-managed key", "storageAccountName", storageAccountName)
+		return stepResultUnchanged, nil
+	}
+
+	// a storage account created in this run is always pointed to the key, an existing one only with reconcile
+	if state.Status == resourceStatusMisconfigured && !config.Reconcile && !isDependencyCreated(ctx) {
+		log.Info("Azure Storage Account customer-managed key does not match the configuration, use reconcile to update it", "storageAccountName", storageAccountName, "reason", state.Reason)
+		return stepResultUnchanged, nil
+	}
+
+	identity, err := getStorageAccountIdentity(ctx, clients, config)
+	if err != nil {
+		return "", err
+	}
+
+	if identity == nil {
+		return "", fmt.Errorf("Azure User Assigned Identity %s doesn't exist", storageAccountIdentityName(config))
+	}
+
+	keyVaultURL, err := getKeyVaultURL(ctx, clients, config)
+	if err != nil {
+		return "", err
+	}
+
+	client, err := clients.accountsClient()
+	if err != nil {
+		log.Error(err, "armstorage.NewAccountsClient")
+		return "", err
+	}
+
+	account, err := client.GetProperties(ctx, resourceGroupName, storageAccountName, nil)
+	if err != nil {
+		log.Error(err, "client.GetProperties")
+		return "", err
+	}
+
+	// infrastructure encryption can't be changed, the current setting is kept
+	var requireInfrastructureEncryption *bool
+	if account.Account.Properties != nil && account.Account.Properties.Encryption != nil {
+		requireInfrastructureEncryption = account.Account.Properties.Encryption.RequireInfrastructureEncryption
+	}
+
+	_, err = client.Update(ctx, resourceGroupName, storageAccountName, armstorage.AccountUpdateParameters{
+		Identity: storageAccountIdentityWith(account.Account.Identity, *identity.ID),
+		Properties: &armstorage.AccountPropertiesUpdateParameters{
+			Encryption: &armstorage.Encryption{
+				KeySource: to.Ptr(armstorage.KeySourceMicrosoftKeyvault),
+				// without a key version the storage account uses the latest version of the key
+				KeyVaultProperties: &armstorage.KeyVaultProperties{
+					KeyName:     to.Ptr(config.KeyVaultKeyName),
+					KeyVaultURI: to.Ptr(keyVaultURL),
+				},
+				EncryptionIdentity: &armstorage.EncryptionIdentity{
+					EncryptionUserAssignedIdentity: identity.ID,
+				},
+				RequireInfrastructureEncryption: requireInfrastructureEncryption,
+				Services: &armstorage.EncryptionServices{
+					Blob: &armstorage.EncryptionService{Enabled: to.Ptr(true), KeyType: to.Ptr(armstorage.KeyTypeAccount)},
+					File: &armstorage.EncryptionService{Enabled: to.Ptr(true), KeyType: to.Ptr(armstorage.KeyTypeAccount)},
+				},
+			},
+		},
+	}, nil)
+	if err != nil {
+		log.Error(err, "client.Update")
+		return "", err
+	}
+
+	log.Info("Azure Storage Account encrypted with customer-managed key", "storageAccountName", storageAccountName, "keyName", config.KeyVaultKeyName)
+
+	if state.Status == resourceStatusMisconfigured {
+		return stepResultUpdated, nil
+	}
+
+	return stepResultCreated, nil
+}
+
+func getStorageAccountEncryptionState(ctx context.Context, clients *clientFactory, config azureConfig) (resourceState, error) {
+	resourceGroupName := config.ResourceGroupName
+	storageAccountName := config.StorageAccountName
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return resourceState{}, err
+	}
+
+	client, err := clients.accountsClient()
+	if err != nil {
+		log.Error(err, "armstorage.NewAccountsClient")
+		return resourceState{}, err
+	}
+
+	res, err := client.GetProperties(ctx, resourceGroupName, storageAccountName, nil)
+	if err != nil {
+		log.Error(err, "client.GetProperties")
+		return resourceState{}, err
+	}
+
+	var encryption *armstorage.Encryption
+	if res.Account.Properties != nil {
+		encryption = res.Account.Properties.Encryption
+	}
+
+	if encryption == nil || encryption.KeySource == nil || *encryption.KeySource != armstorage.KeySourceMicrosoftKeyvault {
+		return resourceState{Status: resourceStatusMissing, Reason: "encrypted with Microsoft-managed keys"}, nil
+	}
+
+	identity, err := getStorageAccountIdentity(ctx, clients, config)
+	if err != nil {
+		return resourceState{}, err
+	}
+
+	keyVaultURL, err := getKeyVaultURL(ctx, clients, config)
+	if err != nil {
+		return resourceState{}, err
+	}
+
+	keyVaultProperties := encryption.KeyVaultProperties
+	if keyVaultProperties == nil || keyVaultProperties.KeyName == nil || *keyVaultProperties.KeyName != config.KeyVaultKeyName {
+		return resourceState{Status: resourceStatusMisconfigured, Reason: "encrypted with another key"}, nil
+	}
+
+	if keyVaultProperties.KeyVaultURI == nil || !strings.EqualFold(strings.TrimSuffix(*keyVaultProperties.KeyVaultURI, "/"), strings.TrimSuffix(keyVaultURL, "/")) {
+		return resourceState{Status: resourceStatusMisconfigured, Reason: "encrypted with a key in another key vault"}, nil
+	}
+
+	if keyVaultProperties.KeyVersion != nil && *keyVaultProperties.KeyVersion != "" {
+		return resourceState{Status: resourceStatusMisconfigured, Reason: "key version is pinned"}, nil
+	}
+
+	encryptionIdentity := encryption.EncryptionIdentity
+	if identity == nil || encryptionIdentity == nil || encryptionIdentity.EncryptionUserAssignedIdentity == nil || !strings.EqualFold(*encryptionIdentity.EncryptionUserAssignedIdentity, *identity.ID) {
+		return resourceState{Status: resourceStatusMisconfigured, Reason: "encryption identity differs"}, nil
+	}
+
+	return resourceState{Status: resourceStatusPresent}, nil
+}
+
+// storageAccountIdentityWith returns the identity of the Storage Account with the user-assigned identity added,
+// keeping the system-assigned and user-assigned identities it already has
+func storageAccountIdentityWith(current *armstorage.Identity, identityID string) *armstorage.Identity {
+	identity := &armstorage.Identity{
+		Type:                   to.Ptr(armstorage.IdentityTypeUserAssigned),
+		UserAssignedIdentities: map[string]*armstorage.UserAssignedIdentity{},
+	}
+
+	if current != nil {
+		if current.Type != nil && strings.Contains(string(*current.Type), string(armstorage.IdentityTypeSystemAssigned)) {
+			identity.Type = to.Ptr(armstorage.IdentityTypeSystemAssignedUserAssigned)
+		}
+
+		for id := range current.UserAssignedIdentities {
+			identity.UserAssignedIdentities[id] = &armstorage.UserAssignedIdentity{}
+		}
+	}
+
+	identity.UserAssignedIdentities[identityID] = &armstorage.UserAssignedIdentity{}
+	return identity
+}
@@ -0,0 +1,58 @@
+package azure
+
+import (
+	"io"
+	"testing"
+)
+
+const testStorageAccountID = "/subscriptions/" + testSubscriptionID + "/resourceGroups/rg-test/providers/Microsoft.Storage/storageAccounts/satest"
+
+func TestStorageAccountEncryptionRequiresReconcile(t *testing.T) {
+	ctx := newTestContext(t)
+	server, clients := newTestClients(t)
+	args := []string{"--storage-account-cmk", "--keyvault-purge-protection", "--keyvault-key-operation", "wrapKey", "--keyvault-key-operation", "unwrapKey"}
+
+	config := newTestConfig(t, args...)
+	err := runAction(ctx, clients, config, io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	state, err := getStorageAccountEncryptionState(ctx, clients, config)
+	if err != nil {
+		t.Fatalf("getStorageAccountEncryptionState: %v", err)
+	}
+	if state.Status != resourceStatusPresent {
+		t.Fatalf("new Storage Account status is %s, expected %s: %s", state.Status, resourceStatusPresent, state.Reason)
+	}
+
+	account, _ := server.Resource(testStorageAccountID)
+	properties, _ := account["properties"].(map[string]any)
+	encryption, _ := properties["encryption"].(map[string]any)
+	keyVaultProperties, _ := encryption["keyvaultproperties"].(map[string]any)
+	keyVaultProperties["keyname"] = "other"
+	server.PutResource(testStorageAccountID, account)
+
+	skip := len(server.Requests())
+	err = runAction(ctx, clients, config, io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	for _, request := range writeRequests(server, skip) {
+		t.Errorf("run without reconcile sent %s %s", request.Method, request.Path)
+	}
+
+	err = runAction(ctx, clients, newTestConfig(t, append(args, "--reconcile")...), io.Discard)
+	if err != nil {
+		t.Fatalf("runAction with reconcile: %v", err)
+	}
+
+	state, err = getStorageAccountEncryptionState(ctx, clients, config)
+	if err != nil {
+		t.Fatalf("getStorageAccountEncryptionState: %v", err)
+	}
+	if state.Status != resourceStatusPresent {
+		t.Errorf("status after reconcile is %s, expected %s: %s", state.Status, resourceStatusPresent, state.Reason)
+	}
+}
@@ -0,0 +1,406 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/keyvault/armkeyvault"
+	"github.com/Azure/azure-sdk-for-go/sdk/security/keyvault/azkeys"
+	"github.com/go-logr/logr"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// sopsFileReference is a SOPS encrypted file with the version of the Azure Key Vault Key it is encrypted with
+type sopsFileReference struct {
+	File       string
+	KeyVersion string
+}
+
+// sopsMetadata is the part of the SOPS metadata of an encrypted file used to find the Azure Key Vault Keys
+type sopsMetadata struct {
+	Sops struct {
+		AzureKV []struct {
+			VaultURL string `yaml:"vault_url"`
+			Name     string `yaml:"name"`
+			Version  string `yaml:"version"`
+		} `yaml:"azure_kv"`
+	} `yaml:"sops"`
+}
+
+// RotateKeyAction creates a new version of the Azure Key Vault Key and reports the SOPS files still using an older version
+func RotateKeyAction(ctx context.Context, cli *cli.Context) error {
+	config := newAzureConfig(cli)
+
+	err := config.Validate()
+	if err != nil {
+		return err
+	}
+
+	clients, err := getClientFactory(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	return rotateKey(ctx, clients, config, cli.String("sops-directory"), os.Stdout)
+}
+
+func rotateKey(ctx context.Context, clients *clientFactory, config azureConfig, sopsDirectory string, w io.Writer) error {
+	keyName := config.KeyVaultKeyName
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	// checked before the key is rotated, so that a wrong directory doesn't create an extra version
+	_, err = os.Stat(sopsDirectory)
+	if err != nil {
+		return err
+	}
+
+	vaultURL, err := getKeyVaultURL(ctx, clients, config)
+	if err != nil {
+		return err
+	}
+
+	client, err := clients.keysDataClient(vaultURL)
+	if err != nil {
+		log.Error(err, "azkeys.NewClient")
+		return err
+	}
+
+	res, err := client.CreateKey(ctx, keyName, keyVaultKeyCreateParameters(config), nil)
+	if err != nil {
+		log.Error(err, "client.CreateKey")
+		return err
+	}
+
+	if res.Key == nil || res.Key.KID == nil {
+		return fmt.Errorf("Azure KeyVault Key %s was created without a key ID", keyName)
+	}
+
+	// the version is the last segment of the key ID, https://<vault>/keys/<name>/<version>
+	keyVersion := path.Base(string(*res.Key.KID))
+	log.Info("Azure KeyVault Key version created", "keyName", keyName, "keyVersion", keyVersion)
+
+	references, err := findOutdatedSopsFiles(sopsDirectory, vaultURL, keyName, keyVersion)
+	if err != nil {
+		log.Error(err, "findOutdatedSopsFiles")
+		return err
+	}
+
+	if len(references) == 0 {
+		fmt.Fprintf(w, "No SOPS files in %s reference an older version of the key.\n", sopsDirectory)
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tKEY VERSION")
+	for _, reference := range references {
+		fmt.Fprintf(tw, "%s\t%s\n", reference.File, reference.KeyVersion)
+	}
+
+	return tw.Flush()
+}
+
+// findOutdatedSopsFiles returns the SOPS files in the directory encrypted with another version of the key
+func findOutdatedSopsFiles(directory, vaultURL, keyName, keyVersion string) ([]sopsFileReference, error) {
+	references := []sopsFileReference{}
+	err := filepath.WalkDir(directory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		// the JSON written by SOPS is valid YAML, other files are not SOPS encrypted
+		metadata := sopsMetadata{}
+		if yaml.Unmarshal(b, &metadata) != nil {
+			return nil
+		}
+
+		for _, key := range metadata.Sops.AzureKV {
+			if !strings.EqualFold(strings.TrimSuffix(key.VaultURL, "/"), strings.TrimSuffix(vaultURL, "/")) || !strings.EqualFold(key.Name, keyName) {
+				continue
+			}
+
+			if key.Version != keyVersion {
+				references = append(references, sopsFileReference{File: path, KeyVersion: key.Version})
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(references, func(i, j int) bool { return references[i].File < references[j].File })
+	return references, nil
+}
+
+func getKeyVaultURL(ctx context.Context, clients *clientFactory, config azureConfig) (string, error) {
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	client, err := clients.vaultsClient()
+	if err != nil {
+		return "", err
+	}
+
+	res, err := client.Get(ctx, config.ResourceGroupName, config.KeyVaultName, nil)
+	if err != nil {
+		log.Error(err, "client.Get")
+		return "", err
+	}
+
+	if res.Vault.Properties == nil || res.Vault.Properties.VaultURI == nil {
+		return "", fmt.Errorf("Azure KeyVault %s has no vault URI", config.KeyVaultName)
+	}
+
+	return *res.Vault.Properties.VaultURI, nil
+}
+
+// updateKeyVaultKeyRotationPolicy replaces the rotation policy of the existing Azure Key Vault Key
+func updateKeyVaultKeyRotationPolicy(ctx context.Context, clients *clientFactory, config azureConfig) error {
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	vaultURL, err := getKeyVaultURL(ctx, clients, config)
+	if err != nil {
+		return err
+	}
+
+	client, err := clients.keysDataClient(vaultURL)
+	if err != nil {
+		log.Error(err, "azkeys.NewClient")
+		return err
+	}
+
+	policy := azkeys.KeyRotationPolicy{
+		Attributes:      &azkeys.KeyRotationPolicyAttributes{},
+		LifetimeActions: []*azkeys.LifetimeAction{},
+	}
+
+	if config.KeyVaultKeyRotationExpiry != "" {
+		policy.Attributes.ExpiryTime = to.Ptr(config.KeyVaultKeyRotationExpiry)
+	}
+
+	if config.KeyVaultKeyRotateAfter != "" {
+		policy.LifetimeActions = append(policy.LifetimeActions, &azkeys.LifetimeAction{
+			Action:  &azkeys.LifetimeActionType{Type: to.Ptr(azkeys.KeyRotationPolicyActionRotate)},
+			Trigger: &azkeys.LifetimeActionTrigger{TimeAfterCreate: to.Ptr(config.KeyVaultKeyRotateAfter)},
+		})
+	}
+
+	if config.KeyVaultKeyNotifyBeforeExpiry != "" {
+		policy.LifetimeActions = append(policy.LifetimeActions, &azkeys.LifetimeAction{
+			Action:  &azkeys.LifetimeActionType{Type: to.Ptr(azkeys.KeyRotationPolicyActionNotify)},
+			Trigger: &azkeys.LifetimeActionTrigger{TimeBeforeExpiry: to.Ptr(config.KeyVaultKeyNotifyBeforeExpiry)},
+		})
+	}
+
+	_, err = client.UpdateKeyRotationPolicy(ctx, config.KeyVaultKeyName, policy, nil)
+	if err != nil {
+		log.Error(err, "client.UpdateKeyRotationPolicy")
+		return err
+	}
+
+	return nil
+}
+
+func keyVaultKeyProperties(config azureConfig) *armkeyvault.KeyProperties {
+	properties := &armkeyvault.KeyProperties{
+		Attributes: &armkeyvault.KeyAttributes{
+			Enabled: to.Ptr(true),
+			Expires: keyVaultKeyExpires(config),
+		},
+		KeyOps: []*armkeyvault.JSONWebKeyOperation{},
+		Kty:    to.Ptr(armkeyvault.JSONWebKeyType(config.KeyVaultKeyType)),
+	}
+
+	for _, operation := range config.KeyVaultKeyOperations {
+		properties.KeyOps = append(properties.KeyOps, to.Ptr(armkeyvault.JSONWebKeyOperation(operation)))
+	}
+
+	if isECKeyType(config.KeyVaultKeyType) {
+		properties.CurveName = to.Ptr(armkeyvault.JSONWebKeyCurveName(config.KeyVaultKeyCurve))
+	} else {
+		properties.KeySize = to.Ptr(int32(config.KeyVaultKeySize))
+	}
+
+	if isKeyRotationPolicyConfigured(config) {
+		properties.RotationPolicy = keyVaultKeyRotationPolicy(config)
+	}
+
+	return properties
+}
+
+func keyVaultKeyCreateParameters(config azureConfig) azkeys.CreateKeyParameters {
+	parameters := azkeys.CreateKeyParameters{
+		KeyAttributes: &azkeys.KeyAttributes{
+			Enabled: to.Ptr(true),
+		},
+		KeyOps: []*azkeys.KeyOperation{},
+		Kty:    to.Ptr(azkeys.KeyType(config.KeyVaultKeyType)),
+	}
+
+	if expires := keyVaultKeyExpires(config); expires != nil {
+		parameters.KeyAttributes.Expires = to.Ptr(time.Unix(*expires, 0))
+	}
+
+	for _, operation := range config.KeyVaultKeyOperations {
+		parameters.KeyOps = append(parameters.KeyOps, to.Ptr(azkeys.KeyOperation(operation)))
+	}
+
+	if isECKeyType(config.KeyVaultKeyType) {
+		parameters.Curve = to.Ptr(azkeys.CurveName(config.KeyVaultKeyCurve))
+	} else {
+		parameters.KeySize = to.Ptr(int32(config.KeyVaultKeySize))
+	}
+
+	return parameters
+}
+
+// keyVaultKeyExpires returns the expiry of a key created now in seconds since the epoch, or nil if keys don't expire
+func keyVaultKeyExpires(config azureConfig) *int64 {
+	if config.KeyVaultKeyExpiry == 0 {
+		return nil
+	}
+
+	return to.Ptr(time.Now().Add(config.KeyVaultKeyExpiry).Unix())
+}
+
+func isKeyRotationPolicyConfigured(config azureConfig) bool {
+	return config.KeyVaultKeyRotateAfter != "" || config.KeyVaultKeyNotifyBeforeExpiry != "" || config.KeyVaultKeyRotationExpiry != ""
+}
+
+// keyVaultKeyRotationPolicy returns the rotation policy of the key, the durations are in ISO 8601 format (for example P90D)
+func keyVaultKeyRotationPolicy(config azureConfig) *armkeyvault.RotationPolicy {
+	policy := &armkeyvault.RotationPolicy{
+		Attributes:      &armkeyvault.KeyRotationPolicyAttributes{},
+		LifetimeActions: []*armkeyvault.LifetimeAction{},
+	}
+
+	if config.KeyVaultKeyRotationExpiry != "" {
+		policy.Attributes.ExpiryTime = to.Ptr(config.KeyVaultKeyRotationExpiry)
+	}
+
+	if config.KeyVaultKeyRotateAfter != "" {
+		policy.LifetimeActions = append(policy.LifetimeActions, &armkeyvault.LifetimeAction{
+			Action:  &armkeyvault.Action{Type: to.Ptr(armkeyvault.KeyRotationPolicyActionTypeRotate)},
+			Trigger: &armkeyvault.Trigger{TimeAfterCreate: to.Ptr(config.KeyVaultKeyRotateAfter)},
+		})
+	}
+
+	if config.KeyVaultKeyNotifyBeforeExpiry != "" {
+		policy.LifetimeActions = append(policy.LifetimeActions, &armkeyvault.LifetimeAction{
+			Action:  &armkeyvault.Action{Type: to.Ptr(armkeyvault.KeyRotationPolicyActionTypeNotify)},
+			Trigger: &armkeyvault.Trigger{TimeBeforeExpiry: to.Ptr(config.KeyVaultKeyNotifyBeforeExpiry)},
+		})
+	}
+
+	return policy
+}
+
+// getKeyVaultKeyDifferences returns how the properties of the existing Azure Key Vault Key differ from the configuration
+func getKeyVaultKeyDifferences(config azureConfig, properties *armkeyvault.KeyProperties) (keyDifferences []string, rotationPolicyDifferences []string) {
+	if properties == nil {
+		return nil, nil
+	}
+
+	if properties.Kty != nil && !strings.EqualFold(string(*properties.Kty), config.KeyVaultKeyType) {
+		keyDifferences = append(keyDifferences, fmt.Sprintf("key type is %s", *properties.Kty))
+	}
+
+	if isECKeyType(config.KeyVaultKeyType) {
+		if properties.CurveName != nil && !strings.EqualFold(string(*properties.CurveName), config.KeyVaultKeyCurve) {
+			keyDifferences = append(keyDifferences, fmt.Sprintf("curve is %s", *properties.CurveName))
+		}
+	} else if properties.KeySize != nil && int(*properties.KeySize) != config.KeyVaultKeySize {
+		keyDifferences = append(keyDifferences, fmt.Sprintf("key size is %d", *properties.KeySize))
+	}
+
+	keyOps := []string{}
+	for _, operation := range properties.KeyOps {
+		if operation != nil {
+			keyOps = append(keyOps, string(*operation))
+		}
+	}
+	if properties.KeyOps != nil && !stringSetsEqual(keyOps, config.KeyVaultKeyOperations) {
+		keyDifferences = append(keyDifferences, fmt.Sprintf("key operations are %s", strings.Join(keyOps, ", ")))
+	}
+
+	if isKeyRotationPolicyConfigured(config) && !keyRotationPolicyEqual(properties.RotationPolicy, keyVaultKeyRotationPolicy(config)) {
+		rotationPolicyDifferences = append(rotationPolicyDifferences, "rotation policy differs")
+	}
+
+	return keyDifferences, rotationPolicyDifferences
+}
+
+func keyRotationPolicyEqual(a, b *armkeyvault.RotationPolicy) bool {
+	values := func(policy *armkeyvault.RotationPolicy) []string {
+		values := []string{}
+		if policy == nil {
+			return values
+		}
+
+		if policy.Attributes != nil && policy.Attributes.ExpiryTime != nil {
+			values = append(values, "expiry="+*policy.Attributes.ExpiryTime)
+		}
+
+		for _, action := range policy.LifetimeActions {
+			if action == nil || action.Action == nil || action.Action.Type == nil || action.Trigger == nil {
+				continue
+			}
+
+			// the data plane returns the action types capitalized
+			actionType := strings.ToLower(string(*action.Action.Type))
+			if action.Trigger.TimeAfterCreate != nil {
+				values = append(values, fmt.Sprintf("%s after create=%s", actionType, *action.Trigger.TimeAfterCreate))
+			}
+
+			if action.Trigger.TimeBeforeExpiry != nil {
+				values = append(values, fmt.Sprintf("%s before expiry=%s", actionType, *action.Trigger.TimeBeforeExpiry))
+			}
+		}
+
+		return values
+	}
+
+	return stringSetsEqual(values(a), values(b))
+}
+
+func isECKeyType(keyType string) bool {
+	return strings.HasPrefix(keyType, "EC")
+}
+
+// keyVaultSKUName returns the Azure Key Vault SKU, HSM protected keys require the premium SKU
+func keyVaultSKUName(config azureConfig) armkeyvault.SKUName {
+	if strings.HasSuffix(config.KeyVaultKeyType, "-HSM") {
+		return armkeyvault.SKUNamePremium
+	}
+
+	return armkeyvault.SKUNameStandard
+}
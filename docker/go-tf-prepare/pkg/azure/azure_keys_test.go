@@ -0,0 +1,49 @@
+package azure
+
+import (
+	"io"
+	"testing"
+)
+
+func TestPlanKeyVaultKeyRotationPolicy(t *testing.T) {
+	ctx := newTestContext(t)
+	_, clients := newTestClients(t)
+
+	err := runAction(ctx, clients, newTestConfig(t), io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	cases := []struct {
+		name    string
+		args    []string
+		updated bool
+	}{
+		{name: "rotation policy differs", args: []string{"--keyvault-key-rotate-after", "P90D", "--reconcile"}, updated: true},
+		{name: "rotation policy differs without reconcile", args: []string{"--keyvault-key-rotate-after", "P90D"}},
+		{name: "key size differs", args: []string{"--keyvault-key-size", "4096", "--reconcile"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := newTestConfig(t, c.args...)
+			state, err := getKeyVaultKeyState(ctx, clients, config)
+			if err != nil {
+				t.Fatalf("getKeyVaultKeyState: %v", err)
+			}
+			if state.Status != resourceStatusMisconfigured {
+				t.Fatalf("status is %s, expected %s", state.Status, resourceStatusMisconfigured)
+			}
+
+			operations, err := planKeyVaultKey(ctx, clients, config, state)
+			if err != nil {
+				t.Fatalf("planKeyVaultKey: %v", err)
+			}
+
+			updated := len(operations) == 1 && operations[0].Action == plannedActionUpdate && operations[0].Details == "rotation policy"
+			if updated != c.updated || (!c.updated && len(operations) > 0) {
+				t.Errorf("planned %v, expected a rotation policy update: %t", operations, c.updated)
+			}
+		})
+	}
+}
@@ -0,0 +1,473 @@
+package azure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armlocks"
+	"github.com/go-logr/logr"
+	"github.com/urfave/cli/v2"
+	"github.com/xenitab/github-actions/docker/go-tf-prepare/pkg/azure/internal/azerrors"
+)
+
+// resourceLockName is the name of the locks created by tf-prepare
+const resourceLockName = "DoNotDelete"
+
+const (
+	resourceLockScopeResource      = "resource"
+	resourceLockScopeResourceGroup = "resource-group"
+)
+
+// managedLock is a lock that tf-prepare creates for the configuration
+type managedLock struct {
+	Resource string
+	Scope    string
+	// LockScope is the lock scope the lock is created for, resource or resource-group
+	LockScope string
+	// Properties are the properties of an existing lock
+	Properties *armlocks.ManagementLockProperties
+}
+
+// resourceLockNotes returns the configured notes of the locks, which default to the lock level
+func resourceLockNotes(config azureConfig) string {
+	if config.ResourceLockNotes != "" {
+		return config.ResourceLockNotes
+	}
+
+	return config.ResourceLockLevel
+}
+
+func resourceLockObject(config azureConfig) armlocks.ManagementLockObject {
+	return armlocks.ManagementLockObject{
+		Properties: &armlocks.ManagementLockProperties{
+			Level: to.Ptr(armlocks.LockLevel(config.ResourceLockLevel)),
+			Notes: to.Ptr(resourceLockNotes(config)),
+		},
+	}
+}
+
+func getResourceLockDifferences(config azureConfig, properties *armlocks.ManagementLockProperties) []string {
+	if properties == nil {
+		properties = &armlocks.ManagementLockProperties{}
+	}
+
+	reasons := []string{}
+
+	if properties.Level != nil && string(*properties.Level) != config.ResourceLockLevel {
+		reasons = append(reasons, fmt.Sprintf("lock level is %s", *properties.Level))
+	}
+
+	notes := ""
+	if properties.Notes != nil {
+		notes = *properties.Notes
+	}
+	if notes != resourceLockNotes(config) {
+		reasons = append(reasons, fmt.Sprintf("lock notes are %q", notes))
+	}
+
+	return reasons
+}
+
+// CreateResourceGroupLock creates Azure Resource Lock on the Resource Group (if it doesn't exist) or return error
+func CreateResourceGroupLock(ctx context.Context, clients *clientFactory, config azureConfig) (stepResult, error) {
+	resourceGroupName := config.ResourceGroupName
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	state, err := getResourceGroupLockState(ctx, clients, config)
+	if err != nil {
+		return "", err
+	}
+
+	if state.Status == resourceStatusMisconfigured && !config.Reconcile {
+		log.Info("Azure Resource Group Lock does not match the configuration, use reconcile to update it", "resourceGroupName", resourceGroupName, "reason", state.Reason)
+		return stepResultUnchanged, nil
+	}
+
+	if state.Status == resourceStatusPresent {
+		log.Info("Azure Resource Group Lock already exists", "resourceGroupName", resourceGroupName)
+		return stepResultUnchanged, nil
+	}
+
+	client, err := clients.managementLocksClient()
+	if err != nil {
+		log.Error(err, "armlocks.NewManagementLocksClient")
+		return "", err
+	}
+
+	ctx, err = withLockAPIVersion(ctx, clients)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = client.CreateOrUpdateAtResourceGroupLevel(ctx, resourceGroupName, resourceLockName, resourceLockObject(config), nil)
+	if err != nil {
+		log.Error(err, "client.CreateOrUpdateAtResourceGroupLevel")
+		return "", authorizationError(err, "write Microsoft.Authorization/locks")
+	}
+
+	if state.Status == resourceStatusMisconfigured {
+		log.Info("Azure Resource Group Lock updated", "resourceGroupName", resourceGroupName, "reason", state.Reason)
+		return stepResultUpdated, nil
+	}
+
+	log.Info("Azure Resource Group Lock created", "resourceGroupName", resourceGroupName)
+	return stepResultCreated, nil
+}
+
+func getResourceGroupLockState(ctx context.Context, clients *clientFactory, config azureConfig) (resourceState, error) {
+	resourceGroupName := config.ResourceGroupName
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return resourceState{}, err
+	}
+
+	client, err := clients.managementLocksClient()
+	if err != nil {
+		log.Error(err, "armlocks.NewManagementLocksClient")
+		return resourceState{}, err
+	}
+
+	ctx, err = withLockAPIVersion(ctx, clients)
+	if err != nil {
+		return resourceState{}, err
+	}
+
+	res, err := client.GetAtResourceGroupLevel(ctx, resourceGroupName, resourceLockName, nil)
+	if azerrors.IsNotFound(err) {
+		return resourceState{Status: resourceStatusMissing}, nil
+	}
+
+	if err != nil {
+		log.Error(err, "client.GetAtResourceGroupLevel")
+		return resourceState{}, err
+	}
+
+	reasons := getResourceLockDifferences(config, res.ManagementLockObject.Properties)
+	if len(reasons) > 0 {
+		return resourceState{Status: resourceStatusMisconfigured, Reason: strings.Join(reasons, ", ")}, nil
+	}
+
+	return resourceState{Status: resourceStatusPresent}, nil
+}
+
+// getManagedLocks returns the locks tf-prepare creates, at both lock scopes since the scope may have been changed
+func getManagedLocks(clients *clientFactory, config azureConfig) []managedLock {
+	return []managedLock{
+		{Resource: resourceKindResourceGroupLock, Scope: fmt.Sprintf("/subscriptions/%s/resourceGroups/%s", clients.subscriptionID, config.ResourceGroupName), LockScope: resourceLockScopeResourceGroup},
+		{Resource: resourceKindStorageAccountLock, Scope: storageAccountID(clients, config), LockScope: resourceLockScopeResource},
+		{Resource: resourceKindKeyVaultLock, Scope: keyVaultScope(clients, config), LockScope: resourceLockScopeResource},
+	}
+}
+
+// getExistingManagedLocks returns the managed locks that exist, with their properties
+func getExistingManagedLocks(ctx context.Context, clients *clientFactory, config azureConfig) ([]managedLock, error) {
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := clients.managementLocksClient()
+	if err != nil {
+		log.Error(err, "armlocks.NewManagementLocksClient")
+		return nil, err
+	}
+
+	ctx, err = withLockAPIVersion(ctx, clients)
+	if err != nil {
+		return nil, err
+	}
+
+	existing := []managedLock{}
+	for _, lock := range getManagedLocks(clients, config) {
+		res, err := client.GetByScope(ctx, lock.Scope, resourceLockName, nil)
+		if azerrors.IsNotFound(err) {
+			log.V(1).Info("Azure Resource Lock doesn't exist", "resource", lock.Resource, "scope", lock.Scope)
+			continue
+		}
+
+		if err != nil {
+			log.Error(err, "client.GetByScope")
+			return nil, err
+		}
+
+		lock.Properties = res.Properties
+		existing = append(existing, lock)
+	}
+
+	return existing, nil
+}
+
+// getStaleLocks returns the existing managed locks at the lock scope that isn't configured,
+// for example the Storage Account and KeyVault locks after changing the lock scope to resource-group
+func getStaleLocks(ctx context.Context, clients *clientFactory, config azureConfig) ([]managedLock, error) {
+	existing, err := getExistingManagedLocks(ctx, clients, config)
+	if err != nil {
+		return nil, err
+	}
+
+	stale := []managedLock{}
+	for _, lock := range existing {
+		if lock.LockScope != config.ResourceLockScope {
+			stale = append(stale, lock)
+		}
+	}
+
+	return stale, nil
+}
+
+func getStaleLocksState(ctx context.Context, clients *clientFactory, config azureConfig) (resourceState, error) {
+	stale, err := getStaleLocks(ctx, clients, config)
+	if err != nil {
+		return resourceState{}, err
+	}
+
+	if len(stale) == 0 {
+		return resourceState{Status: resourceStatusAbsent}, nil
+	}
+
+	resources := []string{}
+	for _, lock := range stale {
+		resources = append(resources, lock.Resource)
+	}
+
+	return resourceState{Status: resourceStatusMisconfigured, Reason: fmt.Sprintf("%s exist but the lock scope is %s", strings.Join(resources, ", "), config.ResourceLockScope)}, nil
+}
+
+// DeleteStaleLocks deletes the managed locks at the lock scope that isn't configured, only with reconcile
+func DeleteStaleLocks(ctx context.Context, clients *clientFactory, config azureConfig) (stepResult, error) {
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	state, err := getStaleLocksState(ctx, clients, config)
+	if err != nil {
+		return "", err
+	}
+
+	if state.Status == resourceStatusAbsent {
+		log.V(1).Info("No Azure Resource Locks at the other lock scope", "resourceLockScope", config.ResourceLockScope)
+		return stepResultUnchanged, nil
+	}
+
+	if !config.Reconcile {
+		log.Info("Azure Resource Locks exist at the other lock scope, use reconcile to delete them", "resourceLockScope", config.ResourceLockScope, "reason", state.Reason)
+		return stepResultUnchanged, nil
+	}
+
+	stale, err := getStaleLocks(ctx, clients, config)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = removeLocks(ctx, clients, stale)
+	if err != nil {
+		return "", err
+	}
+
+	return stepResultDeleted, nil
+}
+
+// removeLocks removes the locks and returns the ones that have been removed, also when an error is returned
+func removeLocks(ctx context.Context, clients *clientFactory, locks []managedLock) ([]managedLock, error) {
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := clients.managementLocksClient()
+	if err != nil {
+		log.Error(err, "armlocks.NewManagementLocksClient")
+		return nil, err
+	}
+
+	ctx, err = withLockAPIVersion(ctx, clients)
+	if err != nil {
+		return nil, err
+	}
+
+	removed := []managedLock{}
+	for _, lock := range locks {
+		_, err = client.DeleteByScope(ctx, lock.Scope, resourceLockName, nil)
+		if err != nil {
+			log.Error(err, "client.DeleteByScope")
+			return removed, authorizationError(err, "delete Microsoft.Authorization/locks")
+		}
+
+		removed = append(removed, lock)
+		log.Info("Azure Resource Lock removed", "resource", lock.Resource, "scope", lock.Scope)
+	}
+
+	return removed, nil
+}
+
+// restoreLocks creates the removed locks again as they were, also when the context has been canceled.
+// Locks that exist again, for example because a lock step created them, are left as they are.
+func restoreLocks(ctx context.Context, clients *clientFactory, removed []managedLock) error {
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	client, err := clients.managementLocksClient()
+	if err != nil {
+		log.Error(err, "armlocks.NewManagementLocksClient")
+		return err
+	}
+
+	ctx, err = withLockAPIVersion(context.WithoutCancel(ctx), clients)
+	if err != nil {
+		return err
+	}
+
+	errs := []error{}
+	for _, lock := range removed {
+		_, err := client.GetByScope(ctx, lock.Scope, resourceLockName, nil)
+		if err == nil {
+			log.V(1).Info("Azure Resource Lock exists again", "resource", lock.Resource, "scope", lock.Scope)
+			continue
+		}
+
+		if !azerrors.IsNotFound(err) {
+			log.Error(err, "client.GetByScope", "scope", lock.Scope)
+			errs = append(errs, err)
+			continue
+		}
+
+		_, err = client.CreateOrUpdateByScope(ctx, lock.Scope, resourceLockName, armlocks.ManagementLockObject{Properties: lock.Properties}, nil)
+		if err != nil {
+			log.Error(err, "client.CreateOrUpdateByScope", "scope", lock.Scope)
+			errs = append(errs, authorizationError(err, "write Microsoft.Authorization/locks"))
+			continue
+		}
+
+		log.Info("Azure Resource Lock restored", "resource", lock.Resource, "scope", lock.Scope)
+	}
+
+	return errors.Join(errs...)
+}
+
+// liftReadOnlyLocks removes the ReadOnly locks managed by tf-prepare when a step has to write below them,
+// since they would make the write fail. The returned function restores the removed locks that the lock steps haven't created again.
+func liftReadOnlyLocks(ctx context.Context, clients *clientFactory, config azureConfig) (func() error, error) {
+	removed := []managedLock{}
+	restore := func() error {
+		restored := []managedLock{}
+		for _, lock := range removed {
+			// the stale locks step deletes the locks of the other lock scope with reconcile
+			if config.ResourceLocks && config.Reconcile && lock.LockScope != config.ResourceLockScope {
+				continue
+			}
+			restored = append(restored, lock)
+		}
+
+		return restoreLocks(ctx, clients, restored)
+	}
+
+	existing, err := getExistingManagedLocks(ctx, clients, config)
+	if err != nil {
+		return restore, err
+	}
+
+	readOnly := []managedLock{}
+	for _, lock := range existing {
+		if lock.Properties != nil && lock.Properties.Level != nil && *lock.Properties.Level == armlocks.LockLevelReadOnly {
+			readOnly = append(readOnly, lock)
+		}
+	}
+	if len(readOnly) == 0 {
+		return restore, nil
+	}
+
+	steps, states, err := getStepStates(ctx, clients, config, getSteps())
+	if err != nil {
+		return restore, err
+	}
+
+	// only missing resources are created, misconfigured ones are updated with reconcile
+	writes := false
+	for _, s := range steps {
+		if slices.Contains(lockSteps, s.Name) {
+			continue
+		}
+
+		state := states[s.Name]
+		if state.Status == resourceStatusMissing || (state.Status == resourceStatusMisconfigured && config.Reconcile) {
+			writes = true
+		}
+	}
+	if !writes {
+		return restore, nil
+	}
+
+	removed, err = removeLocks(ctx, clients, readOnly)
+	return restore, err
+}
+
+// UnlockAction executes the Azure unlock action
+func UnlockAction(ctx context.Context, cli *cli.Context) error {
+	config := newAzureConfig(cli)
+
+	err := config.Validate()
+	if err != nil {
+		return err
+	}
+
+	clients, err := getClientFactory(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	return unlock(ctx, clients, config, cli.Args().Slice())
+}
+
+// unlock removes the locks managed by tf-prepare, runs the command (or waits until interrupted without a command)
+// and restores the removed locks as they were, also when the command fails
+func unlock(ctx context.Context, clients *clientFactory, config azureConfig, command []string) (err error) {
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	existing, err := getExistingManagedLocks(ctx, clients, config)
+	if err != nil {
+		return err
+	}
+
+	removed, err := removeLocks(ctx, clients, existing)
+	defer func() {
+		// the locks are restored even if the context was canceled by an interrupt
+		err = errors.Join(err, restoreLocks(ctx, clients, removed))
+	}()
+	if err != nil {
+		return err
+	}
+
+	if len(command) == 0 {
+		log.Info("Azure Resource Locks removed, interrupt to restore them")
+		<-ctx.Done()
+		return nil
+	}
+
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Run()
+	if err != nil {
+		log.Error(err, "cmd.Run", "command", command[0])
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,233 @@
+package azure
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const (
+	testResourceGroupLockID = "/subscriptions/" + testSubscriptionID + "/resourceGroups/rg-test/providers/Microsoft.Authorization/locks/DoNotDelete"
+	testKeyVaultLockID      = "/subscriptions/" + testSubscriptionID + "/resourceGroups/rg-test/providers/Microsoft.KeyVault/vaults/kv-test/providers/Microsoft.Authorization/locks/DoNotDelete"
+)
+
+func lockLevel(t *testing.T, lock map[string]any) string {
+	t.Helper()
+
+	properties, _ := lock["properties"].(map[string]any)
+	level, _ := properties["level"].(string)
+	return level
+}
+
+func TestReadOnlyLocksAreLiftedForWrites(t *testing.T) {
+	ctx := newTestContext(t)
+	server, clients := newTestClients(t)
+
+	err := runAction(ctx, clients, newTestConfig(t, "--resource-lock-level", "ReadOnly"), io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	skip := len(server.Requests())
+	err = runAction(ctx, clients, newTestConfig(t, "--resource-lock-level", "ReadOnly"), io.Discard)
+	if err != nil {
+		t.Fatalf("second runAction: %v", err)
+	}
+
+	for _, request := range writeRequests(server, skip) {
+		t.Errorf("second run sent %s %s", request.Method, request.Path)
+	}
+
+	// a new container is a write below the ReadOnly lock of the Storage Account
+	err = runAction(ctx, clients, newTestConfig(t, "--resource-lock-level", "ReadOnly", "--storage-account-container", "tfstate-other"), io.Discard)
+	if err != nil {
+		t.Fatalf("runAction with a new container: %v", err)
+	}
+
+	if _, ok := server.Resource("/subscriptions/" + testSubscriptionID + "/resourceGroups/rg-test/providers/Microsoft.Storage/storageAccounts/satest/blobServices/default/containers/tfstate-other"); !ok {
+		t.Error("new container was not created")
+	}
+
+	for _, id := range []string{testStorageAccountLockID, testKeyVaultLockID} {
+		lock, ok := server.Resource(id)
+		if !ok {
+			t.Errorf("lock %s was not restored", id)
+			continue
+		}
+		if level := lockLevel(t, lock); level != "ReadOnly" {
+			t.Errorf("lock %s level is %s, expected ReadOnly", id, level)
+		}
+	}
+}
+
+func TestReadOnlyLocksAreKeptWithoutChanges(t *testing.T) {
+	ctx := newTestContext(t)
+	server, clients := newTestClients(t)
+	config := newTestConfig(t, "--resource-lock-level", "ReadOnly")
+
+	err := runAction(ctx, clients, config, io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	// a misconfigured Storage Account is only updated with reconcile
+	account, _ := server.Resource(testStorageAccountID)
+	properties, _ := account["properties"].(map[string]any)
+	properties["minimumTlsVersion"] = "TLS1_0"
+	server.PutResource(testStorageAccountID, account)
+
+	skip := len(server.Requests())
+	err = runAction(ctx, clients, config, io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	for _, request := range writeRequests(server, skip) {
+		t.Errorf("run without changes sent %s %s", request.Method, request.Path)
+	}
+}
+
+func TestLockScopeChange(t *testing.T) {
+	ctx := newTestContext(t)
+	server, clients := newTestClients(t)
+
+	err := runAction(ctx, clients, newTestConfig(t), io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	config := newTestConfig(t, "--resource-lock-scope", "resource-group")
+	err = runAction(ctx, clients, config, io.Discard)
+	if err != nil {
+		t.Fatalf("runAction with the resource-group scope: %v", err)
+	}
+
+	if _, ok := server.Resource(testResourceGroupLockID); !ok {
+		t.Error("Resource Group lock was not created")
+	}
+
+	for _, id := range []string{testStorageAccountLockID, testKeyVaultLockID} {
+		if _, ok := server.Resource(id); !ok {
+			t.Errorf("lock %s of the other scope was deleted without reconcile", id)
+		}
+	}
+
+	status := &bytes.Buffer{}
+	err = runStatus(ctx, clients, config, status)
+	if err == nil || !strings.Contains(status.String(), "Storage Account Lock, KeyVault Lock exist but the lock scope is resource-group") {
+		t.Fatalf("status doesn't report the locks of the other scope: %v\n%s", err, status)
+	}
+
+	plan := &bytes.Buffer{}
+	err = runAction(ctx, clients, newTestConfig(t, "--resource-lock-scope", "resource-group", "--reconcile", "--dry-run"), plan)
+	if err != nil {
+		t.Fatalf("runAction with dry-run: %v", err)
+	}
+	for _, expected := range []string{`delete Storage Account Lock "DoNotDelete"`, `delete KeyVault Lock "DoNotDelete"`} {
+		if !strings.Contains(plan.String(), expected) {
+			t.Errorf("plan doesn't contain %q:\n%s", expected, plan)
+		}
+	}
+
+	err = runAction(ctx, clients, newTestConfig(t, "--resource-lock-scope", "resource-group", "--reconcile"), io.Discard)
+	if err != nil {
+		t.Fatalf("runAction with reconcile: %v", err)
+	}
+
+	for _, id := range []string{testStorageAccountLockID, testKeyVaultLockID} {
+		if _, ok := server.Resource(id); ok {
+			t.Errorf("lock %s of the other scope was not deleted", id)
+		}
+	}
+
+	status.Reset()
+	err = runStatus(ctx, clients, config, status)
+	if err != nil {
+		t.Errorf("runStatus after reconcile: %v\n%s", err, status)
+	}
+	for _, unexpected := range []string{resourceKindStorageAccountLock, resourceKindKeyVaultLock, resourceKindStaleResourceLocks} {
+		if strings.Contains(status.String(), unexpected) {
+			t.Errorf("status reports %s with the resource-group scope:\n%s", unexpected, status)
+		}
+	}
+}
+
+func TestUnlockRemovesLocksOfBothScopes(t *testing.T) {
+	ctx := newTestContext(t)
+	server, clients := newTestClients(t)
+
+	err := runAction(ctx, clients, newTestConfig(t), io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	config := newTestConfig(t, "--resource-lock-scope", "resource-group")
+	err = runAction(ctx, clients, config, io.Discard)
+	if err != nil {
+		t.Fatalf("runAction with the resource-group scope: %v", err)
+	}
+
+	locked := func() []string {
+		ids := []string{}
+		for _, id := range []string{testResourceGroupLockID, testStorageAccountLockID, testKeyVaultLockID} {
+			if _, ok := server.Resource(id); ok {
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+
+	skip := len(server.Requests())
+	err = unlock(ctx, clients, config, []string{"true"})
+	if err != nil {
+		t.Fatalf("unlock: %v", err)
+	}
+
+	deleted := 0
+	for _, request := range writeRequests(server, skip) {
+		if request.Method == http.MethodDelete {
+			deleted++
+		}
+	}
+	if deleted != 3 {
+		t.Errorf("unlock removed %d locks, expected 3", deleted)
+	}
+
+	if after := locked(); len(after) != 3 {
+		t.Errorf("locks were not restored, found %v", after)
+	}
+}
+
+func TestResourceGroupLockIsSortedLast(t *testing.T) {
+	sorted, err := sortSteps(getSteps())
+	if err != nil {
+		t.Fatalf("sortSteps: %v", err)
+	}
+
+	index := map[stepName]int{}
+	for i, s := range sorted {
+		index[s.Name] = i
+	}
+
+	for _, name := range []stepName{stepStaleResourceLocks, stepStorageAccountLock, stepKeyVaultLock, stepStorageAccountContainer, stepKeyVaultKey} {
+		if index[name] > index[stepResourceGroupLock] {
+			t.Errorf("%s is sorted after %s", name, stepResourceGroupLock)
+		}
+	}
+}
+
+func TestLockWriteForbidden(t *testing.T) {
+	ctx := newTestContext(t)
+	server, clients := newTestClients(t)
+	server.ForbiddenWrites = []string{"Microsoft.Authorization/locks"}
+
+	err := runAction(ctx, clients, newTestConfig(t), io.Discard)
+	if err == nil {
+		t.Fatal("runAction didn't fail without permission to write locks")
+	}
+	if !strings.Contains(err.Error(), "the identity isn't allowed to write Microsoft.Authorization/locks") {
+		t.Errorf("error doesn't name the missing permission: %v", err)
+	}
+}
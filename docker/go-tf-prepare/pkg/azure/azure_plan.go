@@ -0,0 +1,335 @@
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strings"
+)
+
+type plannedAction string
+
+const (
+	plannedActionCreate   plannedAction = "create"
+	plannedActionUpdate   plannedAction = "update"
+	plannedActionRegister plannedAction = "register"
+	plannedActionRecover  plannedAction = "recover"
+	plannedActionDelete   plannedAction = "delete"
+)
+
+// plannedOperation is an operation that Action would execute
+type plannedOperation struct {
+	Action   plannedAction `json:"action"`
+	Resource string        `json:"resource"`
+	Name     string        `json:"name"`
+	Details  string        `json:"details,omitempty"`
+}
+
+// getPlannedOperations walks the same steps as Action and records what would be done
+func getPlannedOperations(ctx context.Context, clients *clientFactory, config azureConfig) ([]plannedOperation, error) {
+	steps, states, err := getStepStates(ctx, clients, config, getSteps())
+	if err != nil {
+		return nil, err
+	}
+
+	operations := []plannedOperation{}
+	for _, s := range steps {
+		stepOperations, err := s.Plan(ctx, clients, config, states[s.Name])
+		if err != nil {
+			return nil, err
+		}
+
+		operations = append(operations, stepOperations...)
+	}
+
+	return operations, nil
+}
+
+// planCreate plans the creation of a resource if it is missing, existing resources are left as is
+func planCreate(resource, name, details string, state resourceState) []plannedOperation {
+	if state.Status != resourceStatusMissing {
+		return nil
+	}
+
+	return []plannedOperation{{Action: plannedActionCreate, Resource: resource, Name: name, Details: details}}
+}
+
+// planResourceLock plans the lock of the configured lock scope
+func planResourceLock(resource string, config azureConfig, state resourceState) []plannedOperation {
+	if state.Status == resourceStatusMisconfigured && config.Reconcile {
+		return []plannedOperation{{Action: plannedActionUpdate, Resource: resource, Name: resourceLockName, Details: state.Reason}}
+	}
+
+	return planCreate(resource, resourceLockName, fmt.Sprintf("level %s, notes %q", config.ResourceLockLevel, resourceLockNotes(config)), state)
+}
+
+// planStaleLocks plans deleting the locks of the other lock scope, which only happens with reconcile
+func planStaleLocks(ctx context.Context, clients *clientFactory, config azureConfig, state resourceState) ([]plannedOperation, error) {
+	if state.Status != resourceStatusMisconfigured || !config.Reconcile {
+		return nil, nil
+	}
+
+	stale, err := getStaleLocks(ctx, clients, config)
+	if err != nil {
+		return nil, err
+	}
+
+	operations := []plannedOperation{}
+	for _, lock := range stale {
+		operations = append(operations, plannedOperation{Action: plannedActionDelete, Resource: lock.Resource, Name: resourceLockName, Details: fmt.Sprintf("the lock scope is %s", config.ResourceLockScope)})
+	}
+
+	return operations, nil
+}
+
+func planStorageAccount(ctx context.Context, clients *clientFactory, config azureConfig, state resourceState) ([]plannedOperation, error) {
+	if state.Status == resourceStatusMisconfigured && config.Reconcile {
+		return []plannedOperation{{Action: plannedActionUpdate, Resource: resourceKindStorageAccount, Name: config.StorageAccountName, Details: state.Reason}}, nil
+	}
+
+	if state.Status != resourceStatusMissing {
+		return nil, nil
+	}
+
+	registrationState, err := getResourceProviderRegistrationState(ctx, clients, config, "Microsoft.Storage")
+	if err != nil {
+		return nil, err
+	}
+
+	operations := []plannedOperation{}
+	if registrationState != "Registered" {
+		operations = append(operations, plannedOperation{Action: plannedActionRegister, Resource: "Resource Provider", Name: "Microsoft.Storage", Details: fmt.Sprintf("registration state %s", registrationState)})
+	}
+
+	details := fmt.Sprintf("sku %s, kind %s", config.StorageAccountSKU, config.StorageAccountKind)
+	if accessTier := storageAccountAccessTier(config); accessTier != nil {
+		details += fmt.Sprintf(", access tier %s", *accessTier)
+	}
+	if config.StorageAccountDoubleEncryption {
+		details += ", infrastructure encryption"
+	}
+	details += fmt.Sprintf(", public network access %s, shared key access %s", config.StorageAccountPublicNetworkAccess, enabledString(config.StorageAccountSharedKeyAccess))
+
+	operations = append(operations, planCreate(resourceKindStorageAccount, config.StorageAccountName, details, state)...)
+	return operations, nil
+}
+
+func planStorageAccountContainer(ctx context.Context, clients *clientFactory, config azureConfig, state resourceState) ([]plannedOperation, error) {
+	if state.Status == resourceStatusMisconfigured && config.Reconcile {
+		return []plannedOperation{{Action: plannedActionUpdate, Resource: resourceKindStorageAccountContainer, Name: config.StorageAccountContainer, Details: state.Reason}}, nil
+	}
+
+	details := []string{}
+	if len(config.StorageAccountContainerMetadata) > 0 {
+		details = append(details, fmt.Sprintf("metadata %s", strings.Join(config.StorageAccountContainerMetadata, ", ")))
+	}
+	if config.ContainerVersionImmutability {
+		details = append(details, "version-level immutability")
+	}
+	if config.ContainerRetentionDays > 0 {
+		details = append(details, retentionDetails("immutability policy", config.ContainerRetentionDays))
+	}
+	if len(config.ContainerLegalHoldTags) > 0 {
+		details = append(details, fmt.Sprintf("legal hold %s", strings.Join(config.ContainerLegalHoldTags, ", ")))
+	}
+
+	return planCreate(resourceKindStorageAccountContainer, config.StorageAccountContainer, strings.Join(details, ", "), state), nil
+}
+
+func planBlobService(ctx context.Context, clients *clientFactory, config azureConfig, state resourceState) ([]plannedOperation, error) {
+	if state.Status == resourceStatusPresent {
+		return nil, nil
+	}
+
+	if state.Status == resourceStatusMisconfigured && !config.Reconcile {
+		return nil, nil
+	}
+
+	settings := []string{}
+	if config.BlobVersioning != nil {
+		settings = append(settings, fmt.Sprintf("versioning %s", enabledString(*config.BlobVersioning)))
+	}
+	if config.BlobSoftDeleteRetentionDays != nil {
+		settings = append(settings, retentionDetails("blob soft delete", *config.BlobSoftDeleteRetentionDays))
+	}
+	if config.ContainerSoftDeleteRetentionDays != nil {
+		settings = append(settings, retentionDetails("container soft delete", *config.ContainerSoftDeleteRetentionDays))
+	}
+	if config.BlobChangeFeed != nil {
+		settings = append(settings, fmt.Sprintf("change feed %s", enabledString(*config.BlobChangeFeed)))
+	}
+	if config.BlobRestoreDays != nil {
+		settings = append(settings, retentionDetails("point-in-time restore", *config.BlobRestoreDays))
+	}
+	details := strings.Join(settings, ", ")
+
+	return []plannedOperation{{Action: plannedActionUpdate, Resource: resourceKindBlobService, Name: config.StorageAccountName, Details: details}}, nil
+}
+
+func retentionDetails(name string, days int) string {
+	if days == 0 {
+		return fmt.Sprintf("%s disabled", name)
+	}
+
+	return fmt.Sprintf("%s %d days", name, days)
+}
+
+func planPrivateEndpoint(ctx context.Context, clients *clientFactory, config azureConfig, state resourceState) ([]plannedOperation, error) {
+	details := fmt.Sprintf("blob, subnet %s", path.Base(config.PrivateEndpointSubnetID))
+	if config.PrivateDNSZoneID != "" {
+		details += fmt.Sprintf(", private DNS zone %s", path.Base(config.PrivateDNSZoneID))
+	}
+
+	switch state.Status {
+	case resourceStatusMissing:
+		return []plannedOperation{{Action: plannedActionCreate, Resource: resourceKindPrivateEndpoint, Name: privateEndpointName(config), Details: details}}, nil
+	case resourceStatusMisconfigured:
+		return []plannedOperation{{Action: plannedActionUpdate, Resource: resourceKindPrivateEndpoint, Name: privateEndpointName(config), Details: fmt.Sprintf("%s: %s", state.Reason, details)}}, nil
+	}
+
+	return nil, nil
+}
+
+func planKeyVault(ctx context.Context, clients *clientFactory, config azureConfig, state resourceState) ([]plannedOperation, error) {
+	if state.Status == resourceStatusMisconfigured && config.Reconcile {
+		return []plannedOperation{{Action: plannedActionUpdate, Resource: resourceKindKeyVault, Name: config.KeyVaultName, Details: state.Reason}}, nil
+	}
+
+	if state.Status == resourceStatusMissing && config.RecoverDeletedKeyVault {
+		deletedKeyVault, err := getDeletedKeyVault(ctx, clients, config)
+		if err != nil {
+			return nil, err
+		}
+
+		if deletedKeyVault != nil {
+			return []plannedOperation{{Action: plannedActionRecover, Resource: resourceKindKeyVault, Name: config.KeyVaultName, Details: "soft-deleted, with its keys"}}, nil
+		}
+	}
+
+	details := fmt.Sprintf("sku %s, soft delete retention %d days, purge protection %t, public network access %s", keyVaultSKUName(config), config.KeyVaultSoftDeleteRetentionDays, config.KeyVaultPurgeProtection, config.KeyVaultPublicNetworkAccess)
+	return planCreate(resourceKindKeyVault, config.KeyVaultName, details, state), nil
+}
+
+func planKeyVaultAccessPolicy(ctx context.Context, clients *clientFactory, config azureConfig, state resourceState) ([]plannedOperation, error) {
+	name := accessPolicyResourceName(config)
+	keyPermissions := []string{}
+	for _, keyPermission := range keyVaultAccessPolicyKeyPermissions(config).Keys {
+		keyPermissions = append(keyPermissions, string(*keyPermission))
+	}
+	details := fmt.Sprintf("key permissions %s", strings.Join(keyPermissions, ", "))
+	switch state.Status {
+	case resourceStatusMissing:
+		return []plannedOperation{{Action: plannedActionCreate, Resource: resourceKindKeyVaultAccessPolicy, Name: name, Details: details}}, nil
+	case resourceStatusMisconfigured:
+		return []plannedOperation{{Action: plannedActionUpdate, Resource: resourceKindKeyVaultAccessPolicy, Name: name, Details: fmt.Sprintf("%s: %s", state.Reason, details)}}, nil
+	}
+
+	return nil, nil
+}
+
+func planKeyVaultKey(ctx context.Context, clients *clientFactory, config azureConfig, state resourceState) ([]plannedOperation, error) {
+	if state.Status == resourceStatusMisconfigured && config.Reconcile && isKeyRotationPolicyConfigured(config) && slices.Contains(state.Differences, resourceDifferenceRotationPolicy) {
+		return []plannedOperation{{Action: plannedActionUpdate, Resource: resourceKindKeyVaultKey, Name: config.KeyVaultKeyName, Details: "rotation policy"}}, nil
+	}
+
+	details := config.KeyVaultKeyType
+	if isECKeyType(config.KeyVaultKeyType) {
+		details += " " + config.KeyVaultKeyCurve
+	} else {
+		details += fmt.Sprintf(" %d", config.KeyVaultKeySize)
+	}
+	details += fmt.Sprintf(", operations %s", strings.Join(config.KeyVaultKeyOperations, ", "))
+	if config.KeyVaultKeyExpiry != 0 {
+		details += fmt.Sprintf(", expires after %s", config.KeyVaultKeyExpiry)
+	}
+	if config.KeyVaultKeyRotateAfter != "" {
+		details += fmt.Sprintf(", rotated after %s", config.KeyVaultKeyRotateAfter)
+	}
+
+	return planCreate(resourceKindKeyVaultKey, config.KeyVaultKeyName, details, state), nil
+}
+
+func planStorageAccountIdentity(ctx context.Context, clients *clientFactory, config azureConfig, state resourceState) ([]plannedOperation, error) {
+	if state.Status != resourceStatusMissing {
+		return nil, nil
+	}
+
+	registrationState, err := getResourceProviderRegistrationState(ctx, clients, config, "Microsoft.ManagedIdentity")
+	if err != nil {
+		return nil, err
+	}
+
+	operations := []plannedOperation{}
+	if registrationState != "Registered" {
+		operations = append(operations, plannedOperation{Action: plannedActionRegister, Resource: "Resource Provider", Name: "Microsoft.ManagedIdentity", Details: fmt.Sprintf("registration state %s", registrationState)})
+	}
+
+	operations = append(operations, planCreate(resourceKindStorageAccountIdentity, storageAccountIdentityName(config), fmt.Sprintf("user-assigned identity in %s", config.ResourceGroupLocation), state)...)
+	return operations, nil
+}
+
+func planStorageAccountKeyAccess(ctx context.Context, clients *clientFactory, config azureConfig, state resourceState) ([]plannedOperation, error) {
+	details := "access policy with key permissions get, wrapKey, unwrapKey"
+	if config.KeyVaultAuthorization == keyVaultAuthorizationRBAC {
+		details = fmt.Sprintf("role %s", storageAccountKeyRoleName)
+	}
+
+	switch state.Status {
+	case resourceStatusMissing:
+		return []plannedOperation{{Action: plannedActionCreate, Resource: resourceKindStorageAccountKeyAccess, Name: storageAccountIdentityName(config), Details: details}}, nil
+	case resourceStatusMisconfigured:
+		return []plannedOperation{{Action: plannedActionUpdate, Resource: resourceKindStorageAccountKeyAccess, Name: storageAccountIdentityName(config), Details: fmt.Sprintf("%s: %s", state.Reason, details)}}, nil
+	}
+
+	return nil, nil
+}
+
+func planStorageAccountEncryption(ctx context.Context, clients *clientFactory, config azureConfig, state resourceState) ([]plannedOperation, error) {
+	details := fmt.Sprintf("customer-managed key %s in %s, identity %s", config.KeyVaultKeyName, config.KeyVaultName, storageAccountIdentityName(config))
+	switch state.Status {
+	case resourceStatusMissing:
+		return []plannedOperation{{Action: plannedActionUpdate, Resource: resourceKindStorageAccountCMK, Name: config.StorageAccountName, Details: details}}, nil
+	case resourceStatusMisconfigured:
+		if !config.Reconcile {
+			return nil, nil
+		}
+		return []plannedOperation{{Action: plannedActionUpdate, Resource: resourceKindStorageAccountCMK, Name: config.StorageAccountName, Details: fmt.Sprintf("%s: %s", state.Reason, details)}}, nil
+	}
+
+	return nil, nil
+}
+
+func writePlannedOperations(w io.Writer, operations []plannedOperation, format string) error {
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(operations)
+	}
+
+	if len(operations) == 0 {
+		_, err := fmt.Fprintln(w, "No changes. The Terraform backend is up-to-date.")
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "tf-prepare will perform the following %d operations:\n\n", len(operations))
+	if err != nil {
+		return err
+	}
+
+	for _, operation := range operations {
+		line := fmt.Sprintf("  %s %s %q", operation.Action, operation.Resource, operation.Name)
+		if operation.Details != "" {
+			line = fmt.Sprintf("%s (%s)", line, operation.Details)
+		}
+
+		_, err := fmt.Fprintln(w, line)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,296 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/authorization/armauthorization/v2"
+	"github.com/go-logr/logr"
+	"github.com/google/uuid"
+	"github.com/xenitab/github-actions/docker/go-tf-prepare/pkg/azure/internal/azerrors"
+)
+
+const (
+	keyVaultAuthorizationAccessPolicy = "accesspolicy"
+	keyVaultAuthorizationRBAC         = "rbac"
+)
+
+const (
+	storageRoleScopeContainer = "container"
+	storageRoleScopeAccount   = "account"
+)
+
+// roleAssignmentNamespace is used to derive stable role assignment names, so that
+// running tf-prepare again does not create duplicate assignments
+var roleAssignmentNamespace = uuid.MustParse("6f0a4b8e-3c1d-4b7a-9f2e-5d8c7b6a4e3f")
+
+// authorizationError adds the action the identity needs to err when the request was forbidden or not authenticated
+func authorizationError(err error, action string) error {
+	switch {
+	case azerrors.IsForbidden(err):
+		return fmt.Errorf("the identity isn't allowed to %s, it needs the Owner or User Access Administrator role: %w", action, err)
+	case azerrors.IsUnauthorized(err):
+		return fmt.Errorf("the identity isn't authenticated to %s, check the credentials and the tenant: %w", action, err)
+	}
+
+	return err
+}
+
+// CreateKeyVaultRoleAssignment creates Azure Key Vault Role Assignment (if it doesn't exist) or returns error
+func CreateKeyVaultRoleAssignment(ctx context.Context, clients *clientFactory, config azureConfig) (stepResult, error) {
+	principalID, err := getAccessPolicyObjectID(ctx, clients, config)
+	if err != nil {
+		return "", err
+	}
+
+	return createRoleAssignment(ctx, clients, keyVaultScope(clients, config), config.KeyVaultRoleName, principalID)
+}
+
+func getKeyVaultRoleAssignmentState(ctx context.Context, clients *clientFactory, config azureConfig) (resourceState, error) {
+	principalID, err := getAccessPolicyObjectID(ctx, clients, config)
+	if err != nil {
+		return resourceState{}, err
+	}
+
+	return getRoleAssignmentState(ctx, clients, keyVaultScope(clients, config), config.KeyVaultRoleName, principalID)
+}
+
+// CreateStorageRoleAssignment assigns the storage role to the caller and the additional principals (if they don't have it) or returns error
+func CreateStorageRoleAssignment(ctx context.Context, clients *clientFactory, config azureConfig) (stepResult, error) {
+	principalIDs, err := getStorageRolePrincipalIDs(ctx, clients, config)
+	if err != nil {
+		return "", err
+	}
+
+	result := stepResultUnchanged
+	for _, principalID := range principalIDs {
+		principalResult, err := createRoleAssignment(ctx, clients, storageRoleScope(clients, config), config.StorageAccountRoleName, principalID)
+		if err != nil {
+			return "", err
+		}
+
+		if principalResult == stepResultCreated {
+			result = stepResultCreated
+		}
+	}
+
+	return result, nil
+}
+
+func getStorageRoleAssignmentState(ctx context.Context, clients *clientFactory, config azureConfig) (resourceState, error) {
+	principalIDs, err := getStorageRolePrincipalIDs(ctx, clients, config)
+	if err != nil {
+		return resourceState{}, err
+	}
+
+	missing := []string{}
+	for _, principalID := range principalIDs {
+		state, err := getRoleAssignmentState(ctx, clients, storageRoleScope(clients, config), config.StorageAccountRoleName, principalID)
+		if err != nil {
+			return resourceState{}, err
+		}
+
+		if state.Status != resourceStatusPresent {
+			missing = append(missing, principalID)
+		}
+	}
+
+	if len(missing) > 0 {
+		return resourceState{Status: resourceStatusMissing, Reason: fmt.Sprintf("not assigned to %s", strings.Join(missing, ", "))}, nil
+	}
+
+	return resourceState{Status: resourceStatusPresent}, nil
+}
+
+// getStorageRolePrincipalIDs returns the object ID of the caller followed by the additional principal IDs, without duplicates
+func getStorageRolePrincipalIDs(ctx context.Context, clients *clientFactory, config azureConfig) ([]string, error) {
+	currentUserObjectID, err := getAccessPolicyObjectID(ctx, clients, config)
+	if err != nil {
+		return nil, err
+	}
+
+	principalIDs := []string{currentUserObjectID}
+	for _, principalID := range config.StorageAccountRolePrincipalIDs {
+		if !slices.ContainsFunc(principalIDs, func(id string) bool { return strings.EqualFold(id, principalID) }) {
+			principalIDs = append(principalIDs, principalID)
+		}
+	}
+
+	return principalIDs, nil
+}
+
+// storageRoleScope returns the container or the storage account, depending on the configured scope
+func storageRoleScope(clients *clientFactory, config azureConfig) string {
+	if config.StorageAccountRoleScope == storageRoleScopeAccount {
+		return storageAccountID(clients, config)
+	}
+
+	return fmt.Sprintf("%s/blobServices/default/containers/%s", storageAccountID(clients, config), config.StorageAccountContainer)
+}
+
+func storageRoleAssignmentResourceName(config azureConfig) string {
+	if len(config.StorageAccountRolePrincipalIDs) == 0 {
+		return accessPolicyResourceName(config)
+	}
+
+	return fmt.Sprintf("%s and %d more", accessPolicyResourceName(config), len(config.StorageAccountRolePrincipalIDs))
+}
+
+func keyVaultScope(clients *clientFactory, config azureConfig) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.KeyVault/vaults/%s", clients.subscriptionID, config.ResourceGroupName, config.KeyVaultName)
+}
+
+// createRoleAssignment assigns the role to the principal at the scope (if it isn't already assigned at or above the scope) or returns error
+func createRoleAssignment(ctx context.Context, clients *clientFactory, scope string, roleName string, principalID string) (stepResult, error) {
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	roleDefinitionID, err := getRoleDefinitionID(ctx, clients, scope, roleName)
+	if err != nil {
+		return "", err
+	}
+
+	state, err := getRoleAssignmentStateForDefinition(ctx, clients, scope, roleDefinitionID, principalID)
+	if err != nil {
+		return "", err
+	}
+
+	if state.Status == resourceStatusPresent {
+		log.Info("Azure Role Assignment already exists", "scope", scope, "roleName", roleName, "principalID", principalID)
+		return stepResultUnchanged, nil
+	}
+
+	client, err := clients.roleAssignmentsClient()
+	if err != nil {
+		log.Error(err, "armauthorization.NewRoleAssignmentsClient")
+		return "", err
+	}
+
+	roleAssignmentName := uuid.NewSHA1(roleAssignmentNamespace, []byte(strings.ToLower(scope+"/"+roleDefinitionID+"/"+principalID))).String()
+	_, err = client.Create(ctx, scope, roleAssignmentName, armauthorization.RoleAssignmentCreateParameters{
+		Properties: &armauthorization.RoleAssignmentProperties{
+			PrincipalID:      to.Ptr(principalID),
+			RoleDefinitionID: to.Ptr(roleDefinitionID),
+		},
+	}, nil)
+	if azerrors.IsConflict(err) {
+		// RoleAssignmentExists, created by someone else since the state was read
+		log.Info("Azure Role Assignment already exists", "scope", scope, "roleName", roleName, "principalID", principalID)
+		return stepResultUnchanged, nil
+	}
+
+	if err != nil {
+		log.Error(err, "client.Create")
+		return "", authorizationError(err, "write Microsoft.Authorization/roleAssignments")
+	}
+
+	log.Info("Azure Role Assignment created", "scope", scope, "roleName", roleName, "principalID", principalID)
+	return stepResultCreated, nil
+}
+
+func getRoleAssignmentState(ctx context.Context, clients *clientFactory, scope string, roleName string, principalID string) (resourceState, error) {
+	roleDefinitionID, err := getRoleDefinitionID(ctx, clients, scope, roleName)
+	if err != nil {
+		return resourceState{}, err
+	}
+
+	return getRoleAssignmentStateForDefinition(ctx, clients, scope, roleDefinitionID, principalID)
+}
+
+func getRoleAssignmentStateForDefinition(ctx context.Context, clients *clientFactory, scope string, roleDefinitionID string, principalID string) (resourceState, error) {
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return resourceState{}, err
+	}
+
+	client, err := clients.roleAssignmentsClient()
+	if err != nil {
+		log.Error(err, "armauthorization.NewRoleAssignmentsClient")
+		return resourceState{}, err
+	}
+
+	// returns the assignments at, above and below the scope, assignments above the scope are inherited
+	pager := client.NewListForScopePager(scope, &armauthorization.RoleAssignmentsClientListForScopeOptions{
+		Filter: to.Ptr(escapeFilter(fmt.Sprintf("principalId eq '%s'", principalID))),
+	})
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			log.Error(err, "pager.NextPage")
+			return resourceState{}, err
+		}
+
+		for _, roleAssignment := range page.Value {
+			properties := roleAssignment.Properties
+			if properties == nil || properties.Scope == nil || properties.RoleDefinitionID == nil {
+				continue
+			}
+
+			if !isScopeWithin(scope, *properties.Scope) {
+				continue
+			}
+
+			if strings.EqualFold(path.Base(*properties.RoleDefinitionID), path.Base(roleDefinitionID)) {
+				return resourceState{Status: resourceStatusPresent}, nil
+			}
+		}
+	}
+
+	return resourceState{Status: resourceStatusMissing}, nil
+}
+
+// getRoleDefinitionID returns the ID of the role definition with the name, for example Key Vault Crypto User
+func getRoleDefinitionID(ctx context.Context, clients *clientFactory, scope string, roleName string) (string, error) {
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	client, err := clients.roleDefinitionsClient()
+	if err != nil {
+		log.Error(err, "armauthorization.NewRoleDefinitionsClient")
+		return "", err
+	}
+
+	// the role definitions client encodes the filter itself
+	pager := client.NewListPager(scope, &armauthorization.RoleDefinitionsClientListOptions{
+		Filter: to.Ptr(fmt.Sprintf("roleName eq '%s'", roleName)),
+	})
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			log.Error(err, "pager.NextPage")
+			return "", err
+		}
+
+		for _, roleDefinition := range page.Value {
+			if roleDefinition.ID != nil && roleDefinition.Properties != nil && roleDefinition.Properties.RoleName != nil && strings.EqualFold(*roleDefinition.Properties.RoleName, roleName) {
+				return *roleDefinition.ID, nil
+			}
+		}
+	}
+
+	err = fmt.Errorf("role definition %q not found", roleName)
+	log.Error(err, "getRoleDefinitionID")
+	return "", err
+}
+
+// escapeFilter encodes an OData filter, since the armauthorization role assignments client adds $filter to the query without encoding it
+func escapeFilter(filter string) string {
+	return strings.ReplaceAll(url.QueryEscape(filter), "+", "%20")
+}
+
+// isScopeWithin reports if the assignment scope is the scope or one of its parents
+func isScopeWithin(scope string, assignmentScope string) bool {
+	scope = strings.ToLower(strings.TrimSuffix(scope, "/"))
+	assignmentScope = strings.ToLower(strings.TrimSuffix(assignmentScope, "/"))
+
+	return assignmentScope == "" || scope == assignmentScope || strings.HasPrefix(scope, assignmentScope+"/")
+}
@@ -0,0 +1,174 @@
+package azure
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestGetRoleDefinitionID(t *testing.T) {
+	ctx := newTestContext(t)
+	server, clients := newTestClients(t)
+
+	scope := fmt.Sprintf("/subscriptions/%s", testSubscriptionID)
+	id, err := getRoleDefinitionID(ctx, clients, scope, "Key Vault Crypto User")
+	if err != nil {
+		t.Fatalf("getRoleDefinitionID: %v", err)
+	}
+
+	if !strings.HasSuffix(id, "/12338af0-0e69-4776-bea7-57ae8d297424") {
+		t.Errorf("role definition ID is %s, expected the Key Vault Crypto User role", id)
+	}
+
+	_, err = getRoleDefinitionID(ctx, clients, scope, "Unknown Role")
+	if err == nil {
+		t.Error("expected an error for an unknown role")
+	}
+
+	for _, request := range server.Requests() {
+		if strings.Contains(request.Query, "%25") {
+			t.Errorf("filter is encoded twice: %s", request.Query)
+		}
+	}
+}
+
+func TestGetRoleAssignmentStateForDefinition(t *testing.T) {
+	ctx := newTestContext(t)
+	_, clients := newTestClients(t)
+
+	scope := fmt.Sprintf("/subscriptions/%s", testSubscriptionID)
+	state, err := getRoleAssignmentStateForDefinition(ctx, clients, scope, "12338af0-0e69-4776-bea7-57ae8d297424", testObjectID)
+	if err != nil {
+		t.Fatalf("getRoleAssignmentStateForDefinition: %v", err)
+	}
+
+	if state.Status != resourceStatusMissing {
+		t.Errorf("status is %s, expected %s", state.Status, resourceStatusMissing)
+	}
+}
+
+func TestRunActionAssignsCryptoOfficerRole(t *testing.T) {
+	ctx := newTestContext(t)
+	server, clients := newTestClients(t)
+
+	err := runAction(ctx, clients, newTestConfig(t, "--keyvault-authorization", "rbac"), io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	found := false
+	for _, request := range server.Requests() {
+		if request.Method == http.MethodPut && strings.Contains(strings.ToLower(request.Path), "/providers/microsoft.authorization/roleassignments/") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("no role assignment was created")
+	}
+
+	config := newTestConfig(t, "--keyvault-authorization", "rbac")
+	scope := fmt.Sprintf("/subscriptions/%s/resourceGroups/rg-test/providers/Microsoft.KeyVault/vaults/kv-test", testSubscriptionID)
+	state, err := getRoleAssignmentStateForDefinition(ctx, clients, scope, "14b46e9e-c2b7-41b4-b07b-48a6ebf60603", config.ServicePrincipalObjectID)
+	if err != nil {
+		t.Fatalf("getRoleAssignmentStateForDefinition: %v", err)
+	}
+	if state.Status != resourceStatusPresent {
+		t.Errorf("Key Vault Crypto Officer assignment status is %s, expected %s", state.Status, resourceStatusPresent)
+	}
+}
+
+func TestStorageRoleAssignment(t *testing.T) {
+	ctx := newTestContext(t)
+	server, clients := newTestClients(t)
+
+	otherPrincipalID := "66666666-2222-2222-2222-222222222222"
+	args := []string{
+		"--storage-account-role-assignment",
+		"--storage-account-role-principal-id", otherPrincipalID,
+		// the caller is only assigned once
+		"--storage-account-role-principal-id", testObjectID,
+	}
+	config := newTestConfig(t, args...)
+	err := runAction(ctx, clients, config, io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	for _, principalID := range []string{testObjectID, otherPrincipalID} {
+		roleAssignments := server.RoleAssignments(principalID)
+		if len(roleAssignments) != 1 {
+			t.Fatalf("principal %s has %d role assignments, expected 1", principalID, len(roleAssignments))
+		}
+
+		properties, _ := roleAssignments[0]["properties"].(map[string]any)
+		if scope, _ := properties["scope"].(string); !strings.EqualFold(scope, testContainerID) {
+			t.Errorf("role assignment scope of %s is %s, expected the container", principalID, scope)
+		}
+		if roleDefinitionID, _ := properties["roleDefinitionId"].(string); !strings.HasSuffix(roleDefinitionID, "/ba92f5b4-2d11-453d-a403-e96b0029c9fe") {
+			t.Errorf("role definition of %s is %s, expected Storage Blob Data Contributor", principalID, roleDefinitionID)
+		}
+	}
+
+	skip := len(server.Requests())
+	err = runAction(ctx, clients, config, io.Discard)
+	if err != nil {
+		t.Fatalf("second runAction: %v", err)
+	}
+	for _, request := range writeRequests(server, skip) {
+		t.Errorf("second run sent %s %s", request.Method, request.Path)
+	}
+
+	state, err := getStorageRoleAssignmentState(ctx, clients, config)
+	if err != nil {
+		t.Fatalf("getStorageRoleAssignmentState: %v", err)
+	}
+	if state.Status != resourceStatusPresent {
+		t.Errorf("status is %s (%s), expected %s", state.Status, state.Reason, resourceStatusPresent)
+	}
+}
+
+func TestStorageRoleAssignmentIsInherited(t *testing.T) {
+	ctx := newTestContext(t)
+	server, clients := newTestClients(t)
+
+	err := runAction(ctx, clients, newTestConfig(t, "--storage-account-role-assignment", "--storage-account-role-scope", "account"), io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	// the assignment on the account is inherited by the container
+	config := newTestConfig(t, "--storage-account-role-assignment")
+	skip := len(server.Requests())
+	err = runAction(ctx, clients, config, io.Discard)
+	if err != nil {
+		t.Fatalf("runAction with the container scope: %v", err)
+	}
+	for _, request := range writeRequests(server, skip) {
+		t.Errorf("run with an inherited assignment sent %s %s", request.Method, request.Path)
+	}
+
+	roleAssignments := server.RoleAssignments(testObjectID)
+	if len(roleAssignments) != 1 {
+		t.Fatalf("caller has %d role assignments, expected the one on the account", len(roleAssignments))
+	}
+	properties, _ := roleAssignments[0]["properties"].(map[string]any)
+	if scope, _ := properties["scope"].(string); !strings.EqualFold(scope, testStorageAccountID) {
+		t.Errorf("role assignment scope is %s, expected the storage account", scope)
+	}
+}
+
+func TestRoleAssignmentForbidden(t *testing.T) {
+	ctx := newTestContext(t)
+	server, clients := newTestClients(t)
+	server.ForbiddenWrites = []string{"Microsoft.Authorization/roleAssignments"}
+
+	err := runAction(ctx, clients, newTestConfig(t, "--keyvault-authorization", "rbac"), io.Discard)
+	if err == nil {
+		t.Fatal("runAction didn't fail without permission to write role assignments")
+	}
+	if !strings.Contains(err.Error(), "the identity isn't allowed to write Microsoft.Authorization/roleAssignments") {
+		t.Errorf("error doesn't name the missing permission: %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v2"
+)
+
+type resourceStatus string
+
+const (
+	resourceStatusPresent       resourceStatus = "present"
+	resourceStatusMissing       resourceStatus = "missing"
+	resourceStatusMisconfigured resourceStatus = "misconfigured"
+	// resourceStatusAbsent is a resource that doesn't exist and shouldn't, it isn't reported
+	resourceStatusAbsent resourceStatus = "absent"
+)
+
+const (
+	resourceKindResourceGroup           = "Resource Group"
+	resourceKindResourceGroupLock       = "Resource Group Lock"
+	resourceKindStorageAccount          = "Storage Account"
+	resourceKindStorageAccountLock      = "Storage Account Lock"
+	resourceKindStorageAccountContainer = "Storage Account Container"
+	resourceKindBlobService             = "Storage Account Blob Service"
+	resourceKindPrivateEndpoint         = "Private Endpoint"
+	resourceKindStorageRoleAssignment   = "Storage Role Assignment"
+	resourceKindStorageAccountIdentity  = "Storage Account Identity"
+	resourceKindStorageAccountKeyAccess = "Storage Account Key Access"
+	resourceKindStorageAccountCMK       = "Storage Account CMK"
+	resourceKindKeyVault                = "KeyVault"
+	resourceKindKeyVaultLock            = "KeyVault Lock"
+	resourceKindStaleResourceLocks      = "Stale Resource Locks"
+	resourceKindKeyVaultAccessPolicy    = "KeyVault Access Policy"
+	resourceKindKeyVaultRoleAssignment  = "KeyVault Role Assignment"
+	resourceKindKeyVaultKey             = "KeyVault Key"
+	resourceKindTags                    = "Tags"
+)
+
+// resourceDifference identifies a difference of a misconfigured resource that the plan needs to know about
+type resourceDifference string
+
+const (
+	resourceDifferenceRotationPolicy resourceDifference = "rotation-policy"
+)
+
+// resourceState is the observed state of a single Azure resource
+type resourceState struct {
+	Status      resourceStatus
+	Reason      string
+	Differences []resourceDifference
+}
+
+// resourceReport is a single line in the status report
+type resourceReport struct {
+	Resource string
+	Name     string
+	State    resourceState
+}
+
+// StatusAction executes the read-only Azure status action
+func StatusAction(ctx context.Context, cli *cli.Context) error {
+	config := newAzureConfig(cli)
+
+	err := config.Validate()
+	if err != nil {
+		return err
+	}
+
+	clients, err := getClientFactory(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	return runStatus(ctx, clients, config, os.Stdout)
+}
+
+// runStatus writes the status report and returns an error if any resource isn't present
+func runStatus(ctx context.Context, clients *clientFactory, config azureConfig, w io.Writer) error {
+	reports, err := getStatusReports(ctx, clients, config)
+	if err != nil {
+		return err
+	}
+
+	err = writeStatusReports(w, reports)
+	if err != nil {
+		return err
+	}
+
+	notPresent := 0
+	for _, report := range reports {
+		if report.State.Status != resourceStatusPresent {
+			notPresent++
+		}
+	}
+
+	if notPresent > 0 {
+		return fmt.Errorf("%d of %d resources are not present or misconfigured", notPresent, len(reports))
+	}
+
+	return nil
+}
+
+func getStatusReports(ctx context.Context, clients *clientFactory, config azureConfig) ([]resourceReport, error) {
+	steps, states, err := getStepStates(ctx, clients, config, getSteps())
+	if err != nil {
+		return nil, err
+	}
+
+	reports := []resourceReport{}
+	for _, s := range steps {
+		if states[s.Name].Status == resourceStatusAbsent {
+			continue
+		}
+		reports = append(reports, resourceReport{Resource: s.Resource, Name: s.ResourceName(config), State: states[s.Name]})
+	}
+
+	return reports, nil
+}
+
+func parentMissingState(parent string) resourceState {
+	return resourceState{Status: resourceStatusMissing, Reason: fmt.Sprintf("%s is missing", parent)}
+}
+
+func writeStatusReports(w io.Writer, reports []resourceReport) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RESOURCE\tNAME\tSTATUS\tREASON")
+	for _, report := range reports {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", report.Resource, report.Name, report.State.Status, report.State.Reason)
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,90 @@
+package azure
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRunStatusIsReadOnly(t *testing.T) {
+	ctx := newTestContext(t)
+	server, clients := newTestClients(t)
+	config := newTestConfig(t)
+
+	err := runStatus(ctx, clients, config, io.Discard)
+	if err == nil {
+		t.Fatal("runStatus didn't fail for a missing backend")
+	}
+
+	for _, request := range writeRequests(server, 0) {
+		t.Errorf("status of a missing backend sent %s %s", request.Method, request.Path)
+	}
+
+	err = runAction(ctx, clients, config, io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	skip := len(server.Requests())
+	status := &bytes.Buffer{}
+	err = runStatus(ctx, clients, config, status)
+	if err != nil {
+		t.Fatalf("runStatus: %v\n%s", err, status)
+	}
+
+	for _, request := range writeRequests(server, skip) {
+		t.Errorf("status sent %s %s", request.Method, request.Path)
+	}
+
+	reports, err := getStatusReports(ctx, clients, config)
+	if err != nil {
+		t.Fatalf("getStatusReports: %v", err)
+	}
+
+	statuses := map[string]resourceStatus{}
+	for _, report := range reports {
+		statuses[report.Resource] = report.State.Status
+	}
+	for _, resource := range []string{
+		resourceKindResourceGroup,
+		resourceKindStorageAccount,
+		resourceKindStorageAccountContainer,
+		resourceKindKeyVault,
+		resourceKindKeyVaultAccessPolicy,
+		resourceKindKeyVaultKey,
+		resourceKindStorageAccountLock,
+		resourceKindKeyVaultLock,
+	} {
+		if statuses[resource] != resourceStatusPresent {
+			t.Errorf("%s status is %q, expected %s", resource, statuses[resource], resourceStatusPresent)
+		}
+	}
+}
+
+func TestRunStatusMisconfigured(t *testing.T) {
+	ctx := newTestContext(t)
+	_, clients := newTestClients(t)
+
+	err := runAction(ctx, clients, newTestConfig(t), io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	config := newTestConfig(t, "--keyvault-purge-protection")
+	reports, err := getStatusReports(ctx, clients, config)
+	if err != nil {
+		t.Fatalf("getStatusReports: %v", err)
+	}
+
+	status := &bytes.Buffer{}
+	err = runStatus(ctx, clients, config, status)
+	expected := fmt.Sprintf("1 of %d resources are not present or misconfigured", len(reports))
+	if err == nil || err.Error() != expected {
+		t.Errorf("runStatus returned %v, expected %q", err, expected)
+	}
+	if !strings.Contains(status.String(), "purge protection is disabled") {
+		t.Errorf("status doesn't report the reason:\n%s", status)
+	}
+}
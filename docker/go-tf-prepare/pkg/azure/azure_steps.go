@@ -0,0 +1,608 @@
+package azure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/go-logr/logr"
+	"github.com/xenitab/github-actions/docker/go-tf-prepare/pkg/azure/internal/azerrors"
+)
+
+type stepName string
+
+const (
+	stepResourceGroup           stepName = "resource-group"
+	stepResourceGroupLock       stepName = "resource-group-lock"
+	stepStorageAccount          stepName = "storage-account"
+	stepStorageAccountLock      stepName = "storage-account-lock"
+	stepStorageAccountContainer stepName = "storage-account-container"
+	stepBlobService             stepName = "storage-account-blob-service"
+	stepPrivateEndpoint         stepName = "private-endpoint"
+	stepStorageRoleAssignment   stepName = "storage-account-role-assignment"
+	stepStorageAccountIdentity  stepName = "storage-account-identity"
+	stepStorageAccountKeyAccess stepName = "storage-account-key-access"
+	stepStorageAccountCMK       stepName = "storage-account-cmk"
+	stepKeyVault                stepName = "keyvault"
+	stepKeyVaultLock            stepName = "keyvault-lock"
+	stepStaleResourceLocks      stepName = "stale-resource-locks"
+	stepKeyVaultAccessPolicy    stepName = "keyvault-access-policy"
+	stepKeyVaultRoleAssignment  stepName = "keyvault-role-assignment"
+	stepKeyVaultKey             stepName = "keyvault-key"
+	stepTags                    stepName = "tags"
+)
+
+// lockSteps are the steps of the resource locks
+var lockSteps = []stepName{stepResourceGroupLock, stepStorageAccountLock, stepKeyVaultLock, stepStaleResourceLocks}
+
+type stepResult string
+
+const (
+	stepResultCreated   stepResult = "created"
+	stepResultUpdated   stepResult = "updated"
+	stepResultRecovered stepResult = "recovered"
+	stepResultDeleted   stepResult = "deleted"
+	stepResultUnchanged stepResult = "unchanged"
+	stepResultSkipped   stepResult = "skipped"
+	stepResultFailed    stepResult = "failed"
+	stepResultCanceled  stepResult = "canceled"
+)
+
+// step is a single resource that tf-prepare manages
+type step struct {
+	Name      stepName
+	Resource  string
+	DependsOn []stepName
+	// After are steps that have to complete first if they run, without the step depending on them
+	After []stepName
+	// Enabled reports if the step should run for the configuration, nil means always enabled
+	Enabled func(config azureConfig) bool
+	// ResourceName returns the name of the resource managed by the step
+	ResourceName func(config azureConfig) string
+	// State returns the observed state without modifying anything
+	State func(ctx context.Context, clients *clientFactory, config azureConfig) (resourceState, error)
+	// Apply creates or updates the resource
+	Apply func(ctx context.Context, clients *clientFactory, config azureConfig) (stepResult, error)
+	// Plan returns the operations Apply would execute for the observed state
+	Plan func(ctx context.Context, clients *clientFactory, config azureConfig, state resourceState) ([]plannedOperation, error)
+}
+
+// isResourceLockScopeResource reports if the Storage Account and KeyVault are locked instead of the Resource Group
+func isResourceLockScopeResource(config azureConfig) bool {
+	return config.ResourceLocks && config.ResourceLockScope == resourceLockScopeResource
+}
+
+type dependencyCreatedKey struct{}
+
+// isDependencyCreated reports if a dependency of the applied step was created in this run,
+// the settings of a new resource are applied without reconcile
+func isDependencyCreated(ctx context.Context) bool {
+	created, _ := ctx.Value(dependencyCreatedKey{}).(bool)
+	return created
+}
+
+// stepOutcome is the result of a step that has been applied
+type stepOutcome struct {
+	Step   stepName
+	Result stepResult
+	Reason string
+}
+
+func getSteps() []step {
+	// the locks are created after the steps that write to the resources below them, so that ReadOnly locks don't block them
+	lockAfter := []stepName{
+		stepStorageAccount,
+		stepStorageAccountContainer,
+		stepBlobService,
+		stepStorageRoleAssignment,
+		stepPrivateEndpoint,
+		stepKeyVault,
+		stepKeyVaultAccessPolicy,
+		stepKeyVaultRoleAssignment,
+		stepKeyVaultKey,
+		stepStorageAccountIdentity,
+		stepStorageAccountKeyAccess,
+		stepStorageAccountCMK,
+		stepTags,
+	}
+
+	return []step{
+		{
+			Name:         stepResourceGroup,
+			Resource:     resourceKindResourceGroup,
+			ResourceName: func(config azureConfig) string { return config.ResourceGroupName },
+			State:        getResourceGroupState,
+			Apply:        CreateResourceGroup,
+			Plan: func(ctx context.Context, clients *clientFactory, config azureConfig, state resourceState) ([]plannedOperation, error) {
+				return planCreate(resourceKindResourceGroup, config.ResourceGroupName, fmt.Sprintf("location %s", config.ResourceGroupLocation), state), nil
+			},
+		},
+		{
+			Name:      stepResourceGroupLock,
+			Resource:  resourceKindResourceGroupLock,
+			DependsOn: []stepName{stepResourceGroup},
+			// a ReadOnly Resource Group lock would block the locks below it, so it is created last
+			After: append(slices.Clone(lockAfter), stepStaleResourceLocks, stepStorageAccountLock, stepKeyVaultLock),
+			Enabled: func(config azureConfig) bool {
+				return config.ResourceLocks && config.ResourceLockScope == resourceLockScopeResourceGroup
+			},
+			ResourceName: func(config azureConfig) string { return resourceLockName },
+			State:        getResourceGroupLockState,
+			Apply:        CreateResourceGroupLock,
+			Plan: func(ctx context.Context, clients *clientFactory, config azureConfig, state resourceState) ([]plannedOperation, error) {
+				return planResourceLock(resourceKindResourceGroupLock, config, state), nil
+			},
+		},
+		{
+			Name:         stepStaleResourceLocks,
+			Resource:     resourceKindStaleResourceLocks,
+			After:        lockAfter,
+			Enabled:      func(config azureConfig) bool { return config.ResourceLocks },
+			ResourceName: func(config azureConfig) string { return resourceLockName },
+			State:        getStaleLocksState,
+			Apply:        DeleteStaleLocks,
+			Plan:         planStaleLocks,
+		},
+		{
+			Name:         stepStorageAccount,
+			Resource:     resourceKindStorageAccount,
+			DependsOn:    []stepName{stepResourceGroup},
+			ResourceName: func(config azureConfig) string { return config.StorageAccountName },
+			State:        getStorageAccountState,
+			Apply:        CreateStorageAccount,
+			Plan:         planStorageAccount,
+		},
+		{
+			Name:         stepStorageAccountLock,
+			Resource:     resourceKindStorageAccountLock,
+			DependsOn:    []stepName{stepStorageAccount},
+			After:        append(slices.Clone(lockAfter), stepStaleResourceLocks),
+			Enabled:      isResourceLockScopeResource,
+			ResourceName: func(config azureConfig) string { return resourceLockName },
+			State: func(ctx context.Context, clients *clientFactory, config azureConfig) (resourceState, error) {
+				return getResourceLockState(ctx, clients, config, "Microsoft.Storage", "", "storageAccounts", config.StorageAccountName, resourceLockName)
+			},
+			Apply: func(ctx context.Context, clients *clientFactory, config azureConfig) (stepResult, error) {
+				return CreateResourceLock(ctx, clients, config, "Microsoft.Storage", "", "storageAccounts", config.StorageAccountName, resourceLockName)
+			},
+			Plan: func(ctx context.Context, clients *clientFactory, config azureConfig, state resourceState) ([]plannedOperation, error) {
+				return planResourceLock(resourceKindStorageAccountLock, config, state), nil
+			},
+		},
+		{
+			Name:         stepStorageAccountContainer,
+			Resource:     resourceKindStorageAccountContainer,
+			DependsOn:    []stepName{stepStorageAccount},
+			ResourceName: func(config azureConfig) string { return config.StorageAccountContainer },
+			State:        getStorageAccountContainerState,
+			Apply:        CreateStorageAccountContainer,
+			Plan:         planStorageAccountContainer,
+		},
+		{
+			Name:         stepBlobService,
+			Resource:     resourceKindBlobService,
+			DependsOn:    []stepName{stepStorageAccount},
+			Enabled:      isBlobServiceConfigured,
+			ResourceName: func(config azureConfig) string { return config.StorageAccountName },
+			State:        getBlobServiceState,
+			Apply:        ConfigureBlobService,
+			Plan:         planBlobService,
+		},
+		{
+			Name:         stepStorageRoleAssignment,
+			Resource:     resourceKindStorageRoleAssignment,
+			DependsOn:    []stepName{stepStorageAccountContainer},
+			Enabled:      func(config azureConfig) bool { return config.StorageAccountRoleAssignment },
+			ResourceName: storageRoleAssignmentResourceName,
+			State:        getStorageRoleAssignmentState,
+			Apply:        CreateStorageRoleAssignment,
+			Plan: func(ctx context.Context, clients *clientFactory, config azureConfig, state resourceState) ([]plannedOperation, error) {
+				details := fmt.Sprintf("role %s on the %s", config.StorageAccountRoleName, config.StorageAccountRoleScope)
+				if state.Reason != "" {
+					details = fmt.Sprintf("%s, %s", details, state.Reason)
+				}
+				return planCreate(resourceKindStorageRoleAssignment, storageRoleAssignmentResourceName(config), details, state), nil
+			},
+		},
+		{
+			Name:         stepPrivateEndpoint,
+			Resource:     resourceKindPrivateEndpoint,
+			DependsOn:    []stepName{stepStorageAccount},
+			Enabled:      func(config azureConfig) bool { return config.PrivateEndpointSubnetID != "" },
+			ResourceName: privateEndpointName,
+			State:        getPrivateEndpointState,
+			Apply:        CreatePrivateEndpoint,
+			Plan:         planPrivateEndpoint,
+		},
+		{
+			Name:         stepKeyVault,
+			Resource:     resourceKindKeyVault,
+			DependsOn:    []stepName{stepResourceGroup},
+			ResourceName: func(config azureConfig) string { return config.KeyVaultName },
+			State:        getKeyVaultState,
+			Apply:        CreateKeyVault,
+			Plan:         planKeyVault,
+		},
+		{
+			Name:         stepKeyVaultLock,
+			Resource:     resourceKindKeyVaultLock,
+			DependsOn:    []stepName{stepKeyVault},
+			After:        append(slices.Clone(lockAfter), stepStaleResourceLocks),
+			Enabled:      isResourceLockScopeResource,
+			ResourceName: func(config azureConfig) string { return resourceLockName },
+			State: func(ctx context.Context, clients *clientFactory, config azureConfig) (resourceState, error) {
+				return getResourceLockState(ctx, clients, config, "Microsoft.KeyVault", "", "vaults", config.KeyVaultName, resourceLockName)
+			},
+			Apply: func(ctx context.Context, clients *clientFactory, config azureConfig) (stepResult, error) {
+				return CreateResourceLock(ctx, clients, config, "Microsoft.KeyVault", "", "vaults", config.KeyVaultName, resourceLockName)
+			},
+			Plan: func(ctx context.Context, clients *clientFactory, config azureConfig, state resourceState) ([]plannedOperation, error) {
+				return planResourceLock(resourceKindKeyVaultLock, config, state), nil
+			},
+		},
+		{
+			Name:      stepKeyVaultAccessPolicy,
+			Resource:  resourceKindKeyVaultAccessPolicy,
+			DependsOn: []stepName{stepKeyVault},
+			Enabled: func(config azureConfig) bool {
+				return config.KeyVaultAuthorization == keyVaultAuthorizationAccessPolicy
+			},
+			ResourceName: accessPolicyResourceName,
+			State: func(ctx context.Context, clients *clientFactory, config azureConfig) (resourceState, error) {
+				currentUserObjectID, err := getAccessPolicyObjectID(ctx, clients, config)
+				if err != nil {
+					return resourceState{}, err
+				}
+
+				return getKeyVaultAccessPolicyState(ctx, clients, config, currentUserObjectID)
+			},
+			Apply: CreateKeyVaultAccessPolicy,
+			Plan:  planKeyVaultAccessPolicy,
+		},
+		{
+			Name:         stepKeyVaultRoleAssignment,
+			Resource:     resourceKindKeyVaultRoleAssignment,
+			DependsOn:    []stepName{stepKeyVault},
+			Enabled:      func(config azureConfig) bool { return config.KeyVaultAuthorization == keyVaultAuthorizationRBAC },
+			ResourceName: accessPolicyResourceName,
+			State:        getKeyVaultRoleAssignmentState,
+			Apply:        CreateKeyVaultRoleAssignment,
+			Plan: func(ctx context.Context, clients *clientFactory, config azureConfig, state resourceState) ([]plannedOperation, error) {
+				return planCreate(resourceKindKeyVaultRoleAssignment, accessPolicyResourceName(config), fmt.Sprintf("role %s", config.KeyVaultRoleName), state), nil
+			},
+		},
+		{
+			Name:         stepKeyVaultKey,
+			Resource:     resourceKindKeyVaultKey,
+			DependsOn:    []stepName{stepKeyVault},
+			ResourceName: func(config azureConfig) string { return config.KeyVaultKeyName },
+			State:        getKeyVaultKeyState,
+			Apply:        CreateKeyVaultKey,
+			Plan:         planKeyVaultKey,
+		},
+		{
+			Name:         stepStorageAccountIdentity,
+			Resource:     resourceKindStorageAccountIdentity,
+			DependsOn:    []stepName{stepResourceGroup},
+			Enabled:      func(config azureConfig) bool { return config.StorageAccountCMK },
+			ResourceName: storageAccountIdentityName,
+			State:        getStorageAccountIdentityState,
+			Apply:        CreateStorageAccountIdentity,
+			Plan:         planStorageAccountIdentity,
+		},
+		{
+			Name:         stepStorageAccountKeyAccess,
+			Resource:     resourceKindStorageAccountKeyAccess,
+			DependsOn:    []stepName{stepStorageAccountIdentity, stepKeyVault},
+			Enabled:      func(config azureConfig) bool { return config.StorageAccountCMK },
+			ResourceName: storageAccountIdentityName,
+			State:        getStorageAccountKeyAccessState,
+			Apply:        CreateStorageAccountKeyAccess,
+			Plan:         planStorageAccountKeyAccess,
+		},
+		{
+			Name:         stepStorageAccountCMK,
+			Resource:     resourceKindStorageAccountCMK,
+			DependsOn:    []stepName{stepStorageAccount, stepKeyVaultKey, stepStorageAccountKeyAccess},
+			Enabled:      func(config azureConfig) bool { return config.StorageAccountCMK },
+			ResourceName: func(config azureConfig) string { return config.StorageAccountName },
+			State:        getStorageAccountEncryptionState,
+			Apply:        ConfigureStorageAccountEncryption,
+			Plan:         planStorageAccountEncryption,
+		},
+		{
+			Name:         stepTags,
+			Resource:     resourceKindTags,
+			DependsOn:    []stepName{stepResourceGroup, stepStorageAccount, stepKeyVault, stepKeyVaultKey},
+			Enabled:      func(config azureConfig) bool { return config.MergeTags && len(config.Tags) > 0 },
+			ResourceName: func(config azureConfig) string { return strings.Join(tagNames(config), ", ") },
+			State:        getTagsState,
+			Apply:        MergeTags,
+			Plan: func(ctx context.Context, clients *clientFactory, config azureConfig, state resourceState) ([]plannedOperation, error) {
+				if state.Status != resourceStatusMisconfigured {
+					return nil, nil
+				}
+				return []plannedOperation{{Action: plannedActionUpdate, Resource: resourceKindTags, Name: strings.Join(tagNames(config), ", "), Details: state.Reason}}, nil
+			},
+		},
+	}
+}
+
+// sortSteps orders the steps so that every step comes after its dependencies
+func sortSteps(steps []step) ([]step, error) {
+	byName := map[stepName]step{}
+	for _, s := range steps {
+		if _, ok := byName[s.Name]; ok {
+			return nil, fmt.Errorf("step %q is defined more than once", s.Name)
+		}
+		byName[s.Name] = s
+	}
+
+	sorted := []step{}
+	visited := map[stepName]bool{}
+	visiting := map[stepName]bool{}
+
+	var visit func(s step) error
+	visit = func(s step) error {
+		if visited[s.Name] {
+			return nil
+		}
+		if visiting[s.Name] {
+			return fmt.Errorf("step %q has a circular dependency", s.Name)
+		}
+		visiting[s.Name] = true
+
+		for _, dependency := range append(slices.Clone(s.DependsOn), s.After...) {
+			d, ok := byName[dependency]
+			if !ok {
+				return fmt.Errorf("step %q depends on unknown step %q", s.Name, dependency)
+			}
+			err := visit(d)
+			if err != nil {
+				return err
+			}
+		}
+
+		visiting[s.Name] = false
+		visited[s.Name] = true
+		sorted = append(sorted, s)
+		return nil
+	}
+
+	for _, s := range steps {
+		err := visit(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return sorted, nil
+}
+
+// getDisabledSteps returns the steps that are disabled, either by configuration or because a dependency is disabled
+func getDisabledSteps(steps []step, config azureConfig) map[stepName]string {
+	disabledByConfig := map[stepName]bool{}
+	for _, name := range config.DisabledSteps {
+		disabledByConfig[stepName(name)] = true
+	}
+
+	disabled := map[stepName]string{}
+	for _, s := range steps {
+		if disabledByConfig[s.Name] || (s.Enabled != nil && !s.Enabled(config)) {
+			disabled[s.Name] = "disabled by configuration"
+			continue
+		}
+
+		for _, dependency := range s.DependsOn {
+			if _, ok := disabled[dependency]; ok {
+				disabled[s.Name] = fmt.Sprintf("dependency %s is disabled", dependency)
+				break
+			}
+		}
+	}
+
+	return disabled
+}
+
+// applySteps runs Apply for every enabled step once its dependencies have completed.
+// Independent steps run concurrently, the first failure cancels the steps that are still running.
+// Without parallel the steps run one at a time in dependency order.
+func applySteps(ctx context.Context, clients *clientFactory, config azureConfig, steps []step) ([]stepOutcome, error) {
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sorted, err := sortSteps(steps)
+	if err != nil {
+		return nil, err
+	}
+
+	parentCtx := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// limit is used as a semaphore for the number of steps running at the same time
+	limit := make(chan struct{}, len(sorted))
+	if !config.Parallel {
+		limit = make(chan struct{}, 1)
+	}
+
+	disabled := getDisabledSteps(sorted, config)
+	done := map[stepName]chan struct{}{}
+	for _, s := range sorted {
+		done[s.Name] = make(chan struct{})
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	outcomes := map[stepName]stepOutcome{}
+	errs := []error{}
+
+	setOutcome := func(outcome stepOutcome, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		outcomes[outcome.Step] = outcome
+		if err != nil {
+			errs = append(errs, err)
+			cancel()
+		}
+	}
+
+	dependencyCreated := func(s step) bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		for _, dependency := range s.DependsOn {
+			if outcomes[dependency].Result == stepResultCreated {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	dependencyNotCompleted := func(s step) string {
+		mu.Lock()
+		defer mu.Unlock()
+
+		for _, dependency := range s.DependsOn {
+			if outcomes[dependency].Result == stepResultFailed || outcomes[dependency].Result == stepResultCanceled {
+				return fmt.Sprintf("dependency %s did not complete", dependency)
+			}
+		}
+
+		return ""
+	}
+
+	for i, s := range sorted {
+		wait := append(slices.Clone(s.DependsOn), s.After...)
+		if !config.Parallel && i > 0 {
+			wait = append(wait, sorted[i-1].Name)
+		}
+
+		wg.Add(1)
+		go func(s step) {
+			defer wg.Done()
+			defer close(done[s.Name])
+
+			for _, dependency := range wait {
+				<-done[dependency]
+			}
+
+			if reason, ok := disabled[s.Name]; ok {
+				log.Info("Step skipped", "step", s.Name, "reason", reason)
+				setOutcome(stepOutcome{Step: s.Name, Result: stepResultSkipped, Reason: reason}, nil)
+				return
+			}
+
+			if reason := dependencyNotCompleted(s); reason != "" {
+				setOutcome(stepOutcome{Step: s.Name, Result: stepResultCanceled, Reason: reason}, nil)
+				return
+			}
+
+			select {
+			case limit <- struct{}{}:
+				defer func() { <-limit }()
+			case <-ctx.Done():
+			}
+
+			if ctx.Err() != nil {
+				setOutcome(stepOutcome{Step: s.Name, Result: stepResultCanceled, Reason: ctx.Err().Error()}, nil)
+				return
+			}
+
+			stepCtx := ctx
+			if dependencyCreated(s) {
+				stepCtx = context.WithValue(ctx, dependencyCreatedKey{}, true)
+			}
+
+			result, err := s.Apply(stepCtx, clients, config)
+			if err != nil && errors.Is(err, context.Canceled) && ctx.Err() != nil {
+				setOutcome(stepOutcome{Step: s.Name, Result: stepResultCanceled, Reason: err.Error()}, nil)
+				return
+			}
+
+			if err != nil {
+				setOutcome(stepOutcome{Step: s.Name, Result: stepResultFailed, Reason: err.Error()}, fmt.Errorf("step %s failed: %w", s.Name, azerrors.Classify(err)))
+				return
+			}
+
+			setOutcome(stepOutcome{Step: s.Name, Result: result}, nil)
+		}(s)
+	}
+
+	wg.Wait()
+
+	sortedOutcomes := []stepOutcome{}
+	for _, s := range sorted {
+		sortedOutcomes = append(sortedOutcomes, outcomes[s.Name])
+	}
+
+	if len(errs) == 0 && parentCtx.Err() != nil {
+		return sortedOutcomes, parentCtx.Err()
+	}
+
+	return sortedOutcomes, errors.Join(errs...)
+}
+
+// getStepStates returns the observed state of every enabled step in dependency order
+func getStepStates(ctx context.Context, clients *clientFactory, config azureConfig, steps []step) ([]step, map[stepName]resourceState, error) {
+	sorted, err := sortSteps(steps)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	disabled := getDisabledSteps(sorted, config)
+	enabled := []step{}
+	resources := map[stepName]string{}
+	states := map[stepName]resourceState{}
+	for _, s := range sorted {
+		resources[s.Name] = s.Resource
+		if _, ok := disabled[s.Name]; ok {
+			continue
+		}
+
+		state, err := getStepState(ctx, clients, config, s, resources, states)
+		if err != nil {
+			return nil, nil, fmt.Errorf("step %s failed: %w", s.Name, azerrors.Classify(err))
+		}
+
+		enabled = append(enabled, s)
+		states[s.Name] = state
+	}
+
+	return enabled, states, nil
+}
+
+func getStepState(ctx context.Context, clients *clientFactory, config azureConfig, s step, resources map[stepName]string, states map[stepName]resourceState) (resourceState, error) {
+	for _, dependency := range s.DependsOn {
+		if states[dependency].Status == resourceStatusMissing {
+			return parentMissingState(resources[dependency]), nil
+		}
+	}
+
+	return s.State(ctx, clients, config)
+}
+
+func accessPolicyResourceName(config azureConfig) string {
+	if config.ServicePrincipalObjectID != "" {
+		return config.ServicePrincipalObjectID
+	}
+
+	return "current identity"
+}
+
+func logStepOutcomes(log logr.Logger, outcomes []stepOutcome) {
+	for _, outcome := range outcomes {
+		if outcome.Reason != "" {
+			log.Info("Step completed", "step", outcome.Step, "result", outcome.Result, "reason", outcome.Reason)
+			continue
+		}
+		log.Info("Step completed", "step", outcome.Step, "result", outcome.Result)
+	}
+}
@@ -0,0 +1,322 @@
+package azure
+
+import (
+	"context"
+	"errors"
+	"io"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+var (
+	errStepA = errors.New("step a failed")
+	errStepB = errors.New("step b failed")
+)
+
+func applyResult(result stepResult) func(context.Context, *clientFactory, azureConfig) (stepResult, error) {
+	return func(ctx context.Context, clients *clientFactory, config azureConfig) (stepResult, error) {
+		return result, nil
+	}
+}
+
+func applyError(err error) func(context.Context, *clientFactory, azureConfig) (stepResult, error) {
+	return func(ctx context.Context, clients *clientFactory, config azureConfig) (stepResult, error) {
+		return "", err
+	}
+}
+
+// applyUntilCanceled blocks until the step is canceled
+func applyUntilCanceled(ctx context.Context, clients *clientFactory, config azureConfig) (stepResult, error) {
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+func TestApplySteps(t *testing.T) {
+	disabled := func(config azureConfig) bool { return false }
+
+	cases := []struct {
+		name     string
+		steps    func() []step
+		expected map[stepName]stepResult
+		errs     []error
+	}{
+		{
+			name: "dependencies run after their dependency",
+			steps: func() []step {
+				return []step{
+					{Name: "a", Apply: applyResult(stepResultCreated)},
+					{Name: "b", DependsOn: []stepName{"a"}, Apply: applyResult(stepResultUnchanged)},
+				}
+			},
+			expected: map[stepName]stepResult{"a": stepResultCreated, "b": stepResultUnchanged},
+		},
+		{
+			name: "failing step cancels its siblings and dependents",
+			steps: func() []step {
+				return []step{
+					{Name: "a", Apply: applyError(errStepA)},
+					{Name: "b", Apply: applyUntilCanceled},
+					{Name: "c", DependsOn: []stepName{"a"}, Apply: applyResult(stepResultCreated)},
+				}
+			},
+			expected: map[stepName]stepResult{"a": stepResultFailed, "b": stepResultCanceled, "c": stepResultCanceled},
+			errs:     []error{errStepA},
+		},
+		{
+			name: "errors of concurrent steps are joined",
+			steps: func() []step {
+				started := sync.WaitGroup{}
+				started.Add(2)
+				failAfterBoth := func(err error) func(context.Context, *clientFactory, azureConfig) (stepResult, error) {
+					return func(ctx context.Context, clients *clientFactory, config azureConfig) (stepResult, error) {
+						started.Done()
+						started.Wait()
+						return "", err
+					}
+				}
+				return []step{
+					{Name: "a", Apply: failAfterBoth(errStepA)},
+					{Name: "b", Apply: failAfterBoth(errStepB)},
+				}
+			},
+			expected: map[stepName]stepResult{"a": stepResultFailed, "b": stepResultFailed},
+			errs:     []error{errStepA, errStepB},
+		},
+		{
+			name: "dependents of a disabled step are skipped",
+			steps: func() []step {
+				return []step{
+					{Name: "a", Enabled: disabled, Apply: applyResult(stepResultCreated)},
+					{Name: "b", DependsOn: []stepName{"a"}, Apply: applyResult(stepResultCreated)},
+					{Name: "c", After: []stepName{"a"}, Apply: applyResult(stepResultCreated)},
+				}
+			},
+			expected: map[stepName]stepResult{"a": stepResultSkipped, "b": stepResultSkipped, "c": stepResultCreated},
+		},
+		{
+			name: "steps after a failed step are canceled",
+			steps: func() []step {
+				return []step{
+					{Name: "a", Apply: applyError(errStepA)},
+					{Name: "b", After: []stepName{"a"}, Apply: applyResult(stepResultCreated)},
+				}
+			},
+			expected: map[stepName]stepResult{"a": stepResultFailed, "b": stepResultCanceled},
+			errs:     []error{errStepA},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			outcomes, err := applySteps(newTestContext(t), nil, azureConfig{Parallel: true}, c.steps())
+
+			for _, expected := range c.errs {
+				if !errors.Is(err, expected) {
+					t.Errorf("error %v doesn't contain %v", err, expected)
+				}
+			}
+			if len(c.errs) == 0 && err != nil {
+				t.Errorf("applySteps: %v", err)
+			}
+
+			if len(outcomes) != len(c.expected) {
+				t.Fatalf("%d outcomes, expected %d: %v", len(outcomes), len(c.expected), outcomes)
+			}
+			for _, outcome := range outcomes {
+				if outcome.Result != c.expected[outcome.Step] {
+					t.Errorf("step %s result is %s, expected %s (%s)", outcome.Step, outcome.Result, c.expected[outcome.Step], outcome.Reason)
+				}
+			}
+		})
+	}
+}
+
+// recordingSteps returns independent steps that record the order they ran in and the most steps running at the same time
+func recordingSteps(names ...stepName) ([]step, *[]stepName, *atomic.Int32) {
+	var mu sync.Mutex
+	order := []stepName{}
+	running := atomic.Int32{}
+	maxRunning := &atomic.Int32{}
+
+	steps := []step{}
+	for _, name := range names {
+		name := name
+		steps = append(steps, step{
+			Name: name,
+			Apply: func(ctx context.Context, clients *clientFactory, config azureConfig) (stepResult, error) {
+				current := running.Add(1)
+				defer running.Add(-1)
+				for {
+					previous := maxRunning.Load()
+					if current <= previous || maxRunning.CompareAndSwap(previous, current) {
+						break
+					}
+				}
+
+				mu.Lock()
+				order = append(order, name)
+				mu.Unlock()
+
+				// keep the step running until the others had a chance to start
+				for i := 0; i < 1000; i++ {
+					if running.Load() > 1 {
+						break
+					}
+					runtime.Gosched()
+				}
+
+				return stepResultCreated, nil
+			},
+		})
+	}
+
+	return steps, &order, maxRunning
+}
+
+func TestApplyStepsSerial(t *testing.T) {
+	// b waits for a, so c would run before b if the free steps ran first
+	steps, order, maxRunning := recordingSteps("a", "b", "c", "d")
+	steps[1].DependsOn = []stepName{"a"}
+	steps[3].After = []stepName{"b"}
+
+	_, err := applySteps(newTestContext(t), nil, azureConfig{Parallel: false}, steps)
+	if err != nil {
+		t.Fatalf("applySteps: %v", err)
+	}
+
+	if running := maxRunning.Load(); running != 1 {
+		t.Errorf("%d steps ran at the same time, expected 1", running)
+	}
+
+	expected := []stepName{"a", "b", "c", "d"}
+	for i := range expected {
+		if i >= len(*order) || (*order)[i] != expected[i] {
+			t.Fatalf("steps ran in order %v, expected the sorted order %v", *order, expected)
+		}
+	}
+}
+
+func TestApplyStepsParallel(t *testing.T) {
+	steps, _, maxRunning := recordingSteps("a", "b", "c")
+
+	_, err := applySteps(newTestContext(t), nil, azureConfig{Parallel: true}, steps)
+	if err != nil {
+		t.Fatalf("applySteps: %v", err)
+	}
+
+	if running := maxRunning.Load(); running < 2 {
+		t.Errorf("independent steps didn't run concurrently, at most %d ran at the same time", running)
+	}
+}
+
+func TestSortSteps(t *testing.T) {
+	cases := []struct {
+		name     string
+		steps    []step
+		expected []stepName
+		err      string
+	}{
+		{
+			name: "dependencies come first",
+			steps: []step{
+				{Name: "c", DependsOn: []stepName{"b"}},
+				{Name: "b", After: []stepName{"a"}},
+				{Name: "a"},
+			},
+			expected: []stepName{"a", "b", "c"},
+		},
+		{
+			name:  "duplicate step",
+			steps: []step{{Name: "a"}, {Name: "a"}},
+			err:   `step "a" is defined more than once`,
+		},
+		{
+			name:  "circular dependency",
+			steps: []step{{Name: "a", DependsOn: []stepName{"b"}}, {Name: "b", After: []stepName{"a"}}},
+			err:   `step "a" has a circular dependency`,
+		},
+		{
+			name:  "unknown dependency",
+			steps: []step{{Name: "a", DependsOn: []stepName{"b"}}},
+			err:   `step "a" depends on unknown step "b"`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sorted, err := sortSteps(c.steps)
+			if c.err != "" {
+				if err == nil || err.Error() != c.err {
+					t.Fatalf("sortSteps returned %v, expected %q", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("sortSteps: %v", err)
+			}
+
+			names := []stepName{}
+			for _, s := range sorted {
+				names = append(names, s.Name)
+			}
+			if !slices.Equal(names, c.expected) {
+				t.Errorf("sorted steps are %v, expected %v", names, c.expected)
+			}
+		})
+	}
+}
+
+func TestGetDisabledStepsPropagatesToDependents(t *testing.T) {
+	sorted, err := sortSteps(getSteps())
+	if err != nil {
+		t.Fatalf("sortSteps: %v", err)
+	}
+
+	disabled := getDisabledSteps(sorted, newTestConfig(t, "--disable-step", "keyvault"))
+	expected := map[stepName]string{
+		stepKeyVault:             "disabled by configuration",
+		stepKeyVaultLock:         "dependency keyvault is disabled",
+		stepKeyVaultAccessPolicy: "dependency keyvault is disabled",
+		stepKeyVaultKey:          "dependency keyvault is disabled",
+	}
+	for name, reason := range expected {
+		if disabled[name] != reason {
+			t.Errorf("step %s is %q, expected %q", name, disabled[name], reason)
+		}
+	}
+
+	for _, name := range []stepName{stepResourceGroup, stepStorageAccount, stepStorageAccountContainer, stepStorageAccountLock} {
+		if reason, ok := disabled[name]; ok {
+			t.Errorf("step %s is %q, expected it to be enabled", name, reason)
+		}
+	}
+}
+
+func TestRunActionWithoutKeyVault(t *testing.T) {
+	ctx := newTestContext(t)
+	server, clients := newTestClients(t)
+	config := newTestConfig(t, "--disable-step", "keyvault")
+
+	err := runAction(ctx, clients, config, io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	for _, request := range writeRequests(server, 0) {
+		if strings.Contains(strings.ToLower(request.Path), "microsoft.keyvault") {
+			t.Errorf("disabled keyvault step sent %s %s", request.Method, request.Path)
+		}
+	}
+	if _, ok := server.Resource(testContainerID); !ok {
+		t.Error("container wasn't created without the keyvault")
+	}
+
+	err = runStatus(ctx, clients, config, io.Discard)
+	if err != nil {
+		t.Errorf("runStatus: %v", err)
+	}
+}
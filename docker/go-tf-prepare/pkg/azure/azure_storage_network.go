@@ -0,0 +1,331 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/storage/armstorage"
+	"github.com/go-logr/logr"
+	"github.com/xenitab/github-actions/docker/go-tf-prepare/pkg/azure/internal/azerrors"
+)
+
+// privateDNSZoneGroupName is the name of the DNS zone group of the private endpoint
+const privateDNSZoneGroupName = "default"
+
+func storageAccountID(clients *clientFactory, config azureConfig) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Storage/storageAccounts/%s", clients.subscriptionID, config.ResourceGroupName, config.StorageAccountName)
+}
+
+// privateEndpointName returns the name of the private endpoint for the blob service of the Storage Account
+func privateEndpointName(config azureConfig) string {
+	return fmt.Sprintf("pe-%s-blob", config.StorageAccountName)
+}
+
+func storageAccountNetworkRuleSet(config azureConfig) *armstorage.NetworkRuleSet {
+	defaultAction := armstorage.DefaultActionAllow
+	if len(config.StorageAccountIPRules) > 0 || len(config.StorageAccountVirtualNetworkRules) > 0 {
+		defaultAction = armstorage.DefaultActionDeny
+	}
+
+	ipRules := []*armstorage.IPRule{}
+	for _, ipRule := range config.StorageAccountIPRules {
+		ipRules = append(ipRules, &armstorage.IPRule{IPAddressOrRange: to.Ptr(ipRule), Action: to.Ptr("Allow")})
+	}
+
+	virtualNetworkRules := []*armstorage.VirtualNetworkRule{}
+	for _, virtualNetworkRule := range config.StorageAccountVirtualNetworkRules {
+		virtualNetworkRules = append(virtualNetworkRules, &armstorage.VirtualNetworkRule{VirtualNetworkResourceID: to.Ptr(virtualNetworkRule), Action: to.Ptr("Allow")})
+	}
+
+	return &armstorage.NetworkRuleSet{
+		Bypass:              to.Ptr(armstorage.BypassAzureServices),
+		DefaultAction:       to.Ptr(defaultAction),
+		IPRules:             ipRules,
+		VirtualNetworkRules: virtualNetworkRules,
+	}
+}
+
+func storageAccountNetworkRuleSetEqual(a, b *armstorage.NetworkRuleSet) bool {
+	defaultAction := func(ruleSet *armstorage.NetworkRuleSet) armstorage.DefaultAction {
+		if ruleSet == nil || ruleSet.DefaultAction == nil {
+			return armstorage.DefaultActionAllow
+		}
+		return *ruleSet.DefaultAction
+	}
+
+	ipRules := func(ruleSet *armstorage.NetworkRuleSet) []string {
+		values := []string{}
+		if ruleSet == nil {
+			return values
+		}
+		for _, ipRule := range ruleSet.IPRules {
+			if ipRule != nil && ipRule.IPAddressOrRange != nil {
+				values = append(values, *ipRule.IPAddressOrRange)
+			}
+		}
+		return values
+	}
+
+	virtualNetworkRules := func(ruleSet *armstorage.NetworkRuleSet) []string {
+		values := []string{}
+		if ruleSet == nil {
+			return values
+		}
+		for _, virtualNetworkRule := range ruleSet.VirtualNetworkRules {
+			if virtualNetworkRule != nil && virtualNetworkRule.VirtualNetworkResourceID != nil {
+				values = append(values, *virtualNetworkRule.VirtualNetworkResourceID)
+			}
+		}
+		return values
+	}
+
+	return strings.EqualFold(string(defaultAction(a)), string(defaultAction(b))) &&
+		stringSetsEqual(ipRules(a), ipRules(b)) &&
+		stringSetsEqual(virtualNetworkRules(a), virtualNetworkRules(b))
+}
+
+// getStorageAccountNetworkDifferences returns how the network and authentication settings of the Storage Account differ from the configuration
+func getStorageAccountNetworkDifferences(config azureConfig, properties *armstorage.AccountProperties) []string {
+	reasons := []string{}
+
+	publicNetworkAccess := armstorage.PublicNetworkAccessEnabled
+	if properties.PublicNetworkAccess != nil {
+		publicNetworkAccess = *properties.PublicNetworkAccess
+	}
+	if !strings.EqualFold(string(publicNetworkAccess), config.StorageAccountPublicNetworkAccess) {
+		reasons = append(reasons, fmt.Sprintf("public network access is %s", publicNetworkAccess))
+	}
+
+	if !storageAccountNetworkRuleSetEqual(properties.NetworkRuleSet, storageAccountNetworkRuleSet(config)) {
+		reasons = append(reasons, "network rules differ")
+	}
+
+	sharedKeyAccess := properties.AllowSharedKeyAccess == nil || *properties.AllowSharedKeyAccess
+	if sharedKeyAccess != config.StorageAccountSharedKeyAccess {
+		reasons = append(reasons, fmt.Sprintf("shared key access is %s", enabledString(sharedKeyAccess)))
+	}
+
+	defaultToOAuth := properties.DefaultToOAuthAuthentication != nil && *properties.DefaultToOAuthAuthentication
+	if defaultToOAuth != config.StorageAccountDefaultToOAuth {
+		reasons = append(reasons, fmt.Sprintf("default to OAuth authentication is %s", enabledString(defaultToOAuth)))
+	}
+
+	return reasons
+}
+
+// CreatePrivateEndpoint creates Azure Private Endpoint for the Storage Account blob service, with a private DNS zone group if configured (if it doesn't exist) or returns error
+func CreatePrivateEndpoint(ctx context.Context, clients *clientFactory, config azureConfig) (stepResult, error) {
+	resourceGroupName := config.ResourceGroupName
+	resourceGroupLocation := config.ResourceGroupLocation
+	name := privateEndpointName(config)
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	state, err := getPrivateEndpointState(ctx, clients, config)
+	if err != nil {
+		return "", err
+	}
+
+	if state.Status == resourceStatusPresent {
+		log.Info("Azure Private Endpoint already exists", "privateEndpointName", name)
+		return stepResultUnchanged, nil
+	}
+
+	client, err := clients.privateEndpointsClient()
+	if err != nil {
+		log.Error(err, "armnetwork.NewPrivateEndpointsClient")
+		return "", err
+	}
+
+	poller, err := client.BeginCreateOrUpdate(ctx, resourceGroupName, name, armnetwork.PrivateEndpoint{
+		Location: to.Ptr(resourceGroupLocation),
+		Tags:     resourceTags(config),
+		Properties: &armnetwork.PrivateEndpointProperties{
+			Subnet: &armnetwork.Subnet{ID: to.Ptr(config.PrivateEndpointSubnetID)},
+			PrivateLinkServiceConnections: []*armnetwork.PrivateLinkServiceConnection{
+				{
+					Name: to.Ptr(name),
+					Properties: &armnetwork.PrivateLinkServiceConnectionProperties{
+						PrivateLinkServiceID: to.Ptr(storageAccountID(clients, config)),
+						GroupIDs:             []*string{to.Ptr("blob")},
+					},
+				},
+			},
+		},
+	}, nil)
+	if err != nil {
+		log.Error(err, "client.BeginCreateOrUpdate")
+		return "", err
+	}
+
+	_, err = poller.PollUntilDone(ctx, &runtime.PollUntilDoneOptions{
+		Frequency: 10 * time.Second,
+	})
+	if err != nil {
+		log.Error(err, "poller.PollUntilDone")
+		return "", err
+	}
+
+	log.Info("Azure Private Endpoint created or updated", "privateEndpointName", name)
+
+	if config.PrivateDNSZoneID != "" {
+		client, err := clients.privateDNSZoneGroupsClient()
+		if err != nil {
+			log.Error(err, "armnetwork.NewPrivateDNSZoneGroupsClient")
+			return "", err
+		}
+
+		poller, err := client.BeginCreateOrUpdate(ctx, resourceGroupName, name, privateDNSZoneGroupName, armnetwork.PrivateDNSZoneGroup{
+			Properties: &armnetwork.PrivateDNSZoneGroupPropertiesFormat{
+				PrivateDNSZoneConfigs: []*armnetwork.PrivateDNSZoneConfig{
+					{
+						Name: to.Ptr(strings.ReplaceAll(path.Base(config.PrivateDNSZoneID), ".", "-")),
+						Properties: &armnetwork.PrivateDNSZonePropertiesFormat{
+							PrivateDNSZoneID: to.Ptr(config.PrivateDNSZoneID),
+						},
+					},
+				},
+			},
+		}, nil)
+		if err != nil {
+			log.Error(err, "client.BeginCreateOrUpdate")
+			return "", err
+		}
+
+		_, err = poller.PollUntilDone(ctx, &runtime.PollUntilDoneOptions{
+			Frequency: 10 * time.Second,
+		})
+		if err != nil {
+			log.Error(err, "poller.PollUntilDone")
+			return "", err
+		}
+
+		log.Info("Azure Private DNS Zone Group created or updated", "privateEndpointName", name, "privateDNSZoneID", config.PrivateDNSZoneID)
+	}
+
+	if state.Status == resourceStatusMisconfigured {
+		return stepResultUpdated, nil
+	}
+
+	return stepResultCreated, nil
+}
+
+func getPrivateEndpointState(ctx context.Context, clients *clientFactory, config azureConfig) (resourceState, error) {
+	resourceGroupName := config.ResourceGroupName
+	name := privateEndpointName(config)
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return resourceState{}, err
+	}
+
+	client, err := clients.privateEndpointsClient()
+	if err != nil {
+		log.Error(err, "armnetwork.NewPrivateEndpointsClient")
+		return resourceState{}, err
+	}
+
+	res, err := client.Get(ctx, resourceGroupName, name, nil)
+	if azerrors.IsNotFound(err) {
+		return resourceState{Status: resourceStatusMissing}, nil
+	}
+
+	if err != nil {
+		log.Error(err, "client.Get")
+		return resourceState{}, err
+	}
+
+	reasons := getPrivateEndpointDifferences(clients, config, res.PrivateEndpoint.Properties)
+
+	if config.PrivateDNSZoneID != "" {
+		reason, err := getPrivateDNSZoneGroupDifference(ctx, clients, config)
+		if err != nil {
+			return resourceState{}, err
+		}
+
+		if reason != "" {
+			reasons = append(reasons, reason)
+		}
+	}
+
+	if len(reasons) > 0 {
+		return resourceState{Status: resourceStatusMisconfigured, Reason: strings.Join(reasons, ", ")}, nil
+	}
+
+	return resourceState{Status: resourceStatusPresent}, nil
+}
+
+func getPrivateEndpointDifferences(clients *clientFactory, config azureConfig, properties *armnetwork.PrivateEndpointProperties) []string {
+	if properties == nil {
+		return []string{"private endpoint has no properties"}
+	}
+
+	reasons := []string{}
+
+	if properties.Subnet == nil || properties.Subnet.ID == nil || !strings.EqualFold(*properties.Subnet.ID, config.PrivateEndpointSubnetID) {
+		reasons = append(reasons, "subnet differs")
+	}
+
+	connected := false
+	for _, connection := range properties.PrivateLinkServiceConnections {
+		if connection == nil || connection.Properties == nil || connection.Properties.PrivateLinkServiceID == nil {
+			continue
+		}
+
+		if !strings.EqualFold(*connection.Properties.PrivateLinkServiceID, storageAccountID(clients, config)) {
+			continue
+		}
+
+		for _, groupID := range connection.Properties.GroupIDs {
+			if groupID != nil && strings.EqualFold(*groupID, "blob") {
+				connected = true
+			}
+		}
+	}
+
+	if !connected {
+		reasons = append(reasons, "not connected to the storage account blob service")
+	}
+
+	return reasons
+}
+
+func getPrivateDNSZoneGroupDifference(ctx context.Context, clients *clientFactory, config azureConfig) (string, error) {
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	client, err := clients.privateDNSZoneGroupsClient()
+	if err != nil {
+		log.Error(err, "armnetwork.NewPrivateDNSZoneGroupsClient")
+		return "", err
+	}
+
+	res, err := client.Get(ctx, config.ResourceGroupName, privateEndpointName(config), privateDNSZoneGroupName, nil)
+	if azerrors.IsNotFound(err) {
+		return "private DNS zone group is missing", nil
+	}
+
+	if err != nil {
+		log.Error(err, "client.Get")
+		return "", err
+	}
+
+	if res.PrivateDNSZoneGroup.Properties != nil {
+		for _, zoneConfig := range res.PrivateDNSZoneGroup.Properties.PrivateDNSZoneConfigs {
+			if zoneConfig != nil && zoneConfig.Properties != nil && zoneConfig.Properties.PrivateDNSZoneID != nil && strings.EqualFold(*zoneConfig.Properties.PrivateDNSZoneID, config.PrivateDNSZoneID) {
+				return "", nil
+			}
+		}
+	}
+
+	return "private DNS zone differs", nil
+}
@@ -0,0 +1,126 @@
+package azure
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+const (
+	testSubnetID              = "/subscriptions/" + testSubscriptionID + "/resourceGroups/rg-network/providers/Microsoft.Network/virtualNetworks/vnet/subnets/endpoints"
+	testPrivateDNSZoneID      = "/subscriptions/" + testSubscriptionID + "/resourceGroups/rg-network/providers/Microsoft.Network/privateDnsZones/privatelink.blob.core.windows.net"
+	testPrivateEndpointID     = "/subscriptions/" + testSubscriptionID + "/resourceGroups/rg-test/providers/Microsoft.Network/privateEndpoints/pe-satest-blob"
+	testPrivateDNSZoneGroupID = testPrivateEndpointID + "/privateDnsZoneGroups/default"
+)
+
+func TestStorageAccountNetworkLockdown(t *testing.T) {
+	ctx := newTestContext(t)
+	server, clients := newTestClients(t)
+
+	args := []string{
+		"--storage-account-ip-rule", "203.0.113.0/24",
+		"--storage-account-virtual-network-rule", testSubnetID,
+		"--storage-account-shared-key-access=false",
+		"--storage-account-default-to-oauth",
+	}
+	err := runAction(ctx, clients, newTestConfig(t, args...), io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	account, _ := server.Resource(testStorageAccountID)
+	properties, _ := account["properties"].(map[string]any)
+	networkACLs, _ := properties["networkAcls"].(map[string]any)
+	if networkACLs["defaultAction"] != "Deny" || networkACLs["bypass"] != "AzureServices" {
+		t.Errorf("network rules are %v, expected deny by default with the Azure services bypass", networkACLs)
+	}
+	if ipRules, _ := networkACLs["ipRules"].([]any); len(ipRules) != 1 {
+		t.Errorf("ip rules are %v, expected 203.0.113.0/24", ipRules)
+	}
+	if virtualNetworkRules, _ := networkACLs["virtualNetworkRules"].([]any); len(virtualNetworkRules) != 1 {
+		t.Errorf("virtual network rules are %v, expected the subnet", virtualNetworkRules)
+	}
+	if properties["allowSharedKeyAccess"] != false || properties["defaultToOAuthAuthentication"] != true {
+		t.Errorf("shared key access is %v and default to OAuth is %v, expected false and true", properties["allowSharedKeyAccess"], properties["defaultToOAuthAuthentication"])
+	}
+
+	state, err := getStorageAccountState(ctx, clients, newTestConfig(t, args...))
+	if err != nil {
+		t.Fatalf("getStorageAccountState: %v", err)
+	}
+	if state.Status != resourceStatusPresent {
+		t.Errorf("status is %s (%s), expected %s", state.Status, state.Reason, resourceStatusPresent)
+	}
+
+	state, err = getStorageAccountState(ctx, clients, newTestConfig(t))
+	if err != nil {
+		t.Fatalf("getStorageAccountState: %v", err)
+	}
+	for _, reason := range []string{"network rules differ", "shared key access is disabled", "default to OAuth authentication is enabled"} {
+		if !strings.Contains(state.Reason, reason) {
+			t.Errorf("reason %q doesn't contain %q", state.Reason, reason)
+		}
+	}
+}
+
+func TestPrivateEndpoint(t *testing.T) {
+	ctx := newTestContext(t)
+	server, clients := newTestClients(t)
+
+	config := newTestConfig(t, "--private-endpoint-subnet-id", testSubnetID, "--private-dns-zone-id", testPrivateDNSZoneID)
+	err := runAction(ctx, clients, config, io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	endpoint, ok := server.Resource(testPrivateEndpointID)
+	if !ok {
+		t.Fatal("private endpoint wasn't created")
+	}
+	properties, _ := endpoint["properties"].(map[string]any)
+	subnet, _ := properties["subnet"].(map[string]any)
+	if subnet["id"] != testSubnetID {
+		t.Errorf("subnet is %v, expected %s", subnet["id"], testSubnetID)
+	}
+	connections, _ := properties["privateLinkServiceConnections"].([]any)
+	if len(connections) != 1 {
+		t.Fatalf("private link service connections are %v, expected one to the blob service", connections)
+	}
+	connection, _ := connections[0].(map[string]any)
+	connectionProperties, _ := connection["properties"].(map[string]any)
+	if serviceID, _ := connectionProperties["privateLinkServiceId"].(string); !strings.EqualFold(serviceID, testStorageAccountID) {
+		t.Errorf("private link service is %q, expected the storage account", serviceID)
+	}
+
+	zoneGroup, ok := server.Resource(testPrivateDNSZoneGroupID)
+	if !ok {
+		t.Fatal("private DNS zone group wasn't created")
+	}
+	zoneGroupProperties, _ := zoneGroup["properties"].(map[string]any)
+	zoneConfigs, _ := zoneGroupProperties["privateDnsZoneConfigs"].([]any)
+	if len(zoneConfigs) != 1 {
+		t.Fatalf("private DNS zone configs are %v, expected the configured zone", zoneConfigs)
+	}
+	zoneConfig, _ := zoneConfigs[0].(map[string]any)
+	if zoneConfig["name"] != "privatelink-blob-core-windows-net" {
+		t.Errorf("private DNS zone config name is %v", zoneConfig["name"])
+	}
+
+	skip := len(server.Requests())
+	err = runAction(ctx, clients, config, io.Discard)
+	if err != nil {
+		t.Fatalf("second runAction: %v", err)
+	}
+	for _, request := range writeRequests(server, skip) {
+		t.Errorf("second run sent %s %s", request.Method, request.Path)
+	}
+
+	otherZoneID := strings.Replace(testPrivateDNSZoneID, "rg-network", "rg-dns", 1)
+	state, err := getPrivateEndpointState(ctx, clients, newTestConfig(t, "--private-endpoint-subnet-id", testSubnetID, "--private-dns-zone-id", otherZoneID))
+	if err != nil {
+		t.Fatalf("getPrivateEndpointState: %v", err)
+	}
+	if state.Status != resourceStatusMisconfigured || state.Reason != "private DNS zone differs" {
+		t.Errorf("status is %s (%s), expected the private DNS zone to differ", state.Status, state.Reason)
+	}
+}
@@ -0,0 +1,164 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armresources"
+	"github.com/go-logr/logr"
+)
+
+// tagScope is a resource created by tf-prepare that the tags are merged onto
+type tagScope struct {
+	Resource string
+	ID       string
+}
+
+// keyValueMap returns key=value pairs as a map, later pairs override earlier ones with the same key
+func keyValueMap(pairs []string) map[string]*string {
+	m := map[string]*string{}
+	for _, pair := range pairs {
+		key, value, _ := strings.Cut(pair, "=")
+		m[key] = to.Ptr(value)
+	}
+
+	return m
+}
+
+// resourceTags returns the configured tags of the created resources, nil if there are none
+func resourceTags(config azureConfig) map[string]*string {
+	if len(config.Tags) == 0 {
+		return nil
+	}
+
+	return keyValueMap(config.Tags)
+}
+
+// tagNames returns the sorted names of the configured tags
+func tagNames(config azureConfig) []string {
+	names := []string{}
+	for name := range keyValueMap(config.Tags) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func getTagScopes(clients *clientFactory, config azureConfig) []tagScope {
+	return []tagScope{
+		{Resource: resourceKindResourceGroup, ID: fmt.Sprintf("/subscriptions/%s/resourceGroups/%s", clients.subscriptionID, config.ResourceGroupName)},
+		{Resource: resourceKindStorageAccount, ID: storageAccountID(clients, config)},
+		{Resource: resourceKindKeyVault, ID: keyVaultScope(clients, config)},
+		{Resource: resourceKindKeyVaultKey, ID: fmt.Sprintf("%s/keys/%s", keyVaultScope(clients, config), config.KeyVaultKeyName)},
+	}
+}
+
+// MergeTags merges the configured tags onto the existing resources (if they differ) or returns error, tags that aren't configured are kept
+func MergeTags(ctx context.Context, clients *clientFactory, config azureConfig) (stepResult, error) {
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	client, err := clients.tagsClient()
+	if err != nil {
+		log.Error(err, "armresources.NewTagsClient")
+		return "", err
+	}
+
+	result := stepResultUnchanged
+	for _, scope := range getTagScopes(clients, config) {
+		reasons, err := getTagDifferences(ctx, clients, config, scope)
+		if err != nil {
+			return "", err
+		}
+
+		if len(reasons) == 0 {
+			continue
+		}
+
+		_, err = client.UpdateAtScope(ctx, scope.ID, armresources.TagsPatchResource{
+			Operation: to.Ptr(armresources.TagsPatchOperationMerge),
+			Properties: &armresources.Tags{
+				Tags: resourceTags(config),
+			},
+		}, nil)
+		if err != nil {
+			log.Error(err, "client.UpdateAtScope")
+			return "", err
+		}
+
+		log.Info("Azure tags merged", "resource", scope.Resource, "scope", scope.ID, "reason", strings.Join(reasons, ", "))
+		result = stepResultUpdated
+	}
+
+	if result == stepResultUnchanged {
+		log.Info("Azure tags already exist", "tags", strings.Join(tagNames(config), ", "))
+	}
+
+	return result, nil
+}
+
+func getTagsState(ctx context.Context, clients *clientFactory, config azureConfig) (resourceState, error) {
+	reasons := []string{}
+	for _, scope := range getTagScopes(clients, config) {
+		scopeReasons, err := getTagDifferences(ctx, clients, config, scope)
+		if err != nil {
+			return resourceState{}, err
+		}
+
+		for _, reason := range scopeReasons {
+			reasons = append(reasons, fmt.Sprintf("%s %s", scope.Resource, reason))
+		}
+	}
+
+	if len(reasons) > 0 {
+		return resourceState{Status: resourceStatusMisconfigured, Reason: strings.Join(reasons, ", ")}, nil
+	}
+
+	return resourceState{Status: resourceStatusPresent}, nil
+}
+
+// getTagDifferences returns how the tags of the resource differ from the configured tags
+func getTagDifferences(ctx context.Context, clients *clientFactory, config azureConfig, scope tagScope) ([]string, error) {
+	log, err := logr.FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := clients.tagsClient()
+	if err != nil {
+		log.Error(err, "armresources.NewTagsClient")
+		return nil, err
+	}
+
+	res, err := client.GetAtScope(ctx, scope.ID, nil)
+	if err != nil {
+		log.Error(err, "client.GetAtScope")
+		return nil, err
+	}
+
+	current := map[string]*string{}
+	if res.Properties != nil && res.Properties.Tags != nil {
+		current = res.Properties.Tags
+	}
+
+	tags := resourceTags(config)
+	reasons := []string{}
+	for _, name := range tagNames(config) {
+		currentValue, ok := lookupKey(current, name)
+		if !ok {
+			reasons = append(reasons, fmt.Sprintf("tag %s is missing", name))
+			continue
+		}
+		if currentValue != *tags[name] {
+			reasons = append(reasons, fmt.Sprintf("tag %s is %q", name, currentValue))
+		}
+	}
+
+	return reasons, nil
+}
@@ -0,0 +1,105 @@
+package azure
+
+import (
+	"io"
+	"maps"
+	"testing"
+
+	"github.com/xenitab/github-actions/docker/go-tf-prepare/pkg/azure/fake"
+)
+
+const testResourceGroupID = "/subscriptions/" + testSubscriptionID + "/resourceGroups/rg-test"
+
+// testTaggedResourceIDs are the resources tf-prepare sets the tags on
+var testTaggedResourceIDs = []string{
+	testResourceGroupID,
+	testStorageAccountID,
+	testKeyVaultID,
+	testKeyVaultID + "/keys/sops",
+}
+
+func getTestTags(t *testing.T, server *fake.ARM, id string) map[string]any {
+	t.Helper()
+
+	resource, ok := server.Resource(id)
+	if !ok {
+		t.Fatalf("resource %s doesn't exist", id)
+	}
+
+	tags, _ := resource["tags"].(map[string]any)
+	return tags
+}
+
+func TestTagsOnCreatedResources(t *testing.T) {
+	ctx := newTestContext(t)
+	server, clients := newTestClients(t)
+
+	err := runAction(ctx, clients, newTestConfig(t, "--tag", "env=dev", "--tag", "team=platform"), io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	expected := map[string]any{"env": "dev", "team": "platform"}
+	for _, id := range testTaggedResourceIDs {
+		if tags := getTestTags(t, server, id); !maps.Equal(tags, expected) {
+			t.Errorf("tags of %s are %v, expected %v", id, tags, expected)
+		}
+	}
+}
+
+func TestMergeTagsKeepsForeignTags(t *testing.T) {
+	ctx := newTestContext(t)
+	server, clients := newTestClients(t)
+
+	err := runAction(ctx, clients, newTestConfig(t), io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	resourceGroup, _ := server.Resource(testResourceGroupID)
+	resourceGroup["tags"] = map[string]any{"costcenter": "42", "Env": "prod"}
+	server.PutResource(testResourceGroupID, resourceGroup)
+
+	// existing resources are only tagged with merge-tags
+	skip := len(server.Requests())
+	err = runAction(ctx, clients, newTestConfig(t, "--tag", "env=dev"), io.Discard)
+	if err != nil {
+		t.Fatalf("runAction without merge-tags: %v", err)
+	}
+	for _, request := range writeRequests(server, skip) {
+		t.Errorf("run without merge-tags sent %s %s", request.Method, request.Path)
+	}
+
+	config := newTestConfig(t, "--tag", "env=dev", "--merge-tags")
+	state, err := getTagsState(ctx, clients, config)
+	if err != nil {
+		t.Fatalf("getTagsState: %v", err)
+	}
+	expectedReason := `Resource Group tag env is "prod", Storage Account tag env is missing, KeyVault tag env is missing, KeyVault Key tag env is missing`
+	if state.Status != resourceStatusMisconfigured || state.Reason != expectedReason {
+		t.Errorf("status is %s (%s), expected %s (%s)", state.Status, state.Reason, resourceStatusMisconfigured, expectedReason)
+	}
+
+	err = runAction(ctx, clients, config, io.Discard)
+	if err != nil {
+		t.Fatalf("runAction with merge-tags: %v", err)
+	}
+
+	if tags := getTestTags(t, server, testResourceGroupID); !maps.Equal(tags, map[string]any{"costcenter": "42", "env": "dev"}) {
+		t.Errorf("resource group tags are %v, expected the foreign costcenter tag to be kept", tags)
+	}
+	for _, id := range testTaggedResourceIDs[1:] {
+		if tags := getTestTags(t, server, id); !maps.Equal(tags, map[string]any{"env": "dev"}) {
+			t.Errorf("tags of %s are %v, expected env=dev", id, tags)
+		}
+	}
+
+	skip = len(server.Requests())
+	err = runAction(ctx, clients, config, io.Discard)
+	if err != nil {
+		t.Fatalf("second runAction with merge-tags: %v", err)
+	}
+	for _, request := range writeRequests(server, skip) {
+		t.Errorf("second run with merge-tags sent %s %s", request.Method, request.Path)
+	}
+}
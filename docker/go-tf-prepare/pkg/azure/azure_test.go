@@ -0,0 +1,351 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/keyvault/armkeyvault"
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/testr"
+	"github.com/urfave/cli/v2"
+	"github.com/xenitab/github-actions/docker/go-tf-prepare/pkg/azure/fake"
+)
+
+const (
+	testTenantID       = "11111111-1111-1111-1111-111111111111"
+	testSubscriptionID = "33333333-3333-3333-3333-333333333333"
+	testObjectID       = "55555555-2222-2222-2222-222222222222"
+	testEndpoint       = "https://management.fake"
+	testKeyVaultID     = "/subscriptions/" + testSubscriptionID + "/resourceGroups/rg-test/providers/Microsoft.KeyVault/vaults/kv-test"
+)
+
+// newTestContext returns a context with a logger writing to the test log
+func newTestContext(t *testing.T) context.Context {
+	t.Helper()
+
+	return logr.NewContext(context.Background(), testr.New(t))
+}
+
+// newTestConfig returns the configuration parsed from the flags, with the required flags set to test values
+func newTestConfig(t *testing.T, args ...string) azureConfig {
+	t.Helper()
+
+	var config azureConfig
+	app := &cli.App{
+		Flags: Flags(),
+		Action: func(cli *cli.Context) error {
+			config = newAzureConfig(cli)
+			return config.Validate()
+		},
+	}
+
+	err := app.Run(append([]string{
+		"tf-prepare",
+		"--subscription-id", testSubscriptionID,
+		"--tenant-id", testTenantID,
+		"--resource-group-name", "rg-test",
+		"--resource-group-location", "westeurope",
+		"--storage-account-name", "satest",
+		"--storage-account-container", "tfstate",
+		"--keyvault-name", "kv-test",
+		"--keyvault-key-name", "sops",
+		"--service-principal-object-id", testObjectID,
+	}, args...))
+	if err != nil {
+		t.Fatalf("invalid configuration: %v", err)
+	}
+
+	return config
+}
+
+// newTestClients returns a fake Azure Resource Manager and a client factory sending every request to it
+func newTestClients(t *testing.T) (*fake.ARM, *clientFactory) {
+	t.Helper()
+
+	server := fake.NewARM()
+	server.DataPlaneURL = testEndpoint
+
+	environment := cloudEnvironment{
+		Configuration: cloud.Configuration{
+			ActiveDirectoryAuthorityHost: testEndpoint,
+			Services: map[cloud.ServiceName]cloud.ServiceConfiguration{
+				cloud.ResourceManager: {Audience: testEndpoint, Endpoint: testEndpoint},
+			},
+		},
+		Custom: true,
+	}
+
+	cred := &fake.Credential{TenantID: testTenantID, ObjectID: testObjectID}
+	clients := newClientFactory(testSubscriptionID, cred, environment, &arm.ClientOptions{
+		ClientOptions: policy.ClientOptions{
+			Retry:     policy.RetryOptions{MaxRetries: -1},
+			Transport: server.Transport(),
+		},
+	})
+
+	return server, clients
+}
+
+func TestGetKeyVaultDifferencesPurgeProtection(t *testing.T) {
+	properties := &armkeyvault.VaultProperties{
+		EnableRbacAuthorization:   to.Ptr(false),
+		SoftDeleteRetentionInDays: to.Ptr(int32(90)),
+	}
+
+	reasons := getKeyVaultDifferences(newTestConfig(t), properties)
+	if len(reasons) > 0 {
+		t.Errorf("existing vault without purge protection differs from the default configuration: %v", reasons)
+	}
+
+	reasons = getKeyVaultDifferences(newTestConfig(t, "--keyvault-purge-protection"), properties)
+	if !slices.Contains(reasons, "purge protection is disabled") {
+		t.Errorf("missing purge protection isn't reported when it is enabled: %v", reasons)
+	}
+}
+
+func TestGetAccessPolicyObjectID(t *testing.T) {
+	cases := []struct {
+		name     string
+		objectID string
+		cred     *fake.Credential
+		expected string
+		graph    string
+	}{
+		{
+			name:     "configured object ID",
+			objectID: "configured-object",
+			cred:     &fake.Credential{TenantID: testTenantID, ObjectID: testObjectID},
+			expected: "configured-object",
+		},
+		{
+			name:     "oid claim of the token",
+			cred:     &fake.Credential{TenantID: testTenantID, ObjectID: testObjectID, AppID: "app"},
+			expected: testObjectID,
+		},
+		{
+			name:     "service principal of the appid claim",
+			cred:     &fake.Credential{TenantID: testTenantID, AppID: "app"},
+			expected: "service-principal-object",
+			graph:    "/v1.0/servicePrincipals(appId='app')",
+		},
+		{
+			name:     "signed in user",
+			cred:     &fake.Credential{TenantID: testTenantID},
+			expected: "user-object",
+			graph:    "/v1.0/me",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			graphRequests := []string{}
+			graph := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				graphRequests = append(graphRequests, r.URL.Path)
+				w.Header().Set("Content-Type", "application/json")
+				switch r.URL.Path {
+				case "/v1.0/servicePrincipals(appId='app')":
+					fmt.Fprint(w, `{"id":"service-principal-object"}`)
+				case "/v1.0/me":
+					fmt.Fprint(w, `{"id":"user-object"}`)
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer graph.Close()
+
+			_, clients := newTestClients(t)
+			clients.cred = c.cred
+			clients.graphEndpoint = graph.URL
+
+			config := newTestConfig(t)
+			config.ServicePrincipalObjectID = c.objectID
+
+			objectID, err := getAccessPolicyObjectID(newTestContext(t), clients, config)
+			if err != nil {
+				t.Fatalf("getAccessPolicyObjectID: %v", err)
+			}
+			if objectID != c.expected {
+				t.Errorf("object ID is %q, expected %q", objectID, c.expected)
+			}
+
+			expectedRequests := []string{}
+			if c.graph != "" {
+				expectedRequests = append(expectedRequests, c.graph)
+			}
+			if !slices.Equal(graphRequests, expectedRequests) {
+				t.Errorf("Microsoft Graph requests are %v, expected %v", graphRequests, expectedRequests)
+			}
+		})
+	}
+}
+
+func TestRunActionWithoutObjectID(t *testing.T) {
+	ctx := newTestContext(t)
+	server, clients := newTestClients(t)
+
+	config := newTestConfig(t)
+	config.ServicePrincipalObjectID = ""
+	err := runAction(ctx, clients, config, io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	vault, _ := server.Resource(testKeyVaultID)
+	properties, _ := vault["properties"].(map[string]any)
+	policies, _ := properties["accessPolicies"].([]any)
+	found := false
+	for _, policy := range policies {
+		policy, _ := policy.(map[string]any)
+		if policy["objectId"] == testObjectID {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("no access policy for the object ID of the token: %v", policies)
+	}
+}
+
+func TestRecoverDeletedKeyVault(t *testing.T) {
+	ctx := newTestContext(t)
+	server, clients := newTestClients(t)
+
+	// the lock would prevent the vault from being deleted
+	args := []string{"--disable-step", "keyvault-lock"}
+	err := runAction(ctx, clients, newTestConfig(t, args...), io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	client, err := clients.vaultsClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Delete(ctx, "rg-test", "kv-test", nil)
+	if err != nil {
+		t.Fatalf("client.Delete: %v", err)
+	}
+
+	err = runAction(ctx, clients, newTestConfig(t, args...), io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "is soft-deleted, enable recover-deleted-keyvault") {
+		t.Fatalf("runAction without recover-deleted-keyvault returned %v, expected the vault to be reported as soft-deleted", err)
+	}
+
+	_, err = getDeletedKeyVault(ctx, clients, newTestConfig(t, append(args, "--resource-group-name", "rg-other")...))
+	if err == nil || !strings.Contains(err.Error(), "soft-deleted in another resource group") {
+		t.Errorf("getDeletedKeyVault for another resource group returned %v", err)
+	}
+
+	args = append(args, "--recover-deleted-keyvault")
+	plan := &bytes.Buffer{}
+	err = runAction(ctx, clients, newTestConfig(t, append(args, "--dry-run")...), plan)
+	if err != nil {
+		t.Fatalf("runAction with dry-run: %v", err)
+	}
+	if !strings.Contains(plan.String(), `recover KeyVault "kv-test"`) {
+		t.Errorf("plan doesn't recover the vault:\n%s", plan)
+	}
+
+	skip := len(server.Requests())
+	err = runAction(ctx, clients, newTestConfig(t, args...), io.Discard)
+	if err != nil {
+		t.Fatalf("runAction with recover-deleted-keyvault: %v", err)
+	}
+
+	for _, request := range writeRequests(server, skip) {
+		if strings.EqualFold(request.Path, testKeyVaultID+"/keys/sops") {
+			t.Errorf("key of the recovered vault was created again with %s %s", request.Method, request.Path)
+		}
+	}
+	if _, ok := server.Resource(testKeyVaultID + "/keys/sops"); !ok {
+		t.Error("key wasn't recovered with the vault")
+	}
+
+	err = runStatus(ctx, clients, newTestConfig(t, args...), io.Discard)
+	if err != nil {
+		t.Errorf("runStatus after recovery: %v", err)
+	}
+}
+
+func TestStorageAccountSKU(t *testing.T) {
+	cases := []struct {
+		name       string
+		args       []string
+		sku        string
+		tier       string
+		accessTier any
+	}{
+		{
+			name:       "standard",
+			args:       []string{"--storage-account-sku", "Standard_LRS", "--storage-account-access-tier", "Cool"},
+			sku:        "Standard_LRS",
+			tier:       "Standard",
+			accessTier: "Cool",
+		},
+		{
+			name: "premium block blob storage",
+			args: []string{"--storage-account-sku", "Premium_ZRS", "--storage-account-kind", "BlockBlobStorage"},
+			sku:  "Premium_ZRS",
+			tier: "Premium",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := newTestContext(t)
+			server, clients := newTestClients(t)
+
+			config := newTestConfig(t, c.args...)
+			err := runAction(ctx, clients, config, io.Discard)
+			if err != nil {
+				t.Fatalf("runAction: %v", err)
+			}
+
+			account, _ := server.Resource(testStorageAccountID)
+			sku, _ := account["sku"].(map[string]any)
+			if sku["name"] != c.sku || sku["tier"] != c.tier {
+				t.Errorf("sku is %v, expected %s %s", sku, c.sku, c.tier)
+			}
+			properties, _ := account["properties"].(map[string]any)
+			if properties["accessTier"] != c.accessTier {
+				t.Errorf("access tier is %v, expected %v", properties["accessTier"], c.accessTier)
+			}
+
+			state, err := getStorageAccountState(ctx, clients, config)
+			if err != nil {
+				t.Fatalf("getStorageAccountState: %v", err)
+			}
+			if state.Status != resourceStatusPresent {
+				t.Errorf("status is %s (%s), expected %s", state.Status, state.Reason, resourceStatusPresent)
+			}
+		})
+	}
+}
+
+func TestStorageAccountSKUMismatch(t *testing.T) {
+	ctx := newTestContext(t)
+	_, clients := newTestClients(t)
+
+	err := runAction(ctx, clients, newTestConfig(t, "--storage-account-sku", "Standard_LRS"), io.Discard)
+	if err != nil {
+		t.Fatalf("runAction: %v", err)
+	}
+
+	state, err := getStorageAccountState(ctx, clients, newTestConfig(t, "--storage-account-sku", "Standard_RAGZRS", "--storage-account-access-tier", "Cool"))
+	if err != nil {
+		t.Fatalf("getStorageAccountState: %v", err)
+	}
+	if state.Status != resourceStatusMisconfigured || state.Reason != "sku is Standard_LRS, access tier is Hot" {
+		t.Errorf("status is %s (%s), expected the sku and access tier to differ", state.Status, state.Reason)
+	}
+}
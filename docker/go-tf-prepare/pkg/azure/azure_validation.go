@@ -1,7 +1,10 @@
 package azure
 
 import (
+	"fmt"
 	"regexp"
+	"slices"
+	"strings"
 
 	"github.com/go-playground/validator/v10"
 )
@@ -110,3 +113,172 @@ func validateKeyVaultKeyName(fl validator.FieldLevel) bool {
 
 	return true
 }
+
+func validateISO8601Duration(fl validator.FieldLevel) bool {
+	// More info: https://learn.microsoft.com/en-us/azure/key-vault/keys/how-to-configure-key-rotation#key-rotation-policy
+	// Durations like P90D, P1Y6M or PT12H, used by Key Vault rotation policies.
+
+	duration := fl.Field().String()
+
+	matched, _ := regexp.MatchString(`^P(\d+Y)?(\d+M)?(\d+W)?(\d+D)?(T(\d+H)?(\d+M)?(\d+S)?)?$`, duration)
+	if !matched || duration == "P" || strings.HasSuffix(duration, "T") {
+		return false
+	}
+
+	return true
+}
+
+func validateUserAssignedIdentityName(fl validator.FieldLevel) bool {
+	// More info: https://docs.microsoft.com/en-us/azure/azure-resource-manager/management/resource-name-rules#microsoftmanagedidentity
+	// Alphanumerics, hyphens and underscores. Start with alphanumeric.
+
+	name := fl.Field().String()
+
+	matched, _ := regexp.MatchString(`^[a-zA-Z0-9][a-zA-Z0-9_-]*$`, name)
+	if !matched {
+		return false
+	}
+
+	return true
+}
+
+func validateContainerMetadata(fl validator.FieldLevel) bool {
+	// More info: https://learn.microsoft.com/en-us/rest/api/storageservices/naming-and-referencing-containers--blobs--and-metadata#metadata-names
+	// key=value, the key has to be a valid C# identifier.
+
+	key, _, found := strings.Cut(fl.Field().String(), "=")
+	if !found {
+		return false
+	}
+
+	matched, _ := regexp.MatchString(`^[a-zA-Z_][a-zA-Z0-9_]*$`, key)
+	if !matched {
+		return false
+	}
+
+	return true
+}
+
+func validateTag(fl validator.FieldLevel) bool {
+	// More info: https://learn.microsoft.com/en-us/azure/azure-resource-manager/management/tag-resources#limitations
+	// key=value, the name can't be longer than 512 characters or contain <, >, %, &, \, ? or /.
+	// The value can't be longer than 256 characters.
+
+	name, value, found := strings.Cut(fl.Field().String(), "=")
+	if !found || name == "" || len(name) > 512 || len(value) > 256 {
+		return false
+	}
+
+	if strings.ContainsAny(name, `<>%&\?/`) {
+		return false
+	}
+
+	return true
+}
+
+// validateStorageAccountSKU validates that the Storage Account SKU can be used with the kind, block blobs need a BlockBlobStorage account with Premium SKUs
+func validateStorageAccountSKU(config azureConfig) error {
+	premium := strings.HasPrefix(config.StorageAccountSKU, "Premium_")
+	blockBlobStorage := config.StorageAccountKind == "BlockBlobStorage"
+
+	if premium && !blockBlobStorage {
+		return fmt.Errorf("storage account sku %s requires the kind BlockBlobStorage, got %s", config.StorageAccountSKU, config.StorageAccountKind)
+	}
+
+	if !premium && blockBlobStorage {
+		return fmt.Errorf("storage account kind BlockBlobStorage requires a Premium sku, got %s", config.StorageAccountSKU)
+	}
+
+	return nil
+}
+
+// validateBlobRestore validates that point-in-time restore can be enabled with the blob service configuration
+func validateBlobRestore(config azureConfig) error {
+	if config.BlobRestoreDays == nil || *config.BlobRestoreDays == 0 {
+		return nil
+	}
+
+	if !isEnabled(config.BlobVersioning) || !isEnabled(config.BlobChangeFeed) {
+		return fmt.Errorf("blob point-in-time restore requires blob versioning and change feed")
+	}
+
+	if config.BlobSoftDeleteRetentionDays == nil || *config.BlobSoftDeleteRetentionDays <= *config.BlobRestoreDays {
+		return fmt.Errorf("blob point-in-time restore of %d days requires a longer blob soft delete retention", *config.BlobRestoreDays)
+	}
+
+	return nil
+}
+
+// validateContainerImmutability validates that the container immutability settings only protect blob versions,
+// a container-level policy would prevent Terraform from updating the state
+func validateContainerImmutability(config azureConfig) error {
+	if config.ContainerVersionImmutability && !isEnabled(config.BlobVersioning) {
+		return fmt.Errorf("container version-level immutability requires blob versioning")
+	}
+
+	if config.ContainerRetentionDays > 0 && !config.ContainerVersionImmutability {
+		return fmt.Errorf("container retention policy requires container version-level immutability")
+	}
+
+	if len(config.ContainerLegalHoldTags) > 0 && !config.ContainerVersionImmutability {
+		return fmt.Errorf("container legal hold requires container version-level immutability")
+	}
+
+	return nil
+}
+
+// validateKeyVaultKeyParameters validates the size of RSA keys and the curve of EC keys, the other one isn't used by the key type
+func validateKeyVaultKeyParameters(config azureConfig) error {
+	if isECKeyType(config.KeyVaultKeyType) {
+		if !slices.Contains([]string{"P-256", "P-384", "P-521", "P-256K"}, config.KeyVaultKeyCurve) {
+			return fmt.Errorf("keyvault key curve must be P-256, P-384, P-521 or P-256K for key type %s, got %s", config.KeyVaultKeyType, config.KeyVaultKeyCurve)
+		}
+
+		return nil
+	}
+
+	if !slices.Contains([]int{2048, 3072, 4096}, config.KeyVaultKeySize) {
+		return fmt.Errorf("keyvault key size must be 2048, 3072 or 4096 for key type %s, got %d", config.KeyVaultKeyType, config.KeyVaultKeySize)
+	}
+
+	return nil
+}
+
+// validateKeyVaultKeyOperations validates that the Azure KeyVault Key type supports the key operations
+func validateKeyVaultKeyOperations(config azureConfig) error {
+	if !isECKeyType(config.KeyVaultKeyType) {
+		return nil
+	}
+
+	for _, operation := range config.KeyVaultKeyOperations {
+		if operation != "sign" && operation != "verify" {
+			return fmt.Errorf("keyvault key type %s only supports the key operations sign and verify, got %s", config.KeyVaultKeyType, operation)
+		}
+	}
+
+	return nil
+}
+
+// validateStorageAccountCMK validates that the Azure KeyVault and Key can be used as customer-managed key for the Storage Account
+func validateStorageAccountCMK(config azureConfig) error {
+	if !config.KeyVaultPurgeProtection {
+		return fmt.Errorf("storage account customer-managed key requires keyvault purge protection")
+	}
+
+	if isECKeyType(config.KeyVaultKeyType) {
+		return fmt.Errorf("storage account customer-managed key requires an RSA keyvault key, got %s", config.KeyVaultKeyType)
+	}
+
+	for _, operation := range []string{"wrapKey", "unwrapKey"} {
+		if !slices.Contains(config.KeyVaultKeyOperations, operation) {
+			return fmt.Errorf("storage account customer-managed key requires the keyvault key operation %s", operation)
+		}
+	}
+
+	return nil
+}
+
+// isEnabled reports if an optional setting is configured and enabled
+func isEnabled(value *bool) bool {
+	return value != nil && *value
+}
@@ -0,0 +1,89 @@
+package azure
+
+import "testing"
+
+func TestValidateKeyVaultKeyOperations(t *testing.T) {
+	cases := []struct {
+		keyType    string
+		operations []string
+		valid      bool
+	}{
+		{keyType: "RSA", operations: []string{"encrypt", "decrypt"}, valid: true},
+		{keyType: "RSA-HSM", operations: []string{"wrapKey", "unwrapKey"}, valid: true},
+		{keyType: "EC", operations: []string{"sign", "verify"}, valid: true},
+		{keyType: "EC", operations: []string{"encrypt", "decrypt"}, valid: false},
+		{keyType: "EC-HSM", operations: []string{"sign", "wrapKey"}, valid: false},
+	}
+
+	for _, c := range cases {
+		config := newTestConfig(t)
+		config.KeyVaultKeyType = c.keyType
+		config.KeyVaultKeyOperations = c.operations
+
+		err := config.Validate()
+		if (err == nil) != c.valid {
+			t.Errorf("Validate() with %s and %v = %v, expected valid %t", c.keyType, c.operations, err, c.valid)
+		}
+	}
+}
+
+func TestValidateStorageAccountSKU(t *testing.T) {
+	cases := []struct {
+		sku   string
+		kind  string
+		tier  string
+		valid bool
+	}{
+		{sku: "Standard_LRS", kind: "StorageV2", tier: "Cool", valid: true},
+		{sku: "Standard_RAGZRS", kind: "StorageV2", tier: "Hot", valid: true},
+		{sku: "Premium_ZRS", kind: "BlockBlobStorage", tier: "Hot", valid: true},
+		{sku: "Premium_LRS", kind: "StorageV2", tier: "Hot", valid: false},
+		{sku: "Standard_GRS", kind: "BlockBlobStorage", tier: "Hot", valid: false},
+		{sku: "Standard_RAGRS", kind: "BlobStorage", tier: "Hot", valid: false},
+		{sku: "Standard_XRS", kind: "StorageV2", tier: "Hot", valid: false},
+		{sku: "Standard_LRS", kind: "StorageV2", tier: "Archive", valid: false},
+	}
+
+	for _, c := range cases {
+		config := newTestConfig(t)
+		config.StorageAccountSKU = c.sku
+		config.StorageAccountKind = c.kind
+		config.StorageAccountAccessTier = c.tier
+
+		err := config.Validate()
+		if (err == nil) != c.valid {
+			t.Errorf("Validate() with %s, %s and %s = %v, expected valid %t", c.sku, c.kind, c.tier, err, c.valid)
+		}
+	}
+}
+
+func TestValidateKeyVaultKeyParameters(t *testing.T) {
+	cases := []struct {
+		keyType string
+		size    int
+		curve   string
+		valid   bool
+	}{
+		{keyType: "RSA", size: 4096, curve: "P-256", valid: true},
+		{keyType: "RSA-HSM", size: 3072, curve: "", valid: true},
+		{keyType: "RSA", size: 1024, curve: "P-256", valid: false},
+		{keyType: "EC", size: 0, curve: "P-384", valid: true},
+		{keyType: "EC-HSM", size: 256, curve: "P-256K", valid: true},
+		{keyType: "EC", size: 2048, curve: "P-224", valid: false},
+	}
+
+	for _, c := range cases {
+		config := newTestConfig(t)
+		config.KeyVaultKeyType = c.keyType
+		config.KeyVaultKeySize = c.size
+		config.KeyVaultKeyCurve = c.curve
+		if isECKeyType(c.keyType) {
+			config.KeyVaultKeyOperations = []string{"sign", "verify"}
+		}
+
+		err := config.Validate()
+		if (err == nil) != c.valid {
+			t.Errorf("Validate() with %s, size %d and curve %q = %v, expected valid %t", c.keyType, c.size, c.curve, err, c.valid)
+		}
+	}
+}
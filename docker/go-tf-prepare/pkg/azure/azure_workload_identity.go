@@ -0,0 +1,122 @@
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+)
+
+const (
+	githubActionsIDTokenRequestURL   = "ACTIONS_ID_TOKEN_REQUEST_URL"
+	githubActionsIDTokenRequestToken = "ACTIONS_ID_TOKEN_REQUEST_TOKEN"
+)
+
+// newWorkloadIdentityCredential returns a credential exchanging a federated token, read from
+// the federated token file or requested from GitHub Actions, for an Azure AD token
+func newWorkloadIdentityCredential(config azureConfig, environment cloudEnvironment, options *arm.ClientOptions) (azcore.TokenCredential, error) {
+	getAssertion, err := getFederatedTokenSource(config, options.Transport)
+	if err != nil {
+		return nil, err
+	}
+
+	return azidentity.NewClientAssertionCredential(config.TenantID, config.ClientID, getAssertion, &azidentity.ClientAssertionCredentialOptions{
+		ClientOptions:            credentialClientOptions(environment, options),
+		DisableInstanceDiscovery: environment.Custom,
+	})
+}
+
+func getFederatedTokenSource(config azureConfig, transport policy.Transporter) (func(context.Context) (string, error), error) {
+	if config.FederatedTokenFile != "" {
+		return func(ctx context.Context) (string, error) {
+			// the file is read for every token since it is rotated by the platform
+			return readFederatedTokenFile(config.FederatedTokenFile)
+		}, nil
+	}
+
+	requestURL := os.Getenv(githubActionsIDTokenRequestURL)
+	requestToken := os.Getenv(githubActionsIDTokenRequestToken)
+	if requestURL != "" && requestToken != "" {
+		return func(ctx context.Context) (string, error) {
+			return getGitHubActionsIDToken(ctx, transport, requestURL, requestToken, config.FederatedTokenAudience)
+		}, nil
+	}
+
+	return nil, fmt.Errorf("no federated token found, set the federated token file or %s and %s", githubActionsIDTokenRequestURL, githubActionsIDTokenRequestToken)
+}
+
+func readFederatedTokenFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("federated token file %s is empty", path)
+	}
+
+	return token, nil
+}
+
+// getGitHubActionsIDToken requests an OIDC token for the audience from the GitHub Actions runtime,
+// using the transport of the Azure clients when the proxy or CA bundle is configured
+func getGitHubActionsIDToken(ctx context.Context, transport policy.Transporter, requestURL, requestToken, audience string) (string, error) {
+	u, err := url.Parse(requestURL)
+	if err != nil {
+		return "", err
+	}
+
+	query := u.Query()
+	query.Set("audience", audience)
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+requestToken)
+	req.Header.Set("Accept", "application/json")
+
+	if transport == nil {
+		transport = http.DefaultClient
+	}
+
+	res, err := transport.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GitHub Actions ID token request failed with status %d: %s", res.StatusCode, string(body))
+	}
+
+	token := struct {
+		Value string `json:"value"`
+	}{}
+	err = json.Unmarshal(body, &token)
+	if err != nil {
+		return "", err
+	}
+
+	if token.Value == "" {
+		return "", fmt.Errorf("GitHub Actions ID token response did not contain a token")
+	}
+
+	return token.Value, nil
+}
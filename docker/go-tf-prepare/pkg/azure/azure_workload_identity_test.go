@@ -0,0 +1,209 @@
+package azure
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/xenitab/github-actions/docker/go-tf-prepare/pkg/azure/fake"
+)
+
+type recordingTransport struct {
+	requests []*http.Request
+}
+
+func (r *recordingTransport) Do(req *http.Request) (*http.Response, error) {
+	r.requests = append(r.requests, req)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(`{"value":"token"}`)),
+		Request:    req,
+	}, nil
+}
+
+func TestGetGitHubActionsIDTokenUsesTransport(t *testing.T) {
+	transport := &recordingTransport{}
+
+	token, err := getGitHubActionsIDToken(newTestContext(t), transport, "https://token.actions.fake/request?api-version=2.0", "request-token", "api://AzureADTokenExchange")
+	if err != nil {
+		t.Fatalf("getGitHubActionsIDToken: %v", err)
+	}
+	if token != "token" {
+		t.Errorf("token is %q, expected %q", token, "token")
+	}
+
+	if len(transport.requests) != 1 {
+		t.Fatalf("transport received %d requests, expected 1", len(transport.requests))
+	}
+	if audience := transport.requests[0].URL.Query().Get("audience"); audience != "api://AzureADTokenExchange" {
+		t.Errorf("audience is %q", audience)
+	}
+}
+
+const testClientID = "44444444-4444-4444-4444-444444444444"
+
+// tokenRequestRecorder records the client assertions sent to the token endpoint and answers the GitHub Actions ID token requests
+type tokenRequestRecorder struct {
+	next       policy.Transporter
+	assertions []string
+}
+
+func (r *tokenRequestRecorder) Do(req *http.Request) (*http.Response, error) {
+	if req.URL.Host == "token.actions.fake" {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{"value":"github-token"}`)),
+			Request:    req,
+		}, nil
+	}
+
+	if strings.HasSuffix(req.URL.Path, "/oauth2/v2.0/token") {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, err
+		}
+		r.assertions = append(r.assertions, form.Get("client_assertion"))
+	}
+
+	return r.next.Do(req)
+}
+
+// newTestTokenServer starts the fake Azure AD token endpoint and returns the cloud environment and client options trusting it
+func newTestTokenServer(t *testing.T) (cloudEnvironment, *arm.ClientOptions, *tokenRequestRecorder) {
+	t.Helper()
+
+	server, err := fake.NewServer("127.0.0.1:0", fake.NewARM(), testObjectID)
+	if err != nil {
+		t.Fatalf("fake.NewServer: %v", err)
+	}
+	t.Cleanup(server.Close)
+
+	caBundleFile := filepath.Join(t.TempDir(), "fake.pem")
+	err = os.WriteFile(caBundleFile, server.CertificatePEM(), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport, err := getTransport(azureConfig{CABundleFile: caBundleFile})
+	if err != nil {
+		t.Fatalf("getTransport: %v", err)
+	}
+	recorder := &tokenRequestRecorder{next: transport}
+
+	environment := cloudEnvironment{
+		Configuration: cloud.Configuration{
+			ActiveDirectoryAuthorityHost: server.URL,
+			Services: map[cloud.ServiceName]cloud.ServiceConfiguration{
+				cloud.ResourceManager: {Audience: server.URL, Endpoint: server.URL},
+			},
+		},
+		Custom: true,
+	}
+
+	return environment, &arm.ClientOptions{ClientOptions: policy.ClientOptions{Transport: recorder}}, recorder
+}
+
+func TestWorkloadIdentityCredential(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	err := os.WriteFile(tokenFile, []byte("file-token\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name      string
+		args      []string
+		github    bool
+		assertion string
+		err       string
+	}{
+		{
+			name:      "federated token file",
+			args:      []string{"--federated-token-file", tokenFile},
+			assertion: "file-token",
+		},
+		{
+			name:      "federated token file is preferred over GitHub Actions",
+			args:      []string{"--federated-token-file", tokenFile},
+			github:    true,
+			assertion: "file-token",
+		},
+		{
+			name:      "GitHub Actions ID token",
+			github:    true,
+			assertion: "github-token",
+		},
+		{
+			name: "no federated token",
+			err:  "no federated token found",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			t.Setenv(githubActionsIDTokenRequestURL, "")
+			t.Setenv(githubActionsIDTokenRequestToken, "")
+			if c.github {
+				t.Setenv(githubActionsIDTokenRequestURL, "https://token.actions.fake/request?api-version=2.0")
+				t.Setenv(githubActionsIDTokenRequestToken, "request-token")
+			}
+
+			environment, options, recorder := newTestTokenServer(t)
+			config := newTestConfig(t, append([]string{"--exclude-workload-identity-credential=false", "--client-id", testClientID}, c.args...)...)
+
+			cred, err := newWorkloadIdentityCredential(config, environment, options)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("newWorkloadIdentityCredential returned %v, expected %q", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newWorkloadIdentityCredential: %v", err)
+			}
+
+			claims, err := probeCredential(newTestContext(t), cred, resourceManagerScope(environment.Configuration))
+			if err != nil {
+				t.Fatalf("probeCredential: %v", err)
+			}
+			if claims.TenantID != testTenantID || claims.ObjectID != testObjectID || claims.appID() != testClientID {
+				t.Errorf("token claims are %+v, expected tenant %s, object %s and app %s", claims, testTenantID, testObjectID, testClientID)
+			}
+
+			if len(recorder.assertions) != 1 || recorder.assertions[0] != c.assertion {
+				t.Errorf("client assertions are %q, expected %q", recorder.assertions, c.assertion)
+			}
+		})
+	}
+}
+
+func TestWorkloadIdentityConfigFromEnvironment(t *testing.T) {
+	t.Setenv("AZURE_EXCLUDE_WORKLOAD_IDENTITY_CREDENTIAL", "false")
+	t.Setenv("AZURE_CLIENT_ID", testClientID)
+	t.Setenv("AZURE_FEDERATED_TOKEN_FILE", "/var/run/secrets/azure/tokens/azure-identity-token")
+
+	config := newTestConfig(t)
+	if config.ExcludeWorkloadIdentityCredential || config.ClientID != testClientID || config.FederatedTokenFile != "/var/run/secrets/azure/tokens/azure-identity-token" {
+		t.Errorf("workload identity isn't configured from the pipeline environment: %+v", config)
+	}
+
+	config.ClientID = ""
+	err := config.Validate()
+	if err == nil {
+		t.Error("workload identity without a client ID is valid")
+	}
+}
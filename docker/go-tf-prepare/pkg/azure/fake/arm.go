@@ -0,0 +1,853 @@
+// Package fake provides an in-memory emulation of the parts of Azure Resource Manager used by tf-prepare
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+const (
+	typeResourceGroup  = "Microsoft.Resources/resourceGroups"
+	typeStorageAccount = "Microsoft.Storage/storageAccounts"
+	typeBlobContainer  = "Microsoft.Storage/storageAccounts/blobServices/containers"
+	typeVault          = "Microsoft.KeyVault/vaults"
+	typeKey            = "Microsoft.KeyVault/vaults/keys"
+	typeLock           = "Microsoft.Authorization/locks"
+	typeIdentity       = "Microsoft.ManagedIdentity/userAssignedIdentities"
+	typeEndpoint       = "Microsoft.Network/privateEndpoints"
+	typeDNSZoneGroup   = "Microsoft.Network/privateEndpoints/privateDnsZoneGroups"
+)
+
+type lroKind int
+
+const (
+	lroNone lroKind = iota
+	// lroLocation returns 202 with a Location header that is polled until the resource is returned
+	lroLocation
+	// lroAsync returns 201 with an Azure-AsyncOperation header that is polled for the operation status
+	lroAsync
+)
+
+// resourceKind describes how a resource type behaves
+type resourceKind struct {
+	Type         string
+	NotFoundCode string
+	// ParentSegments is the number of path segments to remove from the id to get the parent resource id
+	ParentSegments int
+	LRO            lroKind
+	// CreateOnly makes a PUT on an existing resource return it unchanged
+	CreateOnly bool
+	// CreatedStatus is the status code returned when a resource is created, defaults to 201
+	CreatedStatus int
+}
+
+var (
+	resourceGroupKind  = resourceKind{Type: typeResourceGroup, NotFoundCode: "ResourceGroupNotFound"}
+	storageAccountKind = resourceKind{Type: typeStorageAccount, NotFoundCode: "ResourceNotFound", ParentSegments: 4, LRO: lroLocation}
+	blobContainerKind  = resourceKind{Type: typeBlobContainer, NotFoundCode: "ContainerNotFound", ParentSegments: 4}
+	vaultKind          = resourceKind{Type: typeVault, NotFoundCode: "ResourceNotFound", ParentSegments: 4, LRO: lroAsync}
+	keyKind            = resourceKind{Type: typeKey, NotFoundCode: "ResourceNotFound", ParentSegments: 2, CreateOnly: true, CreatedStatus: http.StatusOK}
+	lockKind           = resourceKind{Type: typeLock, NotFoundCode: "LockNotFound", ParentSegments: 4}
+	identityKind       = resourceKind{Type: typeIdentity, NotFoundCode: "ResourceNotFound", ParentSegments: 4, CreateOnly: true}
+	endpointKind       = resourceKind{Type: typeEndpoint, NotFoundCode: "ResourceNotFound", ParentSegments: 4, LRO: lroAsync}
+	dnsZoneGroupKind   = resourceKind{Type: typeDNSZoneGroup, NotFoundCode: "ResourceNotFound", ParentSegments: 2, LRO: lroAsync}
+)
+
+// Request is a request that has been received by the fake
+type Request struct {
+	Method     string
+	Path       string
+	APIVersion string
+	// Query is the raw query of the request
+	Query string
+}
+
+type operation struct {
+	kind       lroKind
+	resourceID string
+	url        string
+	polls      int
+}
+
+// ARM is an in-memory Azure Resource Manager. It can be used as an http.Handler
+// or as an azcore transport through Transport.
+type ARM struct {
+	// LROPolls is the number of times a long-running operation reports that it is in progress,
+	// each of them asks the client to wait one second before polling again
+	LROPolls int
+	// LockAPIVersions are the api-versions accepted for management locks
+	LockAPIVersions []string
+	// DataPlaneURL is the base URL of the Key Vault data plane of the fake, when it is set the vault
+	// URIs are <DataPlaneURL>/_fake/vaults/<name>/ instead of https://<name>.vault.azure.net/
+	DataPlaneURL string
+	// ForbiddenWrites are resource types, e.g. Microsoft.Authorization/locks, the caller isn't allowed
+	// to write or delete, the requests are answered with 403 AuthorizationFailed
+	ForbiddenWrites []string
+
+	mu         sync.Mutex
+	resources  map[string]map[string]any
+	providers  map[string]string
+	takenNames map[string]bool
+	// deletedVaults are the soft-deleted vaults by location and name
+	deletedVaults map[string]*deletedVault
+	operations    map[string]*operation
+	requests      []Request
+	nextID        int
+}
+
+// NewARM returns an empty ARM
+func NewARM() *ARM {
+	return &ARM{
+		resources:     map[string]map[string]any{},
+		providers:     map[string]string{},
+		takenNames:    map[string]bool{},
+		deletedVaults: map[string]*deletedVault{},
+		operations:    map[string]*operation{},
+		// the api-version tf-prepare forces for management locks
+		LockAPIVersions: []string{"2016-09-01"},
+	}
+}
+
+// Requests returns the requests received so far
+func (a *ARM) Requests() []Request {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	requests := make([]Request, len(a.requests))
+	copy(requests, a.requests)
+	return requests
+}
+
+// Resource returns a copy of the resource with the id
+func (a *ARM) Resource(id string) (map[string]any, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	body, ok := a.resources[strings.ToLower(id)]
+	if !ok {
+		return nil, false
+	}
+
+	return deepCopy(body), true
+}
+
+// PutResource adds or replaces the resource with the id, without any validation
+func (a *ARM) PutResource(id string, body map[string]any) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	body = deepCopy(body)
+	body["id"] = id
+	body["name"] = path.Base(id)
+	a.resources[strings.ToLower(id)] = body
+}
+
+// SetProviderRegistrationState sets the registration state of a resource provider namespace
+func (a *ARM) SetProviderRegistrationState(namespace, state string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.providers[strings.ToLower(namespace)] = state
+}
+
+// ReserveName makes the name unavailable for the resource type, as if it was used in another subscription
+func (a *ARM) ReserveName(resourceType, name string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.takenNames[strings.ToLower(resourceType+"/"+name)] = true
+}
+
+// ServeHTTP implements http.Handler
+func (a *ARM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	urlPath := path.Clean("/" + r.URL.Path)
+	a.requests = append(a.requests, Request{Method: r.Method, Path: urlPath, APIVersion: r.URL.Query().Get("api-version"), Query: r.URL.RawQuery})
+
+	if strings.HasPrefix(urlPath, "/_fake/vaults/") {
+		a.serveKeyVaultDataPlane(w, r, urlPath)
+		return
+	}
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		writeError(w, http.StatusUnauthorized, "AuthenticationFailed", "Authentication failed. The 'Authorization' header is missing.")
+		return
+	}
+
+	if a.isForbiddenWrite(r.Method, urlPath) {
+		writeError(w, http.StatusForbidden, "AuthorizationFailed", fmt.Sprintf("The client does not have authorization to perform action over scope '%s'.", urlPath))
+		return
+	}
+
+	if strings.HasPrefix(urlPath, "/_fake/operations/") {
+		a.serveOperation(w, r, path.Base(urlPath))
+		return
+	}
+
+	segments := strings.Split(strings.Trim(urlPath, "/"), "/")
+	lower := strings.Split(strings.ToLower(strings.Trim(urlPath, "/")), "/")
+	if len(lower) < 3 || lower[0] != "subscriptions" {
+		writeNotImplemented(w, r)
+		return
+	}
+
+	id := urlPath
+	rest := lower[2:]
+	n := len(rest)
+
+	switch {
+	case n >= 3 && rest[n-3] == "providers" && rest[n-2] == "microsoft.authorization" && rest[n-1] == "roledefinitions":
+		a.serveRoleDefinitions(w, r, segments[1])
+	case n >= 3 && rest[n-3] == "providers" && rest[n-2] == "microsoft.authorization" && rest[n-1] == "roleassignments":
+		a.serveRoleAssignments(w, r, parentResourceID(id, 3))
+	case n >= 4 && rest[n-4] == "providers" && rest[n-3] == "microsoft.authorization" && rest[n-2] == "roleassignments":
+		a.serveRoleAssignment(w, r, id)
+	case n >= 4 && rest[n-4] == "providers" && rest[n-3] == "microsoft.authorization" && rest[n-2] == "locks":
+		a.serveLock(w, r, id)
+	case n >= 4 && rest[n-4] == "providers" && rest[n-3] == "microsoft.resources" && rest[n-2] == "tags" && rest[n-1] == "default":
+		a.serveTags(w, r, parentResourceID(id, 4))
+	case matches(rest, "resourcegroups", "*"):
+		a.serveResource(w, r, id, resourceGroupKind)
+	case matches(rest, "providers", "microsoft.storage", "checknameavailability"):
+		a.serveCheckNameAvailability(w, r, typeStorageAccount)
+	case matches(rest, "providers", "microsoft.keyvault", "checknameavailability"):
+		a.serveCheckNameAvailability(w, r, typeVault)
+	case matches(rest, "providers", "microsoft.keyvault", "locations", "*", "deletedvaults", "*"):
+		a.serveDeletedVault(w, r, segments[5], segments[7])
+	case matches(rest, "providers", "*"):
+		a.serveProvider(w, r, segments[3], false)
+	case matches(rest, "providers", "*", "register"):
+		a.serveProvider(w, r, segments[3], true)
+	case matches(rest, "resourcegroups", "*", "providers", "microsoft.storage", "storageaccounts", "*"):
+		a.serveResource(w, r, id, storageAccountKind)
+	case matches(rest, "resourcegroups", "*", "providers", "microsoft.storage", "storageaccounts", "*", "blobservices", "default"):
+		a.serveBlobService(w, r, id)
+	case matches(rest, "resourcegroups", "*", "providers", "microsoft.storage", "storageaccounts", "*", "blobservices", "default", "containers", "*"):
+		a.serveResource(w, r, id, blobContainerKind)
+	case matches(rest, "resourcegroups", "*", "providers", "microsoft.storage", "storageaccounts", "*", "blobservices", "default", "containers", "*", "immutabilitypolicies", "default"):
+		a.serveImmutabilityPolicy(w, r, parentResourceID(id, 2))
+	case matches(rest, "resourcegroups", "*", "providers", "microsoft.storage", "storageaccounts", "*", "blobservices", "default", "containers", "*", "setlegalhold"):
+		a.serveSetLegalHold(w, r, parentResourceID(id, 1))
+	case matches(rest, "resourcegroups", "*", "providers", "microsoft.storage", "storageaccounts", "*", "blobservices", "default", "containers", "*", "migrate"):
+		a.serveContainerMigrate(w, r, parentResourceID(id, 1))
+	case matches(rest, "resourcegroups", "*", "providers", "microsoft.keyvault", "vaults", "*"):
+		a.serveVault(w, r, id)
+	case matches(rest, "resourcegroups", "*", "providers", "microsoft.keyvault", "vaults", "*", "accesspolicies", "*"):
+		a.serveAccessPolicy(w, r, id)
+	case matches(rest, "resourcegroups", "*", "providers", "microsoft.keyvault", "vaults", "*", "keys", "*"):
+		a.serveResource(w, r, id, keyKind)
+	case matches(rest, "resourcegroups", "*", "providers", "microsoft.managedidentity", "userassignedidentities", "*"):
+		a.serveResource(w, r, id, identityKind)
+	case matches(rest, "resourcegroups", "*", "providers", "microsoft.network", "privateendpoints", "*"):
+		a.serveResource(w, r, id, endpointKind)
+	case matches(rest, "resourcegroups", "*", "providers", "microsoft.network", "privateendpoints", "*", "privatednszonegroups", "*"):
+		a.serveResource(w, r, id, dnsZoneGroupKind)
+	default:
+		writeNotImplemented(w, r)
+	}
+}
+
+func (a *ARM) serveResource(w http.ResponseWriter, r *http.Request, id string, kind resourceKind) {
+	key := strings.ToLower(id)
+	existing, exists := a.resources[key]
+
+	switch r.Method {
+	case http.MethodHead:
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		if !exists {
+			writeError(w, http.StatusNotFound, kind.NotFoundCode, fmt.Sprintf("The resource '%s' was not found.", id))
+			return
+		}
+		writeJSON(w, http.StatusOK, existing)
+	case http.MethodPut:
+		if exists && kind.CreateOnly {
+			writeJSON(w, http.StatusOK, existing)
+			return
+		}
+
+		if kind.ParentSegments > 0 {
+			parentID := parentResourceID(id, kind.ParentSegments)
+			if _, ok := a.resources[strings.ToLower(parentID)]; !ok {
+				code := "ParentResourceNotFound"
+				if strings.EqualFold(path.Base(path.Dir(parentID)), "resourceGroups") {
+					code = "ResourceGroupNotFound"
+				}
+				writeError(w, http.StatusNotFound, code, fmt.Sprintf("The parent resource '%s' was not found.", parentID))
+				return
+			}
+		}
+
+		if lock := a.findLock(id, true); kind.Type != typeLock && lock != "" {
+			writeError(w, http.StatusConflict, "ScopeLocked", fmt.Sprintf("The scope '%s' cannot perform write operation because it is locked by '%s'.", id, lock))
+			return
+		}
+
+		var body map[string]any
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidRequestContent", err.Error())
+			return
+		}
+
+		resource := a.newResource(id, kind, body)
+		a.resources[key] = resource
+
+		status := http.StatusOK
+		if !exists {
+			status = http.StatusCreated
+			if kind.CreatedStatus != 0 {
+				status = kind.CreatedStatus
+			}
+		}
+
+		switch kind.LRO {
+		case lroLocation:
+			setProperty(resource, "provisioningState", "Creating")
+			w.Header().Set("Location", a.newOperation(r, lroLocation, id))
+			w.WriteHeader(http.StatusAccepted)
+		case lroAsync:
+			setProperty(resource, "provisioningState", "Creating")
+			w.Header().Set("Azure-AsyncOperation", a.newOperation(r, lroAsync, id))
+			writeJSON(w, status, resource)
+		default:
+			writeJSON(w, status, resource)
+		}
+	case http.MethodPatch:
+		if !exists {
+			writeError(w, http.StatusNotFound, kind.NotFoundCode, fmt.Sprintf("The resource '%s' was not found.", id))
+			return
+		}
+
+		if lock := a.findLock(id, true); kind.Type != typeLock && lock != "" {
+			writeError(w, http.StatusConflict, "ScopeLocked", fmt.Sprintf("The scope '%s' cannot perform write operation because it is locked by '%s'.", id, lock))
+			return
+		}
+
+		var body map[string]any
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidRequestContent", err.Error())
+			return
+		}
+
+		// only the top level fields and properties present in the body are replaced
+		for _, field := range []string{"kind", "sku", "tags", "identity"} {
+			if v, ok := body[field]; ok {
+				existing[field] = v
+			}
+		}
+		properties, _ := body["properties"].(map[string]any)
+		for name, value := range properties {
+			setProperty(existing, name, value)
+		}
+
+		writeJSON(w, http.StatusOK, existing)
+	case http.MethodDelete:
+		if !exists {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if lock := a.findLock(id, false); kind.Type != typeLock && lock != "" {
+			writeError(w, http.StatusConflict, "ScopeLocked", fmt.Sprintf("The scope '%s' cannot perform delete operation because it is locked by '%s'.", id, lock))
+			return
+		}
+
+		for k := range a.resources {
+			if k == key || strings.HasPrefix(k, key+"/") {
+				delete(a.resources, k)
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeNotImplemented(w, r)
+	}
+}
+
+// serveTags serves the tags of the resource at the scope, which are the same as the tags of the resource
+func (a *ARM) serveTags(w http.ResponseWriter, r *http.Request, scope string) {
+	resource, ok := a.resources[strings.ToLower(scope)]
+	if !ok {
+		writeError(w, http.StatusNotFound, "ResourceNotFound", fmt.Sprintf("The resource '%s' was not found.", scope))
+		return
+	}
+
+	tags, _ := resource["tags"].(map[string]any)
+	if tags == nil {
+		tags = map[string]any{}
+	}
+
+	if r.Method == http.MethodPut || r.Method == http.MethodPatch {
+		if lock := a.findLock(scope, true); lock != "" {
+			writeError(w, http.StatusConflict, "ScopeLocked", fmt.Sprintf("The scope '%s' cannot perform write operation because it is locked by '%s'.", scope, lock))
+			return
+		}
+
+		var body struct {
+			Operation  string `json:"operation"`
+			Properties struct {
+				Tags map[string]any `json:"tags"`
+			} `json:"properties"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidRequestContent", err.Error())
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodPut || strings.EqualFold(body.Operation, "Replace"):
+			tags = body.Properties.Tags
+		case strings.EqualFold(body.Operation, "Merge"):
+			for name, value := range body.Properties.Tags {
+				for existing := range tags {
+					if strings.EqualFold(existing, name) {
+						delete(tags, existing)
+					}
+				}
+				tags[name] = value
+			}
+		case strings.EqualFold(body.Operation, "Delete"):
+			for name := range body.Properties.Tags {
+				delete(tags, name)
+			}
+		default:
+			writeError(w, http.StatusBadRequest, "InvalidTagsOperation", fmt.Sprintf("The tags operation '%s' is not supported.", body.Operation))
+			return
+		}
+		resource["tags"] = tags
+	} else if r.Method != http.MethodGet {
+		writeNotImplemented(w, r)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"id":         scope + "/providers/Microsoft.Resources/tags/default",
+		"name":       "default",
+		"type":       "Microsoft.Resources/tags",
+		"properties": map[string]any{"tags": tags},
+	})
+}
+
+func (a *ARM) serveLock(w http.ResponseWriter, r *http.Request, id string) {
+	apiVersion := r.URL.Query().Get("api-version")
+	supported := false
+	for _, v := range a.LockAPIVersions {
+		if v == apiVersion {
+			supported = true
+		}
+	}
+	if !supported {
+		writeError(w, http.StatusBadRequest, "NoRegisteredProviderFound", fmt.Sprintf("No registered resource provider found for API version '%s' and type 'locks'. The supported api-versions are '%s'.", apiVersion, strings.Join(a.LockAPIVersions, ", ")))
+		return
+	}
+
+	scope := parentResourceID(id, 4)
+	if _, ok := a.resources[strings.ToLower(scope)]; !ok {
+		writeError(w, http.StatusNotFound, "ResourceNotFound", fmt.Sprintf("The resource '%s' was not found.", scope))
+		return
+	}
+
+	a.serveResource(w, r, id, lockKind)
+}
+
+func (a *ARM) serveProvider(w http.ResponseWriter, r *http.Request, namespace string, register bool) {
+	key := strings.ToLower(namespace)
+	if register {
+		if r.Method != http.MethodPost {
+			writeNotImplemented(w, r)
+			return
+		}
+		a.providers[key] = "Registered"
+	}
+
+	if !register && r.Method != http.MethodGet {
+		writeNotImplemented(w, r)
+		return
+	}
+
+	state, ok := a.providers[key]
+	if !ok {
+		state = "NotRegistered"
+	}
+
+	resourceTypes := []map[string]any{}
+	if key == "microsoft.authorization" {
+		resourceTypes = append(resourceTypes, map[string]any{
+			"resourceType": "locks",
+			"apiVersions":  a.LockAPIVersions,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"id":                path.Join("/subscriptions", strings.Split(strings.Trim(r.URL.Path, "/"), "/")[1], "providers", namespace),
+		"namespace":         namespace,
+		"registrationState": state,
+		"resourceTypes":     resourceTypes,
+	})
+}
+
+func (a *ARM) serveCheckNameAvailability(w http.ResponseWriter, r *http.Request, resourceType string) {
+	if r.Method != http.MethodPost {
+		writeNotImplemented(w, r)
+		return
+	}
+
+	var body struct {
+		Name string `json:"name"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequestContent", err.Error())
+		return
+	}
+
+	available := !a.takenNames[strings.ToLower(resourceType+"/"+body.Name)]
+	if resourceType == typeVault && a.isVaultNameDeleted(body.Name) {
+		available = false
+	}
+	for _, resource := range a.resources {
+		if strings.EqualFold(stringValue(resource, "type"), resourceType) && strings.EqualFold(stringValue(resource, "name"), body.Name) {
+			available = false
+		}
+	}
+
+	result := map[string]any{"nameAvailable": available}
+	if !available {
+		result["reason"] = "AlreadyExists"
+		result["message"] = fmt.Sprintf("The name '%s' is already in use.", body.Name)
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (a *ARM) serveAccessPolicy(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPut {
+		writeNotImplemented(w, r)
+		return
+	}
+
+	vaultID := parentResourceID(id, 2)
+	vault, ok := a.resources[strings.ToLower(vaultID)]
+	if !ok {
+		writeError(w, http.StatusNotFound, "ResourceNotFound", fmt.Sprintf("The resource '%s' was not found.", vaultID))
+		return
+	}
+
+	if lock := a.findLock(vaultID, true); lock != "" {
+		writeError(w, http.StatusConflict, "ScopeLocked", fmt.Sprintf("The scope '%s' cannot perform write operation because it is locked by '%s'.", vaultID, lock))
+		return
+	}
+
+	var body struct {
+		Properties struct {
+			AccessPolicies []map[string]any `json:"accessPolicies"`
+		} `json:"properties"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequestContent", err.Error())
+		return
+	}
+
+	properties, _ := vault["properties"].(map[string]any)
+	if properties == nil {
+		properties = map[string]any{}
+		vault["properties"] = properties
+	}
+
+	current, _ := properties["accessPolicies"].([]any)
+	kind := strings.ToLower(path.Base(id))
+	for _, policy := range body.Properties.AccessPolicies {
+		current = updateAccessPolicies(current, policy, kind)
+	}
+	properties["accessPolicies"] = current
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"id":   id,
+		"name": path.Base(id),
+		"type": "Microsoft.KeyVault/vaults/accessPolicies",
+		"properties": map[string]any{
+			"accessPolicies": body.Properties.AccessPolicies,
+		},
+	})
+}
+
+func (a *ARM) serveOperation(w http.ResponseWriter, r *http.Request, operationID string) {
+	op, ok := a.operations[operationID]
+	if !ok {
+		writeError(w, http.StatusNotFound, "OperationNotFound", fmt.Sprintf("The operation '%s' was not found.", operationID))
+		return
+	}
+
+	op.polls++
+	inProgress := op.polls <= a.LROPolls
+	resource := a.resources[strings.ToLower(op.resourceID)]
+	if !inProgress && resource != nil {
+		setProperty(resource, "provisioningState", "Succeeded")
+	}
+
+	switch op.kind {
+	case lroLocation:
+		if inProgress {
+			w.Header().Set("Location", op.url)
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		writeJSON(w, http.StatusOK, resource)
+	case lroAsync:
+		status := "Succeeded"
+		if inProgress {
+			status = "InProgress"
+			w.Header().Set("Retry-After", "1")
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"status": status})
+	}
+}
+
+func (a *ARM) newOperation(r *http.Request, kind lroKind, resourceID string) string {
+	a.nextID++
+	operationID := fmt.Sprintf("%08d", a.nextID)
+
+	scheme := r.URL.Scheme
+	if scheme == "" {
+		scheme = "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+	}
+
+	host := r.URL.Host
+	if host == "" {
+		host = r.Host
+	}
+
+	url := fmt.Sprintf("%s://%s/_fake/operations/%s", scheme, host, operationID)
+	a.operations[operationID] = &operation{kind: kind, resourceID: resourceID, url: url}
+	return url
+}
+
+// findLock returns the id of a lock that prevents modifying the resource with the id.
+// Existing resources are protected by any lock on them or their parents, while writes are only prevented by read-only locks.
+func (a *ARM) findLock(id string, write bool) string {
+	key := strings.ToLower(id)
+	for lockKey, lock := range a.resources {
+		if !strings.EqualFold(stringValue(lock, "type"), typeLock) {
+			continue
+		}
+
+		scope := strings.ToLower(parentResourceID(lockKey, 4))
+		if key != scope && !strings.HasPrefix(key, scope+"/") {
+			continue
+		}
+
+		properties, _ := lock["properties"].(map[string]any)
+		level, _ := properties["level"].(string)
+		if write && level != "ReadOnly" {
+			continue
+		}
+
+		return stringValue(lock, "id")
+	}
+
+	return ""
+}
+
+func (a *ARM) newResource(id string, kind resourceKind, body map[string]any) map[string]any {
+	resource := map[string]any{
+		"id":   id,
+		"name": path.Base(id),
+		"type": kind.Type,
+	}
+
+	for _, field := range []string{"location", "kind", "sku", "tags", "identity"} {
+		if v, ok := body[field]; ok {
+			resource[field] = v
+		}
+	}
+
+	properties, _ := body["properties"].(map[string]any)
+	if properties == nil {
+		properties = map[string]any{}
+	}
+	resource["properties"] = properties
+
+	switch kind.Type {
+	case typeResourceGroup, typeStorageAccount:
+		properties["provisioningState"] = "Succeeded"
+	case typeVault:
+		properties["provisioningState"] = "Succeeded"
+		properties["vaultUri"] = a.vaultURI(path.Base(id))
+		if _, ok := properties["accessPolicies"]; !ok {
+			properties["accessPolicies"] = []any{}
+		}
+		if _, ok := properties["softDeleteRetentionInDays"]; !ok {
+			properties["softDeleteRetentionInDays"] = 90
+		}
+		if _, ok := properties["publicNetworkAccess"]; !ok {
+			properties["publicNetworkAccess"] = "Enabled"
+		}
+	case typeIdentity:
+		a.nextID++
+		properties["principalId"] = fmt.Sprintf("00000000-0000-4000-8000-%012x", a.nextID)
+		a.nextID++
+		properties["clientId"] = fmt.Sprintf("00000000-0000-4000-8000-%012x", a.nextID)
+	case typeKey:
+		vaultName := path.Base(parentResourceID(id, 2))
+		keyURI := a.vaultURI(vaultName) + "keys/" + path.Base(id)
+		properties["keyUri"] = keyURI
+		a.nextID++
+		properties["keyUriWithVersion"] = fmt.Sprintf("%s/%032x", keyURI, a.nextID)
+	}
+
+	return resource
+}
+
+func updateAccessPolicies(current []any, policy map[string]any, kind string) []any {
+	objectID, _ := policy["objectId"].(string)
+	for i, c := range current {
+		entry, _ := c.(map[string]any)
+		if entry == nil || !strings.EqualFold(stringValue(entry, "objectId"), objectID) {
+			continue
+		}
+
+		switch kind {
+		case "replace":
+			current[i] = policy
+		case "remove":
+			return append(current[:i], current[i+1:]...)
+		default:
+			entry["permissions"] = mergePermissions(entry["permissions"], policy["permissions"])
+		}
+		return current
+	}
+
+	if kind == "remove" {
+		return current
+	}
+
+	return append(current, policy)
+}
+
+func mergePermissions(a, b any) map[string]any {
+	result := map[string]any{}
+	for _, permissions := range []any{a, b} {
+		m, _ := permissions.(map[string]any)
+		for category, values := range m {
+			existing, _ := result[category].([]any)
+			list, _ := values.([]any)
+		OUTER:
+			for _, v := range list {
+				for _, e := range existing {
+					if strings.EqualFold(fmt.Sprint(e), fmt.Sprint(v)) {
+						continue OUTER
+					}
+				}
+				existing = append(existing, v)
+			}
+			result[category] = existing
+		}
+	}
+
+	return result
+}
+
+// matches reports if the lowercase path segments match the pattern, where * matches any segment
+func matches(segments []string, pattern ...string) bool {
+	if len(segments) != len(pattern) {
+		return false
+	}
+
+	for i := range pattern {
+		if pattern[i] != "*" && pattern[i] != segments[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func parentResourceID(id string, segments int) string {
+	parts := strings.Split(strings.Trim(id, "/"), "/")
+	if segments > len(parts) {
+		return "/"
+	}
+
+	return "/" + strings.Join(parts[:len(parts)-segments], "/")
+}
+
+func setProperty(resource map[string]any, name string, value any) {
+	properties, _ := resource["properties"].(map[string]any)
+	if properties == nil {
+		properties = map[string]any{}
+		resource["properties"] = properties
+	}
+
+	properties[name] = value
+}
+
+func stringValue(m map[string]any, key string) string {
+	s, _ := m[key].(string)
+	return s
+}
+
+func deepCopy(m map[string]any) map[string]any {
+	b, err := json.Marshal(m)
+	if err != nil {
+		panic(err)
+	}
+
+	var c map[string]any
+	err = json.Unmarshal(b, &c)
+	if err != nil {
+		panic(err)
+	}
+
+	return c
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func (a *ARM) isForbiddenWrite(method, urlPath string) bool {
+	if method == http.MethodGet || method == http.MethodHead {
+		return false
+	}
+
+	for _, resourceType := range a.ForbiddenWrites {
+		if strings.Contains(strings.ToLower(urlPath), "/providers/"+strings.ToLower(resourceType)+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("x-ms-error-code", code)
+	writeJSON(w, status, map[string]any{
+		"error": map[string]any{
+			"code":    code,
+			"message": message,
+		},
+	})
+}
+
+func writeNotImplemented(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotImplemented, "NotImplementedInFake", fmt.Sprintf("%s %s is not implemented by the fake", r.Method, r.URL.Path))
+}
@@ -0,0 +1,206 @@
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const typeRoleAssignment = "Microsoft.Authorization/roleAssignments"
+
+// builtInRoles are the built-in role definitions known by the fake, by name
+var builtInRoles = map[string]string{
+	"Key Vault Administrator":                  "00482a5a-887f-4fb3-b363-3b7fe8e74483",
+	"Key Vault Crypto User":                    "12338af0-0e69-4776-bea7-57ae8d297424",
+	"Key Vault Crypto Officer":                 "14b46e9e-c2b7-41b4-b07b-48a6ebf60603",
+	"Key Vault Crypto Service Encryption User": "e147488a-f6f5-4113-8e2d-b22465e65bf6",
+	"Storage Blob Data Contributor":            "ba92f5b4-2d11-453d-a403-e96b0029c9fe",
+}
+
+// RoleAssignments returns copies of the role assignments of the principal
+func (a *ARM) RoleAssignments(principalID string) []map[string]any {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	roleAssignments := []map[string]any{}
+	for _, resource := range a.resources {
+		if stringValue(resource, "type") == typeRoleAssignment && strings.EqualFold(roleAssignmentProperty(resource, "principalId"), principalID) {
+			roleAssignments = append(roleAssignments, deepCopy(resource))
+		}
+	}
+
+	return roleAssignments
+}
+
+func (a *ARM) serveRoleDefinitions(w http.ResponseWriter, r *http.Request, subscriptionID string) {
+	if r.Method != http.MethodGet {
+		writeNotImplemented(w, r)
+		return
+	}
+
+	roleName, ok := parseFilter(r.URL.Query().Get("$filter"), "roleName")
+	if !ok {
+		writeError(w, http.StatusBadRequest, "InvalidFilter", fmt.Sprintf("The filter '%s' is not supported.", r.URL.Query().Get("$filter")))
+		return
+	}
+
+	roleDefinitions := []map[string]any{}
+	for name, id := range builtInRoles {
+		if roleName != "" && !strings.EqualFold(roleName, name) {
+			continue
+		}
+
+		roleDefinitions = append(roleDefinitions, map[string]any{
+			"id":   fmt.Sprintf("/subscriptions/%s/providers/Microsoft.Authorization/roleDefinitions/%s", subscriptionID, id),
+			"name": id,
+			"type": "Microsoft.Authorization/roleDefinitions",
+			"properties": map[string]any{
+				"roleName": name,
+				"type":     "BuiltInRole",
+			},
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"value": roleDefinitions})
+}
+
+func (a *ARM) serveRoleAssignments(w http.ResponseWriter, r *http.Request, scope string) {
+	if r.Method != http.MethodGet {
+		writeNotImplemented(w, r)
+		return
+	}
+
+	principalID, ok := parseFilter(r.URL.Query().Get("$filter"), "principalId")
+	if !ok {
+		writeError(w, http.StatusBadRequest, "InvalidFilter", fmt.Sprintf("The filter '%s' is not supported.", r.URL.Query().Get("$filter")))
+		return
+	}
+
+	roleAssignments := []map[string]any{}
+	for _, resource := range a.resources {
+		if stringValue(resource, "type") != typeRoleAssignment {
+			continue
+		}
+
+		if principalID != "" && !strings.EqualFold(roleAssignmentProperty(resource, "principalId"), principalID) {
+			continue
+		}
+
+		assignmentScope := roleAssignmentProperty(resource, "scope")
+		if !isSameOrChildScope(scope, assignmentScope) && !isSameOrChildScope(assignmentScope, scope) {
+			continue
+		}
+
+		roleAssignments = append(roleAssignments, resource)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"value": roleAssignments})
+}
+
+func (a *ARM) serveRoleAssignment(w http.ResponseWriter, r *http.Request, id string) {
+	key := strings.ToLower(id)
+	scope := parentResourceID(id, 4)
+
+	switch r.Method {
+	case http.MethodGet:
+		resource, ok := a.resources[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "RoleAssignmentNotFound", fmt.Sprintf("The role assignment '%s' is not found.", path.Base(id)))
+			return
+		}
+		writeJSON(w, http.StatusOK, resource)
+	case http.MethodPut:
+		if len(strings.Split(strings.Trim(scope, "/"), "/")) > 2 {
+			if _, ok := a.resources[strings.ToLower(scope)]; !ok {
+				writeError(w, http.StatusNotFound, "ResourceNotFound", fmt.Sprintf("The resource '%s' was not found.", scope))
+				return
+			}
+		}
+
+		var body struct {
+			Properties struct {
+				PrincipalID      string `json:"principalId"`
+				RoleDefinitionID string `json:"roleDefinitionId"`
+				PrincipalType    string `json:"principalType"`
+			} `json:"properties"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidRequestContent", err.Error())
+			return
+		}
+
+		for k, resource := range a.resources {
+			if k == key || stringValue(resource, "type") != typeRoleAssignment {
+				continue
+			}
+
+			if strings.EqualFold(roleAssignmentProperty(resource, "scope"), scope) &&
+				strings.EqualFold(roleAssignmentProperty(resource, "principalId"), body.Properties.PrincipalID) &&
+				strings.EqualFold(path.Base(roleAssignmentProperty(resource, "roleDefinitionId")), path.Base(body.Properties.RoleDefinitionID)) {
+				writeError(w, http.StatusConflict, "RoleAssignmentExists", "The role assignment already exists.")
+				return
+			}
+		}
+
+		_, exists := a.resources[key]
+		resource := map[string]any{
+			"id":   id,
+			"name": path.Base(id),
+			"type": typeRoleAssignment,
+			"properties": map[string]any{
+				"scope":            scope,
+				"principalId":      body.Properties.PrincipalID,
+				"principalType":    body.Properties.PrincipalType,
+				"roleDefinitionId": body.Properties.RoleDefinitionID,
+			},
+		}
+		a.resources[key] = resource
+
+		status := http.StatusOK
+		if !exists {
+			status = http.StatusCreated
+		}
+		writeJSON(w, status, resource)
+	case http.MethodDelete:
+		resource, ok := a.resources[key]
+		if !ok {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		delete(a.resources, key)
+		writeJSON(w, http.StatusOK, resource)
+	default:
+		writeNotImplemented(w, r)
+	}
+}
+
+// parseFilter returns the value of a "<name> eq '<value>'" OData filter, an empty filter matches everything
+// and other filters can't be parsed
+func parseFilter(filter string, name string) (string, bool) {
+	if filter == "" {
+		return "", true
+	}
+
+	prefix := strings.ToLower(name) + " eq '"
+	if !strings.HasPrefix(strings.ToLower(filter), prefix) || !strings.HasSuffix(filter, "'") {
+		return "", false
+	}
+
+	return filter[len(prefix) : len(filter)-1], true
+}
+
+func roleAssignmentProperty(resource map[string]any, name string) string {
+	properties, _ := resource["properties"].(map[string]any)
+	return stringValue(properties, name)
+}
+
+// isSameOrChildScope reports if the scope is the parent scope or below it
+func isSameOrChildScope(scope, parent string) bool {
+	scope = strings.ToLower(strings.TrimSuffix(scope, "/"))
+	parent = strings.ToLower(strings.TrimSuffix(parent, "/"))
+
+	return scope == parent || strings.HasPrefix(scope, parent+"/")
+}
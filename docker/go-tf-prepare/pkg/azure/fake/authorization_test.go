@@ -0,0 +1,44 @@
+package fake
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	cases := []struct {
+		filter   string
+		expected string
+		ok       bool
+	}{
+		{filter: "", expected: "", ok: true},
+		{filter: "roleName eq 'Key Vault Crypto User'", expected: "Key Vault Crypto User", ok: true},
+		{filter: "rolename eq 'Key Vault Crypto User'", expected: "Key Vault Crypto User", ok: true},
+		{filter: "roleName%20eq%20%27Key%20Vault%20Crypto%20User%27", ok: false},
+		{filter: "principalId eq 'x'", ok: false},
+	}
+
+	for _, c := range cases {
+		value, ok := parseFilter(c.filter, "roleName")
+		if ok != c.ok || value != c.expected {
+			t.Errorf("parseFilter(%q) = %q, %t, expected %q, %t", c.filter, value, ok, c.expected, c.ok)
+		}
+	}
+}
+
+func TestServeRoleDefinitionsRejectsUnknownFilter(t *testing.T) {
+	arm := NewARM()
+
+	query := url.Values{"api-version": {"2022-04-01"}, "$filter": {"roleName%20eq%20%27Key%20Vault%20Crypto%20User%27"}}
+	req := httptest.NewRequest(http.MethodGet, "/subscriptions/33333333-3333-3333-3333-333333333333/providers/Microsoft.Authorization/roleDefinitions?"+query.Encode(), nil)
+	req.Header.Set("Authorization", "Bearer x")
+	rec := httptest.NewRecorder()
+
+	arm.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status is %d, expected %d", rec.Code, http.StatusBadRequest)
+	}
+}
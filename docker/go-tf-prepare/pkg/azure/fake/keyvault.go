@@ -0,0 +1,308 @@
+package fake
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+const typeDeletedVault = "Microsoft.KeyVault/deletedVaults"
+
+// deletedVaultRetention is the soft delete retention used for the scheduled purge date
+const deletedVaultRetention = 90 * 24 * time.Hour
+
+// deletedVault is a soft-deleted vault, with the vault and its keys as they were when it was deleted
+type deletedVault struct {
+	subscriptionID string
+	vaultID        string
+	location       string
+	deletionDate   time.Time
+	resources      map[string]map[string]any
+}
+
+// softDeleteVault moves the vault and its children to the deleted vaults of its location
+func (a *ARM) softDeleteVault(id string) {
+	key := strings.ToLower(id)
+	vault, ok := a.resources[key]
+	if !ok {
+		return
+	}
+
+	resources := map[string]map[string]any{}
+	for k, resource := range a.resources {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			resources[k] = deepCopy(resource)
+		}
+	}
+
+	location := stringValue(vault, "location")
+	a.deletedVaults[deletedVaultKey(location, path.Base(id))] = &deletedVault{
+		subscriptionID: strings.Split(strings.Trim(id, "/"), "/")[1],
+		vaultID:        id,
+		location:       location,
+		deletionDate:   time.Now().UTC(),
+		resources:      resources,
+	}
+}
+
+// serveVault handles the recover create mode and name conflicts with deleted vaults before serving the vault
+func (a *ARM) serveVault(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method == http.MethodDelete {
+		if lock := a.findLock(id, false); lock == "" {
+			a.softDeleteVault(id)
+		}
+	}
+
+	_, exists := a.resources[strings.ToLower(id)]
+	if r.Method != http.MethodPut || exists {
+		a.serveResource(w, r, id, vaultKind)
+		return
+	}
+
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequestContent", err.Error())
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(b))
+
+	var body struct {
+		Location   string `json:"location"`
+		Properties struct {
+			CreateMode string `json:"createMode"`
+		} `json:"properties"`
+	}
+	err = json.Unmarshal(b, &body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequestContent", err.Error())
+		return
+	}
+
+	deletedKey := deletedVaultKey(body.Location, path.Base(id))
+	deleted, isDeleted := a.deletedVaults[deletedKey]
+	if !strings.EqualFold(body.Properties.CreateMode, "recover") {
+		if a.isVaultNameDeleted(path.Base(id)) {
+			writeError(w, http.StatusConflict, "ConflictError", fmt.Sprintf("Exist soft deleted vault with the same name %s.", path.Base(id)))
+			return
+		}
+
+		a.serveResource(w, r, id, vaultKind)
+		return
+	}
+
+	if !isDeleted || !strings.EqualFold(deleted.vaultID, id) {
+		writeError(w, http.StatusNotFound, "DeletedVaultNotFound", fmt.Sprintf("The deleted vault '%s' was not found in location '%s'.", id, body.Location))
+		return
+	}
+
+	if lock := a.findLock(id, true); lock != "" {
+		writeError(w, http.StatusConflict, "ScopeLocked", fmt.Sprintf("The scope '%s' cannot perform write operation because it is locked by '%s'.", id, lock))
+		return
+	}
+
+	for k, resource := range deleted.resources {
+		a.resources[k] = resource
+	}
+	delete(a.deletedVaults, deletedKey)
+
+	resource := a.resources[strings.ToLower(id)]
+	setProperty(resource, "provisioningState", "Recovering")
+	w.Header().Set("Azure-AsyncOperation", a.newOperation(r, lroAsync, id))
+	writeJSON(w, http.StatusOK, resource)
+}
+
+func (a *ARM) serveDeletedVault(w http.ResponseWriter, r *http.Request, location, name string) {
+	if r.Method != http.MethodGet {
+		writeNotImplemented(w, r)
+		return
+	}
+
+	deleted, ok := a.deletedVaults[deletedVaultKey(location, name)]
+	if !ok {
+		writeError(w, http.StatusNotFound, "ResourceNotFound", fmt.Sprintf("The deleted vault '%s' was not found in location '%s'.", name, location))
+		return
+	}
+
+	vault := deleted.resources[strings.ToLower(deleted.vaultID)]
+	properties, _ := vault["properties"].(map[string]any)
+	purgeProtection, _ := properties["enablePurgeProtection"].(bool)
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"id":   fmt.Sprintf("/subscriptions/%s/providers/Microsoft.KeyVault/locations/%s/deletedVaults/%s", deleted.subscriptionID, deleted.location, name),
+		"name": name,
+		"type": typeDeletedVault,
+		"properties": map[string]any{
+			"vaultId":                deleted.vaultID,
+			"location":               deleted.location,
+			"deletionDate":           deleted.deletionDate.Format(time.RFC3339),
+			"scheduledPurgeDate":     deleted.deletionDate.Add(deletedVaultRetention).Format(time.RFC3339),
+			"purgeProtectionEnabled": purgeProtection,
+			"tags":                   vault["tags"],
+		},
+	})
+}
+
+func (a *ARM) isVaultNameDeleted(name string) bool {
+	for _, deleted := range a.deletedVaults {
+		if strings.EqualFold(path.Base(deleted.vaultID), name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func deletedVaultKey(location, name string) string {
+	return strings.ToLower(location + "/" + name)
+}
+
+// vaultURI returns the URI of the vault, pointing to the data plane of the fake when DataPlaneURL is set
+func (a *ARM) vaultURI(name string) string {
+	if a.DataPlaneURL == "" {
+		return fmt.Sprintf("https://%s.vault.azure.net/", name)
+	}
+
+	return fmt.Sprintf("%s/_fake/vaults/%s/", strings.TrimSuffix(a.DataPlaneURL, "/"), name)
+}
+
+// serveKeyVaultDataPlane serves the key operations of the Key Vault data plane used by tf-prepare,
+// the keys are the same as the ones in Azure Resource Manager
+func (a *ARM) serveKeyVaultDataPlane(w http.ResponseWriter, r *http.Request, urlPath string) {
+	segments := strings.Split(strings.Trim(urlPath, "/"), "/")
+	if len(segments) < 3 {
+		writeNotImplemented(w, r)
+		return
+	}
+
+	vaultID, vault := a.findVault(segments[2])
+	if vault == nil {
+		writeError(w, http.StatusNotFound, "VaultNotFound", fmt.Sprintf("The vault '%s' was not found.", segments[2]))
+		return
+	}
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		// the Key Vault clients send a request without a token first and authenticate with the challenge
+		properties, _ := vault["properties"].(map[string]any)
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer authorization="%s/%s", resource="https://vault.azure.net"`, strings.TrimSuffix(a.DataPlaneURL, "/"), stringValue(properties, "tenantId")))
+		writeError(w, http.StatusUnauthorized, "Unauthorized", "AKV10000: Request is missing a Bearer or PoP token.")
+		return
+	}
+
+	lower := lowerSegments(segments[3:])
+	switch {
+	case matches(lower, "keys", "*", "create"):
+		a.serveCreateKey(w, r, vaultID, segments[4])
+	case matches(lower, "keys", "*", "rotationpolicy"):
+		a.serveKeyRotationPolicy(w, r, vaultID, segments[4])
+	default:
+		writeNotImplemented(w, r)
+	}
+}
+
+func (a *ARM) serveCreateKey(w http.ResponseWriter, r *http.Request, vaultID, name string) {
+	if r.Method != http.MethodPost {
+		writeNotImplemented(w, r)
+		return
+	}
+
+	var body struct {
+		Kty        string   `json:"kty"`
+		KeySize    int      `json:"key_size"`
+		Curve      string   `json:"crv"`
+		KeyOps     []string `json:"key_ops"`
+		Attributes struct {
+			Enabled *bool  `json:"enabled"`
+			Expires *int64 `json:"exp"`
+		} `json:"attributes"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "BadParameter", err.Error())
+		return
+	}
+
+	keyID := vaultID + "/keys/" + name
+	key, exists := a.resources[strings.ToLower(keyID)]
+	if !exists {
+		key = a.newResource(keyID, keyKind, map[string]any{})
+		a.resources[strings.ToLower(keyID)] = key
+	}
+
+	properties, _ := key["properties"].(map[string]any)
+	a.nextID++
+	keyURIWithVersion := fmt.Sprintf("%s/%032x", stringValue(properties, "keyUri"), a.nextID)
+	properties["keyUriWithVersion"] = keyURIWithVersion
+	properties["kty"] = body.Kty
+	properties["keyOps"] = body.KeyOps
+	delete(properties, "keySize")
+	delete(properties, "curveName")
+	if body.KeySize != 0 {
+		properties["keySize"] = body.KeySize
+	}
+	if body.Curve != "" {
+		properties["curveName"] = body.Curve
+	}
+
+	attributes := map[string]any{"enabled": body.Attributes.Enabled == nil || *body.Attributes.Enabled}
+	if body.Attributes.Expires != nil {
+		attributes["exp"] = *body.Attributes.Expires
+	}
+	properties["attributes"] = attributes
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"key": map[string]any{
+			"kid":     keyURIWithVersion,
+			"kty":     body.Kty,
+			"key_ops": body.KeyOps,
+		},
+		"attributes": attributes,
+	})
+}
+
+func (a *ARM) serveKeyRotationPolicy(w http.ResponseWriter, r *http.Request, vaultID, name string) {
+	keyID := vaultID + "/keys/" + name
+	key, exists := a.resources[strings.ToLower(keyID)]
+	if !exists {
+		writeError(w, http.StatusNotFound, "KeyNotFound", fmt.Sprintf("A key with (name/id) %s was not found in this key vault.", name))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		properties, _ := key["properties"].(map[string]any)
+		policy, _ := properties["rotationPolicy"].(map[string]any)
+		if policy == nil {
+			policy = map[string]any{"lifetimeActions": []any{}, "attributes": map[string]any{}}
+		}
+		writeJSON(w, http.StatusOK, policy)
+	case http.MethodPut:
+		var policy map[string]any
+		err := json.NewDecoder(r.Body).Decode(&policy)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "BadParameter", err.Error())
+			return
+		}
+
+		policy["id"] = stringValue(key["properties"].(map[string]any), "keyUri") + "/rotationpolicy"
+		setProperty(key, "rotationPolicy", policy)
+		writeJSON(w, http.StatusOK, policy)
+	default:
+		writeNotImplemented(w, r)
+	}
+}
+
+// findVault returns the id and resource of the vault with the name
+func (a *ARM) findVault(name string) (string, map[string]any) {
+	for _, resource := range a.resources {
+		if strings.EqualFold(stringValue(resource, "type"), typeVault) && strings.EqualFold(stringValue(resource, "name"), name) {
+			return stringValue(resource, "id"), resource
+		}
+	}
+
+	return "", nil
+}
@@ -0,0 +1,125 @@
+package fake
+
+import (
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+)
+
+// Server serves an ARM and the Azure AD token endpoints over HTTPS, so that the
+// tf-prepare binary can be run against it with a client secret credential:
+//
+//	AZURE_RESOURCE_MANAGER_ENDPOINT=<URL>
+//	AZURE_AUTHORITY_HOST=<URL>
+//	SSL_CERT_FILE=<file with CertificatePEM>
+//
+// The requests received are returned as JSON from <URL>/_fake/requests
+type Server struct {
+	// URL is the base URL of the server, for example https://127.0.0.1:8443
+	URL string
+
+	arm      *ARM
+	objectID string
+	server   *httptest.Server
+}
+
+// NewServer starts a server listening on the address, the object ID is used in the issued tokens
+func NewServer(address string, arm *ARM, objectID string) (*Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		arm:      arm,
+		objectID: objectID,
+	}
+
+	s.server = httptest.NewUnstartedServer(s)
+	s.server.Listener.Close()
+	s.server.Listener = listener
+	s.server.StartTLS()
+	s.URL = s.server.URL
+	arm.DataPlaneURL = s.URL
+
+	return s, nil
+}
+
+// CertificatePEM returns the self-signed certificate of the server in PEM format
+func (s *Server) CertificatePEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.server.Certificate().Raw})
+}
+
+// Close shuts down the server
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	urlPath := path.Clean("/" + r.URL.Path)
+	segments := strings.Split(strings.Trim(urlPath, "/"), "/")
+
+	switch {
+	case urlPath == "/_fake/requests":
+		writeJSON(w, http.StatusOK, s.arm.Requests())
+	case matches(lowerSegments(segments), "*", "v2.0", ".well-known", "openid-configuration"):
+		s.serveOpenIDConfiguration(w, r, segments[0])
+	case matches(lowerSegments(segments), "*", "oauth2", "v2.0", "token"):
+		s.serveToken(w, r, segments[0])
+	default:
+		s.arm.ServeHTTP(w, r)
+	}
+}
+
+func (s *Server) serveOpenIDConfiguration(w http.ResponseWriter, r *http.Request, tenantID string) {
+	base := s.URL + "/" + tenantID
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                 base + "/v2.0",
+		"authorization_endpoint": base + "/oauth2/v2.0/authorize",
+		"token_endpoint":         base + "/oauth2/v2.0/token",
+	})
+}
+
+func (s *Server) serveToken(w http.ResponseWriter, r *http.Request, tenantID string) {
+	if r.Method != http.MethodPost {
+		writeNotImplemented(w, r)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid_request", "error_description": err.Error()})
+		return
+	}
+
+	if r.PostForm.Get("grant_type") != "client_credentials" {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"error": "unsupported_grant_type", "error_description": "only client_credentials is supported by the fake"})
+		return
+	}
+
+	audience := strings.TrimSuffix(r.PostForm.Get("scope"), "/.default")
+	token, err := newAccessToken(tenantID, s.objectID, r.PostForm.Get("client_id"), audience)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"error": "server_error", "error_description": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"token_type":   "Bearer",
+		"access_token": token.Token,
+		"expires_in":   3600,
+	})
+}
+
+func lowerSegments(segments []string) []string {
+	lower := make([]string, len(segments))
+	for i := range segments {
+		lower[i] = strings.ToLower(segments[i])
+	}
+
+	return lower
+}
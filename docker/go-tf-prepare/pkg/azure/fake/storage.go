@@ -0,0 +1,196 @@
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const typeBlobService = "Microsoft.Storage/storageAccounts/blobServices"
+
+// serveBlobService serves the blob service properties, which exist as long as the storage account exists
+func (a *ARM) serveBlobService(w http.ResponseWriter, r *http.Request, id string) {
+	accountID := parentResourceID(id, 2)
+	if _, ok := a.resources[strings.ToLower(accountID)]; !ok {
+		writeError(w, http.StatusNotFound, "ResourceNotFound", fmt.Sprintf("The resource '%s' was not found.", accountID))
+		return
+	}
+
+	key := strings.ToLower(id)
+	service, ok := a.resources[key]
+	if !ok {
+		service = map[string]any{
+			"id":   id,
+			"name": "default",
+			"type": typeBlobService,
+			"properties": map[string]any{
+				"deleteRetentionPolicy": map[string]any{"enabled": false, "allowPermanentDelete": false},
+			},
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, service)
+	case http.MethodPut:
+		if lock := a.findLock(accountID, true); lock != "" {
+			writeError(w, http.StatusConflict, "ScopeLocked", fmt.Sprintf("The scope '%s' cannot perform write operation because it is locked by '%s'.", accountID, lock))
+			return
+		}
+
+		var body map[string]any
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidRequestContent", err.Error())
+			return
+		}
+
+		// the properties that aren't in the body are left as they are
+		properties, _ := body["properties"].(map[string]any)
+		for name, value := range properties {
+			setProperty(service, name, value)
+		}
+		a.resources[key] = service
+
+		writeJSON(w, http.StatusOK, service)
+	default:
+		writeNotImplemented(w, r)
+	}
+}
+
+// serveImmutabilityPolicy serves the time-based immutability policy of the container, which is stored in the container properties like Azure returns it
+func (a *ARM) serveImmutabilityPolicy(w http.ResponseWriter, r *http.Request, containerID string) {
+	container, ok := a.resources[strings.ToLower(containerID)]
+	if !ok {
+		writeError(w, http.StatusNotFound, "ContainerNotFound", fmt.Sprintf("The resource '%s' was not found.", containerID))
+		return
+	}
+
+	properties, _ := container["properties"].(map[string]any)
+	current, _ := properties["immutabilityPolicy"].(map[string]any)
+
+	switch r.Method {
+	case http.MethodGet:
+		if current == nil {
+			writeError(w, http.StatusNotFound, "ImmutabilityPolicyNotFound", "The immutability policy was not found.")
+			return
+		}
+		w.Header().Set("ETag", stringValue(current, "etag"))
+		writeJSON(w, http.StatusOK, immutabilityPolicyResource(containerID, current))
+	case http.MethodPut:
+		if current != nil {
+			if r.Header.Get("If-Match") != stringValue(current, "etag") {
+				writeError(w, http.StatusPreconditionFailed, "ConditionNotMet", "The condition specified using HTTP conditional header(s) is not met.")
+				return
+			}
+
+			currentProperties, _ := current["properties"].(map[string]any)
+			if stringValue(currentProperties, "state") == "Locked" {
+				writeError(w, http.StatusConflict, "ContainerImmutabilityPolicyLocked", "Locked immutability policies can only be extended.")
+				return
+			}
+		}
+
+		var body map[string]any
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidRequestContent", err.Error())
+			return
+		}
+
+		policyProperties, _ := body["properties"].(map[string]any)
+		if policyProperties == nil {
+			policyProperties = map[string]any{}
+		}
+		policyProperties["state"] = "Unlocked"
+
+		a.nextID++
+		policy := map[string]any{
+			"properties": policyProperties,
+			"etag":       fmt.Sprintf(`"%016x"`, a.nextID),
+		}
+		setProperty(container, "immutabilityPolicy", policy)
+		setProperty(container, "hasImmutabilityPolicy", true)
+
+		w.Header().Set("ETag", stringValue(policy, "etag"))
+		writeJSON(w, http.StatusOK, immutabilityPolicyResource(containerID, policy))
+	default:
+		writeNotImplemented(w, r)
+	}
+}
+
+func immutabilityPolicyResource(containerID string, policy map[string]any) map[string]any {
+	return map[string]any{
+		"id":         containerID + "/immutabilityPolicies/default",
+		"name":       "default",
+		"type":       "Microsoft.Storage/storageAccounts/blobServices/containers/immutabilityPolicies",
+		"etag":       policy["etag"],
+		"properties": policy["properties"],
+	}
+}
+
+// serveSetLegalHold adds the legal hold tags to the container, tags are stored in lowercase
+func (a *ARM) serveSetLegalHold(w http.ResponseWriter, r *http.Request, containerID string) {
+	if r.Method != http.MethodPost {
+		writeNotImplemented(w, r)
+		return
+	}
+
+	container, ok := a.resources[strings.ToLower(containerID)]
+	if !ok {
+		writeError(w, http.StatusNotFound, "ContainerNotFound", fmt.Sprintf("The resource '%s' was not found.", containerID))
+		return
+	}
+
+	var body struct {
+		Tags []string `json:"tags"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequestContent", err.Error())
+		return
+	}
+
+	properties, _ := container["properties"].(map[string]any)
+	legalHold, _ := properties["legalHold"].(map[string]any)
+	tags, _ := legalHold["tags"].([]any)
+	for _, tag := range body.Tags {
+		exists := false
+		for _, t := range tags {
+			if current, _ := t.(map[string]any); strings.EqualFold(stringValue(current, "tag"), tag) {
+				exists = true
+			}
+		}
+		if !exists {
+			tags = append(tags, map[string]any{"tag": strings.ToLower(tag)})
+		}
+	}
+
+	setProperty(container, "legalHold", map[string]any{"hasLegalHold": len(tags) > 0, "tags": tags})
+	setProperty(container, "hasLegalHold", len(tags) > 0)
+
+	names := []string{}
+	for _, t := range tags {
+		names = append(names, stringValue(t.(map[string]any), "tag"))
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"hasLegalHold": len(tags) > 0, "tags": names})
+}
+
+// serveContainerMigrate migrates the container to version-level immutability
+func (a *ARM) serveContainerMigrate(w http.ResponseWriter, r *http.Request, containerID string) {
+	if r.Method != http.MethodPost {
+		writeNotImplemented(w, r)
+		return
+	}
+
+	container, ok := a.resources[strings.ToLower(containerID)]
+	if !ok {
+		writeError(w, http.StatusNotFound, "ContainerNotFound", fmt.Sprintf("The resource '%s' was not found.", containerID))
+		return
+	}
+
+	setProperty(container, "immutableStorageWithVersioning", map[string]any{"enabled": true, "migrationState": "Completed"})
+	w.Header().Set("Location", a.newOperation(r, lroLocation, containerID))
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,73 @@
+package fake
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+// Transport returns an azcore transport that serves every request from the ARM without any network access
+func (a *ARM) Transport() policy.Transporter {
+	return &transporter{handler: a}
+}
+
+type transporter struct {
+	handler http.Handler
+}
+
+func (t *transporter) Do(req *http.Request) (*http.Response, error) {
+	rec := httptest.NewRecorder()
+	t.handler.ServeHTTP(rec, req)
+
+	resp := rec.Result()
+	resp.Request = req
+	return resp, nil
+}
+
+// Credential is an azcore.TokenCredential returning unsigned tokens with the configured claims
+type Credential struct {
+	TenantID string
+	ObjectID string
+	AppID    string
+}
+
+// GetToken implements azcore.TokenCredential
+func (c *Credential) GetToken(ctx context.Context, options policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	audience := strings.TrimSuffix(strings.Join(options.Scopes, " "), "/.default")
+	return newAccessToken(c.TenantID, c.ObjectID, c.AppID, audience)
+}
+
+// newAccessToken returns an unsigned token with the claims tf-prepare and Azure use to identify the caller
+func newAccessToken(tenantID, objectID, appID, audience string) (azcore.AccessToken, error) {
+	expiresOn := time.Now().Add(time.Hour)
+	claims := map[string]any{
+		"aud": audience,
+		"iss": "https://sts.windows.net/" + tenantID + "/",
+		"tid": tenantID,
+		"oid": objectID,
+		"exp": expiresOn.Unix(),
+	}
+	if appID != "" {
+		claims["appid"] = appID
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": "none", "typ": "JWT"})
+	if err != nil {
+		return azcore.AccessToken{}, err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return azcore.AccessToken{}, err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload) + "."
+	return azcore.AccessToken{Token: token, ExpiresOn: expiresOn}, nil
+}
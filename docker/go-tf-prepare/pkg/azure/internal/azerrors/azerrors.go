@@ -0,0 +1,124 @@
+// Package azerrors classifies errors returned by the Azure SDK
+package azerrors
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+)
+
+var (
+	// ErrNotFound is returned when the requested resource (or its parent) doesn't exist
+	ErrNotFound = errors.New("azure resource not found")
+	// ErrConflict is returned when the request conflicts with the current state of the resource
+	ErrConflict = errors.New("azure resource conflict")
+	// ErrForbidden is returned when the identity isn't allowed to execute the request
+	ErrForbidden = errors.New("azure request forbidden")
+	// ErrUnauthorized is returned when the request isn't authenticated
+	ErrUnauthorized = errors.New("azure request unauthorized")
+)
+
+// notFoundErrorCodes are error codes used by resource providers for missing resources,
+// some of them are returned with other status codes than 404
+var notFoundErrorCodes = map[string]bool{
+	"ResourceNotFound":       true,
+	"ResourceGroupNotFound":  true,
+	"ParentResourceNotFound": true,
+	"ContainerNotFound":      true,
+	"LockNotFound":           true,
+	"VaultNotFound":          true,
+	"KeyNotFound":            true,
+	"StorageAccountNotFound": true,
+}
+
+// configurationErrorCodes are returned with status 404 when the subscription or resource provider is wrong,
+// they must fail the run instead of being treated as a missing resource that can be created
+var configurationErrorCodes = map[string]bool{
+	"SubscriptionNotFound":     true,
+	"ResourceProviderNotFound": true,
+}
+
+type classifiedError struct {
+	sentinel error
+	err      error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() []error {
+	return []error{e.sentinel, e.err}
+}
+
+// Classify wraps err with the matching sentinel error, making it possible to use errors.Is.
+// Errors that aren't an azcore.ResponseError or can't be classified are returned as is.
+func Classify(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var classified *classifiedError
+	if errors.As(err, &classified) {
+		return err
+	}
+
+	sentinel := classify(err)
+	if sentinel == nil {
+		return err
+	}
+
+	return &classifiedError{
+		sentinel: sentinel,
+		err:      err,
+	}
+}
+
+func classify(err error) error {
+	var respErr *azcore.ResponseError
+	if !errors.As(err, &respErr) {
+		return nil
+	}
+
+	if configurationErrorCodes[respErr.ErrorCode] {
+		return nil
+	}
+
+	if notFoundErrorCodes[respErr.ErrorCode] {
+		return ErrNotFound
+	}
+
+	switch respErr.StatusCode {
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusConflict:
+		return ErrConflict
+	case http.StatusForbidden:
+		return ErrForbidden
+	case http.StatusUnauthorized:
+		return ErrUnauthorized
+	}
+
+	return nil
+}
+
+// IsNotFound reports if err is caused by a missing resource
+func IsNotFound(err error) bool {
+	return errors.Is(Classify(err), ErrNotFound)
+}
+
+// IsConflict reports if err is caused by a conflict with the current state of the resource
+func IsConflict(err error) bool {
+	return errors.Is(Classify(err), ErrConflict)
+}
+
+// IsForbidden reports if err is caused by missing permissions
+func IsForbidden(err error) bool {
+	return errors.Is(Classify(err), ErrForbidden)
+}
+
+// IsUnauthorized reports if err is caused by a request that isn't authenticated
+func IsUnauthorized(err error) bool {
+	return errors.Is(Classify(err), ErrUnauthorized)
+}
@@ -0,0 +1,52 @@
+package azerrors
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+)
+
+func TestIsNotFound(t *testing.T) {
+	cases := []struct {
+		statusCode int
+		errorCode  string
+		expected   bool
+	}{
+		{statusCode: http.StatusNotFound, errorCode: "ResourceGroupNotFound", expected: true},
+		{statusCode: http.StatusBadRequest, errorCode: "ContainerNotFound", expected: true},
+		{statusCode: http.StatusNotFound, errorCode: "", expected: true},
+		{statusCode: http.StatusNotFound, errorCode: "SubscriptionNotFound", expected: false},
+		{statusCode: http.StatusNotFound, errorCode: "ResourceProviderNotFound", expected: false},
+		{statusCode: http.StatusConflict, errorCode: "Conflict", expected: false},
+	}
+
+	for _, c := range cases {
+		err := &azcore.ResponseError{StatusCode: c.statusCode, ErrorCode: c.errorCode}
+		if actual := IsNotFound(err); actual != c.expected {
+			t.Errorf("IsNotFound(%d %s) = %t, expected %t", c.statusCode, c.errorCode, actual, c.expected)
+		}
+	}
+}
+
+func TestIsForbiddenAndIsUnauthorized(t *testing.T) {
+	cases := []struct {
+		statusCode   int
+		forbidden    bool
+		unauthorized bool
+	}{
+		{statusCode: http.StatusForbidden, forbidden: true},
+		{statusCode: http.StatusUnauthorized, unauthorized: true},
+		{statusCode: http.StatusNotFound},
+	}
+
+	for _, c := range cases {
+		err := &azcore.ResponseError{StatusCode: c.statusCode}
+		if actual := IsForbidden(err); actual != c.forbidden {
+			t.Errorf("IsForbidden(%d) = %t, expected %t", c.statusCode, actual, c.forbidden)
+		}
+		if actual := IsUnauthorized(err); actual != c.unauthorized {
+			t.Errorf("IsUnauthorized(%d) = %t, expected %t", c.statusCode, actual, c.unauthorized)
+		}
+	}
+}
@@ -23,17 +23,20 @@ if [ -z "${OPA_BLAST_RADIUS}" ]; then
 fi
 
 prepare () {
-  AZ_ACCOUNT_TYPE="$(az account show --query user.type --output tsv)"
-  if [[ "${AZ_ACCOUNT_TYPE}" = "servicePrincipal" ]]; then
-    export AZURE_SERVICE_PRINCIPAL_APP_ID="$(az account show --query user.name --output tsv)"
-    export AZURE_SERVICE_PRINCIPAL_OBJECT_ID="$(az ad sp show --id $AZURE_SERVICE_PRINCIPAL_APP_ID --query id --output tsv)"
+  export AZURE_EXCLUDE_WORKLOAD_IDENTITY_CREDENTIAL="${AZURE_EXCLUDE_WORKLOAD_IDENTITY_CREDENTIAL:-true}"
+  # With workload identity federation AZURE_SUBSCRIPTION_ID, AZURE_TENANT_ID and AZURE_CLIENT_ID are provided by the pipeline
+  if [[ "${AZURE_EXCLUDE_WORKLOAD_IDENTITY_CREDENTIAL}" = "true" ]]; then
+    export AZURE_SUBSCRIPTION_ID=$(az account show --output tsv --query id)
+    export AZURE_TENANT_ID=$(az account show --output tsv --query tenantId)
   fi
-  export AZURE_SUBSCRIPTION_ID=$(az account show --output tsv --query id)
-  export AZURE_TENANT_ID=$(az account show --output tsv --query tenantId)
   export AZURE_RESOURCE_GROUP_NAME="${BACKEND_RG}"
   export AZURE_RESOURCE_GROUP_LOCATION="${RG_LOCATION_LONG}"
   export AZURE_STORAGE_ACCOUNT_NAME="${BACKEND_NAME}"
   export AZURE_STORAGE_ACCOUNT_CONTAINER="${CONTAINER_NAME}"
+  # Record the environment and directory owning the state container, opt-in since existing containers have no metadata
+  if [[ "${AZURE_STORAGE_ACCOUNT_CONTAINER_OWNER_METADATA:-false}" = "true" ]]; then
+    export AZURE_STORAGE_ACCOUNT_CONTAINER_METADATA="${AZURE_STORAGE_ACCOUNT_CONTAINER_METADATA:-env=${ENVIRONMENT},dir=${DIR}}"
+  fi
   export AZURE_KEYVAULT_NAME="${BACKEND_KV}"
   export AZURE_KEYVAULT_KEY_NAME="${BACKEND_KV_KEY}"
   export AZURE_RESOURCE_LOCKS="${AZURE_RESOURCE_LOCKS:-true}"